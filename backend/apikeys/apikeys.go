@@ -0,0 +1,321 @@
+// Package apikeys 供仓库、ERP等脚本调用接口使用的API密钥。密钥的格式为"wsk_<前缀>_<密钥>"，
+// 数据库中只保存前缀和密钥的SHA-256，明文只在创建时返回一次。每个密钥有自己的权限范围、过期时间和限流配额，
+// 不对应任何用户，审计日志中以非人工操作者记录。
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"web-security/backend/authz"
+	"web-security/backend/db"
+)
+
+const (
+	// Header 携带API密钥的请求头
+	Header = "X-API-Key"
+	// keyPrefix 所有密钥的固定开头，便于在代码和日志中识别泄露的密钥
+	keyPrefix = "wsk_"
+	// prefixBytes 前缀的随机字节数，前缀为其十六进制
+	prefixBytes = 6
+	// secretBytes 密钥的随机字节数
+	secretBytes = 32
+	// lastUsedInterval 最后使用时间的更新间隔，避免每个请求都写数据库
+	lastUsedInterval = time.Minute
+)
+
+var (
+	// ErrInvalidKey 密钥格式错误、不存在、已过期或已撤销，不区分具体原因
+	ErrInvalidKey = errors.New("API密钥无效、已过期或已被撤销")
+	// ErrKeyNotFound 密钥不存在
+	ErrKeyNotFound = errors.New("API密钥不存在")
+	// ErrAlreadyRevoked 密钥已经撤销
+	ErrAlreadyRevoked = errors.New("API密钥已经撤销")
+	// ErrInvalidScope 权限范围不存在，或者不能授予API密钥
+	ErrInvalidScope = errors.New("无效的权限范围")
+)
+
+// APIKey 一个API密钥，不包含密钥本身
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit,omitempty"` // 每个限流窗口的请求数，0表示使用api_key策略的默认值
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy  *int       `json:"revoked_by,omitempty"`
+
+	// secretHash 密钥的SHA-256，十六进制
+	secretHash string
+}
+
+// HasScope 判断密钥是否拥有指定权限
+func (k *APIKey) HasScope(permission string) bool {
+	for _, scope := range k.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Actor 审计日志和上下文中使用的操作者名称
+func (k *APIKey) Actor() string {
+	return "api_key:" + k.Prefix
+}
+
+// Active 密钥未撤销且未过期
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && now.Before(k.ExpiresAt)
+}
+
+// NewKey 创建密钥时的参数
+type NewKey struct {
+	Name      string
+	Scopes    []string
+	RateLimit int
+	ExpiresAt time.Time
+	CreatedBy int
+}
+
+// Create 生成新的API密钥，返回密钥信息和只显示一次的完整密钥。权限范围必须是已定义的权限，不能是全部权限
+func Create(params NewKey) (*APIKey, string, error) {
+	scopes, err := validateScopes(params.Scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if params.RateLimit < 0 {
+		return nil, "", fmt.Errorf("限流配额不能为负数")
+	}
+	if !params.ExpiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("过期时间必须晚于当前时间")
+	}
+
+	prefix, err := randomHex(prefixBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("生成密钥失败: %w", err)
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &APIKey{
+		Name:       params.Name,
+		Prefix:     prefix,
+		Scopes:     scopes,
+		RateLimit:  params.RateLimit,
+		ExpiresAt:  params.ExpiresAt.UTC().Truncate(time.Second),
+		CreatedBy:  params.CreatedBy,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		secretHash: hashSecret(encodedSecret),
+	}
+	var rateLimit sql.NullInt64
+	if key.RateLimit > 0 {
+		rateLimit = sql.NullInt64{Int64: int64(key.RateLimit), Valid: true}
+	}
+	res, err := db.DB.Exec(`
+		INSERT INTO api_keys(name, prefix, secret_hash, scopes, rate_limit, expires_at, created_by, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+	`, key.Name, key.Prefix, key.secretHash, strings.Join(key.Scopes, ","), rateLimit, key.ExpiresAt, key.CreatedBy, key.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if key.ID, err = res.LastInsertId(); err != nil {
+		return nil, "", err
+	}
+	return key, keyPrefix + prefix + "_" + encodedSecret, nil
+}
+
+// Authenticate 校验请求中的完整密钥，成功时更新最后使用时间和IP
+func Authenticate(raw, ip string) (*APIKey, error) {
+	prefix, secret, ok := parseKey(raw)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	key, err := queryKey("WHERE prefix = ?", prefix)
+	if err == ErrKeyNotFound {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := hex.DecodeString(key.secretHash)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	actual := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(expected, actual[:]) != 1 {
+		return nil, ErrInvalidKey
+	}
+	now := time.Now().UTC()
+	if !key.Active(now) {
+		return nil, ErrInvalidKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedInterval || key.LastUsedIP != ip {
+		// 失败不影响本次请求，下次使用时再更新
+		_, _ = db.DB.Exec("UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ?", now, ip, key.ID)
+	}
+	return key, nil
+}
+
+// List 列出API密钥，includeRevoked为false时不包括已撤销的密钥
+func List(includeRevoked bool) ([]APIKey, error) {
+	where := "WHERE revoked_at IS NULL"
+	if includeRevoked {
+		where = ""
+	}
+	return queryKeys(where + " ORDER BY id DESC")
+}
+
+// Get 获取指定的API密钥
+func Get(id int64) (*APIKey, error) {
+	return queryKey("WHERE id = ?", id)
+}
+
+// Revoke 撤销API密钥，立即生效
+func Revoke(id int64, revokedBy int) (*APIKey, error) {
+	key, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return key, ErrAlreadyRevoked
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	res, err := db.DB.Exec("UPDATE api_keys SET revoked_at = ?, revoked_by = ? WHERE id = ? AND revoked_at IS NULL", now, revokedBy, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return key, ErrAlreadyRevoked
+	}
+	key.RevokedAt = &now
+	key.RevokedBy = &revokedBy
+	return key, nil
+}
+
+// validateScopes 检查权限范围都是已定义的权限，去重并排序
+func validateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: 至少需要一个权限", ErrInvalidScope)
+	}
+	known, err := authz.ListPermissions()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == authz.PermissionAll {
+			return nil, fmt.Errorf("%w: 不能授予全部权限", ErrInvalidScope)
+		}
+		if _, ok := known[scope]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// parseKey 拆分"wsk_<前缀>_<密钥>"，前缀是固定长度的十六进制，密钥中可能包含下划线
+func parseKey(raw string) (prefix, secret string, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(raw), keyPrefix)
+	if !found || len(rest) < prefixBytes*2+2 || rest[prefixBytes*2] != '_' {
+		return "", "", false
+	}
+	prefix, secret = rest[:prefixBytes*2], rest[prefixBytes*2+1:]
+	if _, err := hex.DecodeString(prefix); err != nil {
+		return "", "", false
+	}
+	return prefix, secret, true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const keyColumns = "id, name, prefix, secret_hash, scopes, rate_limit, expires_at, last_used_at, last_used_ip, created_by, created_at, revoked_at, revoked_by"
+
+func queryKey(where string, args ...interface{}) (*APIKey, error) {
+	keys, err := queryKeys(where+" LIMIT 1", args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return &keys[0], nil
+}
+
+func queryKeys(where string, args ...interface{}) ([]APIKey, error) {
+	rows, err := db.DB.Query("SELECT "+keyColumns+" FROM api_keys "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var (
+			key                   APIKey
+			scopes                string
+			rateLimit, revokedBy  sql.NullInt64
+			lastUsedAt, revokedAt sql.NullTime
+			lastUsedIP            sql.NullString
+		)
+		err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.secretHash, &scopes, &rateLimit, &key.ExpiresAt,
+			&lastUsedAt, &lastUsedIP, &key.CreatedBy, &key.CreatedAt, &revokedAt, &revokedBy)
+		if err != nil {
+			return nil, err
+		}
+		key.Scopes = []string{}
+		if scopes != "" {
+			key.Scopes = strings.Split(scopes, ",")
+		}
+		key.RateLimit = int(rateLimit.Int64)
+		key.LastUsedIP = lastUsedIP.String
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		if revokedBy.Valid {
+			by := int(revokedBy.Int64)
+			key.RevokedBy = &by
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,447 @@
+// Package audit 只追加的审计日志。每条记录保存操作者、IP、请求ID以及前一条记录的哈希，
+// 所有记录组成一条哈希链，任何一条被修改、删除或插入都会在校验时被发现。
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"web-security/backend/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计动作
+const (
+	ActionLogin                 = "auth.login"
+	ActionLoginFailed           = "auth.login_failed"
+	ActionTokenRefresh          = "auth.token_refresh"
+	ActionTokenReuse            = "auth.token_reuse"
+	ActionLogout                = "auth.logout"
+	ActionPasswordChange        = "auth.password_change"
+	ActionPasswordReset         = "auth.password_reset"
+	ActionMFADisable            = "auth.mfa_disable"
+	ActionUserStatusChange      = "user.status_change"
+	ActionUserRoleChange        = "user.role_change"
+	ActionUserDelete            = "user.delete"
+	ActionUserDataExport        = "user.data_export"
+	ActionUserErasureRequest    = "user.erasure_request"
+	ActionUserErasureCancel     = "user.erasure_cancel"
+	ActionUserErase             = "user.erase"
+	ActionIdentityLink          = "user.identity_link"
+	ActionIdentityUnlink        = "user.identity_unlink"
+	ActionRolePermissionsChange = "role.permissions_change"
+	ActionProductCreate         = "product.create"
+	ActionProductUpdate         = "product.update"
+	ActionProductDelete         = "product.delete"
+	ActionCategoryCreate        = "category.create"
+	ActionCategoryUpdate        = "category.update"
+	ActionCategoryDelete        = "category.delete"
+	ActionOrderStatusChange     = "order.status_change"
+	ActionPaymentCheckout       = "payment.checkout"
+	ActionPaymentCompleted      = "payment.completed"
+	ActionIPRuleCreate          = "ip_rule.create"
+	ActionIPRuleDelete          = "ip_rule.delete"
+	ActionAPIKeyCreate          = "api_key.create"
+	ActionAPIKeyRevoke          = "api_key.revoke"
+)
+
+// 操作结果
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// 操作对象类型
+const (
+	TargetUser     = "user"
+	TargetProduct  = "product"
+	TargetCategory = "category"
+	TargetOrder    = "order"
+	TargetSession  = "session"
+	TargetRole     = "role"
+	TargetIPRule   = "ip_rule"
+	TargetAPIKey   = "api_key"
+)
+
+// GenesisHash 第一条记录的prev_hash
+var GenesisHash = strings.Repeat("0", 64)
+
+// Event 一条待写入的审计记录
+type Event struct {
+	Action        string
+	Outcome       string
+	ActorUserID   int
+	ActorUsername string
+	ActorRole     string
+	IP            string
+	UserAgent     string
+	RequestID     string
+	TargetType    string
+	TargetID      string
+	Details       map[string]interface{}
+
+	// occurredAt 操作发生的时间，异步写入时由Record设置，为空时使用写入时间
+	occurredAt time.Time
+}
+
+// Entry 已经写入的审计记录
+type Entry struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Action        string          `json:"action"`
+	Outcome       string          `json:"outcome"`
+	ActorUserID   int             `json:"actor_user_id,omitempty"`
+	ActorUsername string          `json:"actor_username,omitempty"`
+	ActorRole     string          `json:"actor_role,omitempty"`
+	IP            string          `json:"ip,omitempty"`
+	UserAgent     string          `json:"user_agent,omitempty"`
+	RequestID     string          `json:"request_id,omitempty"`
+	TargetType    string          `json:"target_type,omitempty"`
+	TargetID      string          `json:"target_id,omitempty"`
+	Details       json.RawMessage `json:"details,omitempty"`
+	PrevHash      string          `json:"prev_hash"`
+	Hash          string          `json:"hash"`
+
+	// rawDetails 数据库中保存的details原文，哈希按它计算
+	rawDetails string
+}
+
+// 异步写入：请求只把记录放进队列，后台写入器每次取出一批，在一个事务中追加到链尾，
+// 请求不必等待链头的行锁，大量失败登录也不会让其他请求排队
+const (
+	queueSize    = 4096
+	maxBatchSize = 100
+
+	// 写入失败时按指数退避重试，数据库短暂不可用时记录不会丢失
+	maxAppendAttempts = 5
+	initialRetryDelay = 100 * time.Millisecond
+	maxRetryDelay     = 5 * time.Second
+)
+
+var (
+	queue       = make(chan Event, queueSize)
+	startWriter sync.Once
+	// writerDone 写入器处理完关闭后的队列时关闭
+	writerDone = make(chan struct{})
+	// queueMu 保护closed，Close之后Record不再向队列发送记录
+	queueMu sync.RWMutex
+	closed  bool
+)
+
+// Record 记录当前请求中的一次操作，操作者、IP、User-Agent和请求ID没有指定时从请求上下文中获取。
+// 记录由后台写入器异步写入，失败时重试；重试后仍然无法写入的记录会把完整内容写入日志，不影响请求本身。
+func Record(c *gin.Context, event Event) {
+	if event.ActorUserID == 0 {
+		event.ActorUserID = c.GetInt("userID")
+	}
+	if event.ActorUsername == "" {
+		event.ActorUsername = c.GetString("username")
+	}
+	if event.ActorRole == "" {
+		event.ActorRole = c.GetString("role")
+	}
+	if event.IP == "" {
+		event.IP = c.ClientIP()
+	}
+	if event.UserAgent == "" {
+		event.UserAgent = c.Request.UserAgent()
+	}
+	if event.RequestID == "" {
+		event.RequestID = c.GetString("requestID")
+	}
+
+	event.occurredAt = time.Now()
+
+	queueMu.RLock()
+	defer queueMu.RUnlock()
+	if !closed {
+		startWriter.Do(func() { go runWriter() })
+		select {
+		case queue <- event:
+			return
+		default:
+		}
+	}
+	// 队列已满或已经关闭时同步写入，由请求承担背压
+	writeBatch([]Event{event})
+}
+
+// Close 停止接收新的异步记录，等待队列中已有的记录写入完成，服务退出前调用。
+// ctx到期时返回错误，此时仍在队列中的记录会丢失。
+func Close(ctx context.Context) error {
+	queueMu.Lock()
+	if !closed {
+		closed = true
+		startWriter.Do(func() { go runWriter() })
+		close(queue)
+	}
+	queueMu.Unlock()
+
+	select {
+	case <-writerDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待审计日志写入超时，队列中还有%d条记录: %w", len(queue), ctx.Err())
+	}
+}
+
+// runWriter 后台写入器：取出队列中已有的记录（最多maxBatchSize条），一次事务写入，队列关闭并取完后退出
+func runWriter() {
+	defer close(writerDone)
+	for event := range queue {
+		batch := []Event{event}
+	drain:
+		for len(batch) < maxBatchSize {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		writeBatch(batch)
+	}
+}
+
+// writeBatch 写入一批记录，重试后仍然失败时改为逐条写入，避免一条无法写入的记录连累整批。
+// 逐条写入也失败的记录把完整内容写入日志，以便人工补录
+func writeBatch(batch []Event) {
+	err := appendWithRetry(batch)
+	if err == nil {
+		return
+	}
+	if len(batch) > 1 {
+		log.Printf("批量写入审计日志失败，改为逐条写入 (%d条): %v", len(batch), err)
+		for _, event := range batch {
+			if _, err := Append(event); err != nil {
+				logLostEvent(event, err)
+			}
+		}
+		return
+	}
+	logLostEvent(batch[0], err)
+}
+
+// appendWithRetry 追加一批记录，失败时按指数退避重试，最多尝试maxAppendAttempts次
+func appendWithRetry(events []Event) error {
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		_, err := appendBatch(events)
+		if err == nil {
+			return nil
+		}
+		if attempt == maxAppendAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// logLostEvent 记录无法写入哈希链的审计事件的完整内容
+func logLostEvent(event Event, err error) {
+	details, _ := json.Marshal(event.Details)
+	log.Printf("审计记录无法写入，需要人工补录: time=%s action=%s outcome=%s actor=%d/%s role=%s ip=%s request_id=%s target=%s/%s details=%s: %v",
+		event.occurredAt.UTC().Format(time.RFC3339Nano), event.Action, event.Outcome, event.ActorUserID, event.ActorUsername,
+		event.ActorRole, event.IP, event.RequestID, event.TargetType, event.TargetID, details, err)
+}
+
+// Append 把记录同步追加到哈希链末尾
+func Append(event Event) (*Entry, error) {
+	entries, err := appendBatch([]Event{event})
+	if err != nil {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// appendBatch 按顺序把一批记录追加到哈希链末尾。链头所在的行在事务中被锁定，并发写入会按顺序排队，
+// 保证ID连续且每条记录都指向前一条。一批记录只锁定和更新一次链头。
+func appendBatch(events []Event) ([]*Entry, error) {
+	entries := make([]*Entry, 0, len(events))
+	for _, event := range events {
+		entry, err := newEntry(event)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var lastID int64
+	var lastHash string
+	if err := tx.QueryRow("SELECT last_id, last_hash FROM audit_chain_head WHERE id = 1 FOR UPDATE").Scan(&lastID, &lastHash); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		entry.ID = lastID + 1
+		entry.PrevHash = lastHash
+		entry.Hash = computeHash(entry)
+		if err := insertEntry(tx, entry); err != nil {
+			return nil, err
+		}
+		lastID, lastHash = entry.ID, entry.Hash
+	}
+
+	if _, err := tx.Exec("UPDATE audit_chain_head SET last_id = ?, last_hash = ? WHERE id = 1", lastID, lastHash); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newEntry 根据事件生成待写入的记录，ID和哈希在写入时确定
+func newEntry(event Event) (*Entry, error) {
+	occurredAt := event.occurredAt
+	if occurredAt.IsZero() {
+		occurredAt = time.Now()
+	}
+	entry := &Entry{
+		CreatedAt:     occurredAt.UTC().Truncate(time.Microsecond),
+		Action:        truncate(event.Action, 64),
+		Outcome:       truncate(event.Outcome, 16),
+		ActorUserID:   event.ActorUserID,
+		ActorUsername: truncate(event.ActorUsername, 50),
+		ActorRole:     truncate(event.ActorRole, 32),
+		IP:            truncate(event.IP, 45),
+		UserAgent:     truncate(event.UserAgent, 512),
+		RequestID:     truncate(event.RequestID, 64),
+		TargetType:    truncate(event.TargetType, 32),
+		TargetID:      truncate(event.TargetID, 64),
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = OutcomeSuccess
+	}
+	if len(event.Details) > 0 {
+		details, err := json.Marshal(event.Details)
+		if err != nil {
+			return nil, err
+		}
+		entry.Details = details
+		entry.rawDetails = string(details)
+	}
+
+	return entry, nil
+}
+
+// insertEntry 在事务中写入一条记录
+func insertEntry(tx *sql.Tx, entry *Entry) error {
+	var actorID interface{}
+	if entry.ActorUserID != 0 {
+		actorID = entry.ActorUserID
+	}
+	var details interface{}
+	if entry.rawDetails != "" {
+		details = entry.rawDetails
+	}
+	_, err := tx.Exec(`INSERT INTO audit_events
+		(id, created_at, action, outcome, actor_user_id, actor_username, actor_role, ip_address, user_agent,
+		 request_id, target_type, target_id, details, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.ID, entry.CreatedAt, entry.Action, entry.Outcome, actorID, entry.ActorUsername, entry.ActorRole,
+		entry.IP, entry.UserAgent, entry.RequestID, entry.TargetType, entry.TargetID, details,
+		entry.PrevHash, entry.Hash)
+	return err
+}
+
+// hashInput 参与哈希计算的字段，字段顺序固定，修改后已有的记录将无法通过校验
+type hashInput struct {
+	ID            int64  `json:"id"`
+	PrevHash      string `json:"prev_hash"`
+	CreatedAt     string `json:"created_at"`
+	Action        string `json:"action"`
+	Outcome       string `json:"outcome"`
+	ActorUserID   int    `json:"actor_user_id"`
+	ActorUsername string `json:"actor_username"`
+	ActorRole     string `json:"actor_role"`
+	IP            string `json:"ip"`
+	UserAgent     string `json:"user_agent"`
+	RequestID     string `json:"request_id"`
+	TargetType    string `json:"target_type"`
+	TargetID      string `json:"target_id"`
+	Details       string `json:"details"`
+}
+
+// computeHash 计算记录的哈希：SHA-256(前一条记录的哈希 + 记录内容的JSON)
+func computeHash(entry *Entry) string {
+	data, _ := json.Marshal(hashInput{
+		ID:            entry.ID,
+		PrevHash:      entry.PrevHash,
+		CreatedAt:     entry.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		Action:        entry.Action,
+		Outcome:       entry.Outcome,
+		ActorUserID:   entry.ActorUserID,
+		ActorUsername: entry.ActorUsername,
+		ActorRole:     entry.ActorRole,
+		IP:            entry.IP,
+		UserAgent:     entry.UserAgent,
+		RequestID:     entry.RequestID,
+		TargetType:    entry.TargetType,
+		TargetID:      entry.TargetID,
+		Details:       entry.rawDetails,
+	})
+	sum := sha256.Sum256(append([]byte(entry.PrevHash), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// scanEntry 从查询结果中读取一条记录，列的顺序与entryColumns一致
+func scanEntry(scanner interface{ Scan(...interface{}) error }) (*Entry, error) {
+	entry := &Entry{}
+	var actorID sql.NullInt64
+	var details sql.NullString
+	err := scanner.Scan(&entry.ID, &entry.CreatedAt, &entry.Action, &entry.Outcome, &actorID,
+		&entry.ActorUsername, &entry.ActorRole, &entry.IP, &entry.UserAgent, &entry.RequestID,
+		&entry.TargetType, &entry.TargetID, &details, &entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	entry.ActorUserID = int(actorID.Int64)
+	entry.rawDetails = details.String
+	if details.String != "" {
+		if json.Valid([]byte(details.String)) {
+			entry.Details = json.RawMessage(details.String)
+		} else {
+			// 被改坏的内容按字符串返回，不影响查询接口
+			quoted, _ := json.Marshal(details.String)
+			entry.Details = quoted
+		}
+	}
+	return entry, nil
+}
+
+// entryColumns 查询审计记录时使用的列
+const entryColumns = `id, created_at, action, outcome, actor_user_id, actor_username, actor_role, ip_address,
+	user_agent, request_id, target_type, target_id, details, prev_hash, hash`
+
+// truncate 按字节截断字符串以适应列长度，不会截断多字节字符。必须在计算哈希之前截断，
+// 否则数据库保存的内容与参与哈希的内容不一致。
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+	"time"
+	"web-security/backend/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var entryColumnNames = []string{"id", "created_at", "action", "outcome", "actor_user_id", "actor_username", "actor_role",
+	"ip_address", "user_agent", "request_id", "target_type", "target_id", "details", "prev_hash", "hash"}
+
+// buildChain 生成n条首尾相连的有效记录
+func buildChain(n int) []*Entry {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 678000, time.UTC)
+	prevHash := GenesisHash
+	entries := make([]*Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		entry := &Entry{
+			ID:            int64(i),
+			CreatedAt:     created.Add(time.Duration(i) * time.Second),
+			Action:        ActionLogin,
+			Outcome:       OutcomeSuccess,
+			ActorUserID:   i,
+			ActorUsername: "alice",
+			ActorRole:     "user",
+			IP:            "203.0.113.7",
+			UserAgent:     "test",
+			RequestID:     "req",
+			TargetType:    TargetUser,
+			TargetID:      "1",
+			PrevHash:      prevHash,
+			rawDetails:    `{"method":"password"}`,
+		}
+		entry.Hash = computeHash(entry)
+		prevHash = entry.Hash
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func entryRow(entry *Entry) []driver.Value {
+	return []driver.Value{entry.ID, entry.CreatedAt, entry.Action, entry.Outcome, int64(entry.ActorUserID),
+		entry.ActorUsername, entry.ActorRole, entry.IP, entry.UserAgent, entry.RequestID,
+		entry.TargetType, entry.TargetID, entry.rawDetails, entry.PrevHash, entry.Hash}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// mutate 在链生成后修改记录，模拟数据库中的篡改，返回数据库中剩下的记录
+		mutate func(entries []*Entry) []*Entry
+		// head 链头指向的记录，为0时指向最后一条记录
+		head int64
+		want []Problem
+	}{
+		{
+			name:   "有效的链",
+			mutate: func(entries []*Entry) []*Entry { return entries },
+		},
+		{
+			name: "记录内容被修改",
+			mutate: func(entries []*Entry) []*Entry {
+				entries[1].Outcome = OutcomeFailure
+				return entries
+			},
+			want: []Problem{{ID: 2, Kind: ProblemHashMismatch}},
+		},
+		{
+			name: "详情被修改",
+			mutate: func(entries []*Entry) []*Entry {
+				entries[2].rawDetails = `{"method":"oidc"}`
+				return entries
+			},
+			want: []Problem{{ID: 3, Kind: ProblemHashMismatch}},
+		},
+		{
+			name: "中间的记录被删除",
+			mutate: func(entries []*Entry) []*Entry {
+				return append(entries[:1], entries[2:]...)
+			},
+			want: []Problem{{ID: 3, Kind: ProblemGap}, {ID: 3, Kind: ProblemChainBroken}},
+		},
+		{
+			name: "末尾的记录被删除",
+			mutate: func(entries []*Entry) []*Entry {
+				return entries[:len(entries)-1]
+			},
+			head: 4,
+			want: []Problem{{ID: 4, Kind: ProblemHeadMismatch}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New: %v", err)
+			}
+			defer mockDB.Close()
+			db.DB = mockDB
+
+			chain := buildChain(4)
+			head := chain[len(chain)-1]
+			if tt.head != 0 {
+				head = chain[tt.head-1]
+			}
+			headID, headHash := head.ID, head.Hash
+			entries := tt.mutate(chain)
+
+			mock.ExpectQuery("SELECT last_id, last_hash FROM audit_chain_head").
+				WillReturnRows(sqlmock.NewRows([]string{"last_id", "last_hash"}).AddRow(headID, headHash))
+			rows := sqlmock.NewRows(entryColumnNames)
+			for _, entry := range entries {
+				rows.AddRow(entryRow(entry)...)
+			}
+			mock.ExpectQuery("FROM audit_events ORDER BY id").WillReturnRows(rows)
+
+			report, err := Verify()
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if report.Checked != int64(len(entries)) {
+				t.Errorf("Checked = %d, want %d", report.Checked, len(entries))
+			}
+			if report.Valid != (len(tt.want) == 0) {
+				t.Errorf("Valid = %v, want %v", report.Valid, len(tt.want) == 0)
+			}
+			got := []Problem{}
+			for _, problem := range report.Problems {
+				got = append(got, Problem{ID: problem.ID, Kind: problem.Kind})
+			}
+			want := tt.want
+			if want == nil {
+				want = []Problem{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Problems = %+v, want %+v", report.Problems, want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"strings"
+	"time"
+	"web-security/backend/db"
+)
+
+// Filter 查询审计记录的条件，零值表示不限制
+type Filter struct {
+	ActorUserID int
+	Action      string
+	Outcome     string
+	TargetType  string
+	TargetID    string
+	RequestID   string
+	From        time.Time
+	To          time.Time
+	Page        int
+	Limit       int
+}
+
+// Query 按条件分页查询审计记录，按时间倒序返回记录和符合条件的总数
+func Query(filter Filter) ([]Entry, int, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.ActorUserID != 0 {
+		conditions = append(conditions, "actor_user_id = ?")
+		args = append(args, filter.ActorUserID)
+	}
+	if filter.Action != "" {
+		// 以"."结尾时按前缀匹配，例如"auth."匹配所有认证相关的记录
+		if strings.HasSuffix(filter.Action, ".") {
+			conditions = append(conditions, "action LIKE ?")
+			args = append(args, escapeLike(filter.Action)+"%")
+		} else {
+			conditions = append(conditions, "action = ?")
+			args = append(args, filter.Action)
+		}
+	}
+	if filter.Outcome != "" {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, filter.Outcome)
+	}
+	if filter.TargetType != "" {
+		conditions = append(conditions, "target_type = ?")
+		args = append(args, filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		conditions = append(conditions, "target_id = ?")
+		args = append(args, filter.TargetID)
+	}
+	if filter.RequestID != "" {
+		conditions = append(conditions, "request_id = ?")
+		args = append(args, filter.RequestID)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC())
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.Limit < 1 || filter.Limit > 200 {
+		filter.Limit = 50
+	}
+	query := "SELECT " + entryColumns + " FROM audit_events" + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	rows, err := db.DB.Query(query, append(args, filter.Limit, (filter.Page-1)*filter.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, total, rows.Err()
+}
+
+// escapeLike 转义LIKE中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
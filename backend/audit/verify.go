@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"web-security/backend/db"
+)
+
+// 校验发现的问题类型
+const (
+	ProblemGap          = "gap"           // ID不连续，中间的记录被删除
+	ProblemChainBroken  = "chain_broken"  // prev_hash与前一条记录的哈希不一致
+	ProblemHashMismatch = "hash_mismatch" // 记录内容被修改
+	ProblemHeadMismatch = "head_mismatch" // 链头与最后一条记录不一致，末尾的记录被删除或链头被改动
+)
+
+// maxProblems 报告中最多列出的问题数量，链从某处断开后后面的记录通常都会报错
+const maxProblems = 100
+
+// Problem 校验发现的一个问题
+type Problem struct {
+	ID      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// VerifyReport 哈希链的校验结果
+type VerifyReport struct {
+	Valid     bool      `json:"valid"`
+	Checked   int64     `json:"checked"`
+	LastID    int64     `json:"last_id"`
+	LastHash  string    `json:"last_hash"`
+	Problems  []Problem `json:"problems"`
+	Truncated bool      `json:"truncated"` // 问题数量超过上限，只列出了前面的部分
+}
+
+func (r *VerifyReport) add(id int64, kind, format string, args ...interface{}) {
+	r.Valid = false
+	if len(r.Problems) == maxProblems {
+		r.Truncated = true
+		return
+	}
+	r.Problems = append(r.Problems, Problem{ID: id, Kind: kind, Message: fmt.Sprintf(format, args...)})
+}
+
+// Verify 从第一条记录开始重新计算整条哈希链，检查ID是否连续、每条记录是否指向前一条、
+// 内容是否与哈希一致，以及链头是否指向最后一条记录
+func Verify() (*VerifyReport, error) {
+	report := &VerifyReport{Valid: true, Problems: []Problem{}}
+
+	var headID int64
+	var headHash string
+	err := db.DB.QueryRow("SELECT last_id, last_hash FROM audit_chain_head WHERE id = 1").Scan(&headID, &headHash)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("审计链头不存在")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.DB.Query("SELECT " + entryColumns + " FROM audit_events ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expectedID := int64(1)
+	prevHash := GenesisHash
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		report.Checked++
+
+		if entry.ID != expectedID {
+			report.add(entry.ID, ProblemGap, "缺少记录%d到%d", expectedID, entry.ID-1)
+		}
+		if entry.PrevHash != prevHash {
+			report.add(entry.ID, ProblemChainBroken, "prev_hash与前一条记录的哈希不一致")
+		}
+		if computeHash(entry) != entry.Hash {
+			report.add(entry.ID, ProblemHashMismatch, "记录内容与哈希不一致")
+		}
+
+		expectedID = entry.ID + 1
+		prevHash = entry.Hash
+		report.LastID = entry.ID
+		report.LastHash = entry.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if headID != report.LastID || (headID != 0 && headHash != report.LastHash) {
+		report.add(headID, ProblemHeadMismatch, "链头指向记录%d，最后一条记录为%d", headID, report.LastID)
+	}
+	return report, nil
+}
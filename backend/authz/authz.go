@@ -0,0 +1,262 @@
+// Package authz 基于角色和权限的授权。角色、权限以及二者的对应关系保存在MySQL中，
+// 运行时缓存在内存里并定期刷新，修改角色权限后无需重启服务。
+package authz
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"web-security/backend/db"
+)
+
+// 权限名称，格式为"资源:操作"
+const (
+	// PermissionAll 拥有全部权限，只授予admin角色
+	PermissionAll = "*"
+
+	ProductsWrite   = "products:write"
+	CategoriesWrite = "categories:write"
+
+	OrdersRead         = "orders:read"          // 查看所有用户的订单
+	OrdersUpdateStatus = "orders:update_status" // 修改订单状态（发货、取消等）
+	OrdersRefund       = "orders:refund"        // 将订单标记为已退款
+
+	UsersRead     = "users:read"     // 查看用户列表和资料
+	UsersSuspend  = "users:suspend"  // 修改账户状态
+	UsersDelete   = "users:delete"   // 删除账户
+	UsersSecurity = "users:security" // 管理会话、安全事件、两步验证要求和登录锁定
+	UsersRoles    = "users:roles"    // 分配角色和修改角色的权限
+
+	AuditRead = "audit:read" // 查询和校验审计日志
+
+	IPRulesManage = "ip_rules:manage" // 管理IP允许和拒绝规则
+
+	APIKeysManage = "api_keys:manage" // 创建、查看和撤销API密钥
+)
+
+// 内置角色
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+	// RoleAPIKey 使用API密钥的请求的角色，不在roles表中，权限由密钥的权限范围决定
+	RoleAPIKey = "api_key"
+)
+
+// ErrUnknownRole 角色不存在
+var ErrUnknownRole = errors.New("角色不存在")
+
+// ErrUnknownPermission 权限不存在
+var ErrUnknownPermission = errors.New("权限不存在")
+
+// ErrInvalidGrant 不允许的权限分配：修改admin角色的权限，或者把全部权限授予其他角色
+var ErrInvalidGrant = errors.New("不允许的权限分配")
+
+// Role 角色及其权限
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	IsSystem    bool     `json:"is_system"` // user和admin为内置角色
+	Permissions []string `json:"permissions"`
+}
+
+// refreshInterval 缓存的刷新间隔，多个实例之间的权限变更最多延迟这么久生效
+const refreshInterval = time.Minute
+
+var cache = struct {
+	sync.RWMutex
+	roles    map[string]*Role
+	grants   map[string]map[string]bool
+	loadedAt time.Time
+}{}
+
+// Init 从数据库加载角色和权限，服务启动时调用
+func Init() error {
+	return Reload()
+}
+
+// Reload 重新从数据库加载角色和权限
+func Reload() error {
+	roles := map[string]*Role{}
+	rows, err := db.DB.Query("SELECT name, COALESCE(description, ''), is_system FROM roles")
+	if err != nil {
+		return fmt.Errorf("加载角色失败: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		role := &Role{Permissions: []string{}}
+		if err := rows.Scan(&role.Name, &role.Description, &role.IsSystem); err != nil {
+			return fmt.Errorf("加载角色失败: %w", err)
+		}
+		roles[role.Name] = role
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("加载角色失败: %w", err)
+	}
+
+	grants := map[string]map[string]bool{}
+	permRows, err := db.DB.Query("SELECT role, permission FROM role_permissions ORDER BY role, permission")
+	if err != nil {
+		return fmt.Errorf("加载角色权限失败: %w", err)
+	}
+	defer permRows.Close()
+	for permRows.Next() {
+		var roleName, permission string
+		if err := permRows.Scan(&roleName, &permission); err != nil {
+			return fmt.Errorf("加载角色权限失败: %w", err)
+		}
+		role, ok := roles[roleName]
+		if !ok {
+			continue
+		}
+		role.Permissions = append(role.Permissions, permission)
+		if grants[roleName] == nil {
+			grants[roleName] = map[string]bool{}
+		}
+		grants[roleName][permission] = true
+	}
+	if err := permRows.Err(); err != nil {
+		return fmt.Errorf("加载角色权限失败: %w", err)
+	}
+
+	cache.Lock()
+	cache.roles = roles
+	cache.grants = grants
+	cache.loadedAt = time.Now()
+	cache.Unlock()
+	return nil
+}
+
+// refreshIfStale 缓存过期时重新加载，加载失败时继续使用旧的缓存
+func refreshIfStale() {
+	cache.RLock()
+	stale := time.Since(cache.loadedAt) > refreshInterval
+	cache.RUnlock()
+	if !stale {
+		return
+	}
+	if err := Reload(); err != nil {
+		log.Printf("刷新角色权限缓存失败，继续使用旧数据: %v", err)
+		// 避免每个请求都去重试
+		cache.Lock()
+		cache.loadedAt = time.Now()
+		cache.Unlock()
+	}
+}
+
+// HasPermission 判断角色是否拥有指定权限
+func HasPermission(role, permission string) bool {
+	refreshIfStale()
+
+	cache.RLock()
+	defer cache.RUnlock()
+	grants := cache.grants[role]
+	return grants[PermissionAll] || grants[permission]
+}
+
+// RoleExists 判断角色是否存在
+func RoleExists(role string) bool {
+	refreshIfStale()
+
+	cache.RLock()
+	defer cache.RUnlock()
+	_, ok := cache.roles[role]
+	return ok
+}
+
+// RolePermissions 返回角色拥有的权限，角色不存在时返回nil
+func RolePermissions(role string) []string {
+	refreshIfStale()
+
+	cache.RLock()
+	defer cache.RUnlock()
+	r, ok := cache.roles[role]
+	if !ok {
+		return nil
+	}
+	return append([]string{}, r.Permissions...)
+}
+
+// ListRoles 返回所有角色及其权限，按名称排序
+func ListRoles() []Role {
+	refreshIfStale()
+
+	cache.RLock()
+	defer cache.RUnlock()
+	roles := make([]Role, 0, len(cache.roles))
+	for _, role := range cache.roles {
+		copied := *role
+		copied.Permissions = append([]string{}, role.Permissions...)
+		roles = append(roles, copied)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+// ListPermissions 返回所有已定义的权限及其说明
+func ListPermissions() (map[string]string, error) {
+	rows, err := db.DB.Query("SELECT name, COALESCE(description, '') FROM permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := map[string]string{}
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			return nil, err
+		}
+		permissions[name] = description
+	}
+	return permissions, rows.Err()
+}
+
+// SetRolePermissions 替换角色的全部权限并刷新缓存
+func SetRolePermissions(role string, permissions []string) error {
+	if role == RoleAdmin {
+		// admin角色始终拥有全部权限，防止管理员把自己锁在外面
+		return fmt.Errorf("%w: 不能修改%s角色的权限", ErrInvalidGrant, RoleAdmin)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT 1 FROM roles WHERE name = ? FOR UPDATE", role).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUnknownRole
+		}
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = ?", role); err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if permission == PermissionAll {
+			return fmt.Errorf("%w: 只有%s角色可以拥有全部权限", ErrInvalidGrant, RoleAdmin)
+		}
+		var known int
+		if err := tx.QueryRow("SELECT 1 FROM permissions WHERE name = ?", permission).Scan(&known); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: %s", ErrUnknownPermission, permission)
+			}
+			return err
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO role_permissions (role, permission) VALUES (?, ?)", role, permission); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return Reload()
+}
@@ -0,0 +1,44 @@
+package authz
+
+import (
+	"database/sql"
+	"errors"
+	"web-security/backend/db"
+)
+
+// ErrResourceNotFound 资源不存在
+var ErrResourceNotFound = errors.New("资源不存在")
+
+// Resource 描述一种属于某个用户的资源，以及如何查询它的所有者
+type Resource struct {
+	Name string
+	// ownerQuery 根据资源ID查询所有者的用户ID
+	ownerQuery string
+}
+
+// 受所有权保护的资源
+var (
+	Orders = Resource{Name: "order", ownerQuery: "SELECT user_id FROM orders WHERE id = ?"}
+	// Payments 支付信息保存在订单上，所有者就是订单的所有者
+	Payments  = Resource{Name: "payment", ownerQuery: "SELECT user_id FROM orders WHERE id = ?"}
+	CartItems = Resource{Name: "cart_item", ownerQuery: "SELECT user_id FROM cart_items WHERE id = ?"}
+)
+
+// Owner 返回资源所有者的用户ID，资源不存在时返回ErrResourceNotFound
+func (r Resource) Owner(id int) (int, error) {
+	var ownerID int
+	err := db.DB.QueryRow(r.ownerQuery, id).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return 0, ErrResourceNotFound
+	}
+	return ownerID, err
+}
+
+// CanAccessOwnedBy 判断用户能否访问属于ownerID的资源：自己的资源总是可以访问，
+// 其他用户的资源需要角色拥有staffPermission，staffPermission为空表示只有所有者可以访问
+func CanAccessOwnedBy(userID int, role string, ownerID int, staffPermission string) bool {
+	if userID != 0 && userID == ownerID {
+		return true
+	}
+	return staffPermission != "" && HasPermission(role, staffPermission)
+}
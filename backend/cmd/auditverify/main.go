@@ -0,0 +1,55 @@
+// Command auditverify recomputes the audit log hash chain and reports gaps, edited entries
+// and a chain head that does not point at the last entry. It exits with status 1 when the
+// chain is broken, so it can run from cron or CI.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"web-security/backend/audit"
+	"web-security/backend/config"
+	"web-security/backend/db"
+)
+
+func main() {
+	configPath := flag.String("config", ".", "directory containing app.env")
+	asJSON := flag.Bool("json", false, "print the full report as JSON")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+
+	db.InitMySQL(cfg.DBSource)
+	defer db.CloseMySQL()
+
+	report, err := audit.Verify()
+	if err != nil {
+		log.Fatalf("Could not verify audit log: %v", err)
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("Checked %d entries, last id %d\n", report.Checked, report.LastID)
+		for _, problem := range report.Problems {
+			fmt.Printf("  #%d %s: %s\n", problem.ID, problem.Kind, problem.Message)
+		}
+		if report.Truncated {
+			fmt.Println("  ... more problems omitted")
+		}
+	}
+
+	if !report.Valid {
+		fmt.Println("Audit log verification FAILED")
+		db.CloseMySQL()
+		os.Exit(1)
+	}
+	fmt.Println("Audit log verification passed")
+}
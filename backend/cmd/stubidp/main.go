@@ -0,0 +1,316 @@
+// Command stubidp is a minimal OpenID Connect provider for local development and manual testing
+// of the OIDC login. It serves discovery, JWKS, authorize and token endpoints, approves every
+// authorization request without a login page and signs RS256 ID tokens with a key generated at
+// startup. PKCE (S256), redirect_uri, client credentials and one-time codes are checked like a
+// real provider would, so the backend's own checks can be exercised end to end.
+//
+// Never expose it outside localhost: anyone who can reach it can sign in as any email.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	keyID     = "stubidp-1"
+	codeTTL   = time.Minute
+	tokenTTL  = 10 * time.Minute
+	jwksPath  = "/jwks"
+	authPath  = "/authorize"
+	tokenPath = "/token"
+)
+
+// options are the command line flags
+type options struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURL   string
+	email         string
+	emailVerified bool
+	name          string
+	audience      string
+	nonce         string
+}
+
+// pendingCode is an issued authorization code waiting to be exchanged
+type pendingCode struct {
+	clientID      string
+	redirectURI   string
+	challenge     string
+	nonce         string
+	email         string
+	emailVerified bool
+	expiresAt     time.Time
+}
+
+type server struct {
+	opts options
+	key  *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]pendingCode
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "listen address")
+	var opts options
+	flag.StringVar(&opts.issuer, "issuer", "http://127.0.0.1:9000", "issuer URL, must match OIDC_<NAME>_ISSUER")
+	flag.StringVar(&opts.clientID, "client-id", "web-security", "expected client_id")
+	flag.StringVar(&opts.clientSecret, "client-secret", "stub-secret", "expected client secret, empty for a public client")
+	flag.StringVar(&opts.redirectURL, "redirect-url", "", "allowed redirect_uri, empty allows any")
+	flag.StringVar(&opts.email, "email", "alice@example.com", "email of the signed in user, login_hint overrides it")
+	flag.BoolVar(&opts.emailVerified, "email-verified", true, "value of the email_verified claim")
+	flag.StringVar(&opts.name, "name", "", "name claim, defaults to the local part of the email")
+	flag.StringVar(&opts.audience, "audience", "", "aud claim instead of the client_id, to test audience checks")
+	flag.StringVar(&opts.nonce, "nonce", "", "nonce claim instead of the one from the request, to test nonce checks")
+	flag.Parse()
+	opts.issuer = strings.TrimRight(opts.issuer, "/")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Could not generate signing key: %v", err)
+	}
+	s := &server{opts: opts, key: key, codes: map[string]pendingCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc(jwksPath, s.jwks)
+	mux.HandleFunc(authPath, s.authorize)
+	mux.HandleFunc(tokenPath, s.token)
+
+	log.Printf("Stub OIDC provider %s listening on %s (client_id=%s)", opts.issuer, *addr, opts.clientID)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		log.Fatalf("Server stopped: %v", err)
+	}
+}
+
+func (s *server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.opts.issuer,
+		"authorization_endpoint":                s.opts.issuer + authPath,
+		"token_endpoint":                        s.opts.issuer + tokenPath,
+		"jwks_uri":                              s.opts.issuer + jwksPath,
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (s *server) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(s.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize approves the request immediately and redirects back with a one-time code
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	if q.Get("client_id") != s.opts.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if redirectURI == "" || (s.opts.redirectURL != "" && redirectURI != s.opts.redirectURL) {
+		http.Error(w, "redirect_uri not allowed", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	// From here on errors are reported to the client through the redirect, as in RFC 6749 4.1.2.1
+	fail := func(code, description string) {
+		params := target.Query()
+		params.Set("error", code)
+		params.Set("error_description", description)
+		params.Set("state", q.Get("state"))
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	if !strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	email := s.opts.email
+	if hint := q.Get("login_hint"); hint != "" {
+		email = hint
+	}
+	code := randomString(24)
+	s.mu.Lock()
+	s.codes[code] = pendingCode{
+		clientID:      s.opts.clientID,
+		redirectURI:   redirectURI,
+		challenge:     q.Get("code_challenge"),
+		nonce:         q.Get("nonce"),
+		email:         email,
+		emailVerified: s.opts.emailVerified,
+		expiresAt:     time.Now().Add(codeTTL),
+	}
+	s.mu.Unlock()
+
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	target.RawQuery = params.Encode()
+	log.Printf("Approved authorization for %s", email)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token after checking the client, redirect_uri and PKCE verifier
+func (s *server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+	if !s.authenticateClient(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Codes can be used only once, even when the exchange fails
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	pending, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok || time.Now().After(pending.expiresAt) {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != pending.redirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+		tokenError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	idToken, err := s.signIDToken(pending)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(24),
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// authenticateClient accepts client_secret_basic and client_secret_post, or no secret for a public client
+func (s *server) authenticateClient(r *http.Request) bool {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.opts.clientID {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(s.opts.clientSecret)) == 1
+}
+
+func (s *server) signIDToken(pending pendingCode) (string, error) {
+	local, _, _ := strings.Cut(pending.email, "@")
+	name := s.opts.name
+	if name == "" {
+		name = local
+	}
+	audience := s.opts.audience
+	if audience == "" {
+		audience = pending.clientID
+	}
+	nonce := pending.nonce
+	if s.opts.nonce != "" {
+		nonce = s.opts.nonce
+	}
+	// The subject is derived from the email, so the same email always maps to the same identity
+	sub := sha256.Sum256([]byte(strings.ToLower(pending.email)))
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                s.opts.issuer,
+		"sub":                hex.EncodeToString(sub[:16]),
+		"aud":                audience,
+		"iat":                now.Unix(),
+		"exp":                now.Add(tokenTTL).Unix(),
+		"nonce":              nonce,
+		"email":              pending.email,
+		"email_verified":     pending.emailVerified,
+		"name":               name,
+		"preferred_username": local,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(s.key)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Could not read random bytes: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
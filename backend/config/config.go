@@ -1,6 +1,10 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -13,6 +17,123 @@ type Config struct {
 	RedisDB       int    `mapstructure:"REDIS_DB"`
 	ServerAddress string `mapstructure:"SERVER_ADDRESS"`
 	StripeAPIKey  string `mapstructure:"STRIPE_API_KEY"`
+	FrontendURL   string `mapstructure:"FRONTEND_URL"`
+
+	// 密码策略
+	PasswordMinLength        int    `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxLength        int    `mapstructure:"PASSWORD_MAX_LENGTH"`
+	PasswordBreachedListFile string `mapstructure:"PASSWORD_BREACHED_LIST_FILE"` // Local list of breached passwords, empty to disable
+
+	// 密码哈希，旧算法或旧参数的哈希在用户下次登录时自动升级
+	PasswordHashAlgorithm     string `mapstructure:"PASSWORD_HASH_ALGORITHM"`    // argon2id或bcrypt
+	PasswordArgon2MemoryKiB   uint32 `mapstructure:"PASSWORD_ARGON2_MEMORY_KIB"` // Argon2id内存，单位KiB
+	PasswordArgon2Iterations  uint32 `mapstructure:"PASSWORD_ARGON2_ITERATIONS"`
+	PasswordArgon2Parallelism uint8  `mapstructure:"PASSWORD_ARGON2_PARALLELISM"`
+	PasswordBcryptCost        int    `mapstructure:"PASSWORD_BCRYPT_COST"`
+
+	// 邮箱验证
+	EmailVerificationRequired bool   `mapstructure:"EMAIL_VERIFICATION_REQUIRED"` // New accounts must verify their email before placing orders
+	EmailVerificationSecret   string `mapstructure:"EMAIL_VERIFICATION_SECRET"`   // HMAC key used to sign verification links
+
+	// 邮件配置
+	MailDriver    string `mapstructure:"MAIL_DRIVER"`     // log or file
+	MailOutboxDir string `mapstructure:"MAIL_OUTBOX_DIR"` // Directory used by the file driver
+
+	// JWT签名配置
+	JWTSigningAlgorithm string `mapstructure:"JWT_SIGNING_ALGORITHM"` // RS256, EdDSA, or HS256 (local development only)
+	JWTSigningKeyID     string `mapstructure:"JWT_SIGNING_KEY_ID"`    // kid of the active signing key
+	JWTPrivateKeyFile   string `mapstructure:"JWT_PRIVATE_KEY_FILE"`  // PEM file of the active signing key
+	JWTSecret           string `mapstructure:"JWT_SECRET"`            // Shared secret, only used with HS256
+	JWTVerificationKeys string `mapstructure:"JWT_VERIFICATION_KEYS"` // Comma separated kid:path pairs of extra verification keys
+	JWTRetiredKeyIDs    string `mapstructure:"JWT_RETIRED_KEY_IDS"`   // Comma separated kids whose tokens are rejected
+
+	// 认证Cookie
+	CookieSecure   bool   `mapstructure:"COOKIE_SECURE"`    // Only send auth cookies over HTTPS
+	CookieHTTPOnly bool   `mapstructure:"COOKIE_HTTP_ONLY"` // Hide token cookies from JavaScript
+	CookieSameSite string `mapstructure:"COOKIE_SAMESITE"`  // lax, strict or none
+	CookieDomain   string `mapstructure:"COOKIE_DOMAIN"`    // Empty means the current host only
+	AuthCookieOnly bool   `mapstructure:"AUTH_COOKIE_ONLY"` // Do not return tokens in login/refresh response bodies
+	CSRFSecret     string `mapstructure:"CSRF_SECRET"`      // HMAC key binding CSRF tokens to the session
+
+	// 登录防暴力破解
+	LoginMaxFailuresPerUser int           `mapstructure:"LOGIN_MAX_FAILURES_PER_USER"` // Failures per username before lockout
+	LoginMaxFailuresPerIP   int           `mapstructure:"LOGIN_MAX_FAILURES_PER_IP"`   // Failures per client IP before lockout
+	LoginFailureWindow      time.Duration `mapstructure:"LOGIN_FAILURE_WINDOW"`        // Window in which failures are counted
+	LoginLockoutDuration    time.Duration `mapstructure:"LOGIN_LOCKOUT_DURATION"`      // How long a locked username or IP is refused
+
+	// 异常登录检测
+	LoginRiskEnabled             bool          `mapstructure:"LOGIN_RISK_ENABLED"`
+	LoginRiskStepUp              bool          `mapstructure:"LOGIN_RISK_STEP_UP"`                // Require an emailed code for flagged logins without TOTP
+	LoginRiskGeoIPFile           string        `mapstructure:"LOGIN_RISK_GEOIP_FILE"`             // Local GeoIP CSV, empty disables the impossible travel check
+	LoginRiskMaxTravelSpeedKmh   float64       `mapstructure:"LOGIN_RISK_MAX_TRAVEL_SPEED_KMH"`   // Faster travel between two logins is flagged
+	LoginRiskMinTravelDistanceKm float64       `mapstructure:"LOGIN_RISK_MIN_TRAVEL_DISTANCE_KM"` // Shorter distances are ignored to absorb GeoIP inaccuracy
+	LoginRiskSharedIPMaxAccounts int           `mapstructure:"LOGIN_RISK_SHARED_IP_MAX_ACCOUNTS"` // Accounts per IP within the window before logins are flagged
+	LoginRiskSharedIPWindow      time.Duration `mapstructure:"LOGIN_RISK_SHARED_IP_WINDOW"`
+	LoginRiskHistoryTTL          time.Duration `mapstructure:"LOGIN_RISK_HISTORY_TTL"` // How long known devices and networks are remembered
+	LoginAlertNotifier           string        `mapstructure:"LOGIN_ALERT_NOTIFIER"`   // mail, log or none
+
+	// IP访问规则
+	IPAdminAllowlistOnly bool          `mapstructure:"IP_ADMIN_ALLOWLIST_ONLY"` // 管理接口只允许allowlist中的IP访问
+	IPAutoBanEnabled     bool          `mapstructure:"IP_AUTO_BAN_ENABLED"`     // 是否自动封禁因登录暴力破解被锁定的IP
+	IPAutoBanDuration    time.Duration `mapstructure:"IP_AUTO_BAN_DURATION"`    // 登录暴力破解IP的封禁时长，0表示不封禁
+	TrustedProxies       string        `mapstructure:"TRUSTED_PROXIES"`         // 逗号分隔的可信代理IP或CIDR，为空时不信任X-Forwarded-For
+
+	// 个人信息字段加密，主密钥二选一
+	FieldEncryptionMasterKey     string `mapstructure:"FIELD_ENCRYPTION_MASTER_KEY"`      // base64编码的32字节主密钥
+	FieldEncryptionMasterKeyFile string `mapstructure:"FIELD_ENCRYPTION_MASTER_KEY_FILE"` // 保存主密钥的文件
+	FieldEncryptionOldMasterKeys string `mapstructure:"FIELD_ENCRYPTION_OLD_MASTER_KEYS"` // 逗号分隔的旧主密钥，轮换完成后删除
+
+	// 账户注销
+	ErasureGracePeriod   time.Duration `mapstructure:"ERASURE_GRACE_PERIOD"`   // 申请注销后多久执行，期间可以撤销
+	ErasureCheckInterval time.Duration `mapstructure:"ERASURE_CHECK_INTERVAL"` // 检查到期注销申请的间隔
+
+	// 限流策略，格式为"次数/窗口[,算法][,维度]"，例如"20/1m"或"300/1m,token_bucket,ip"
+	RateLimitAuth     string `mapstructure:"RATE_LIMIT_AUTH"`
+	RateLimitSession  string `mapstructure:"RATE_LIMIT_SESSION"`  // 刷新令牌、CSRF令牌和会话管理
+	RateLimitPreAuth  string `mapstructure:"RATE_LIMIT_PRE_AUTH"` // 认证之前按IP计数
+	RateLimitPayments string `mapstructure:"RATE_LIMIT_PAYMENTS"`
+	RateLimitCatalog  string `mapstructure:"RATE_LIMIT_CATALOG"`
+	RateLimitDefault  string `mapstructure:"RATE_LIMIT_DEFAULT"`
+	RateLimitAPIKey   string `mapstructure:"RATE_LIMIT_API_KEY"` // 使用API密钥的请求，按密钥计数
+
+	// 跨域配置
+	CORSAllowedOrigins        string        `mapstructure:"CORS_ALLOWED_ORIGINS"`         // Comma separated exact origins, e.g. https://shop.example.com
+	CORSAllowedOriginPatterns string        `mapstructure:"CORS_ALLOWED_ORIGIN_PATTERNS"` // Comma separated wildcard origins, e.g. https://*.example.com
+	CORSAllowCredentials      bool          `mapstructure:"CORS_ALLOW_CREDENTIALS"`       // Allow cookies on cross-origin requests
+	CORSMaxAge                time.Duration `mapstructure:"CORS_MAX_AGE"`                 // How long browsers may cache preflight results
+	CORSGroupOverrides        string        `mapstructure:"CORS_GROUP_OVERRIDES"`         // Per path prefix origins, e.g. /api/products=*;/api/payments=https://pay.example.com
+
+	// 安全响应头
+	SecurityCSP                   string        `mapstructure:"SECURITY_CSP"`                     // Content-Security-Policy, {nonce} is replaced per request
+	SecurityCSPReportOnly         bool          `mapstructure:"SECURITY_CSP_REPORT_ONLY"`         // Send Content-Security-Policy-Report-Only instead
+	SecurityCSPReportURI          string        `mapstructure:"SECURITY_CSP_REPORT_URI"`          // Where browsers send violation reports
+	SecurityHSTSMaxAge            time.Duration `mapstructure:"SECURITY_HSTS_MAX_AGE"`            // 0 disables Strict-Transport-Security
+	SecurityHSTSIncludeSubdomains bool          `mapstructure:"SECURITY_HSTS_INCLUDE_SUBDOMAINS"` // Add includeSubDomains to HSTS
+	SecurityHSTSPreload           bool          `mapstructure:"SECURITY_HSTS_PRELOAD"`            // Add preload to HSTS
+	SecurityFrameOptions          string        `mapstructure:"SECURITY_FRAME_OPTIONS"`           // DENY or SAMEORIGIN
+	SecurityReferrerPolicy        string        `mapstructure:"SECURITY_REFERRER_POLICY"`
+	SecurityPermissionsPolicy     string        `mapstructure:"SECURITY_PERMISSIONS_POLICY"`
+
+	// OpenID Connect登录，每个提供方的配置通过OIDC_<NAME>_*读取，见LoadOIDCProviders
+	OIDCProviderNames string         `mapstructure:"OIDC_PROVIDERS"` // Comma separated provider names, e.g. google,okta
+	OIDCProviders     []OIDCProvider `mapstructure:"-"`
+
+	// 两步验证配置
+	MFAIssuer            string `mapstructure:"MFA_ISSUER"`              // Issuer name shown in authenticator apps
+	MFARequiredForAdmins bool   `mapstructure:"MFA_REQUIRED_FOR_ADMINS"` // Require TOTP for every admin account
+}
+
+// OIDCProvider is the configuration of one OpenID Connect identity provider.
+// For a provider named "okta" the values come from OIDC_OKTA_ISSUER, OIDC_OKTA_CLIENT_ID and so on.
+type OIDCProvider struct {
+	Name         string
+	DisplayName  string   // OIDC_<NAME>_DISPLAY_NAME, shown on the login page
+	Issuer       string   // OIDC_<NAME>_ISSUER, discovery is read from <issuer>/.well-known/openid-configuration
+	ClientID     string   // OIDC_<NAME>_CLIENT_ID
+	ClientSecret string   // OIDC_<NAME>_CLIENT_SECRET, empty for public clients
+	RedirectURL  string   // OIDC_<NAME>_REDIRECT_URL, defaults to <FRONTEND_URL>/auth/callback/<name>
+	Scopes       []string // OIDC_<NAME>_SCOPES, space separated, defaults to "openid email profile"
+	TrustEmail   bool     // OIDC_<NAME>_TRUST_EMAIL, treat emails as verified even without the email_verified claim
 }
 
 // LoadConfig reads configuration from file or environment variables.
@@ -23,6 +144,79 @@ func LoadConfig(path string) (config Config, err error) {
 
 	viper.AutomaticEnv() // Read in environment variables that match
 
+	// Defaults for optional settings, so they can also be supplied through environment variables only
+	viper.SetDefault("FRONTEND_URL", "http://localhost:3000")
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 8)
+	viper.SetDefault("PASSWORD_MAX_LENGTH", 72)
+	viper.SetDefault("PASSWORD_BREACHED_LIST_FILE", "")
+	viper.SetDefault("PASSWORD_HASH_ALGORITHM", "argon2id")
+	viper.SetDefault("PASSWORD_ARGON2_MEMORY_KIB", 19456)
+	viper.SetDefault("PASSWORD_ARGON2_ITERATIONS", 2)
+	viper.SetDefault("PASSWORD_ARGON2_PARALLELISM", 1)
+	viper.SetDefault("PASSWORD_BCRYPT_COST", 12)
+	viper.SetDefault("EMAIL_VERIFICATION_REQUIRED", false)
+	viper.SetDefault("EMAIL_VERIFICATION_SECRET", "")
+	viper.SetDefault("MAIL_DRIVER", "log")
+	viper.SetDefault("MAIL_OUTBOX_DIR", "mail_outbox")
+	viper.SetDefault("JWT_SIGNING_ALGORITHM", "EdDSA")
+	viper.SetDefault("JWT_SIGNING_KEY_ID", "")
+	viper.SetDefault("JWT_PRIVATE_KEY_FILE", "")
+	viper.SetDefault("JWT_SECRET", "")
+	viper.SetDefault("JWT_VERIFICATION_KEYS", "")
+	viper.SetDefault("JWT_RETIRED_KEY_IDS", "")
+	viper.SetDefault("COOKIE_SECURE", false)
+	viper.SetDefault("COOKIE_HTTP_ONLY", true)
+	viper.SetDefault("COOKIE_SAMESITE", "lax")
+	viper.SetDefault("COOKIE_DOMAIN", "")
+	viper.SetDefault("AUTH_COOKIE_ONLY", false)
+	viper.SetDefault("CSRF_SECRET", "")
+	viper.SetDefault("LOGIN_MAX_FAILURES_PER_USER", 5)
+	viper.SetDefault("LOGIN_MAX_FAILURES_PER_IP", 20)
+	viper.SetDefault("LOGIN_FAILURE_WINDOW", "15m")
+	viper.SetDefault("LOGIN_LOCKOUT_DURATION", "15m")
+	viper.SetDefault("LOGIN_RISK_ENABLED", true)
+	viper.SetDefault("LOGIN_RISK_STEP_UP", true)
+	viper.SetDefault("LOGIN_RISK_GEOIP_FILE", "")
+	viper.SetDefault("LOGIN_RISK_MAX_TRAVEL_SPEED_KMH", 900)
+	viper.SetDefault("LOGIN_RISK_MIN_TRAVEL_DISTANCE_KM", 300)
+	viper.SetDefault("LOGIN_RISK_SHARED_IP_MAX_ACCOUNTS", 5)
+	viper.SetDefault("LOGIN_RISK_SHARED_IP_WINDOW", "1h")
+	viper.SetDefault("LOGIN_RISK_HISTORY_TTL", "4320h")
+	viper.SetDefault("LOGIN_ALERT_NOTIFIER", "mail")
+	viper.SetDefault("IP_ADMIN_ALLOWLIST_ONLY", false)
+	viper.SetDefault("IP_AUTO_BAN_ENABLED", false)
+	viper.SetDefault("IP_AUTO_BAN_DURATION", "1h")
+	viper.SetDefault("TRUSTED_PROXIES", "")
+	viper.SetDefault("FIELD_ENCRYPTION_MASTER_KEY", "")
+	viper.SetDefault("FIELD_ENCRYPTION_MASTER_KEY_FILE", "")
+	viper.SetDefault("FIELD_ENCRYPTION_OLD_MASTER_KEYS", "")
+	viper.SetDefault("ERASURE_GRACE_PERIOD", "720h")
+	viper.SetDefault("ERASURE_CHECK_INTERVAL", "10m")
+	viper.SetDefault("RATE_LIMIT_AUTH", "")
+	viper.SetDefault("RATE_LIMIT_SESSION", "")
+	viper.SetDefault("RATE_LIMIT_PRE_AUTH", "")
+	viper.SetDefault("RATE_LIMIT_PAYMENTS", "")
+	viper.SetDefault("RATE_LIMIT_CATALOG", "")
+	viper.SetDefault("RATE_LIMIT_DEFAULT", "")
+	viper.SetDefault("RATE_LIMIT_API_KEY", "")
+	viper.SetDefault("CORS_ALLOWED_ORIGINS", "http://localhost:3000")
+	viper.SetDefault("CORS_ALLOWED_ORIGIN_PATTERNS", "")
+	viper.SetDefault("CORS_ALLOW_CREDENTIALS", true)
+	viper.SetDefault("CORS_MAX_AGE", "2h")
+	viper.SetDefault("CORS_GROUP_OVERRIDES", "")
+	viper.SetDefault("SECURITY_CSP", "default-src 'self'; script-src 'self' {nonce}; object-src 'none'; base-uri 'self'; form-action 'self'")
+	viper.SetDefault("SECURITY_CSP_REPORT_ONLY", false)
+	viper.SetDefault("SECURITY_CSP_REPORT_URI", "/api/security/csp-report")
+	viper.SetDefault("SECURITY_HSTS_MAX_AGE", "4320h")
+	viper.SetDefault("SECURITY_HSTS_INCLUDE_SUBDOMAINS", false)
+	viper.SetDefault("SECURITY_HSTS_PRELOAD", false)
+	viper.SetDefault("SECURITY_FRAME_OPTIONS", "DENY")
+	viper.SetDefault("SECURITY_REFERRER_POLICY", "strict-origin-when-cross-origin")
+	viper.SetDefault("SECURITY_PERMISSIONS_POLICY", "camera=(), microphone=(), geolocation=(), payment=()")
+	viper.SetDefault("MFA_ISSUER", "Web Security Shop")
+	viper.SetDefault("MFA_REQUIRED_FOR_ADMINS", false)
+	viper.SetDefault("OIDC_PROVIDERS", "")
+
 	err = viper.ReadInConfig()
 	if err != nil {
 		// If config file not found, try to use environment variables only
@@ -31,6 +225,60 @@ func LoadConfig(path string) (config Config, err error) {
 		}
 	}
 
-	err = viper.Unmarshal(&config)
+	if err = viper.Unmarshal(&config); err != nil {
+		return
+	}
+	config.OIDCProviders, err = LoadOIDCProviders(config.OIDCProviderNames, config.FrontendURL)
 	return
 }
+
+// LoadOIDCProviders reads the settings of every provider listed in OIDC_PROVIDERS.
+// Provider names may only contain letters, digits and underscores, since they are part of the variable names.
+func LoadOIDCProviders(names, frontendURL string) ([]OIDCProvider, error) {
+	var providers []OIDCProvider
+	seen := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !validProviderName(name) {
+			return nil, fmt.Errorf("invalid OIDC provider name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("OIDC provider %q is listed twice", name)
+		}
+		seen[name] = true
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		viper.SetDefault(prefix+"DISPLAY_NAME", name)
+		viper.SetDefault(prefix+"REDIRECT_URL", strings.TrimRight(frontendURL, "/")+"/auth/callback/"+name)
+		viper.SetDefault(prefix+"SCOPES", "openid email profile")
+		viper.SetDefault(prefix+"TRUST_EMAIL", false)
+
+		provider := OIDCProvider{
+			Name:         name,
+			DisplayName:  viper.GetString(prefix + "DISPLAY_NAME"),
+			Issuer:       viper.GetString(prefix + "ISSUER"),
+			ClientID:     viper.GetString(prefix + "CLIENT_ID"),
+			ClientSecret: viper.GetString(prefix + "CLIENT_SECRET"),
+			RedirectURL:  viper.GetString(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(viper.GetString(prefix + "SCOPES")),
+			TrustEmail:   viper.GetBool(prefix + "TRUST_EMAIL"),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+func validProviderName(name string) bool {
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
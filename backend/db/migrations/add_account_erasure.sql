@@ -0,0 +1,21 @@
+-- Account erasure requests. Users are no longer deleted: when the grace period is over the
+-- account is anonymized and its orders are kept, without the personal data, for accounting.
+CREATE TABLE IF NOT EXISTS `account_erasure_requests` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `status` enum('pending','cancelled','completed') NOT NULL DEFAULT 'pending',
+  `requested_by` int NOT NULL, -- The user themselves, or the admin who deleted the account
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `requested_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `scheduled_for` datetime NOT NULL,
+  `cancelled_at` datetime DEFAULT NULL,
+  `cancelled_by` int DEFAULT NULL,
+  `completed_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_account_erasure_user` (`user_id`, `status`),
+  KEY `idx_account_erasure_due` (`status`, `scheduled_for`),
+  CONSTRAINT `account_erasure_requests_user_fk` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+ALTER TABLE `users`
+  ADD COLUMN `erased_at` datetime DEFAULT NULL; -- Set when the account has been anonymized
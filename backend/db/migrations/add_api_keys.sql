@@ -0,0 +1,22 @@
+-- API keys for scripts and integrations. Keys look like wsk_<prefix>_<secret>; only the prefix
+-- and the SHA-256 of the secret are stored, the full key is shown once when it is created.
+CREATE TABLE IF NOT EXISTS `api_keys` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `name` varchar(100) NOT NULL,
+  `prefix` char(12) NOT NULL,
+  `secret_hash` char(64) NOT NULL,
+  `scopes` varchar(1024) NOT NULL, -- Comma separated permission names
+  `rate_limit` int DEFAULT NULL, -- Requests per RATE_LIMIT_API_KEY window, NULL uses the policy limit
+  `expires_at` datetime NOT NULL,
+  `last_used_at` datetime DEFAULT NULL,
+  `last_used_ip` varchar(45) DEFAULT NULL,
+  `created_by` int NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `revoked_at` datetime DEFAULT NULL,
+  `revoked_by` int DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_api_keys_prefix` (`prefix`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+INSERT INTO `permissions` (`name`, `description`) VALUES
+('api_keys:manage', 'Create, list and revoke API keys');
@@ -0,0 +1,47 @@
+-- Append-only audit log. Every row stores the hash of the previous row, so edits, deletions
+-- and insertions can be detected by recomputing the chain (cmd/auditverify).
+CREATE TABLE `audit_events` (
+  `id` bigint NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  `action` varchar(64) NOT NULL,
+  `outcome` varchar(16) NOT NULL,
+  `actor_user_id` int DEFAULT NULL,
+  `actor_username` varchar(50) NOT NULL DEFAULT '',
+  `actor_role` varchar(32) NOT NULL DEFAULT '',
+  `ip_address` varchar(45) NOT NULL DEFAULT '',
+  `user_agent` varchar(512) NOT NULL DEFAULT '',
+  `request_id` varchar(64) NOT NULL DEFAULT '',
+  `target_type` varchar(32) NOT NULL DEFAULT '',
+  `target_id` varchar(64) NOT NULL DEFAULT '',
+  -- Stored as text rather than json so the bytes that were hashed are kept exactly
+  `details` text DEFAULT NULL,
+  `prev_hash` char(64) NOT NULL,
+  `hash` char(64) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_audit_events_created_at` (`created_at`),
+  KEY `idx_audit_events_actor` (`actor_user_id`),
+  KEY `idx_audit_events_action` (`action`),
+  KEY `idx_audit_events_target` (`target_type`,`target_id`),
+  KEY `idx_audit_events_request_id` (`request_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Single row pointing at the last entry; appends lock it so ids stay contiguous
+CREATE TABLE `audit_chain_head` (
+  `id` tinyint NOT NULL,
+  `last_id` bigint NOT NULL,
+  `last_hash` char(64) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+INSERT INTO `audit_chain_head` (`id`, `last_id`, `last_hash`) VALUES
+(1, 0, '0000000000000000000000000000000000000000000000000000000000000000');
+
+-- Reject changes made through the application account; the hash chain catches anything else
+CREATE TRIGGER `audit_events_no_update` BEFORE UPDATE ON `audit_events`
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only';
+
+CREATE TRIGGER `audit_events_no_delete` BEFORE DELETE ON `audit_events`
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only';
+
+INSERT INTO `permissions` (`name`, `description`) VALUES
+('audit:read', 'Query and verify the audit log');
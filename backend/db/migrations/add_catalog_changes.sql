@@ -0,0 +1,19 @@
+-- Who changed which product or category, with the editable fields before and after the change
+CREATE TABLE `catalog_changes` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `entity_type` enum('product','category') NOT NULL,
+  `entity_id` int NOT NULL,
+  `action` enum('create','update','delete') NOT NULL,
+  `actor_user_id` int DEFAULT NULL,
+  `actor_username` varchar(50) NOT NULL DEFAULT '',
+  `actor_role` varchar(32) NOT NULL DEFAULT '',
+  `ip_address` varchar(45) NOT NULL DEFAULT '',
+  `before_data` json DEFAULT NULL,
+  `after_data` json DEFAULT NULL,
+  `changed_fields` json NOT NULL,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_catalog_changes_entity` (`entity_type`,`entity_id`),
+  KEY `idx_catalog_changes_actor` (`actor_user_id`),
+  KEY `idx_catalog_changes_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,22 @@
+-- Content-Security-Policy violation reports sent by browsers
+CREATE TABLE `csp_reports` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `document_uri` varchar(2048) NOT NULL DEFAULT '',
+  `referrer` varchar(2048) NOT NULL DEFAULT '',
+  `blocked_uri` varchar(2048) NOT NULL DEFAULT '',
+  `violated_directive` varchar(255) NOT NULL DEFAULT '',
+  `effective_directive` varchar(255) NOT NULL DEFAULT '',
+  `original_policy` text,
+  `disposition` varchar(16) NOT NULL DEFAULT '',
+  `source_file` varchar(2048) NOT NULL DEFAULT '',
+  `script_sample` varchar(255) NOT NULL DEFAULT '',
+  `line_number` int NOT NULL DEFAULT '0',
+  `column_number` int NOT NULL DEFAULT '0',
+  `status_code` int NOT NULL DEFAULT '0',
+  `user_agent` varchar(512) NOT NULL DEFAULT '',
+  `ip_address` varchar(45) NOT NULL DEFAULT '',
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_csp_reports_created_at` (`created_at`),
+  KEY `idx_csp_reports_directive` (`effective_directive`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
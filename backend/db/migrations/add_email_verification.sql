@@ -0,0 +1,6 @@
+-- Track when the email address of a user was verified
+ALTER TABLE `users`
+ADD COLUMN `email_verified_at` timestamp NULL DEFAULT NULL AFTER `email`;
+
+-- Accounts created before email verification existed are treated as verified
+UPDATE `users` SET `email_verified_at` = COALESCE(`created_at`, CURRENT_TIMESTAMP) WHERE `email_verified_at` IS NULL;
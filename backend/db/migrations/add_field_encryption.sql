@@ -0,0 +1,22 @@
+-- Data keys for field-level encryption, wrapped (AES-GCM) by the master key from the config.
+-- 'data' keys encrypt column values, the 'index' key computes blind indexes and is not rotated
+-- with the data keys. Retired data keys are kept so older ciphertexts can still be decrypted.
+CREATE TABLE IF NOT EXISTS `data_keys` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `purpose` enum('data','index') NOT NULL DEFAULT 'data',
+  `wrapped_key` varbinary(128) NOT NULL,
+  `master_key_id` char(16) NOT NULL, -- First 8 bytes of SHA-256 of the wrapping master key, hex encoded
+  `status` enum('active','retired') NOT NULL DEFAULT 'active',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_data_keys_purpose_status` (`purpose`, `status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Encrypted values are stored as enc:v1:<key id>:<base64>, which is longer than the plaintext.
+-- Existing plaintext rows keep working and are encrypted by go run ./cmd/rotatekeys.
+ALTER TABLE `users`
+  MODIFY `phone` varchar(255) DEFAULT NULL,
+  MODIFY `city` varchar(1024) DEFAULT NULL,
+  MODIFY `zip_postal_code` varchar(255) DEFAULT NULL,
+  ADD COLUMN `phone_bidx` char(64) DEFAULT NULL AFTER `phone`, -- HMAC-SHA256 blind index for exact phone lookups
+  ADD KEY `idx_users_phone_bidx` (`phone_bidx`);
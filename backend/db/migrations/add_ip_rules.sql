@@ -0,0 +1,17 @@
+-- IP allow/deny rules, single addresses are stored as /32 or /128 networks
+CREATE TABLE IF NOT EXISTS `ip_rules` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `cidr` varchar(49) NOT NULL,
+  `action` enum('allow','deny') NOT NULL,
+  `scope` enum('all','admin') NOT NULL DEFAULT 'all',
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `created_by` int DEFAULT NULL, -- NULL for rules created automatically, e.g. login brute-force bans
+  `expires_at` datetime DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_ip_rules_expires_at` (`expires_at`),
+  KEY `idx_ip_rules_cidr` (`cidr`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+INSERT INTO `permissions` (`name`, `description`) VALUES
+('ip_rules:manage', 'Create, list and delete IP allow/deny rules');
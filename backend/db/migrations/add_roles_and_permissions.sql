@@ -0,0 +1,61 @@
+-- Roles and permissions for authorization. Permissions are named "<resource>:<action>",
+-- "*" grants everything and is reserved for the admin role.
+CREATE TABLE `roles` (
+  `name` varchar(32) NOT NULL,
+  `description` varchar(255) DEFAULT NULL,
+  `is_system` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+CREATE TABLE `permissions` (
+  `name` varchar(64) NOT NULL,
+  `description` varchar(255) DEFAULT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+CREATE TABLE `role_permissions` (
+  `role` varchar(32) NOT NULL,
+  `permission` varchar(64) NOT NULL,
+  PRIMARY KEY (`role`,`permission`),
+  KEY `permission` (`permission`),
+  CONSTRAINT `role_permissions_ibfk_1` FOREIGN KEY (`role`) REFERENCES `roles` (`name`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `role_permissions_ibfk_2` FOREIGN KEY (`permission`) REFERENCES `permissions` (`name`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+INSERT INTO `roles` (`name`, `description`, `is_system`) VALUES
+('user', 'Customer account', 1),
+('admin', 'Full access to everything', 1),
+('support', 'Customer support staff', 0),
+('catalog_manager', 'Maintains products and categories', 0),
+('warehouse', 'Fulfils and ships orders', 0);
+
+INSERT INTO `permissions` (`name`, `description`) VALUES
+('*', 'All permissions'),
+('products:write', 'Create, update and delete products'),
+('categories:write', 'Create, update and delete categories'),
+('orders:read', 'View orders of every user'),
+('orders:update_status', 'Change the status of any order'),
+('orders:refund', 'Mark orders as refunded'),
+('users:read', 'View user accounts'),
+('users:suspend', 'Change the account status of users'),
+('users:delete', 'Delete user accounts'),
+('users:security', 'Manage sessions, security events, MFA requirement and login lockouts of users'),
+('users:roles', 'Assign roles to users and change role permissions');
+
+INSERT INTO `role_permissions` (`role`, `permission`) VALUES
+('admin', '*'),
+('support', 'users:read'),
+('support', 'users:security'),
+('support', 'orders:read'),
+('support', 'orders:refund'),
+('support', 'orders:update_status'),
+('catalog_manager', 'products:write'),
+('catalog_manager', 'categories:write'),
+('warehouse', 'orders:read'),
+('warehouse', 'orders:update_status');
+
+-- The role enum only allowed 'user' and 'admin'; roles are now rows in the roles table
+ALTER TABLE `users`
+MODIFY COLUMN `role` varchar(32) NOT NULL DEFAULT 'user',
+ADD CONSTRAINT `users_role_fk` FOREIGN KEY (`role`) REFERENCES `roles` (`name`) ON UPDATE CASCADE;
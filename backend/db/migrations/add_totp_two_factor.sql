@@ -0,0 +1,17 @@
+-- Add TOTP two-factor authentication fields to users table
+ALTER TABLE `users`
+ADD COLUMN `totp_secret` VARCHAR(64) NULL AFTER `refresh_token`,
+ADD COLUMN `totp_enabled` TINYINT(1) NOT NULL DEFAULT '0' AFTER `totp_secret`,
+ADD COLUMN `mfa_required` TINYINT(1) NOT NULL DEFAULT '0' AFTER `totp_enabled`;
+
+-- One-time recovery codes, only SHA-256 hashes are stored
+CREATE TABLE `user_recovery_codes` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_code` (`user_id`,`code_hash`),
+  CONSTRAINT `user_recovery_codes_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,21 @@
+-- External identities from OpenID Connect providers. A user can link several identities;
+-- an identity (provider + subject) belongs to exactly one user.
+CREATE TABLE IF NOT EXISTS `user_identities` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `provider` varchar(50) NOT NULL, -- Provider name from OIDC_PROVIDERS
+  `subject` varchar(255) NOT NULL, -- The sub claim of the ID token
+  `email` varchar(255) DEFAULT NULL, -- Email returned by the provider at the last login
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_login_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_user_identities_subject` (`provider`, `subject`),
+  KEY `idx_user_identities_user` (`user_id`),
+  CONSTRAINT `user_identities_user_fk` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Set only when the user proved control of the address with a link or token sent to it (email
+-- verification or password reset). Unlike email_verified_at it is never set at registration or
+-- backfilled, so an OIDC identity is linked by email only to accounts that have it.
+ALTER TABLE `users`
+  ADD COLUMN `email_proven_at` timestamp NULL DEFAULT NULL AFTER `email_verified_at`;
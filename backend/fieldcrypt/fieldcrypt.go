@@ -0,0 +1,478 @@
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"web-security/backend/db"
+)
+
+// 密钥用途：data用于加密字段，index用于计算盲索引，盲索引密钥不随数据密钥轮换
+const (
+	PurposeData  = "data"
+	PurposeIndex = "index"
+)
+
+const (
+	// ciphertextPrefix 加密后的值的格式为 enc:v1:<数据密钥ID>:<base64(nonce|密文)>
+	ciphertextPrefix = "enc:v1:"
+	keyLength        = 32
+)
+
+// KeyRefreshInterval 各实例重新加载密钥表的间隔，轮换后最迟在这个时间之后改用新的数据密钥
+const KeyRefreshInterval = time.Minute
+
+var (
+	// ErrNotInitialized 没有调用Init或没有可用的数据密钥
+	ErrNotInitialized = errors.New("字段加密尚未初始化")
+	// ErrUnknownDataKey 密文使用的数据密钥不存在
+	ErrUnknownDataKey = errors.New("找不到加密数据使用的密钥")
+	// ErrDecrypt 密文格式错误或认证失败
+	ErrDecrypt = errors.New("解密失败，数据可能被篡改")
+)
+
+// Config 主密钥配置，MasterKey和MasterKeyFile二选一
+type Config struct {
+	// MasterKey base64编码的32字节主密钥
+	MasterKey string
+	// MasterKeyFile 保存主密钥的文件，内容为base64编码或32字节原始密钥
+	MasterKeyFile string
+	// OldMasterKeys 轮换前的主密钥，只用来解开还没有重新包装的数据密钥
+	OldMasterKeys []string
+}
+
+// Column 一个加密列，BlindIndex不为空时同时维护该列的盲索引
+type Column struct {
+	Table      string
+	Column     string
+	BlindIndex string
+	// Normalize 计算盲索引前统一格式，使写法不同的相同值得到相同的索引
+	Normalize func(string) string
+}
+
+// Field 作为附加认证数据，防止密文被挪到其他列使用
+func (c Column) Field() string {
+	return c.Table + "." + c.Column
+}
+
+// 加密的个人信息列
+var (
+	UserPhone            = Column{Table: "users", Column: "phone", BlindIndex: "phone_bidx", Normalize: NormalizePhone}
+	UserAddress          = Column{Table: "users", Column: "address"}
+	UserCity             = Column{Table: "users", Column: "city"}
+	UserZipPostalCode    = Column{Table: "users", Column: "zip_postal_code"}
+	OrderShippingAddress = Column{Table: "orders", Column: "shipping_address"}
+)
+
+// Columns 所有加密列，轮换数据密钥后按表逐行重新加密
+var Columns = []Column{UserPhone, UserAddress, UserCity, UserZipPostalCode, OrderShippingAddress}
+
+type dataKey struct {
+	id          int64
+	purpose     string
+	key         []byte
+	masterKeyID string
+	status      string
+}
+
+// keyring 解开后的密钥，只保存在内存中
+var keyring = struct {
+	sync.RWMutex
+	masterKeys  map[string][]byte
+	masterKeyID string
+	keys        map[int64]dataKey
+	activeID    int64
+	indexKey    []byte
+	loadedAt    time.Time
+}{}
+
+// Init 加载主密钥和数据密钥，密钥表为空时生成第一个数据密钥和盲索引密钥
+func Init(cfg Config) error {
+	master, err := loadMasterKey(cfg)
+	if err != nil {
+		return err
+	}
+	masterKeys := map[string][]byte{masterKeyID(master): master}
+	for _, encoded := range cfg.OldMasterKeys {
+		if encoded = strings.TrimSpace(encoded); encoded == "" {
+			continue
+		}
+		old, err := decodeKey(encoded)
+		if err != nil {
+			return fmt.Errorf("旧主密钥格式错误: %w", err)
+		}
+		masterKeys[masterKeyID(old)] = old
+	}
+
+	keyring.Lock()
+	keyring.masterKeys = masterKeys
+	keyring.masterKeyID = masterKeyID(master)
+	keyring.Unlock()
+
+	for _, purpose := range []string{PurposeData, PurposeIndex} {
+		if err := ensureKey(purpose); err != nil {
+			return fmt.Errorf("生成%s密钥失败: %w", purpose, err)
+		}
+	}
+	return loadKeys()
+}
+
+// loadMasterKey 从配置或密钥文件读取主密钥
+func loadMasterKey(cfg Config) ([]byte, error) {
+	if cfg.MasterKey != "" {
+		return decodeKey(cfg.MasterKey)
+	}
+	if cfg.MasterKeyFile == "" {
+		return nil, errors.New("没有配置字段加密的主密钥")
+	}
+	raw, err := os.ReadFile(cfg.MasterKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取主密钥文件失败: %w", err)
+	}
+	if key, err := decodeKey(strings.TrimSpace(string(raw))); err == nil {
+		return key, nil
+	}
+	if len(raw) == keyLength {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("主密钥文件 %s 必须包含base64编码或原始的32字节密钥", cfg.MasterKeyFile)
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLength {
+		return nil, fmt.Errorf("密钥长度必须是 %d 字节", keyLength)
+	}
+	return key, nil
+}
+
+// masterKeyID 主密钥的指纹，记录每个数据密钥由哪个主密钥包装
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// wrapKey 用主密钥加密数据密钥
+func wrapKey(master, key []byte, purpose string) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, []byte("data_keys:"+purpose)), nil
+}
+
+// unwrapKey 用主密钥解开数据密钥
+func unwrapKey(master, wrapped []byte, purpose string) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	key, err := gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte("data_keys:"+purpose))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ensureKey 没有该用途的有效密钥时生成一个，锁住查询范围防止多个实例同时生成
+func ensureKey(purpose string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow("SELECT id FROM data_keys WHERE purpose = ? AND status = 'active' ORDER BY id DESC LIMIT 1 FOR UPDATE", purpose).Scan(&id)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := insertKey(tx, purpose); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertKey 生成新的随机密钥，用当前主密钥包装后保存
+func insertKey(tx *sql.Tx, purpose string) (int64, error) {
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	keyring.RLock()
+	master := keyring.masterKeys[keyring.masterKeyID]
+	masterID := keyring.masterKeyID
+	keyring.RUnlock()
+
+	wrapped, err := wrapKey(master, key, purpose)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO data_keys (purpose, wrapped_key, master_key_id, status, created_at) VALUES (?, ?, ?, 'active', ?)",
+		purpose, wrapped, masterID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// loadKeys 读取并解开所有密钥，ID最大的有效数据密钥用于加密
+func loadKeys() error {
+	keyring.RLock()
+	masterKeys := keyring.masterKeys
+	keyring.RUnlock()
+	if masterKeys == nil {
+		return ErrNotInitialized
+	}
+
+	rows, err := db.DB.Query("SELECT id, purpose, wrapped_key, master_key_id, status FROM data_keys ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("读取密钥失败: %w", err)
+	}
+	defer rows.Close()
+
+	keys := map[int64]dataKey{}
+	var activeID int64
+	var indexKey []byte
+	for rows.Next() {
+		var k dataKey
+		var wrapped []byte
+		if err := rows.Scan(&k.id, &k.purpose, &wrapped, &k.masterKeyID, &k.status); err != nil {
+			return err
+		}
+		master, ok := masterKeys[k.masterKeyID]
+		if !ok {
+			return fmt.Errorf("密钥 %d 由未配置的主密钥 %s 包装", k.id, k.masterKeyID)
+		}
+		if k.key, err = unwrapKey(master, wrapped, k.purpose); err != nil {
+			return fmt.Errorf("解开密钥 %d 失败: %w", k.id, err)
+		}
+		keys[k.id] = k
+		if k.status == "active" && k.purpose == PurposeData {
+			activeID = k.id
+		}
+		if k.status == "active" && k.purpose == PurposeIndex {
+			indexKey = k.key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if activeID == 0 || indexKey == nil {
+		return ErrNotInitialized
+	}
+
+	keyring.Lock()
+	keyring.keys = keys
+	keyring.activeID = activeID
+	keyring.indexKey = indexKey
+	keyring.loadedAt = time.Now()
+	keyring.Unlock()
+	return nil
+}
+
+// refreshIfStale 定期重新加载密钥，发现其他进程轮换后的新数据密钥
+func refreshIfStale() {
+	keyring.Lock()
+	stale := keyring.masterKeys != nil && time.Since(keyring.loadedAt) > KeyRefreshInterval
+	if stale {
+		keyring.loadedAt = time.Now()
+	}
+	keyring.Unlock()
+	if stale {
+		if err := loadKeys(); err != nil {
+			log.Printf("重新加载字段加密密钥失败，继续使用已加载的密钥: %v", err)
+		}
+	}
+}
+
+// keyByID 查找数据密钥，找不到时重新加载一次，可能是其他进程刚生成的
+func keyByID(id int64) ([]byte, error) {
+	keyring.RLock()
+	k, ok := keyring.keys[id]
+	keyring.RUnlock()
+	if ok && k.purpose == PurposeData {
+		return k.key, nil
+	}
+	if err := loadKeys(); err != nil {
+		return nil, err
+	}
+	keyring.RLock()
+	k, ok = keyring.keys[id]
+	keyring.RUnlock()
+	if !ok || k.purpose != PurposeData {
+		return nil, ErrUnknownDataKey
+	}
+	return k.key, nil
+}
+
+// Encrypt 用当前数据密钥加密字段值，空字符串原样返回
+func Encrypt(col Column, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	refreshIfStale()
+	keyring.RLock()
+	id := keyring.activeID
+	k, ok := keyring.keys[id]
+	keyring.RUnlock()
+	if !ok {
+		return "", ErrNotInitialized
+	}
+
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(col.Field()))
+	return ciphertextPrefix + strconv.FormatInt(id, 10) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt 解密字段值，还没有被加密的旧数据原样返回
+func Decrypt(col Column, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	id, payload, err := parseCiphertext(value)
+	if err != nil {
+		return "", err
+	}
+	key, err := keyByID(id)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) < gcm.NonceSize() {
+		return "", ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, payload[:gcm.NonceSize()], payload[gcm.NonceSize():], []byte(col.Field()))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// DecryptNull 解密可以为NULL的列，NULL返回空字符串
+func DecryptNull(col Column, value sql.NullString) (string, error) {
+	if !value.Valid {
+		return "", nil
+	}
+	return Decrypt(col, value.String)
+}
+
+// IsEncrypted 判断值是否是本包生成的密文
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, ciphertextPrefix)
+}
+
+func parseCiphertext(value string) (int64, []byte, error) {
+	rest := strings.TrimPrefix(value, ciphertextPrefix)
+	idPart, payloadPart, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, nil, ErrDecrypt
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, nil, ErrDecrypt
+	}
+	payload, err := base64.RawStdEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return 0, nil, ErrDecrypt
+	}
+	return id, payload, nil
+}
+
+// NeedsReencrypt 值是明文或者不是用当前数据密钥加密的
+func NeedsReencrypt(value string) bool {
+	if value == "" {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	id, _, err := parseCiphertext(value)
+	if err != nil {
+		return false // 损坏的密文无法重新加密，留给人工处理
+	}
+	keyring.RLock()
+	defer keyring.RUnlock()
+	return id != keyring.activeID
+}
+
+// BlindIndex 计算用于等值查询的盲索引，值为空时返回NULL
+func BlindIndex(col Column, value string) sql.NullString {
+	if col.Normalize != nil {
+		value = col.Normalize(value)
+	}
+	if value == "" {
+		return sql.NullString{}
+	}
+	keyring.RLock()
+	indexKey := keyring.indexKey
+	keyring.RUnlock()
+	if indexKey == nil {
+		return sql.NullString{}
+	}
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(col.Field() + "\x00" + value))
+	return sql.NullString{String: hex.EncodeToString(mac.Sum(nil)), Valid: true}
+}
+
+// NormalizePhone 只保留数字和开头的+号，"+86 138-0000-0000"和"+8613800000000"得到相同的索引
+func NormalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	var b strings.Builder
+	for i, r := range phone {
+		if r == '+' && i == 0 {
+			b.WriteRune(r)
+		} else if unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	if b.String() == "+" {
+		return ""
+	}
+	return b.String()
+}
@@ -0,0 +1,442 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"web-security/backend/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testKey 生成测试用的固定密钥，每个字节都是b
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keyLength)
+}
+
+// setKeyring 直接在内存中设置数据密钥和盲索引密钥，不访问数据库，测试结束后恢复
+func setKeyring(t *testing.T, keys map[int64][]byte, activeID int64) {
+	t.Helper()
+	keyring.Lock()
+	savedMasterKeys, savedMasterKeyID := keyring.masterKeys, keyring.masterKeyID
+	savedKeys, savedActiveID := keyring.keys, keyring.activeID
+	savedIndexKey, savedLoadedAt := keyring.indexKey, keyring.loadedAt
+	keyring.keys = map[int64]dataKey{}
+	for id, key := range keys {
+		status := "retired"
+		if id == activeID {
+			status = "active"
+		}
+		keyring.keys[id] = dataKey{id: id, purpose: PurposeData, key: key, status: status}
+	}
+	keyring.activeID = activeID
+	keyring.indexKey = testKey(0xEE)
+	keyring.loadedAt = time.Now()
+	keyring.Unlock()
+
+	t.Cleanup(func() {
+		keyring.Lock()
+		keyring.masterKeys, keyring.masterKeyID = savedMasterKeys, savedMasterKeyID
+		keyring.keys, keyring.activeID = savedKeys, savedActiveID
+		keyring.indexKey, keyring.loadedAt = savedIndexKey, savedLoadedAt
+		keyring.Unlock()
+	})
+}
+
+// encryptWithKey 使用指定的数据密钥加密，模拟还没有加载新密钥的实例写入的数据
+func encryptWithKey(t *testing.T, id int64, col Column, plaintext string) string {
+	t.Helper()
+	keyring.Lock()
+	activeID := keyring.activeID
+	keyring.activeID = id
+	keyring.Unlock()
+	defer func() {
+		keyring.Lock()
+		keyring.activeID = activeID
+		keyring.Unlock()
+	}()
+
+	ciphertext, err := Encrypt(col, plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return ciphertext
+}
+
+// keyIDOf 密文使用的数据密钥ID
+func keyIDOf(t *testing.T, ciphertext string) int64 {
+	t.Helper()
+	id, _, err := parseCiphertext(ciphertext)
+	if err != nil {
+		t.Fatalf("parseCiphertext(%q): %v", ciphertext, err)
+	}
+	return id
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	setKeyring(t, map[int64][]byte{1: testKey(1)}, 1)
+
+	tests := []struct {
+		name      string
+		col       Column
+		plaintext string
+	}{
+		{"电话", UserPhone, "+86 138-0000-0000"},
+		{"地址", UserAddress, "北京市海淀区中关村大街1号"},
+		{"邮编", UserZipPostalCode, "100080"},
+		{"收货地址", OrderShippingAddress, "Line 1\nLine 2, \"quoted\""},
+		{"单个字符", UserCity, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := Encrypt(tt.col, tt.plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if !IsEncrypted(ciphertext) || strings.Contains(ciphertext, tt.plaintext) {
+				t.Fatalf("密文格式不正确: %q", ciphertext)
+			}
+			if id := keyIDOf(t, ciphertext); id != 1 {
+				t.Errorf("数据密钥ID = %d, want 1", id)
+			}
+			again, _ := Encrypt(tt.col, tt.plaintext)
+			if again == ciphertext {
+				t.Error("相同的明文得到了相同的密文，nonce没有随机生成")
+			}
+
+			got, err := Decrypt(tt.col, ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if got != tt.plaintext {
+				t.Errorf("Decrypt = %q, want %q", got, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsCiphertextFromAnotherColumn(t *testing.T) {
+	setKeyring(t, map[int64][]byte{1: testKey(1)}, 1)
+
+	tests := []struct {
+		name     string
+		from, to Column
+	}{
+		{"同一张表的其他列", UserAddress, UserCity},
+		{"电话挪到地址", UserPhone, UserAddress},
+		{"用户地址挪到订单", UserAddress, OrderShippingAddress},
+		{"订单地址挪到用户", OrderShippingAddress, UserAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := Encrypt(tt.from, "北京市海淀区中关村大街1号")
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if _, err := Decrypt(tt.to, ciphertext); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("err = %v, want ErrDecrypt", err)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsWrongKeyAndTampering(t *testing.T) {
+	setKeyring(t, map[int64][]byte{1: testKey(1)}, 1)
+	ciphertext, err := Encrypt(UserAddress, "北京市海淀区中关村大街1号")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	prefix, payload, _ := strings.Cut(strings.TrimPrefix(ciphertext, ciphertextPrefix), ":")
+
+	tests := []struct {
+		name  string
+		keys  map[int64][]byte
+		value string
+	}{
+		// 同一个ID下是另一把密钥，例如密钥表被替换
+		{"错误的密钥", map[int64][]byte{1: testKey(2)}, ciphertext},
+		{"修改了密文", map[int64][]byte{1: testKey(1)}, ciphertext[:len(ciphertext)-2] + flip(ciphertext[len(ciphertext)-2:])},
+		{"截断的密文", map[int64][]byte{1: testKey(1)}, ciphertextPrefix + prefix + ":" + payload[:8]},
+		{"无效的密钥ID", map[int64][]byte{1: testKey(1)}, ciphertextPrefix + "abc:" + payload},
+		{"无效的base64", map[int64][]byte{1: testKey(1)}, ciphertextPrefix + prefix + ":!!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setKeyring(t, tt.keys, 1)
+			if _, err := Decrypt(UserAddress, tt.value); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("err = %v, want ErrDecrypt", err)
+			}
+		})
+	}
+}
+
+// flip 替换base64字符，使解码后的密文改变
+func flip(s string) string {
+	if s[0] == 'A' {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
+
+func TestPlaintextPassthrough(t *testing.T) {
+	setKeyring(t, map[int64][]byte{1: testKey(1)}, 1)
+
+	tests := []struct {
+		name           string
+		value          string
+		needsReencrypt bool
+	}{
+		{"空值", "", false},
+		{"未加密的旧数据", "+86 138-0000-0000", true},
+		{"看起来像密文的明文", "enc:v2:1:abc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decrypt(UserPhone, tt.value)
+			if err != nil || got != tt.value {
+				t.Errorf("Decrypt = (%q, %v), want (%q, nil)", got, err, tt.value)
+			}
+			if NeedsReencrypt(tt.value) != tt.needsReencrypt {
+				t.Errorf("NeedsReencrypt = %v, want %v", !tt.needsReencrypt, tt.needsReencrypt)
+			}
+		})
+	}
+
+	if ciphertext, err := Encrypt(UserPhone, ""); err != nil || ciphertext != "" {
+		t.Errorf("Encrypt(\"\") = (%q, %v), want (\"\", nil)", ciphertext, err)
+	}
+	if got, err := DecryptNull(UserPhone, sql.NullString{}); err != nil || got != "" {
+		t.Errorf("DecryptNull(NULL) = (%q, %v), want (\"\", nil)", got, err)
+	}
+}
+
+// capture 匹配任意字符串参数并保存，用于检查写入数据库的密文
+type capture struct {
+	value *string
+}
+
+func (c capture) Match(v driver.Value) bool {
+	switch v := v.(type) {
+	case string:
+		*c.value = v
+	case []byte:
+		*c.value = string(v)
+	default:
+		return false
+	}
+	return true
+}
+
+var (
+	userColumns           = []string{"id", "phone", "address", "city", "zip_postal_code"}
+	selectUsers           = regexp.QuoteMeta("SELECT id, phone, address, city, zip_postal_code FROM users WHERE id > ? ORDER BY id LIMIT ?")
+	selectOrders          = regexp.QuoteMeta("SELECT id, shipping_address FROM orders WHERE id > ? ORDER BY id LIMIT ?")
+	updateUserPhone       = regexp.QuoteMeta("UPDATE users SET phone = ?, phone_bidx = ?, updated_at = updated_at WHERE id = ?")
+	updateShippingAddress = regexp.QuoteMeta("UPDATE orders SET shipping_address = ?, updated_at = updated_at WHERE id = ?")
+)
+
+// TestReencryptPasses 模拟cmd/rotatekeys的两轮重新加密：轮换数据密钥后第一轮处理明文和旧密钥的密文，
+// 期间还没有加载新密钥的实例用旧密钥写入的行会被跳过，由第二轮处理，第二轮之后所有值都使用新密钥
+func TestReencryptPasses(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer mockDB.Close()
+	db.DB = mockDB
+
+	// 数据密钥1已经退役，2是轮换后的新密钥
+	setKeyring(t, map[int64][]byte{1: testKey(1), 2: testKey(2)}, 2)
+	const phone, staleServerPhone, address = "+86 138-0000-0000", "+86 139-0000-0000", "北京市海淀区中关村大街1号"
+	oldPhone := encryptWithKey(t, 1, UserPhone, phone)
+	oldShipping := encryptWithKey(t, 1, OrderShippingAddress, address)
+	currentAddress := encryptWithKey(t, 2, UserAddress, address)
+
+	type update struct {
+		query    string
+		id       int64
+		affected int64
+		// args 语句的参数个数：SET中的值、id以及WHERE中比较的原值
+		args int
+		col  Column
+		want string
+	}
+	passes := []struct {
+		name    string
+		users   [][]driver.Value
+		orders  [][]driver.Value
+		updates []update
+		want    ReencryptStats
+	}{
+		{
+			name: "第一轮",
+			users: [][]driver.Value{
+				{int64(1), phone, nil, nil, nil},              // 未加密的旧数据
+				{int64(2), oldPhone, currentAddress, "", nil}, // 电话使用旧密钥，地址已经是新密钥
+				{int64(3), nil, currentAddress, nil, nil},     // 不需要处理
+			},
+			orders: [][]driver.Value{{int64(5), oldShipping}},
+			updates: []update{
+				{updateUserPhone, 1, 1, 7, UserPhone, phone},
+				// 读取之后被还在使用旧密钥的实例修改，比较原值失败，这一行跳过
+				{updateUserPhone, 2, 0, 7, UserPhone, phone},
+				{updateShippingAddress, 5, 1, 3, OrderShippingAddress, address},
+			},
+			want: ReencryptStats{Scanned: 4, Updated: 2, Skipped: 1},
+		},
+		{
+			name: "第二轮",
+			users: [][]driver.Value{
+				{int64(1), encryptWithKey(t, 2, UserPhone, phone), nil, nil, nil},
+				{int64(2), encryptWithKey(t, 1, UserPhone, staleServerPhone), currentAddress, "", nil},
+				{int64(3), nil, currentAddress, nil, nil},
+			},
+			orders: [][]driver.Value{{int64(5), encryptWithKey(t, 2, OrderShippingAddress, address)}},
+			updates: []update{
+				{updateUserPhone, 2, 1, 7, UserPhone, staleServerPhone},
+			},
+			want: ReencryptStats{Scanned: 4, Updated: 1},
+		},
+	}
+
+	for _, pass := range passes {
+		t.Run(pass.name, func(t *testing.T) {
+			ciphertexts := make([]string, len(pass.updates))
+			indexes := make([]string, len(pass.updates))
+			byID := map[int64][]int{}
+			for i, u := range pass.updates {
+				byID[u.id] = append(byID[u.id], i)
+			}
+			expectUpdates := func(id int64) {
+				for _, i := range byID[id] {
+					u := pass.updates[i]
+					args := []driver.Value{capture{&ciphertexts[i]}}
+					if u.col.BlindIndex != "" {
+						args = append(args, capture{&indexes[i]})
+					}
+					args = append(args, u.id)
+					for len(args) < u.args {
+						args = append(args, sqlmock.AnyArg())
+					}
+					mock.ExpectExec(u.query).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, u.affected))
+				}
+			}
+
+			users := sqlmock.NewRows(userColumns)
+			for _, row := range pass.users {
+				users.AddRow(row...)
+			}
+			mock.ExpectQuery(selectUsers).WithArgs(int64(0), 100).WillReturnRows(users)
+			for _, row := range pass.users {
+				expectUpdates(row[0].(int64))
+			}
+			mock.ExpectQuery(selectUsers).WithArgs(int64(3), 100).WillReturnRows(sqlmock.NewRows(userColumns))
+
+			orders := sqlmock.NewRows([]string{"id", "shipping_address"})
+			for _, row := range pass.orders {
+				orders.AddRow(row...)
+			}
+			mock.ExpectQuery(selectOrders).WithArgs(int64(0), 100).WillReturnRows(orders)
+			for _, row := range pass.orders {
+				expectUpdates(row[0].(int64))
+			}
+			mock.ExpectQuery(selectOrders).WithArgs(int64(5), 100).WillReturnRows(sqlmock.NewRows([]string{"id", "shipping_address"}))
+
+			stats, err := Reencrypt(ReencryptOptions{BatchSize: 100})
+			if err != nil {
+				t.Fatalf("Reencrypt: %v", err)
+			}
+			if stats != pass.want {
+				t.Errorf("stats = %+v, want %+v", stats, pass.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, u := range pass.updates {
+				if id := keyIDOf(t, ciphertexts[i]); id != 2 {
+					t.Errorf("#%d 写入的密文使用数据密钥 %d, want 2", u.id, id)
+				}
+				if got, err := Decrypt(u.col, ciphertexts[i]); err != nil || got != u.want {
+					t.Errorf("#%d 写入的密文解密为 (%q, %v), want %q", u.id, got, err, u.want)
+				}
+				if u.col.BlindIndex != "" && indexes[i] != BlindIndex(u.col, u.want).String {
+					t.Errorf("#%d 盲索引 = %q, want %q", u.id, indexes[i], BlindIndex(u.col, u.want).String)
+				}
+			}
+		})
+	}
+}
+
+func TestRewrapKeys(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer mockDB.Close()
+	db.DB = mockDB
+
+	setKeyring(t, map[int64][]byte{1: testKey(1)}, 1)
+	oldMaster, newMaster := testKey(0xA0), testKey(0xB0)
+	oldID, newID := masterKeyID(oldMaster), masterKeyID(newMaster)
+	keyring.Lock()
+	keyring.masterKeys = map[string][]byte{oldID: oldMaster, newID: newMaster}
+	keyring.masterKeyID = newID
+	keyring.Unlock()
+
+	keys := []struct {
+		id      int64
+		purpose string
+		key     []byte
+	}{
+		{1, PurposeData, testKey(1)},
+		{2, PurposeIndex, testKey(0xEE)},
+	}
+	rows := sqlmock.NewRows([]string{"id", "purpose", "wrapped_key", "master_key_id"})
+	for _, k := range keys {
+		wrapped, err := wrapKey(oldMaster, k.key, k.purpose)
+		if err != nil {
+			t.Fatalf("wrapKey: %v", err)
+		}
+		rows.AddRow(k.id, k.purpose, wrapped, oldID)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, purpose, wrapped_key, master_key_id FROM data_keys WHERE master_key_id <> ?")).
+		WithArgs(newID).WillReturnRows(rows)
+	rewrapped := make([]string, len(keys))
+	for i, k := range keys {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE data_keys SET wrapped_key = ?, master_key_id = ? WHERE id = ? AND master_key_id = ?")).
+			WithArgs(capture{&rewrapped[i]}, newID, k.id, oldID).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	n, err := RewrapKeys()
+	if err != nil {
+		t.Fatalf("RewrapKeys: %v", err)
+	}
+	if n != len(keys) {
+		t.Errorf("RewrapKeys = %d, want %d", n, len(keys))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		key, err := unwrapKey(newMaster, []byte(rewrapped[i]), k.purpose)
+		if err != nil || !bytes.Equal(key, k.key) {
+			t.Errorf("密钥 %d 不能用新的主密钥解开: %v", k.id, err)
+		}
+		if _, err := unwrapKey(newMaster, []byte(rewrapped[i]), otherPurpose(k.purpose)); err == nil {
+			t.Errorf("密钥 %d 包装时没有绑定用途", k.id)
+		}
+	}
+}
+
+func otherPurpose(purpose string) string {
+	if purpose == PurposeData {
+		return PurposeIndex
+	}
+	return PurposeData
+}
@@ -0,0 +1,236 @@
+package fieldcrypt
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"web-security/backend/db"
+)
+
+// RewrapKeys 把由旧主密钥包装的密钥改用当前主密钥包装，完成后旧主密钥可以从配置中删除
+func RewrapKeys() (int, error) {
+	keyring.RLock()
+	masterKeys := keyring.masterKeys
+	currentID := keyring.masterKeyID
+	keyring.RUnlock()
+	if masterKeys == nil {
+		return 0, ErrNotInitialized
+	}
+
+	rows, err := db.DB.Query("SELECT id, purpose, wrapped_key, master_key_id FROM data_keys WHERE master_key_id <> ?", currentID)
+	if err != nil {
+		return 0, err
+	}
+	type wrappedKey struct {
+		id          int64
+		purpose     string
+		wrapped     []byte
+		masterKeyID string
+	}
+	var pending []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.id, &k.purpose, &k.wrapped, &k.masterKeyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, k := range pending {
+		old, ok := masterKeys[k.masterKeyID]
+		if !ok {
+			return rewrapped, fmt.Errorf("密钥 %d 由未配置的主密钥 %s 包装", k.id, k.masterKeyID)
+		}
+		key, err := unwrapKey(old, k.wrapped, k.purpose)
+		if err != nil {
+			return rewrapped, fmt.Errorf("解开密钥 %d 失败: %w", k.id, err)
+		}
+		wrapped, err := wrapKey(masterKeys[currentID], key, k.purpose)
+		if err != nil {
+			return rewrapped, err
+		}
+		_, err = db.DB.Exec("UPDATE data_keys SET wrapped_key = ?, master_key_id = ? WHERE id = ? AND master_key_id = ?",
+			wrapped, currentID, k.id, k.masterKeyID)
+		if err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// RotateDataKey 生成新的数据密钥用于之后的加密，旧数据密钥标记为retired，仍然可以解密
+func RotateDataKey() (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE data_keys SET status = 'retired' WHERE purpose = ? AND status = 'active'", PurposeData); err != nil {
+		return 0, err
+	}
+	id, err := insertKey(tx, PurposeData)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, loadKeys()
+}
+
+// ReencryptOptions 控制重新加密的批量大小和节奏
+type ReencryptOptions struct {
+	// BatchSize 每批读取的行数
+	BatchSize int
+	// Pause 每批之间的暂停时间，避免长时间占用数据库
+	Pause time.Duration
+	// Logf 输出进度，为nil时不输出
+	Logf func(format string, args ...any)
+}
+
+// ReencryptStats 一次重新加密的结果
+type ReencryptStats struct {
+	Scanned int `json:"scanned"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"` // 处理期间被业务修改过或者无法解密的行
+}
+
+// Reencrypt 分批扫描所有加密列，把明文或旧数据密钥加密的值用当前数据密钥重新加密，并更新盲索引。
+// 更新时比较原值，处理期间被业务修改过的行会跳过，由下一轮处理
+func Reencrypt(opts ReencryptOptions) (ReencryptStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 200
+	}
+	var stats ReencryptStats
+	var tables []string
+	byTable := map[string][]Column{}
+	for _, col := range Columns {
+		if _, ok := byTable[col.Table]; !ok {
+			tables = append(tables, col.Table)
+		}
+		byTable[col.Table] = append(byTable[col.Table], col)
+	}
+	for _, table := range tables {
+		if err := reencryptTable(table, byTable[table], opts, &stats); err != nil {
+			return stats, fmt.Errorf("重新加密表 %s 失败: %w", table, err)
+		}
+	}
+	return stats, nil
+}
+
+func reencryptTable(table string, cols []Column, opts ReencryptOptions, stats *ReencryptStats) error {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Column
+	}
+	// 表名和列名来自Columns，不是用户输入
+	query := fmt.Sprintf("SELECT id, %s FROM %s WHERE id > ? ORDER BY id LIMIT ?", strings.Join(names, ", "), table)
+
+	var lastID int64
+	for {
+		rows, err := db.DB.Query(query, lastID, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id     int64
+			values []sql.NullString
+		}
+		var batch []row
+		for rows.Next() {
+			r := row{values: make([]sql.NullString, len(cols))}
+			dest := []any{&r.id}
+			for i := range r.values {
+				dest = append(dest, &r.values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, r := range batch {
+			lastID = r.id
+			stats.Scanned++
+			updated, err := reencryptRow(table, cols, r.id, r.values)
+			if err != nil {
+				stats.Skipped++
+				if opts.Logf != nil {
+					opts.Logf("跳过 %s #%d: %v", table, r.id, err)
+				}
+				continue
+			}
+			if updated {
+				stats.Updated++
+			}
+		}
+		if opts.Logf != nil {
+			opts.Logf("%s: 已处理到 #%d，共扫描 %d 行，重新加密 %d 行", table, lastID, stats.Scanned, stats.Updated)
+		}
+		if opts.Pause > 0 {
+			time.Sleep(opts.Pause)
+		}
+	}
+	return nil
+}
+
+// reencryptRow 重新加密一行中需要处理的列，原值在此期间被修改时返回错误
+func reencryptRow(table string, cols []Column, id int64, values []sql.NullString) (bool, error) {
+	var sets []string
+	var args []any
+	for i, col := range cols {
+		if !values[i].Valid || !NeedsReencrypt(values[i].String) {
+			continue
+		}
+		plaintext, err := Decrypt(col, values[i].String)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", col.Column, err)
+		}
+		ciphertext, err := Encrypt(col, plaintext)
+		if err != nil {
+			return false, err
+		}
+		sets = append(sets, col.Column+" = ?")
+		args = append(args, ciphertext)
+		if col.BlindIndex != "" {
+			sets = append(sets, col.BlindIndex+" = ?")
+			args = append(args, BlindIndex(col, plaintext))
+		}
+	}
+	if len(sets) == 0 {
+		return false, nil
+	}
+
+	// 显式保留updated_at，重新加密不算业务修改
+	query := "UPDATE " + table + " SET " + strings.Join(sets, ", ") + ", updated_at = updated_at WHERE id = ?"
+	args = append(args, id)
+	for i, col := range cols {
+		query += " AND " + col.Column + " <=> ?"
+		args = append(args, values[i])
+	}
+	res, err := db.DB.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, fmt.Errorf("处理期间被修改")
+	}
+	return true, nil
+}
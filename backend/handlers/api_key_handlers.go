@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"web-security/backend/apikeys"
+	"web-security/backend/audit"
+	"web-security/backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListAPIKeys 列出API密钥，include_revoked=true时包括已撤销的密钥
+func ListAPIKeys(c *gin.Context) {
+	keys, err := apikeys.List(c.Query("include_revoked") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取API密钥失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// GetAPIKey 查看指定的API密钥
+func GetAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的密钥ID"})
+		return
+	}
+	key, err := apikeys.Get(id)
+	if errors.Is(err, apikeys.ErrKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取API密钥失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+// CreateAPIKey 创建API密钥，完整的密钥只在响应中出现一次。
+// 权限范围不能超出创建者自己的权限，API密钥也不能用来创建新的密钥
+func CreateAPIKey(c *gin.Context) {
+	if _, ok := c.Get("apiKey"); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能使用API密钥创建API密钥"})
+		return
+	}
+
+	var req struct {
+		Name      string     `json:"name" binding:"required,max=100" sanitize:"text"`
+		Scopes    []string   `json:"scopes" binding:"required,min=1"`
+		RateLimit int        `json:"rate_limit" binding:"min=0"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		// ExpiresIn 相对的有效期，例如"2160h"，与expires_at二选一
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+	if (req.ExpiresAt == nil) == (req.ExpiresIn == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "必须指定expires_at或expires_in中的一个"})
+		return
+	}
+	if req.ExpiresIn != "" {
+		duration, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的expires_in"})
+			return
+		}
+		expiresAt := time.Now().Add(duration)
+		req.ExpiresAt = &expiresAt
+	}
+	for _, scope := range req.Scopes {
+		if !middleware.HasPermission(c, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "不能授予自己没有的权限", "permission": scope})
+			return
+		}
+	}
+
+	key, secret, err := apikeys.Create(apikeys.NewKey{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		ExpiresAt: *req.ExpiresAt,
+		CreatedBy: c.GetInt("userID"),
+	})
+	if errors.Is(err, apikeys.ErrInvalidScope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建API密钥失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionAPIKeyCreate,
+		TargetType: audit.TargetAPIKey,
+		TargetID:   strconv.FormatInt(key.ID, 10),
+		Details: map[string]interface{}{
+			"name":       key.Name,
+			"prefix":     key.Prefix,
+			"scopes":     key.Scopes,
+			"rate_limit": key.RateLimit,
+			"expires_at": key.ExpiresAt,
+		},
+	})
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": key,
+		"key":     secret,
+		"message": "请立即保存密钥，之后无法再次查看",
+	})
+}
+
+// RevokeAPIKey 撤销API密钥，使用该密钥的请求立即被拒绝
+func RevokeAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的密钥ID"})
+		return
+	}
+
+	key, err := apikeys.Revoke(id, c.GetInt("userID"))
+	switch {
+	case errors.Is(err, apikeys.ErrKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, apikeys.ErrAlreadyRevoked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销API密钥失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionAPIKeyRevoke,
+		TargetType: audit.TargetAPIKey,
+		TargetID:   strconv.FormatInt(key.ID, 10),
+		Details:    map[string]interface{}{"name": key.Name, "prefix": key.Prefix},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "API密钥已撤销", "api_key": key})
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"web-security/backend/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListAuditEvents 按条件分页查询审计日志
+func ListAuditEvents(c *gin.Context) {
+	filter := audit.Filter{
+		Action:     c.Query("action"),
+		Outcome:    c.Query("outcome"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+		RequestID:  c.Query("request_id"),
+	}
+
+	var err error
+	if value := c.Query("actor_id"); value != "" {
+		if filter.ActorUserID, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的actor_id"})
+			return
+		}
+	}
+	if value := c.Query("from"); value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的from，应为RFC3339格式"})
+			return
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的to，应为RFC3339格式"})
+			return
+		}
+	}
+
+	// 获取分页参数
+	filter.Page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	filter.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.Limit < 1 || filter.Limit > 200 {
+		filter.Limit = 50
+	}
+
+	entries, total, err := audit.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询审计日志失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": entries,
+		"pagination": gin.H{
+			"current_page": filter.Page,
+			"per_page":     filter.Limit,
+			"total_events": total,
+			"total_pages":  (total + filter.Limit - 1) / filter.Limit,
+		},
+	})
+}
+
+// VerifyAuditLog 校验审计日志的哈希链，发现问题时返回409
+func VerifyAuditLog(c *gin.Context) {
+	report, err := audit.Verify()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "校验审计日志失败: " + err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if !report.Valid {
+		status = http.StatusConflict
+	}
+	c.JSON(status, report)
+}
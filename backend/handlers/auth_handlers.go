@@ -2,31 +2,40 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"web-security/backend/audit"
 	"web-security/backend/db"
 	"web-security/backend/models"
+	"web-security/backend/privacy"
 	"web-security/backend/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/microcosm-cc/bluemonday"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var authSanitizer = bluemonday.UGCPolicy()
-
 // RegisterUserHandler handles new user registration
 func RegisterUserHandler(c *gin.Context) {
 	var req models.UserRegister
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		respondBindError(c, "无效的请求数据", err)
 		return
 	}
 
-	// XSS保护，净化用户输入
-	req.Username = authSanitizer.Sanitize(req.Username)
-	req.Email = authSanitizer.Sanitize(req.Email)
+	// 检查密码是否符合密码策略
+	if err := utils.ValidatePassword(req.Password, req.Username, req.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 注销后的账户使用保留的用户名
+	if strings.HasPrefix(strings.ToLower(req.Username), privacy.ErasedUsernamePrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该用户名不可用"})
+		return
+	}
 
 	// 检查用户名或邮箱是否已存在
 	var existingUser models.User
@@ -42,7 +51,7 @@ func RegisterUserHandler(c *gin.Context) {
 	}
 
 	// 哈希密码
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码哈希失败"})
 		return
@@ -52,7 +61,7 @@ func RegisterUserHandler(c *gin.Context) {
 	role := "user"
 
 	// 执行插入操作
-	stmt, err := db.DB.Prepare("INSERT INTO users(username, email, password_hash, role, account_status, created_at) VALUES(?, ?, ?, ?, ?, ?)")
+	stmt, err := db.DB.Prepare("INSERT INTO users(username, email, email_verified_at, password_hash, role, account_status, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "准备SQL语句失败: " + err.Error()})
 		return
@@ -60,7 +69,12 @@ func RegisterUserHandler(c *gin.Context) {
 	defer stmt.Close()
 
 	now := time.Now()
-	res, err := stmt.Exec(req.Username, req.Email, hashedPassword, role, "active", now)
+	// 开启邮箱验证时新用户的邮箱处于未验证状态，否则视为已验证
+	var emailVerifiedAt *time.Time
+	if !utils.EmailVerificationRequired() {
+		emailVerifiedAt = &now
+	}
+	res, err := stmt.Exec(req.Username, req.Email, emailVerifiedAt, hashedPassword, role, "active", now)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "注册用户失败: " + err.Error()})
 		return
@@ -78,6 +92,16 @@ func RegisterUserHandler(c *gin.Context) {
 		CreatedAt: now,
 	}
 
+	if emailVerifiedAt == nil {
+		go sendVerificationEmail(newUser)
+		c.JSON(http.StatusCreated, gin.H{
+			"message":        "用户注册成功，请查收验证邮件完成邮箱验证",
+			"user":           newUser,
+			"email_verified": false,
+		})
+		return
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "用户注册成功",
 		"user":    newUser,
@@ -88,131 +112,304 @@ func RegisterUserHandler(c *gin.Context) {
 func LoginUserHandler(c *gin.Context) {
 	var req models.UserLogin
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		respondBindError(c, "无效的请求数据", err)
 		return
 	}
 
-	// XSS保护，净化用户输入
-	req.Username = authSanitizer.Sanitize(req.Username)
+	// 防暴力破解：用户名或IP被锁定、或者仍在等待期内时直接拒绝，不校验密码
+	wait, err := utils.CheckLoginAllowed(req.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "登录检查失败: " + err.Error()})
+		return
+	}
+	if wait > 0 {
+		// 被限流拒绝的尝试不写审计日志，锁定本身已经记录为安全事件，避免攻击流量挤占审计写入
+		respondLoginThrottled(c, wait)
+		return
+	}
 
 	var user models.User
 	// 查询用户信息
-	err := db.DB.QueryRow(`
-		SELECT id, username, password_hash, email, role, account_status, last_login, created_at, updated_at 
+	err = db.DB.QueryRow(`
+		SELECT id, username, password_hash, email, role, account_status, totp_enabled, mfa_required,
+		last_login, created_at, updated_at 
 		FROM users WHERE username = ?
 	`, req.Username).Scan(
-		&user.ID, &user.Username, &user.PasswordHash, &user.Email, 
-		&user.Role, &user.AccountStatus, &user.LastLogin, &user.CreatedAt, &user.UpdatedAt,
+		&user.ID, &user.Username, &user.PasswordHash, &user.Email,
+		&user.Role, &user.AccountStatus, &user.TOTPEnabled, &user.MFARequired,
+		&user.LastLogin, &user.CreatedAt, &user.UpdatedAt,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			// 用户不存在，返回通用错误信息，避免暴露哪个字段有误
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码不正确"})
+			// 用户不存在，返回通用错误信息，避免暴露哪个字段有误；不存在的用户名同样计入失败次数
+			// 仍然做一次密码校验，使响应时间和用户是否存在无关
+			utils.VerifyDummyPassword(req.Username, req.Password)
+			respondLoginFailure(c, 0, req.Username)
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询错误: " + err.Error()})
 		}
 		return
 	}
 
+	// 只通过第三方登录的账户没有密码，同样做一次校验，响应时间不暴露账户是否设置了密码
+	if !utils.HasPassword(user.PasswordHash) {
+		utils.VerifyDummyPassword(req.Username, req.Password)
+		respondLoginFailure(c, user.ID, req.Username)
+		return
+	}
+
+	// 验证密码，先于账户状态检查，只有知道密码的人才能看出账户被禁用
+	ok, needsRehash, err := utils.VerifyPassword(user.PasswordHash, req.Password)
+	if err != nil {
+		log.Printf("校验用户 %d 的密码失败: %v", user.ID, err)
+	}
+	if !ok {
+		respondLoginFailure(c, user.ID, req.Username)
+		return
+	}
+	// 哈希使用的是旧算法或旧参数时，趁有明文密码升级
+	if needsRehash {
+		rehashPassword(user.ID, user.PasswordHash, req.Password)
+	}
+
 	// 检查账户状态
 	if user.AccountStatus != "active" {
+		recordLoginFailure(c, user.ID, user.Username, "account_"+user.AccountStatus)
 		c.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用，请联系管理员"})
 		return
 	}
 
-	// 验证密码
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码不正确"})
+	// 失败记录要到完成全部验证后才清除，第二步验证的失败同样计入该用户名的失败次数
+	continueLogin(c, user, nil)
+}
+
+// continueLogin 在第一步验证（密码或第三方登录）通过后检测异常登录，按需要求两步验证或邮件验证码，
+// 否则直接完成登录。extra中的字段会一并返回
+func continueLogin(c *gin.Context, user models.User, extra gin.H) {
+	// 检测异常登录：新设备、新网段、不可能的行程或同一IP登录了多个账户
+	risk := assessLoginRisk(c, user)
+	mfa := user.TOTPEnabled || isMFARequired(user)
+	// 启用了两步验证的账户本来就需要第二步，其他账户出现异常时要求输入邮件验证码
+	stepUp := risk.Flagged() && !mfa && utils.LoginRiskStepUpEnabled()
+	if risk.Flagged() {
+		reportUnusualLogin(c, user, risk, mfa || stepUp)
+	}
+
+	// 启用了两步验证或被要求使用两步验证的账户，需要先完成第二步才能拿到令牌
+	if mfa {
+		respondMFAChallenge(c, user)
+		return
+	}
+	if stepUp {
+		respondLoginStepUp(c, user)
 		return
 	}
 
-	// 生成JWT令牌对
-	accessToken, refreshToken, err := utils.GenerateJWTPair(user.ID, user.Username, user.Role)
+	completeLogin(c, user, extra)
+}
+
+// RefreshPasswordTimingProfiles 统计账户实际使用的密码哈希参数，为每种参数准备占位哈希，
+// 使不存在的用户名的登录耗时与真实账户（包括尚未升级的旧哈希）分布一致。启动时调用，之后定期刷新
+func RefreshPasswordTimingProfiles(interval time.Duration) error {
+	if err := loadPasswordHashProfiles(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := loadPasswordHashProfiles(); err != nil {
+				log.Printf("刷新密码哈希参数统计失败: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadPasswordHashProfiles 按哈希中盐值之前的部分（算法和代价参数）统计账户数
+func loadPasswordHashProfiles() error {
+	rows, err := db.DB.Query("SELECT SUBSTRING_INDEX(password_hash, '$', 4) AS profile, COUNT(*) FROM users GROUP BY profile")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成令牌失败: " + err.Error()})
-		return
+		return err
 	}
+	defer rows.Close()
 
-	// 存储令牌到Redis
-	err = utils.StoreAccessToken(user.ID, accessToken)
+	counts := map[string]int{}
+	for rows.Next() {
+		var profile string
+		var count int
+		if err := rows.Scan(&profile, &count); err != nil {
+			return err
+		}
+		counts[profile] = count
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return utils.SetPasswordHashProfiles(counts)
+}
+
+// rehashPassword 用当前的哈希参数重新保存密码，哈希已被其他请求修改时不覆盖，失败只记录日志不影响登录
+func rehashPassword(userID int, oldHash, password string) {
+	newHash, err := utils.HashPassword(password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储令牌失败: " + err.Error()})
+		log.Printf("升级用户 %d 的密码哈希失败: %v", userID, err)
 		return
 	}
+	if _, err := db.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?", newHash, userID, oldHash); err != nil {
+		log.Printf("保存用户 %d 升级后的密码哈希失败: %v", userID, err)
+	}
+}
 
-	err = utils.StoreRefreshToken(user.ID, refreshToken)
+// respondLoginFailure 记录登录失败并返回通用的错误信息，达到上限时返回429
+func respondLoginFailure(c *gin.Context, userID int, username string) {
+	recordLoginFailure(c, userID, username, "invalid_credentials")
+	wait, err := utils.RegisterLoginFailure(userID, username, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储刷新令牌失败: " + err.Error()})
+		log.Printf("记录登录失败次数失败: %v", err)
+	}
+	if wait >= utils.LoginLockoutDuration() {
+		respondLoginThrottled(c, wait)
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码不正确"})
+}
+
+// recordLoginFailure 把失败的登录尝试写入审计日志，userID为0表示用户名不存在或尚未查询
+func recordLoginFailure(c *gin.Context, userID int, username, reason string) {
+	event := audit.Event{
+		Action:        audit.ActionLoginFailed,
+		Outcome:       audit.OutcomeFailure,
+		ActorUserID:   userID,
+		ActorUsername: username,
+		Details:       map[string]interface{}{"reason": reason},
+	}
+	if userID != 0 {
+		event.TargetType = audit.TargetUser
+		event.TargetID = strconv.Itoa(userID)
+	}
+	audit.Record(c, event)
+}
+
+// respondLoginThrottled 返回429和Retry-After，提示内容不区分用户名是否存在
+func respondLoginThrottled(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "登录尝试次数过多，请稍后再试",
+		"retry_after": seconds,
+	})
+}
+
+// completeLogin 为通过全部验证的用户创建会话、签发令牌对并返回登录响应，extra中的字段会一并返回
+func completeLogin(c *gin.Context, user models.User, extra gin.H) {
+	accessToken, refreshToken, ok := startSession(c, user)
+	if !ok {
 		return
 	}
 
+	// 全部验证通过，清除该用户名的失败记录
+	_ = utils.ClearLoginFailures(user.Username)
+
+	// 记住本次登录的设备和网段，之后从这里登录不再视为异常
+	err := utils.RememberLogin(utils.LoginAttempt{UserID: user.ID, IP: c.ClientIP(), UserAgent: c.Request.UserAgent()})
+	if err != nil {
+		log.Printf("记录登录设备失败(user_id=%d): %v", user.ID, err)
+	}
+
+	audit.Record(c, audit.Event{
+		Action:        audit.ActionLogin,
+		ActorUserID:   user.ID,
+		ActorUsername: user.Username,
+		ActorRole:     user.Role,
+		TargetType:    audit.TargetUser,
+		TargetID:      strconv.Itoa(user.ID),
+		Details:       map[string]interface{}{"mfa": user.TOTPEnabled},
+	})
+
 	// 更新用户最后登录时间
 	_, err = db.DB.Exec("UPDATE users SET last_login = ? WHERE id = ?", time.Now(), user.ID)
 	if err != nil {
 		// 非关键错误，可以继续流程
-		// log.Printf("更新用户最后登录时间失败: %v", err)
-	}
-
-	// 设置Cookie - 访问令牌 (在开发环境中禁用Secure标志)
-	c.SetCookie(
-		"access_token",
-		accessToken,
-		int(utils.AccessTokenExpiry.Seconds()),
-		"/",
-		"", // 域名留空表示仅用于当前域名
-		false, // 在开发环境中设为false，生产环境应设为true
-		false, // HttpOnly设为false，允许前端JavaScript访问
-	)
-
-	// 设置Cookie - 刷新令牌
-	c.SetCookie(
-		"refresh_token",
-		refreshToken,
-		int(utils.RefreshTokenExpiry.Seconds()),
-		"/",
-		"", // 域名留空表示仅用于当前域名
-		false, // 在开发环境中设为false，生产环境应设为true
-		false, // HttpOnly设为false，允许前端JavaScript访问
-	)
+		log.Printf("更新用户 %d 的最后登录时间失败: %v", user.ID, err)
+	}
 
-	// 将令牌返回给客户端
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+	// 将令牌返回给客户端，仅使用Cookie模式时不在响应体中返回令牌
+	response := gin.H{
 		"user": gin.H{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"role":     user.Role,
+			"id":           user.ID,
+			"username":     user.Username,
+			"email":        user.Email,
+			"role":         user.Role,
+			"totp_enabled": user.TOTPEnabled,
 		},
-	})
+	}
+	if utils.TokensInResponseBody() {
+		response["access_token"] = accessToken
+		response["refresh_token"] = refreshToken
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// startSession 为当前设备创建新的会话，签发并存储令牌对，同时写入Cookie。
+// 失败时已经写入了错误响应，调用方直接返回即可。
+func startSession(c *gin.Context, user models.User) (string, string, bool) {
+	// 为当前设备创建新的会话，不影响该用户在其他设备上的会话
+	session, err := utils.CreateSession(user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建会话失败: " + err.Error()})
+		return "", "", false
+	}
+
+	// 生成JWT令牌对
+	accessToken, refreshToken, err := utils.GenerateJWTPair(user.ID, user.Username, user.Role, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成令牌失败: " + err.Error()})
+		return "", "", false
+	}
+
+	// 存储令牌到Redis
+	err = utils.StoreAccessToken(session.ID, accessToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储令牌失败: " + err.Error()})
+		return "", "", false
+	}
+
+	err = utils.StoreRefreshToken(session.ID, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储刷新令牌失败: " + err.Error()})
+		return "", "", false
+	}
+
+	// 设置HttpOnly的令牌Cookie和CSRF令牌Cookie，属性由配置决定
+	if err := utils.SetAuthCookies(c, session.ID, accessToken, refreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置Cookie失败: " + err.Error()})
+		return "", "", false
+	}
+
+	return accessToken, refreshToken, true
 }
 
 // LogoutUser 处理用户注销
 func LogoutUser(c *gin.Context) {
-	// 从上下文中获取用户ID
-	userID, exists := c.Get("userID")
+	// 从上下文中获取会话ID
+	sessionID, exists := c.Get("sessionID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
 		return
 	}
 
-	// 获取认证令牌
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
+	// 获取认证令牌（来自Authorization头或Cookie，由AuthMiddleware设置）
+	tokenString := c.GetString("accessToken")
+	if tokenString == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少认证令牌"})
 		return
 	}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "认证令牌格式无效"})
-		return
-	}
-	tokenString := parts[1]
-
 	// 解析令牌以获取过期时间
 	claims, err := utils.ParseToken(tokenString)
 	if err != nil {
@@ -235,23 +432,64 @@ func LogoutUser(c *gin.Context) {
 		return
 	}
 
-	// 使该用户的所有令牌失效
-	if err := utils.InvalidateUserTokens(userID.(int)); err != nil {
-		// 记录错误，但仍然继续注销过程
-		// log.Printf("使令牌失效失败: %v", err)
+	// 撤销当前会话，其他设备上的会话不受影响。撤销失败时刷新令牌仍然有效，必须告诉客户端注销没有完成，
+	// Cookie保留下来以便客户端重试
+	if err := utils.RevokeSession(sessionID.(string)); err != nil {
+		log.Printf("注销时撤销会话 %s 失败: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "注销失败，请重试"})
+		return
 	}
 
+	utils.ClearAuthCookies(c)
+
+	audit.Record(c, audit.Event{Action: audit.ActionLogout, TargetType: audit.TargetSession, TargetID: sessionID.(string)})
 	c.JSON(http.StatusOK, gin.H{"message": "注销成功"})
 }
 
 // RefreshToken 处理令牌刷新
 func RefreshToken(c *gin.Context) {
 	var req struct {
-		RefreshToken string `json:"refresh_token" binding:"required"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+	// 刷新令牌可以放在请求体中，也可以来自HttpOnly的refresh_token Cookie
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, "无效的请求数据", err)
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		req.RefreshToken, _ = c.Cookie(utils.RefreshTokenCookie)
+	}
+	if req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少刷新令牌"})
+		return
+	}
+
+	// 检查刷新令牌是否已被轮换过，已轮换的令牌再次出现时撤销整个令牌家族
+	family, err := utils.DetectRefreshTokenReuse(req.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证令牌时出错"})
+		return
+	}
+	if family != nil {
+		// 宽限期内的重试（例如上一次响应在网络中丢失）拿到同一对后继令牌，不算重复使用
+		successor, err := utils.RefreshTokenSuccessor(req.RefreshToken, family.FamilyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "验证令牌时出错"})
+			return
+		}
+		if successor == nil {
+			revokeReusedRefreshTokenFamily(c, family)
+			return
+		}
+		successorClaims, err := utils.ValidateAccessToken(successor.AccessToken)
+		if err != nil {
+			revokeReusedRefreshTokenFamily(c, family)
+			return
+		}
+		respondRefreshedTokens(c, successorClaims.UserID, successorClaims.Username, successorClaims.Role, family.FamilyID, successor)
 		return
 	}
 
@@ -273,9 +511,9 @@ func RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// 检查刷新令牌是否在Redis中并且是最新的
-	valid, err := utils.ValidateTokenInRedis(claims.UserID, req.RefreshToken, false)
-	if err != nil || !valid {
+	// 检查刷新令牌所属的会话是否有效，并且令牌是该会话最新签发的
+	session, err := utils.ValidateTokenInRedis(claims, req.RefreshToken, false)
+	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "刷新令牌已失效，请重新登录"})
 		return
 	}
@@ -295,58 +533,102 @@ func RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// 生成新的JWT令牌对
-	newAccessToken, newRefreshToken, err := utils.GenerateJWTPair(claims.UserID, user.Username, user.Role)
+	// 先生成新的JWT令牌对，沿用原有的会话。签发失败时旧令牌尚未被标记，客户端可以安全重试
+	newAccessToken, newRefreshToken, err := utils.GenerateJWTPair(claims.UserID, user.Username, user.Role, session.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成新令牌失败: " + err.Error()})
 		return
 	}
 
+	// 原子地标记旧令牌已轮换并存储新令牌，并发请求中只有一个能成功轮换
+	rotation, successor, err := utils.RotateRefreshToken(req.RefreshToken, claims, newAccessToken, newRefreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "轮换刷新令牌失败: " + err.Error()})
+		return
+	}
+	switch rotation {
+	case utils.RefreshReused:
+		revokeReusedRefreshTokenFamily(c, &utils.RefreshTokenFamily{FamilyID: claims.SessionID, UserID: claims.UserID})
+		return
+	case utils.RefreshStale:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "刷新令牌已失效，请重新登录"})
+		return
+	case utils.RefreshRetried:
+		respondRefreshedTokens(c, claims.UserID, user.Username, user.Role, session.ID, successor)
+		return
+	}
+
 	// 将旧的刷新令牌加入黑名单
 	if err := utils.BlacklistToken(req.RefreshToken, time.Hour*24*7); err != nil {
 		// log.Printf("将旧令牌加入黑名单失败: %v", err)
 	}
 
-	// 存储新令牌
-	if err := utils.StoreAccessToken(claims.UserID, newAccessToken); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储新访问令牌失败: " + err.Error()})
-		return
-	}
-	if err := utils.StoreRefreshToken(claims.UserID, newRefreshToken); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储新刷新令牌失败: " + err.Error()})
-		return
-	}
+	audit.Record(c, audit.Event{
+		Action:        audit.ActionTokenRefresh,
+		ActorUserID:   claims.UserID,
+		ActorUsername: user.Username,
+		ActorRole:     user.Role,
+		TargetType:    audit.TargetSession,
+		TargetID:      session.ID,
+	})
 
-	// 在刷新令牌响应中设置Cookie (开发环境配置)
-	c.SetCookie(
-		"access_token", 
-		newAccessToken, 
-		int(utils.AccessTokenExpiry.Seconds()), 
-		"/", 
-		"", // 域名留空表示仅用于当前域名
-		false, // 在开发环境中设为false，生产环境应设为true
-		false, // HttpOnly设为false，允许前端JavaScript访问
-	)
+	respondRefreshedTokens(c, claims.UserID, user.Username, user.Role, session.ID, &utils.RefreshSuccessor{
+		AccessToken:  newAccessToken,
+		RefreshToken: newRefreshToken,
+	})
+}
 
-	c.SetCookie(
-		"refresh_token", 
-		newRefreshToken, 
-		int(utils.RefreshTokenExpiry.Seconds()),
-		"/", 
-		"", // 域名留空表示仅用于当前域名
-		false, // 在开发环境中设为false，生产环境应设为true
-		false, // HttpOnly设为false，允许前端JavaScript访问
-	)
+// respondRefreshedTokens 设置令牌Cookie并返回刷新后的令牌对，保持与登录响应格式一致
+func respondRefreshedTokens(c *gin.Context, userID int, username, role, sessionID string, tokens *utils.RefreshSuccessor) {
+	if err := utils.SetAuthCookies(c, sessionID, tokens.AccessToken, tokens.RefreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置Cookie失败: " + err.Error()})
+		return
+	}
 
-	// 返回令牌和用户信息，保持与登录响应格式一致
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  newAccessToken,
-		"refresh_token": newRefreshToken,
+	response := gin.H{
 		"user": gin.H{
-			"id":       claims.UserID,
-			"username": user.Username,
+			"id":       userID,
+			"username": username,
 			"email":    "", // 由于这里没有查询用户邮箱，暂时保留空字符串
-			"role":     user.Role,
+			"role":     role,
 		},
+	}
+	if utils.TokensInResponseBody() {
+		response["access_token"] = tokens.AccessToken
+		response["refresh_token"] = tokens.RefreshToken
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// revokeReusedRefreshTokenFamily 在检测到刷新令牌被重复使用时撤销整个令牌家族
+func revokeReusedRefreshTokenFamily(c *gin.Context, family *utils.RefreshTokenFamily) {
+	if err := utils.RevokeTokenFamily(family, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销令牌家族失败: " + err.Error()})
+		return
+	}
+	audit.Record(c, audit.Event{
+		Action:      audit.ActionTokenReuse,
+		Outcome:     audit.OutcomeFailure,
+		ActorUserID: family.UserID,
+		TargetType:  audit.TargetSession,
+		TargetID:    family.FamilyID,
+		Details:     map[string]interface{}{"family_revoked": true},
 	})
+	utils.ClearAuthCookies(c)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "检测到刷新令牌被重复使用，相关会话已全部撤销，请重新登录"})
+}
+
+// GetCSRFToken 返回当前的CSRF令牌，没有令牌或令牌不属于当前会话时生成新的令牌并写入Cookie。
+// 使用Cookie认证的客户端需要在状态变更请求的X-CSRF-Token请求头中带上该令牌。
+func GetCSRFToken(c *gin.Context) {
+	sessionID := utils.CookieSessionID(c)
+	token, err := c.Cookie(utils.CSRFTokenCookie)
+	if err != nil || !utils.ValidCSRFToken(token, sessionID) {
+		token, err = utils.IssueCSRFToken(c, sessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "生成CSRF令牌失败: " + err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"csrf_token": token})
 }
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"web-security/backend/sanitize"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondBindError 统一返回请求绑定失败的响应，净化策略拒绝的字段在violations中逐个列出。
+// 结构体上的sanitize标签写错属于服务器错误，返回500
+func respondBindError(c *gin.Context, message string, err error) {
+	if errors.Is(err, sanitize.ErrInvalidTag) {
+		log.Printf("请求 %s %s 的结构体定义有误: %v", c.Request.Method, c.FullPath(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器内部错误"})
+		return
+	}
+	var violations sanitize.Violations
+	if errors.As(err, &violations) {
+		log.Printf("请求 %s %s 的输入被拒绝 (IP: %s): %v", c.Request.Method, c.FullPath(), c.ClientIP(), err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      message + ": " + err.Error(),
+			"violations": violations,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": message + ": " + err.Error()})
+}
@@ -89,7 +89,7 @@ func AddToCart(c *gin.Context) {
 
 	var req models.CartItemRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		respondBindError(c, "Invalid request", err)
 		return
 	}
 
@@ -165,29 +165,14 @@ func UpdateCartItem(c *gin.Context) {
 		Quantity int `json:"quantity" binding:"required,min=1"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		respondBindError(c, "Invalid request", err)
 		return
 	}
 
-	// 验证购物车项属于当前用户
-	var belongs bool
-	err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM cart_items WHERE id = ? AND user_id = ?)", 
-		cartItemID, userID).Scan(&belongs)
-	
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify cart item ownership: " + err.Error()})
-		return
-	}
-	
-	if !belongs {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to update this cart item"})
-		return
-	}
-
-	// 更新购物车项数量
+	// 所有权已由路由上的RequireOwnership检查，这里仍然限定user_id，防止检查与更新之间的竞争
 	_, err = db.DB.Exec(
-		"UPDATE cart_items SET quantity = ?, updated_at = ? WHERE id = ?",
-		req.Quantity, time.Now(), cartItemID,
+		"UPDATE cart_items SET quantity = ?, updated_at = ? WHERE id = ? AND user_id = ?",
+		req.Quantity, time.Now(), cartItemID, userID,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item: " + err.Error()})
@@ -214,23 +199,8 @@ func RemoveFromCart(c *gin.Context) {
 		return
 	}
 
-	// 验证购物车项属于当前用户
-	var belongs bool
-	err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM cart_items WHERE id = ? AND user_id = ?)", 
-		cartItemID, userID).Scan(&belongs)
-	
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify cart item ownership: " + err.Error()})
-		return
-	}
-	
-	if !belongs {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to remove this cart item"})
-		return
-	}
-
-	// 删除购物车项
-	_, err = db.DB.Exec("DELETE FROM cart_items WHERE id = ?", cartItemID)
+	// 删除购物车项，所有权已由路由上的RequireOwnership检查
+	_, err = db.DB.Exec("DELETE FROM cart_items WHERE id = ? AND user_id = ?", cartItemID, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove cart item: " + err.Error()})
 		return
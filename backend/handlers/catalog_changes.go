@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"web-security/backend/audit"
+	"web-security/backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Entity types and actions recorded in catalog_changes
+const (
+	catalogEntityProduct  = "product"
+	catalogEntityCategory = "category"
+
+	catalogActionCreate = "create"
+	catalogActionUpdate = "update"
+	catalogActionDelete = "delete"
+)
+
+// recordCatalogChange stores who changed which product or category, with snapshots of the
+// editable fields before and after the change. It runs in the caller's transaction, so a
+// mutation is never committed without its change record. before is nil for creates and
+// after is nil for deletes.
+func recordCatalogChange(tx *sql.Tx, c *gin.Context, entityType string, entityID int, action string, before, after interface{}) error {
+	beforeJSON, beforeFields, err := snapshotJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, afterFields, err := snapshotJSON(after)
+	if err != nil {
+		return err
+	}
+
+	changedJSON, err := json.Marshal(changedFields(beforeFields, afterFields))
+	if err != nil {
+		return err
+	}
+
+	var actorID interface{}
+	if userID := c.GetInt("userID"); userID != 0 {
+		actorID = userID
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO catalog_changes(
+			entity_type, entity_id, action, actor_user_id, actor_username, actor_role,
+			ip_address, before_data, after_data, changed_fields
+		) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		entityType, entityID, action, actorID, c.GetString("username"), c.GetString("role"),
+		c.ClientIP(), beforeJSON, afterJSON, string(changedJSON),
+	)
+	return err
+}
+
+// auditCatalogChange writes a committed catalog change to the audit log. Price changes are
+// spelled out in the details because they are the edits most worth tracing back.
+func auditCatalogChange(c *gin.Context, entityType string, entityID int, action string, before, after interface{}) {
+	_, beforeFields, _ := snapshotJSON(before)
+	_, afterFields, _ := snapshotJSON(after)
+
+	details := map[string]interface{}{"changed_fields": changedFields(beforeFields, afterFields)}
+	for _, field := range []string{"price", "discount_price"} {
+		if !reflect.DeepEqual(beforeFields[field], afterFields[field]) {
+			details[field] = map[string]interface{}{"from": beforeFields[field], "to": afterFields[field]}
+		}
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     entityType + "." + action,
+		TargetType: entityType,
+		TargetID:   strconv.Itoa(entityID),
+		Details:    details,
+	})
+}
+
+// snapshotJSON encodes a snapshot for storage and decodes it back into a field map for diffing
+func snapshotJSON(snapshot interface{}) (interface{}, map[string]interface{}, error) {
+	if snapshot == nil || reflect.ValueOf(snapshot).IsNil() {
+		return nil, nil, nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	return string(data), fields, nil
+}
+
+// changedFields lists the JSON field names whose values differ between two snapshots
+func changedFields(before, after map[string]interface{}) []string {
+	changed := []string{}
+	seen := map[string]bool{}
+	for _, fields := range []map[string]interface{}{before, after} {
+		for name := range fields {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !reflect.DeepEqual(before[name], after[name]) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// productSnapshot returns the editable fields of a product as a fully populated ProductUpdate
+func productSnapshot(p models.Product) *models.ProductUpdate {
+	return &models.ProductUpdate{
+		Name:          &p.Name,
+		Description:   &p.Description,
+		Price:         &p.Price,
+		DiscountPrice: p.DiscountPrice,
+		StockQuantity: &p.StockQuantity,
+		CategoryID:    &p.CategoryID,
+		ImageMain:     &p.ImageMain,
+		ImagesGallery: &p.ImagesGallery,
+		SKU:           &p.SKU,
+		IsFeatured:    &p.IsFeatured,
+		IsActive:      &p.IsActive,
+		ViewCount:     &p.ViewCount,
+		Tags:          &p.Tags,
+	}
+}
+
+// categorySnapshot returns the editable fields of a category as a fully populated CategoryUpdate
+func categorySnapshot(cat models.Category) *models.CategoryUpdate {
+	return &models.CategoryUpdate{
+		Name:         &cat.Name,
+		Description:  &cat.Description,
+		Icon:         &cat.Icon,
+		Image:        &cat.Image,
+		DisplayOrder: &cat.DisplayOrder,
+		ParentID:     cat.ParentID,
+		IsFeatured:   &cat.IsFeatured,
+	}
+}
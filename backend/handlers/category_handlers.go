@@ -14,11 +14,19 @@ import (
 func CreateCategory(c *gin.Context) {
 	var req models.CategoryCreate
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		respondBindError(c, "Invalid request payload", err)
 		return
 	}
 
-	stmt, err := db.DB.Prepare(`
+	// The category and its change record are committed together
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
 		INSERT INTO categories(
 			name, description, icon, image, display_order, parent_id, is_featured
 		) VALUES(?, ?, ?, ?, ?, ?, ?)
@@ -48,7 +56,7 @@ func CreateCategory(c *gin.Context) {
 	
 	// Fetch the complete category with all fields
 	var category models.Category
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT id, name, description, icon, image, display_order, parent_id, 
 		is_featured, created_at, updated_at
 		FROM categories WHERE id = ?
@@ -61,6 +69,16 @@ func CreateCategory(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Category created but failed to retrieve: " + err.Error()})
 		return
 	}
+
+	if err := recordCatalogChange(tx, c, catalogEntityCategory, category.ID, catalogActionCreate, nil, categorySnapshot(category)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record category change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit category: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityCategory, category.ID, catalogActionCreate, nil, categorySnapshot(category))
 	
 	c.JSON(http.StatusCreated, category)
 }
@@ -226,15 +244,23 @@ func UpdateCategory(c *gin.Context) {
 
 	var req models.CategoryUpdate
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		respondBindError(c, "Invalid request payload", err)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
 		return
 	}
+	defer tx.Rollback()
 
-	// Fetch current category to ensure it exists and to have default values
+	// Fetch current category to ensure it exists and to have default values.
+	// The row is locked so the "before" snapshot matches what this update overwrites.
 	var currentCategory models.Category
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT name, description, icon, image, display_order, parent_id, is_featured 
-		FROM categories WHERE id = ?
+		FROM categories WHERE id = ? FOR UPDATE
 	`, categoryID).Scan(
 		&currentCategory.Name, &currentCategory.Description, &currentCategory.Icon,
 		&currentCategory.Image, &currentCategory.DisplayOrder, &currentCategory.ParentID,
@@ -287,7 +313,7 @@ func UpdateCategory(c *gin.Context) {
 		WHERE id = ?
 	`
 
-	stmt, err := db.DB.Prepare(updateQuery)
+	stmt, err := tx.Prepare(updateQuery)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare update: " + err.Error()})
 		return
@@ -312,7 +338,7 @@ func UpdateCategory(c *gin.Context) {
 	
 	// Fetch the updated category to return it
 	var updatedCategory models.Category
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT id, name, description, icon, image, display_order, parent_id, 
 		is_featured, created_at, updated_at
 		FROM categories WHERE id = ?
@@ -328,6 +354,16 @@ func UpdateCategory(c *gin.Context) {
 		return
 	}
 
+	if err := recordCatalogChange(tx, c, catalogEntityCategory, categoryID, catalogActionUpdate, categorySnapshot(currentCategory), categorySnapshot(updatedCategory)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record category change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit category update: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityCategory, categoryID, catalogActionUpdate, categorySnapshot(currentCategory), categorySnapshot(updatedCategory))
+
 	c.JSON(http.StatusOK, updatedCategory)
 }
 
@@ -343,7 +379,33 @@ func DeleteCategory(c *gin.Context) {
 	// Optional: Check if any products are associated with this category before deleting
 	// For simplicity, this check is omitted here. The DB schema uses ON DELETE SET NULL for products.
 
-	stmt, err := db.DB.Prepare("DELETE FROM categories WHERE id = ?")
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// Keep a snapshot of the category being deleted for the change record
+	var category models.Category
+	err = tx.QueryRow(`
+		SELECT name, description, icon, image, display_order, parent_id, is_featured 
+		FROM categories WHERE id = ? FOR UPDATE
+	`, categoryID).Scan(
+		&category.Name, &category.Description, &category.Icon,
+		&category.Image, &category.DisplayOrder, &category.ParentID,
+		&category.IsFeatured,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Category not found or already deleted"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error on fetch: " + err.Error()})
+		}
+		return
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM categories WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare delete statement: " + err.Error()})
 		return
@@ -362,5 +424,15 @@ func DeleteCategory(c *gin.Context) {
 		return
 	}
 
+	if err := recordCatalogChange(tx, c, catalogEntityCategory, categoryID, catalogActionDelete, categorySnapshot(category), nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record category change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit category deletion: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityCategory, categoryID, catalogActionDelete, categorySnapshot(category), nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Category deleted successfully"})
 }
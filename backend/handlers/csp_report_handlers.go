@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+	"web-security/backend/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// cspReportMaxBody 单次报告请求体的上限
+	cspReportMaxBody = 64 << 10
+	// cspReportMaxBatch Reporting API一次可能发送多条报告，只保存前面若干条
+	cspReportMaxBatch = 20
+)
+
+// cspViolation 统一后的CSP违规报告
+type cspViolation struct {
+	DocumentURI        string
+	Referrer           string
+	BlockedURI         string
+	ViolatedDirective  string
+	EffectiveDirective string
+	OriginalPolicy     string
+	Disposition        string
+	SourceFile         string
+	ScriptSample       string
+	LineNumber         int
+	ColumnNumber       int
+	StatusCode         int
+}
+
+// legacyCSPReport report-uri发送的报告，Content-Type为application/csp-report
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		Referrer           string `json:"referrer"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		OriginalPolicy     string `json:"original-policy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		ScriptSample       string `json:"script-sample"`
+		LineNumber         int    `json:"line-number"`
+		ColumnNumber       int    `json:"column-number"`
+		StatusCode         int    `json:"status-code"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport report-to发送的报告，Content-Type为application/reports+json，请求体是报告数组
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		Referrer           string `json:"referrer"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		OriginalPolicy     string `json:"originalPolicy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		Sample             string `json:"sample"`
+		LineNumber         int    `json:"lineNumber"`
+		ColumnNumber       int    `json:"columnNumber"`
+		StatusCode         int    `json:"statusCode"`
+	} `json:"body"`
+}
+
+// ReportCSPViolation 接收浏览器发送的CSP违规报告并保存，同时支持report-uri和Reporting API两种格式
+func ReportCSPViolation(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, cspReportMaxBody))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "报告内容过大"})
+		return
+	}
+
+	violations, err := parseCSPReports(body)
+	if err != nil || len(violations) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的CSP报告"})
+		return
+	}
+
+	userAgent := truncate(c.Request.UserAgent(), 512)
+	ip := c.ClientIP()
+	for _, v := range violations {
+		_, err := db.DB.Exec(`INSERT INTO csp_reports
+			(document_uri, referrer, blocked_uri, violated_directive, effective_directive, original_policy,
+			 disposition, source_file, script_sample, line_number, column_number, status_code, user_agent, ip_address)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			truncate(v.DocumentURI, 2048), truncate(v.Referrer, 2048), truncate(v.BlockedURI, 2048),
+			truncate(v.ViolatedDirective, 255), truncate(v.EffectiveDirective, 255), truncate(v.OriginalPolicy, 4096),
+			truncate(v.Disposition, 16), truncate(v.SourceFile, 2048), truncate(v.ScriptSample, 255),
+			v.LineNumber, v.ColumnNumber, v.StatusCode, userAgent, ip)
+		if err != nil {
+			log.Printf("保存CSP报告失败: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存CSP报告失败"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseCSPReports 解析两种格式的CSP报告
+func parseCSPReports(body []byte) ([]cspViolation, error) {
+	trimmed := strings.TrimSpace(string(body))
+
+	if strings.HasPrefix(trimmed, "[") {
+		var reports []reportingAPIReport
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var violations []cspViolation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			if len(violations) == cspReportMaxBatch {
+				break
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        r.Body.DocumentURL,
+				Referrer:           r.Body.Referrer,
+				BlockedURI:         r.Body.BlockedURL,
+				ViolatedDirective:  r.Body.EffectiveDirective,
+				EffectiveDirective: r.Body.EffectiveDirective,
+				OriginalPolicy:     r.Body.OriginalPolicy,
+				Disposition:        r.Body.Disposition,
+				SourceFile:         r.Body.SourceFile,
+				ScriptSample:       r.Body.Sample,
+				LineNumber:         r.Body.LineNumber,
+				ColumnNumber:       r.Body.ColumnNumber,
+				StatusCode:         r.Body.StatusCode,
+			})
+		}
+		return violations, nil
+	}
+
+	var report legacyCSPReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	r := report.Report
+	if r.DocumentURI == "" && r.ViolatedDirective == "" && r.EffectiveDirective == "" {
+		return nil, nil
+	}
+	return []cspViolation{{
+		DocumentURI:        r.DocumentURI,
+		Referrer:           r.Referrer,
+		BlockedURI:         r.BlockedURI,
+		ViolatedDirective:  r.ViolatedDirective,
+		EffectiveDirective: r.EffectiveDirective,
+		OriginalPolicy:     r.OriginalPolicy,
+		Disposition:        r.Disposition,
+		SourceFile:         r.SourceFile,
+		ScriptSample:       r.ScriptSample,
+		LineNumber:         r.LineNumber,
+		ColumnNumber:       r.ColumnNumber,
+		StatusCode:         r.StatusCode,
+	}}, nil
+}
+
+// truncate 按字节截断字符串，避免超出数据库列长度，不会截断多字节字符
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"web-security/backend/db"
+	"web-security/backend/mail"
+	"web-security/backend/models"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendVerificationEmail 生成签名的验证链接并发送到用户邮箱，失败只记录日志
+func sendVerificationEmail(user models.User) {
+	token, err := utils.GenerateEmailVerificationToken(user.ID, user.Email)
+	if err != nil {
+		log.Printf("生成邮箱验证令牌失败(user_id=%d): %v", user.ID, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", mailFrontendURL, url.QueryEscape(token))
+	body := fmt.Sprintf("%s，您好：\n\n感谢您的注册。请在%d小时内打开以下链接验证您的邮箱地址：\n\n%s\n\n如果您没有注册过账户，请忽略此邮件。",
+		user.Username, int(utils.EmailVerificationTokenExpiry.Hours()), link)
+
+	err = Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "请验证您的邮箱地址",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("发送邮箱验证邮件失败(user_id=%d): %v", user.ID, err)
+	}
+}
+
+// VerifyEmail 通过邮件中的签名链接验证邮箱
+func VerifyEmail(c *gin.Context) {
+	userID, email, err := utils.ParseEmailVerificationToken(c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// email_verified_at可能在注册时没有经过验证就已设置，email_proven_at只有通过邮件中的链接或令牌才会设置
+	var verifiedAt, provenAt *time.Time
+	err = db.DB.QueryRow("SELECT email_verified_at, email_proven_at FROM users WHERE id = ? AND email = ?", userID, email).Scan(&verifiedAt, &provenAt)
+	if err == sql.ErrNoRows {
+		// 用户不存在或邮箱已修改，旧链接不再有效
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.ErrInvalidVerificationToken.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询错误: " + err.Error()})
+		return
+	}
+	if verifiedAt != nil && provenAt != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "邮箱已经验证过了"})
+		return
+	}
+
+	now := time.Now()
+	_, err = db.DB.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?), email_proven_at = COALESCE(email_proven_at, ?) WHERE id = ? AND email = ?",
+		now, now, userID, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证邮箱失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "邮箱验证成功"})
+}
+
+// ResendVerificationEmail 重新发送验证邮件，有单独的频率限制
+func ResendVerificationEmail(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	var user models.User
+	var verifiedAt *time.Time
+	err := db.DB.QueryRow("SELECT id, username, email, email_verified_at FROM users WHERE id = ?", userID).Scan(
+		&user.ID, &user.Username, &user.Email, &verifiedAt,
+	)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if verifiedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "邮箱已经验证过了"})
+		return
+	}
+
+	allowed, retryAfter, err := utils.AllowVerificationEmailResend(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "发送验证邮件失败: " + err.Error()})
+		return
+	}
+	if !allowed {
+		seconds := int(retryAfter.Seconds() + 0.5)
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "发送过于频繁，请稍后再试",
+			"retry_after": seconds,
+		})
+		return
+	}
+
+	go sendVerificationEmail(user)
+
+	c.JSON(http.StatusOK, gin.H{"message": "验证邮件已发送，请查收"})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/iprules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListIPRules 列出IP规则，include_expired=true时包括已过期的规则
+func ListIPRules(c *gin.Context) {
+	rules, err := iprules.List(c.Query("include_expired") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取IP规则失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rules":                rules,
+		"admin_allowlist_only": iprules.AdminAllowlistOnly(),
+	})
+}
+
+// CreateIPRule 新建IP规则，cidr可以是单个IP或CIDR网段
+func CreateIPRule(c *gin.Context) {
+	var req struct {
+		CIDR      string     `json:"cidr" binding:"required"`
+		Action    string     `json:"action" binding:"required"`
+		Scope     string     `json:"scope"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		// ExpiresIn 相对的有效期，例如"24h"，与expires_at二选一
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+	if req.ExpiresIn != "" {
+		if req.ExpiresAt != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at和expires_in只能指定一个"})
+			return
+		}
+		duration, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的expires_in"})
+			return
+		}
+		expiresAt := time.Now().Add(duration)
+		req.ExpiresAt = &expiresAt
+	}
+
+	// 防止管理员把自己当前的IP挡在管理接口之外
+	if network, err := iprules.ParseCIDR(req.CIDR); err == nil && req.Action == iprules.ActionDeny {
+		if ip := net.ParseIP(c.ClientIP()); ip != nil && network.Contains(ip) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不能封禁自己当前使用的IP"})
+			return
+		}
+	}
+
+	createdBy := c.GetInt("userID")
+	rule, err := iprules.Create(iprules.Rule{
+		CIDR:      req.CIDR,
+		Action:    req.Action,
+		Scope:     req.Scope,
+		Reason:    req.Reason,
+		CreatedBy: &createdBy,
+		ExpiresAt: req.ExpiresAt,
+	})
+	switch {
+	case errors.Is(err, iprules.ErrCacheNotUpdated):
+		// 规则已经保存，继续返回成功
+		log.Printf("创建IP规则 %d 后更新缓存失败: %v", rule.ID, err)
+	case errors.Is(err, iprules.ErrInvalidRule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建IP规则失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionIPRuleCreate,
+		TargetType: audit.TargetIPRule,
+		TargetID:   strconv.FormatInt(rule.ID, 10),
+		Details: map[string]interface{}{
+			"cidr":       rule.CIDR,
+			"action":     rule.Action,
+			"scope":      rule.Scope,
+			"reason":     rule.Reason,
+			"expires_at": rule.ExpiresAt,
+		},
+	})
+	c.JSON(http.StatusCreated, rule)
+}
+
+// DeleteIPRule 删除IP规则，解除封禁时使用
+func DeleteIPRule(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的规则ID"})
+		return
+	}
+
+	err = iprules.Delete(id)
+	switch {
+	case errors.Is(err, iprules.ErrCacheNotUpdated):
+		log.Printf("删除IP规则 %d 后更新缓存失败: %v", id, err)
+	case errors.Is(err, iprules.ErrRuleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除IP规则失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionIPRuleDelete,
+		TargetType: audit.TargetIPRule,
+		TargetID:   strconv.FormatInt(id, 10),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "IP规则已删除", "id": id})
+}
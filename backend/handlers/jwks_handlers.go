@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"net/http"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJWKS 公开当前用于验证JWT的公钥（JWKS），供其他服务离线校验令牌
+func GetJWKS(c *gin.Context) {
+	// 允许短时间缓存，密钥轮换时新公钥会提前加入验证密钥列表
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, utils.PublicJWKS())
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"web-security/backend/mail"
+	"web-security/backend/models"
+	"web-security/backend/notify"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoginNotifier 通知用户异常登录的实现，由InitLoginNotifier根据配置选择
+var LoginNotifier notify.Notifier = &notify.LogNotifier{}
+
+// InitLoginNotifier 初始化异常登录的通知方式
+func InitLoginNotifier(notifier notify.Notifier) {
+	LoginNotifier = notifier
+}
+
+// assessLoginRisk 检测本次登录是否异常。检测失败时只记录日志并按正常登录处理，
+// 避免Redis故障导致所有用户都无法登录。
+func assessLoginRisk(c *gin.Context, user models.User) *utils.LoginRisk {
+	risk, err := utils.AssessLogin(utils.LoginAttempt{
+		UserID:    user.ID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		LastLogin: user.LastLogin,
+	})
+	if err != nil {
+		log.Printf("检测异常登录失败(user_id=%d): %v", user.ID, err)
+		return nil
+	}
+	return risk
+}
+
+// reportUnusualLogin 记录异常登录的安全事件，并在后台通知用户
+func reportUnusualLogin(c *gin.Context, user models.User, risk *utils.LoginRisk, stepUpRequired bool) {
+	details := map[string]interface{}{
+		"reasons":          risk.Reasons,
+		"step_up_required": stepUpRequired,
+	}
+	for key, value := range risk.Details {
+		details[key] = value
+	}
+	country := ""
+	if risk.Location != nil {
+		country = risk.Location.Country
+		details["country"] = country
+	}
+	utils.RecordSecurityEvent(utils.SecurityEvent{
+		Type:      utils.SecurityEventSuspiciousLogin,
+		UserID:    user.ID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Details:   details,
+	})
+
+	alert := notify.LoginAlert{
+		UserID:         user.ID,
+		Username:       user.Username,
+		Email:          user.Email,
+		IP:             c.ClientIP(),
+		UserAgent:      c.Request.UserAgent(),
+		Country:        country,
+		Reasons:        risk.Reasons,
+		StepUpRequired: stepUpRequired,
+		Time:           time.Now(),
+	}
+	go func() {
+		if err := LoginNotifier.NotifyLogin(alert); err != nil {
+			log.Printf("发送异常登录通知失败(user_id=%d): %v", alert.UserID, err)
+		}
+	}()
+}
+
+// respondLoginStepUp 异常登录需要二次验证：签发二次验证令牌，并把一次性验证码发送到用户邮箱
+func respondLoginStepUp(c *gin.Context, user models.User) {
+	stepUpToken, err := utils.GenerateLoginStepUpToken(user.ID, user.Username, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成二次验证令牌失败: " + err.Error()})
+		return
+	}
+	claims, err := utils.ValidateLoginStepUpToken(stepUpToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成二次验证令牌失败: " + err.Error()})
+		return
+	}
+	code, err := utils.CreateLoginStepUpCode(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成验证码失败: " + err.Error()})
+		return
+	}
+
+	go sendLoginStepUpEmail(user, code)
+
+	c.JSON(http.StatusOK, gin.H{
+		"step_up_required": true,
+		"step_up_token":    stepUpToken,
+		"methods":          []string{"email_code"},
+		"expires_in":       int(utils.LoginStepUpTokenExpiry.Seconds()),
+	})
+}
+
+// sendLoginStepUpEmail 发送二次验证码邮件，失败只记录日志
+func sendLoginStepUpEmail(user models.User, code string) {
+	body := fmt.Sprintf("%s，您好：\n\n我们检测到一次异常登录，需要确认是您本人的操作。验证码为：\n\n%s\n\n验证码%d分钟内有效。如果这不是您本人的操作，请不要把验证码告诉任何人，并立即修改密码。",
+		user.Username, code, int(utils.LoginStepUpTokenExpiry.Minutes()))
+
+	err := Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "登录验证码",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("发送登录验证码邮件失败(user_id=%d): %v", user.ID, err)
+	}
+}
+
+// VerifyLoginStepUp 异常登录的第二步：提交邮件中的验证码换取正式的令牌对
+func VerifyLoginStepUp(c *gin.Context) {
+	if !checkMFAAttempts(c) {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	claims := c.MustGet("mfaClaims").(*utils.Claims)
+	if !checkSecondFactorAllowed(c, claims.Username) {
+		return
+	}
+	if err := utils.VerifyLoginStepUpCode(claims, req.Code); err != nil {
+		if errors.Is(err, utils.ErrInvalidStepUpCode) {
+			// 错误的验证码计入登录失败次数和该用户第二步验证的失败次数，重新登录拿到新令牌不会重置计数
+			respondSecondFactorFailure(c, claims.UserID, claims.Username, "invalid_step_up_code", err.Error())
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		}
+		return
+	}
+
+	user, err := loadMFAUser(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if user.AccountStatus != "active" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用，请联系管理员"})
+		return
+	}
+	// 签发二次验证令牌之后账户被要求使用两步验证，邮件验证码不能代替TOTP
+	if user.TOTPEnabled || isMFARequired(user) {
+		consumeMFAToken(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "该账户需要两步验证，请重新登录"})
+		return
+	}
+
+	consumeMFAToken(c)
+	_ = utils.ClearMFAFailures(user.ID)
+	completeLogin(c, user, nil)
+}
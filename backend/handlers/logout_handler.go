@@ -2,8 +2,8 @@ package handlers
 
 import (
 	"net/http"
-	"strings"
 	"time"
+	"web-security/backend/audit"
 	"web-security/backend/utils"
 
 	"github.com/gin-gonic/gin"
@@ -11,52 +11,44 @@ import (
 
 // LogoutHandler 处理用户注销 (旧LogoutUser函数的重命名版本)
 func LogoutHandler(c *gin.Context) {
-	// 从上下文中获取用户ID
-	userID, exists := c.Get("userID")
+	// 从上下文中获取会话ID
+	sessionID, exists := c.Get("sessionID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
 		return
 	}
 
 	// 清除客户端Cookie
-	c.SetCookie("access_token", "", -1, "/", "", true, true)
-	c.SetCookie("refresh_token", "", -1, "/", "", true, true)
-
-	// 获取认证令牌
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		// 如果没有认证头，我们可能正在使用Cookie认证
-		// 仍然进行后续操作以使Redis中的令牌无效
-	} else {
-		parts := strings.Split(authHeader, " ")
-		if len(parts) == 2 && parts[0] == "Bearer" {
-			tokenString := parts[1]
-
-			// 将令牌加入黑名单
-			// 解析令牌以获取过期时间
-			claims, err := utils.ParseToken(tokenString)
-			if err == nil && claims != nil && claims.ExpiresAt != nil {
-				// 使用剩余的过期时间
-				expiry := time.Until(claims.ExpiresAt.Time)
-				if expiry > 0 {
-					_ = utils.BlacklistToken(tokenString, expiry)
-				} else {
-					// 令牌已过期，使用短期黑名单时间
-					_ = utils.BlacklistToken(tokenString, 1*time.Minute)
-				}
+	utils.ClearAuthCookies(c)
+
+	// 获取认证令牌（来自Authorization头或Cookie，由AuthMiddleware设置）
+	tokenString := c.GetString("accessToken")
+	if tokenString != "" {
+		// 将令牌加入黑名单
+		// 解析令牌以获取过期时间
+		claims, err := utils.ParseToken(tokenString)
+		if err == nil && claims != nil && claims.ExpiresAt != nil {
+			// 使用剩余的过期时间
+			expiry := time.Until(claims.ExpiresAt.Time)
+			if expiry > 0 {
+				_ = utils.BlacklistToken(tokenString, expiry)
 			} else {
-				// 解析失败，使用默认值
-				_ = utils.BlacklistToken(tokenString, 15*time.Minute)
+				// 令牌已过期，使用短期黑名单时间
+				_ = utils.BlacklistToken(tokenString, 1*time.Minute)
 			}
+		} else {
+			// 解析失败，使用默认值
+			_ = utils.BlacklistToken(tokenString, 15*time.Minute)
 		}
 	}
 
-	// 使该用户的所有令牌失效
-	err := utils.InvalidateUserTokens(userID.(int))
+	// 只撤销当前设备的会话，其他设备保持登录
+	err := utils.RevokeSession(sessionID.(string))
 	if err != nil {
 		// 记录错误但继续流程
-		// log.Printf("使令牌无效失败: %v", err)
+		// log.Printf("撤销会话失败: %v", err)
 	}
 
+	audit.Record(c, audit.Event{Action: audit.ActionLogout, TargetType: audit.TargetSession, TargetID: sessionID.(string)})
 	c.JSON(http.StatusOK, gin.H{"message": "注销成功"})
 }
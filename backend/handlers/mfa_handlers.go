@@ -0,0 +1,558 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/db"
+	"web-security/backend/models"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// mfaIssuer 显示在认证器App中的发行方名称
+	mfaIssuer = "Web Security Shop"
+	// mfaRequiredForAdmins 是否强制所有管理员账户使用两步验证
+	mfaRequiredForAdmins = false
+)
+
+// InitMFAPolicy 初始化两步验证的策略
+func InitMFAPolicy(issuer string, requiredForAdmins bool) {
+	if issuer != "" {
+		mfaIssuer = issuer
+	}
+	mfaRequiredForAdmins = requiredForAdmins
+}
+
+// isMFARequired 判断账户是否被要求使用两步验证
+func isMFARequired(user models.User) bool {
+	return user.MFARequired || (mfaRequiredForAdmins && user.Role == "admin")
+}
+
+// respondMFAChallenge 密码验证通过后签发两步验证等待令牌，要求客户端完成第二步
+func respondMFAChallenge(c *gin.Context, user models.User) {
+	mfaToken, err := utils.GenerateMFAPendingToken(user.ID, user.Username, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成两步验证令牌失败: " + err.Error()})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"methods":      []string{"totp", "recovery_code"},
+			"expires_in":   int(utils.MFAPendingTokenExpiry.Seconds()),
+		})
+		return
+	}
+
+	// 账户被要求使用两步验证但尚未绑定，需要先完成绑定
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_setup_required": true,
+		"mfa_token":          mfaToken,
+		"expires_in":         int(utils.MFAPendingTokenExpiry.Seconds()),
+	})
+}
+
+// VerifyLoginMFA 登录第二步：使用TOTP验证码或恢复码换取正式的令牌对
+func VerifyLoginMFA(c *gin.Context) {
+	if !checkMFAAttempts(c) {
+		return
+	}
+
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "需要提供验证码或恢复码"})
+		return
+	}
+
+	userID, _ := c.Get("userID")
+	user, err := loadMFAUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if user.AccountStatus != "active" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用，请联系管理员"})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该账户尚未启用两步验证"})
+		return
+	}
+	if !checkSecondFactorAllowed(c, user.Username) {
+		return
+	}
+
+	ok, err := verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return
+	}
+	if !ok {
+		respondSecondFactorFailure(c, user.ID, user.Username, "invalid_mfa_code", "验证码不正确")
+		return
+	}
+
+	consumeMFAToken(c)
+	_ = utils.ClearMFAFailures(user.ID)
+	completeLogin(c, user, nil)
+}
+
+// EnrollTOTP 开始绑定TOTP：生成新的密钥和otpauth URI，确认之前不会生效
+func EnrollTOTP(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	user, err := loadMFAUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "已经启用了两步验证"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成密钥失败: " + err.Error()})
+		return
+	}
+
+	_, err = db.DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 0 WHERE id = ?", secret, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存密钥失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(mfaIssuer, user.Username, secret),
+	})
+}
+
+// ConfirmTOTP 使用认证器App生成的验证码确认绑定，启用两步验证并返回一次性恢复码。
+// 如果是在登录过程中被要求绑定的，确认成功后同时完成登录。
+func ConfirmTOTP(c *gin.Context) {
+	pending := c.GetBool("mfaPending")
+	if pending && !checkMFAAttempts(c) {
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	user, err := loadMFAUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "已经启用了两步验证"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请先发起两步验证绑定"})
+		return
+	}
+	if !checkMFAChangeAllowed(c, user) {
+		return
+	}
+
+	ok, err := verifyTOTP(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return
+	}
+	if !ok {
+		respondSecondFactorFailure(c, user.ID, user.Username, "invalid_mfa_enroll_code", "验证码不正确")
+		return
+	}
+	_ = utils.ClearMFAFailures(user.ID)
+
+	codes, err := replaceRecoveryCodes(user.ID, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "启用两步验证失败: " + err.Error()})
+		return
+	}
+
+	if pending {
+		if user.AccountStatus != "active" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用，请联系管理员"})
+			return
+		}
+		user.TOTPEnabled = true
+		consumeMFAToken(c)
+		completeLogin(c, user, gin.H{"recovery_codes": codes})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "两步验证已启用，请妥善保存恢复码，每个恢复码只能使用一次",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP 关闭两步验证，需要同时提供当前密码和验证码
+func DisableTOTP(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	var req models.MFADisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	user, err := loadMFAUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "尚未启用两步验证"})
+		return
+	}
+	if isMFARequired(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "该账户被要求必须使用两步验证，不能关闭"})
+		return
+	}
+
+	if !checkMFAChangeAllowed(c, user) {
+		return
+	}
+
+	if ok, _, err := utils.VerifyPassword(user.PasswordHash, req.Password); err != nil || !ok {
+		respondSecondFactorFailure(c, user.ID, user.Username, "invalid_current_password", "密码不正确")
+		return
+	}
+	ok, err := verifyTOTP(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return
+	}
+	if !ok {
+		respondSecondFactorFailure(c, user.ID, user.Username, "invalid_mfa_code", "验证码不正确")
+		return
+	}
+	_ = utils.ClearMFAFailures(user.ID)
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0 WHERE id = ?", user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "关闭两步验证失败: " + err.Error()})
+		return
+	}
+	if _, err = tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除恢复码失败: " + err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionMFADisable,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+	})
+
+	// 关闭两步验证后，其他设备上的会话全部撤销，当前设备保持登录
+	if err := utils.InvalidateUserTokensExcept(user.ID, c.GetString("sessionID")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "两步验证已关闭，但撤销其他会话失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "两步验证已关闭，其他设备需要重新登录"})
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，旧的恢复码全部作废
+func RegenerateRecoveryCodes(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	user, err := loadMFAUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "尚未启用两步验证"})
+		return
+	}
+	if !checkMFAChangeAllowed(c, user) {
+		return
+	}
+
+	ok, err := verifyTOTP(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return
+	}
+	if !ok {
+		respondSecondFactorFailure(c, user.ID, user.Username, "invalid_mfa_code", "验证码不正确")
+		return
+	}
+	_ = utils.ClearMFAFailures(user.ID)
+
+	codes, err := replaceRecoveryCodes(user.ID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成恢复码失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// AdminSetMFARequired 管理员专用：要求（或取消要求）指定用户必须使用两步验证
+func AdminSetMFARequired(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	var req struct {
+		Required *bool `json:"required" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE users SET mfa_required = ?, updated_at = ? WHERE id = ?", *req.Required, time.Now(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新两步验证要求失败: " + err.Error()})
+		return
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "两步验证要求已更新",
+		"user_id":      userID,
+		"mfa_required": *req.Required,
+	})
+}
+
+// loadMFAUser 查询两步验证所需的用户信息
+func loadMFAUser(userID int) (models.User, error) {
+	var user models.User
+	var totpSecret sql.NullString
+	err := db.DB.QueryRow(`
+		SELECT id, username, email, password_hash, role, account_status, totp_secret, totp_enabled, mfa_required
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role,
+		&user.AccountStatus, &totpSecret, &user.TOTPEnabled, &user.MFARequired,
+	)
+	user.TOTPSecret = totpSecret.String
+	return user, err
+}
+
+// verifySecondFactor 校验TOTP验证码或一次性恢复码
+func verifySecondFactor(user models.User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		return verifyTOTP(user, code)
+	}
+
+	// 恢复码只能使用一次，通过带条件的UPDATE保证并发下也只有一个请求成功
+	result, err := db.DB.Exec(`
+		UPDATE user_recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now(), user.ID, utils.HashRecoveryCode(recoveryCode))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+// verifyTOTP 校验TOTP验证码，同一个验证码不能重复使用
+func verifyTOTP(user models.User, code string) (bool, error) {
+	step, ok := utils.ValidateTOTPCode(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return utils.MarkTOTPStepUsed(user.ID, step)
+}
+
+// replaceRecoveryCodes 生成新的恢复码并替换旧的，enable为true时同时启用两步验证
+func replaceRecoveryCodes(userID int, enable bool) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if enable {
+		if _, err := tx.Exec("UPDATE users SET totp_enabled = 1 WHERE id = ?", userID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO user_recovery_codes(user_id, code_hash) VALUES(?, ?)", userID, utils.HashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// checkMFAAttempts 限制第二步验证的尝试次数：用户的第二步验证被锁定时直接拒绝，
+// 每个等待令牌的尝试次数超过上限后令牌作废
+func checkMFAAttempts(c *gin.Context) bool {
+	claims := c.MustGet("mfaClaims").(*utils.Claims)
+	locked, err := utils.MFALockedFor(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return false
+	}
+	if locked > 0 {
+		consumeMFAToken(c)
+		respondLoginThrottled(c, locked)
+		return false
+	}
+
+	attempts, err := utils.RegisterMFAAttempt(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return false
+	}
+	if attempts > utils.MaxMFAAttempts {
+		consumeMFAToken(c)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "验证尝试次数过多，请重新登录"})
+		return false
+	}
+	return true
+}
+
+// checkSecondFactorAllowed 第二步验证同样受登录防暴力破解限制，用户名或IP被锁定、或者仍在等待期内时直接拒绝
+func checkSecondFactorAllowed(c *gin.Context, username string) bool {
+	wait, err := utils.CheckLoginAllowed(username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "登录检查失败: " + err.Error()})
+		return false
+	}
+	if wait > 0 {
+		respondLoginThrottled(c, wait)
+		return false
+	}
+	return true
+}
+
+// checkMFAChangeAllowed 绑定、关闭两步验证和重新生成恢复码时校验的验证码与登录第二步共用失败次数，
+// 第二步验证被锁定或登录被限制时直接拒绝，避免拿到访问令牌后无限次猜测验证码
+func checkMFAChangeAllowed(c *gin.Context, user models.User) bool {
+	locked, err := utils.MFALockedFor(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证失败: " + err.Error()})
+		return false
+	}
+	if locked > 0 {
+		respondLoginThrottled(c, locked)
+		return false
+	}
+	return checkSecondFactorAllowed(c, user.Username)
+}
+
+// respondSecondFactorFailure 第二步验证失败时计入该用户名的登录失败次数，
+// 重新登录拿到新的等待令牌不会重置计数。达到上限时作废当前等待令牌并返回429
+func respondSecondFactorFailure(c *gin.Context, userID int, username, reason, message string) {
+	recordLoginFailure(c, userID, username, reason)
+	wait, err := utils.RegisterLoginFailure(userID, username, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		log.Printf("记录登录失败次数失败: %v", err)
+	}
+	// 同时计入该用户第二步验证的失败次数，统计窗口更长，慢速猜测也会被锁定
+	mfaLocked, err := utils.RegisterMFAFailure(userID, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		log.Printf("记录第二步验证失败次数失败: %v", err)
+	}
+	if mfaLocked {
+		consumeMFAToken(c)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "验证失败次数过多，第二步验证已被暂时锁定"})
+		return
+	}
+	if wait >= utils.LoginLockoutDuration() {
+		consumeMFAToken(c)
+		respondLoginThrottled(c, wait)
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// consumeMFAToken 将已使用的两步验证等待令牌加入黑名单，保证只能使用一次。已登录用户的请求没有等待令牌，不做处理
+func consumeMFAToken(c *gin.Context) {
+	value, exists := c.Get("mfaClaims")
+	if !exists {
+		return
+	}
+	tokenString := c.GetString("mfaToken")
+	claims := value.(*utils.Claims)
+
+	expiry := utils.MFAPendingTokenExpiry
+	if claims.ExpiresAt != nil {
+		expiry = time.Until(claims.ExpiresAt.Time)
+	}
+	if expiry <= 0 {
+		expiry = time.Minute
+	}
+	_ = utils.BlacklistToken(tokenString, expiry)
+}
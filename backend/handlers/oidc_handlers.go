@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/db"
+	"web-security/backend/models"
+	"web-security/backend/oidc"
+	"web-security/backend/privacy"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcStateCookiePath state Cookie只需要发送给第三方登录的接口
+const oidcStateCookiePath = "/api/auth/oidc"
+
+var (
+	// errOIDCEmailUnverified 提供方没有返回已验证的邮箱，无法按邮箱关联或创建账户
+	errOIDCEmailUnverified = errors.New("身份提供方没有返回已验证的邮箱，无法登录")
+	// errOIDCLocalEmailUnverified 同邮箱的本地账户没有通过邮件证明拥有该邮箱，不能确定账户属于同一个人
+	errOIDCLocalEmailUnverified = errors.New("该邮箱已被其他账户使用，请先使用该账户的密码登录，再在账户设置中绑定第三方账户")
+)
+
+// ListOIDCProviders 列出可用的第三方登录方式
+func ListOIDCProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": oidc.Providers()})
+}
+
+// StartOIDCLogin 发起第三方登录，返回提供方的授权地址，并用Cookie把本次登录绑定到当前浏览器
+func StartOIDCLogin(c *gin.Context) {
+	beginOIDCFlow(c, 0)
+}
+
+// StartOIDCLink 已登录用户发起绑定新的第三方身份，完成后不签发新的令牌
+func StartOIDCLink(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+	beginOIDCFlow(c, userID.(int))
+}
+
+func beginOIDCFlow(c *gin.Context, linkUserID int) {
+	provider, err := oidc.Lookup(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	authorization, err := provider.Begin(linkUserID)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+	utils.SetFlowCookie(c, oidc.StateCookie, authorization.State, int(oidc.StateTTL.Seconds()), oidcStateCookiePath)
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authorization.URL})
+}
+
+// OIDCCallback 用提供方回调中的code和state完成第三方登录或绑定。
+// 登录时先按sub查找已绑定的身份，找不到再按已验证的邮箱关联本地账户，都没有时创建新账户，
+// 之后和密码登录一样检测异常登录、要求两步验证，最后签发令牌对
+func OIDCCallback(c *gin.Context) {
+	provider, err := oidc.Lookup(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var req models.OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	// 回调中的state必须和发起登录时写入Cookie的一致，防止把攻击者的授权码注入到受害者的浏览器中
+	cookieState, _ := c.Cookie(oidc.StateCookie)
+	utils.ClearFlowCookie(c, oidc.StateCookie, oidcStateCookiePath)
+	if cookieState == "" || subtle.ConstantTimeCompare([]byte(cookieState), []byte(req.State)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": oidc.ErrInvalidState.Error()})
+		return
+	}
+
+	result, err := provider.Finish(req.State, req.Code)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+	if result.LinkUserID != 0 {
+		finishOIDCLink(c, provider, result)
+		return
+	}
+
+	user, created, err := resolveOIDCUser(c, provider, result.Claims)
+	switch {
+	case errors.Is(err, errOIDCEmailUnverified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errOIDCLocalEmailUnverified), errors.Is(err, oidc.ErrIdentityLinked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "第三方登录失败: " + err.Error()})
+		return
+	}
+
+	if user.AccountStatus != "active" {
+		recordLoginFailure(c, user.ID, user.Username, "account_"+user.AccountStatus)
+		c.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用，请联系管理员"})
+		return
+	}
+
+	continueLogin(c, user, gin.H{"provider": provider.Name, "account_created": created})
+}
+
+// resolveOIDCUser 找到第三方身份对应的本地用户，必要时按邮箱关联或创建新用户，created表示新建了账户
+func resolveOIDCUser(c *gin.Context, provider *oidc.Provider, claims oidc.Claims) (models.User, bool, error) {
+	identity, err := oidc.FindIdentity(provider.Name, claims.Subject)
+	if err == nil {
+		if err := oidc.TouchIdentity(identity.ID, claims.Email); err != nil {
+			log.Printf("更新第三方身份 %d 的登录时间失败: %v", identity.ID, err)
+		}
+		user, err := loadOIDCUser(identity.UserID)
+		return user, false, err
+	}
+	if !errors.Is(err, oidc.ErrIdentityNotFound) {
+		return models.User{}, false, err
+	}
+
+	// 没有绑定过的身份只能通过提供方验证过的邮箱关联，未验证的邮箱可能属于任何人
+	if claims.Email == "" || !claims.EmailVerified {
+		return models.User{}, false, errOIDCEmailUnverified
+	}
+
+	var (
+		userID        int
+		emailProvenAt sql.NullTime
+	)
+	err = db.DB.QueryRow("SELECT id, email_proven_at FROM users WHERE email = ?", claims.Email).Scan(&userID, &emailProvenAt)
+	switch {
+	case err == nil:
+		// 本地账户可能是他人用受害者的邮箱抢注的，关联后抢注者就能用密码登录受害者的第三方账户。
+		// email_verified_at在关闭邮箱验证时注册即设置，不能证明邮箱的归属，只有通过验证链接或重置令牌设置的email_proven_at可以
+		if !emailProvenAt.Valid {
+			return models.User{}, false, errOIDCLocalEmailUnverified
+		}
+		identity, err := oidc.LinkIdentity(userID, provider.Name, claims)
+		if err != nil {
+			return models.User{}, false, err
+		}
+		recordIdentityLink(c, userID, provider.Name, identity, "verified_email")
+		user, err := loadOIDCUser(userID)
+		return user, false, err
+
+	case err == sql.ErrNoRows:
+		user, identity, err := createOIDCUser(provider.Name, claims)
+		if err != nil {
+			return models.User{}, false, err
+		}
+		recordIdentityLink(c, user.ID, provider.Name, identity, "created")
+		return user, true, nil
+	}
+	return models.User{}, false, err
+}
+
+// createOIDCUser 为第三方身份创建新账户。账户没有密码，邮箱已由提供方验证，之后可以通过找回密码设置密码
+func createOIDCUser(providerName string, claims oidc.Claims) (models.User, *oidc.Identity, error) {
+	username, err := oidcUsername(claims)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var fullName sql.NullString
+	if claims.Name != "" {
+		fullName = sql.NullString{String: truncate(claims.Name, 100), Valid: true}
+	}
+	res, err := tx.Exec(`
+		INSERT INTO users(username, email, email_verified_at, password_hash, full_name, role, account_status, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+	`, username, claims.Email, now, utils.NoPasswordHash, fullName, "user", "active", now)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	identity, err := oidc.LinkIdentityTx(tx, int(userID), providerName, claims)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.User{}, nil, err
+	}
+
+	user, err := loadOIDCUser(int(userID))
+	return user, identity, err
+}
+
+// oidcUsername 根据preferred_username或邮箱生成一个未被使用的用户名
+func oidcUsername(claims oidc.Claims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = claims.Email
+	}
+	// 有的提供方把邮箱作为preferred_username
+	base, _, _ = strings.Cut(base, "@")
+
+	var b strings.Builder
+	for _, r := range base {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' || r == '.' {
+			b.WriteRune(r)
+		}
+	}
+	base = b.String()
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	// 太短或者使用了注销账户保留的前缀时改用通用的名称
+	if len(base) < 3 || strings.HasPrefix(strings.ToLower(base), privacy.ErasedUsernamePrefix) {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		var exists bool
+		if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		candidate = base + "_" + hex.EncodeToString(suffix)
+	}
+	return "", errors.New("无法生成可用的用户名")
+}
+
+// loadOIDCUser 按ID读取登录需要的用户信息
+func loadOIDCUser(userID int) (models.User, error) {
+	var user models.User
+	err := db.DB.QueryRow(`
+		SELECT id, username, password_hash, email, role, account_status, totp_enabled, mfa_required,
+		last_login, created_at, updated_at
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.PasswordHash, &user.Email,
+		&user.Role, &user.AccountStatus, &user.TOTPEnabled, &user.MFARequired,
+		&user.LastLogin, &user.CreatedAt, &user.UpdatedAt,
+	)
+	return user, err
+}
+
+// finishOIDCLink 把身份绑定到发起绑定的用户
+func finishOIDCLink(c *gin.Context, provider *oidc.Provider, result *oidc.Result) {
+	existing, err := oidc.FindIdentity(provider.Name, result.Claims.Subject)
+	if err == nil {
+		if existing.UserID == result.LinkUserID {
+			c.JSON(http.StatusOK, gin.H{"message": "该身份已绑定到当前账户", "identity": existing})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": oidc.ErrIdentityLinked.Error()})
+		return
+	}
+	if !errors.Is(err, oidc.ErrIdentityNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "绑定第三方身份失败: " + err.Error()})
+		return
+	}
+
+	identity, err := oidc.LinkIdentity(result.LinkUserID, provider.Name, result.Claims)
+	if errors.Is(err, oidc.ErrIdentityLinked) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "绑定第三方身份失败: " + err.Error()})
+		return
+	}
+
+	recordIdentityLink(c, result.LinkUserID, provider.Name, identity, "link")
+	c.JSON(http.StatusOK, gin.H{"message": "第三方身份绑定成功", "identity": identity})
+}
+
+// recordIdentityLink 记录身份绑定的审计事件。回调接口不需要认证，操作者就是身份绑定到的用户
+func recordIdentityLink(c *gin.Context, userID int, providerName string, identity *oidc.Identity, method string) {
+	audit.Record(c, audit.Event{
+		Action:      audit.ActionIdentityLink,
+		ActorUserID: userID,
+		TargetType:  audit.TargetUser,
+		TargetID:    strconv.Itoa(userID),
+		Details: map[string]interface{}{
+			"provider":    providerName,
+			"subject":     identity.Subject,
+			"identity_id": identity.ID,
+			"method":      method,
+		},
+	})
+}
+
+// ListMyIdentities 列出当前用户绑定的第三方身份
+func ListMyIdentities(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+	identities, err := oidc.ListIdentities(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取绑定的身份失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// UnlinkMyIdentity 解除绑定的第三方身份。账户没有密码时不能解除最后一个身份，否则将无法登录
+func UnlinkMyIdentity(c *gin.Context) {
+	value, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+	userID := value.(int)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的身份ID"})
+		return
+	}
+
+	var passwordHash string
+	if err := db.DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if !utils.HasPassword(passwordHash) {
+		identities, err := oidc.ListIdentities(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取绑定的身份失败: " + err.Error()})
+			return
+		}
+		if len(identities) <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "这是账户唯一的登录方式，请先通过找回密码设置密码"})
+			return
+		}
+	}
+
+	identity, err := oidc.UnlinkIdentity(userID, id)
+	if errors.Is(err, oidc.ErrIdentityNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "解除绑定失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionIdentityUnlink,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"provider": identity.Provider, "subject": identity.Subject, "identity_id": identity.ID},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "已解除绑定", "identity": identity})
+}
+
+// respondOIDCError 把第三方登录流程的错误转换为响应
+func respondOIDCError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, oidc.ErrInvalidState), errors.Is(err, oidc.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, oidc.ErrInvalidIDToken):
+		log.Printf("第三方登录的ID令牌验证失败: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": oidc.ErrInvalidIDToken.Error()})
+	case errors.Is(err, oidc.ErrProviderUnavailable):
+		log.Printf("访问身份提供方失败: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": oidc.ErrProviderUnavailable.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "第三方登录失败: " + err.Error()})
+	}
+}
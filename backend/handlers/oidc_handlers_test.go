@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"web-security/backend/db"
+	"web-security/backend/oidc"
+	"web-security/backend/oidc/oidctest"
+	"web-security/backend/redis_client"
+	"web-security/backend/utils"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testOIDCUserID = 7
+	testOIDCEmail  = "alice@example.com"
+)
+
+var identityColumns = []string{"id", "user_id", "provider", "subject", "email", "created_at", "last_login_at"}
+
+// oidcTest 一个测试用例使用的提供方、数据库和路由
+type oidcTest struct {
+	idp    *oidctest.Server
+	mock   sqlmock.Sqlmock
+	router *gin.Engine
+}
+
+// oidcLogin 发起登录得到的授权参数和state Cookie
+type oidcLogin struct {
+	auth   oidctest.Authorization
+	cookie *http.Cookie
+}
+
+func setupOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	mr := miniredis.RunT(t)
+	redis_client.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	t.Cleanup(func() { mockDB.Close() })
+	db.DB = mockDB
+
+	idp := oidctest.NewServer("web-security", "stub-secret")
+	t.Cleanup(idp.Close)
+	err = oidc.Init([]oidc.ProviderConfig{{
+		Name:         "stub",
+		Issuer:       idp.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  "http://localhost:5173/auth/callback/stub",
+	}})
+	if err != nil {
+		t.Fatalf("oidc.Init: %v", err)
+	}
+
+	router := gin.New()
+	router.POST("/api/auth/oidc/:provider/authorize", StartOIDCLogin)
+	router.POST("/api/auth/oidc/:provider/callback", OIDCCallback)
+	protected := router.Group("/api/auth", func(c *gin.Context) {
+		c.Set("userID", testOIDCUserID)
+		c.Next()
+	})
+	protected.DELETE("/oidc/identities/:id", UnlinkMyIdentity)
+
+	return &oidcTest{idp: idp, mock: mock, router: router}
+}
+
+func (tt *oidcTest) serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	tt.router.ServeHTTP(w, req)
+	return w
+}
+
+// startLogin 通过接口发起登录，返回授权参数和写入的state Cookie
+func (tt *oidcTest) startLogin(t *testing.T) oidcLogin {
+	t.Helper()
+	w := tt.serve(httptest.NewRequest(http.MethodPost, "/api/auth/oidc/stub/authorize", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("authorize: status = %d, body = %s", w.Code, w.Body)
+	}
+	var body struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("解析authorize响应: %v", err)
+	}
+	auth, err := oidctest.ParseAuthorization(body.AuthorizationURL)
+	if err != nil {
+		t.Fatalf("ParseAuthorization: %v", err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidc.StateCookie {
+			if cookie.Value != auth.State || !cookie.HttpOnly {
+				t.Fatalf("state Cookie不正确: %+v", cookie)
+			}
+			return oidcLogin{auth: auth, cookie: cookie}
+		}
+	}
+	t.Fatal("authorize没有写入state Cookie")
+	return oidcLogin{}
+}
+
+// issueCode 让提供方为登录签发授权码，ID令牌带有给定的邮箱
+func (tt *oidcTest) issueCode(login oidcLogin, email string, emailVerified bool) string {
+	claims := tt.idp.Claims(login.auth.Nonce, "subject-1")
+	claims["email"] = email
+	claims["email_verified"] = emailVerified
+	return tt.idp.IssueCode(login.auth, tt.idp.Sign(claims))
+}
+
+// callback 提交回调参数，cookie为nil时不带state Cookie
+func (tt *oidcTest) callback(state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"state": state, "code": code})
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/stub/callback", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return tt.serve(req)
+}
+
+func (tt *oidcTest) expectNoIdentity() {
+	tt.mock.ExpectQuery("FROM user_identities WHERE provider = \\? AND subject = \\?").
+		WithArgs("stub", "subject-1").
+		WillReturnRows(sqlmock.NewRows(identityColumns))
+}
+
+func (tt *oidcTest) expectLocalUser(provenAt interface{}) {
+	tt.mock.ExpectQuery("SELECT id, email_proven_at FROM users WHERE email = \\?").
+		WithArgs(testOIDCEmail).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email_proven_at"}).AddRow(testOIDCUserID, provenAt))
+}
+
+func (tt *oidcTest) checkExpectations(t *testing.T) {
+	t.Helper()
+	if err := tt.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func assertError(t *testing.T, w *httptest.ResponseRecorder, status int, message string) {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != status || body.Error != message {
+		t.Fatalf("status = %d, error = %q, want %d, %q", w.Code, body.Error, status, message)
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	tt := setupOIDCTest(t)
+	victim := tt.startLogin(t)
+	other := tt.startLogin(t)
+	code := tt.issueCode(victim, testOIDCEmail, true)
+
+	// 没有state Cookie，例如攻击者把自己的授权码和state发给受害者的浏览器
+	assertError(t, tt.callback(victim.auth.State, code, nil), http.StatusBadRequest, oidc.ErrInvalidState.Error())
+	// Cookie属于浏览器发起的另一个登录
+	assertError(t, tt.callback(victim.auth.State, code, other.cookie), http.StatusBadRequest, oidc.ErrInvalidState.Error())
+	tt.checkExpectations(t)
+}
+
+func TestOIDCCallbackRejectsReusedState(t *testing.T) {
+	tt := setupOIDCTest(t)
+	login := tt.startLogin(t)
+	code := tt.issueCode(login, testOIDCEmail, false)
+
+	// 第一次回调消耗了state，提供方没有验证邮箱，不能关联或创建账户
+	tt.expectNoIdentity()
+	assertError(t, tt.callback(login.auth.State, code, login.cookie), http.StatusForbidden, errOIDCEmailUnverified.Error())
+
+	// 重放同一个回调
+	assertError(t, tt.callback(login.auth.State, code, login.cookie), http.StatusBadRequest, oidc.ErrInvalidState.Error())
+	tt.checkExpectations(t)
+}
+
+func TestOIDCCallbackRejectsPKCEVerifierMismatch(t *testing.T) {
+	tt := setupOIDCTest(t)
+	victim := tt.startLogin(t)
+	attacker := tt.startLogin(t)
+	// 授权码是为攻击者的授权请求签发的，受害者的code_verifier无法换取令牌
+	code := tt.issueCode(attacker, testOIDCEmail, true)
+
+	assertError(t, tt.callback(victim.auth.State, code, victim.cookie), http.StatusBadRequest, oidc.ErrInvalidCode.Error())
+	tt.checkExpectations(t)
+}
+
+func TestOIDCCallbackRejectsInvalidIDToken(t *testing.T) {
+	tt := setupOIDCTest(t)
+	login := tt.startLogin(t)
+	claims := tt.idp.Claims("another-nonce", "subject-1")
+	code := tt.idp.IssueCode(login.auth, tt.idp.Sign(claims))
+
+	assertError(t, tt.callback(login.auth.State, code, login.cookie), http.StatusUnauthorized, oidc.ErrInvalidIDToken.Error())
+	tt.checkExpectations(t)
+}
+
+func TestOIDCCallbackRefusesUnprovenLocalEmail(t *testing.T) {
+	tt := setupOIDCTest(t)
+	login := tt.startLogin(t)
+	code := tt.issueCode(login, testOIDCEmail, true)
+
+	// 同邮箱的账户没有通过邮件证明拥有该邮箱（例如关闭邮箱验证时注册），不能自动关联
+	tt.expectNoIdentity()
+	tt.expectLocalUser(nil)
+	assertError(t, tt.callback(login.auth.State, code, login.cookie), http.StatusConflict, errOIDCLocalEmailUnverified.Error())
+	tt.checkExpectations(t)
+}
+
+func TestResolveOIDCUserLinksProvenEmail(t *testing.T) {
+	tt := setupOIDCTest(t)
+	provider, err := oidc.Lookup("stub")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	now := time.Now()
+
+	tt.expectNoIdentity()
+	tt.expectLocalUser(now)
+	tt.mock.ExpectExec("INSERT INTO user_identities").
+		WithArgs(testOIDCUserID, "stub", "subject-1", testOIDCEmail, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	tt.mock.ExpectQuery("FROM users WHERE id = \\?").
+		WithArgs(testOIDCUserID).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "username", "password_hash", "email", "role", "account_status", "totp_enabled", "mfa_required",
+			"last_login", "created_at", "updated_at",
+		}).AddRow(testOIDCUserID, "alice", utils.NoPasswordHash, testOIDCEmail, "user", "active", false, false, nil, now, now))
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/auth/oidc/stub/callback", nil)
+	claims := oidc.Claims{Subject: "subject-1", Email: testOIDCEmail, EmailVerified: true}
+	user, created, err := resolveOIDCUser(c, provider, claims)
+	if err != nil {
+		t.Fatalf("resolveOIDCUser: %v", err)
+	}
+	if user.ID != testOIDCUserID || created {
+		t.Fatalf("user.ID = %d, created = %v, want %d, false", user.ID, created, testOIDCUserID)
+	}
+	tt.checkExpectations(t)
+}
+
+func TestResolveOIDCUserRequiresProviderVerifiedEmail(t *testing.T) {
+	tt := setupOIDCTest(t)
+	provider, err := oidc.Lookup("stub")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	tt.expectNoIdentity()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/auth/oidc/stub/callback", nil)
+	claims := oidc.Claims{Subject: "subject-1", Email: testOIDCEmail}
+	if _, _, err := resolveOIDCUser(c, provider, claims); !errors.Is(err, errOIDCEmailUnverified) {
+		t.Fatalf("err = %v, want errOIDCEmailUnverified", err)
+	}
+	tt.checkExpectations(t)
+}
+
+func TestUnlinkMyIdentityKeepsLastLoginMethod(t *testing.T) {
+	passwordHash, err := utils.HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	now := time.Now()
+	identity := func(id int64) []driver.Value {
+		return []driver.Value{id, testOIDCUserID, "stub", "subject-" + strconv.FormatInt(id, 10), testOIDCEmail, now, now}
+	}
+
+	tests := []struct {
+		name         string
+		passwordHash string
+		identities   []int64 // 没有密码时查询到的全部身份
+		wantStatus   int
+	}{
+		{"没有密码时不能解除唯一的身份", utils.NoPasswordHash, []int64{3}, http.StatusConflict},
+		{"没有密码时可以解除其他身份", utils.NoPasswordHash, []int64{3, 4}, http.StatusOK},
+		{"有密码时可以解除唯一的身份", passwordHash, nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tt := setupOIDCTest(t)
+			tt.mock.ExpectQuery("SELECT password_hash FROM users WHERE id = \\?").
+				WithArgs(testOIDCUserID).
+				WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(test.passwordHash))
+			if test.identities != nil {
+				rows := sqlmock.NewRows(identityColumns)
+				for _, id := range test.identities {
+					rows.AddRow(identity(id)...)
+				}
+				tt.mock.ExpectQuery("FROM user_identities WHERE user_id = \\? ORDER BY id").
+					WithArgs(testOIDCUserID).
+					WillReturnRows(rows)
+			}
+			if test.wantStatus == http.StatusOK {
+				tt.mock.ExpectQuery("FROM user_identities WHERE id = \\? AND user_id = \\?").
+					WithArgs(3, testOIDCUserID).
+					WillReturnRows(sqlmock.NewRows(identityColumns).AddRow(identity(3)...))
+				tt.mock.ExpectExec("DELETE FROM user_identities WHERE id = \\? AND user_id = \\?").
+					WithArgs(3, testOIDCUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			w := tt.serve(httptest.NewRequest(http.MethodDelete, "/api/auth/oidc/identities/3", nil))
+			if w.Code != test.wantStatus {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body, test.wantStatus)
+			}
+			tt.checkExpectations(t)
+		})
+	}
+}
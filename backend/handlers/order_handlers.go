@@ -8,7 +8,11 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"web-security/backend/audit"
+	"web-security/backend/authz"
 	"web-security/backend/db"
+	"web-security/backend/fieldcrypt"
+	"web-security/backend/middleware"
 	"web-security/backend/models"
 
 	// "web-security/backend/redis_client" // For cart interactions later
@@ -21,7 +25,7 @@ import (
 func CreateOrder(c *gin.Context) {
 	var req models.OrderCreateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		respondBindError(c, "Invalid request payload", err)
 		return
 	}
 
@@ -97,6 +101,13 @@ func CreateOrder(c *gin.Context) {
 		})
 	}
 
+	// The shipping address is personal data and stored encrypted
+	encryptedAddress, err := fieldcrypt.Encrypt(fieldcrypt.OrderShippingAddress, req.ShippingAddress)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt shipping address: " + err.Error()})
+		return
+	}
+
 	// Create the order
 	orderStmt, err := tx.Prepare("INSERT INTO orders(order_number, user_id, subtotal, tax, shipping_cost, discount_amount, total_amount, payment_method, payment_status, order_status, shipping_address) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
@@ -115,7 +126,7 @@ func CreateOrder(c *gin.Context) {
 	shippingCost := 0.0
 	discountAmount := 0.0
 
-	res, err := orderStmt.Exec(orderNumber, req.UserID, subtotal, tax, shippingCost, discountAmount, totalAmount, paymentMethod, paymentStatus, orderStatus, req.ShippingAddress)
+	res, err := orderStmt.Exec(orderNumber, req.UserID, subtotal, tax, shippingCost, discountAmount, totalAmount, paymentMethod, paymentStatus, orderStatus, encryptedAddress)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order: " + err.Error()})
 		return
@@ -243,6 +254,10 @@ func GetOrdersByUserID(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan order row: " + err.Error()})
 			return
 		}
+		if shippingAddress, err = fieldcrypt.Decrypt(fieldcrypt.OrderShippingAddress, shippingAddress); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt shipping address: " + err.Error()})
+			return
+		}
 
 		// 创建前端期望格式的订单对象
 		order := map[string]interface{}{
@@ -323,45 +338,7 @@ func GetOrderByID(c *gin.Context) {
 		return
 	}
 
-	// Validate user ownership or admin access
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-
-	userRole, roleExists := c.Get("role")
-	if !roleExists {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User role not found"})
-		return
-	}
-
-	// Check if user is admin or owns the order
-	// Safe type assertion with error handling
-	role, ok := userRole.(string)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user role type"})
-		return
-	}
-
-	if role != "admin" {
-		// Verify order ownership for non-admin users
-		var orderOwnerID int
-		err = db.DB.QueryRow("SELECT user_id FROM orders WHERE id = ?", orderID).Scan(&orderOwnerID)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
-			}
-			return
-		}
-
-		if orderOwnerID != userID.(int) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied: You can only view your own orders"})
-			return
-		}
-	}
+	// Ownership is checked by middleware.RequireOwnership on the route
 
 	// 查询订单详情，包含更多字段
 	var (
@@ -397,6 +374,10 @@ func GetOrderByID(c *gin.Context) {
 		}
 		return
 	}
+	if shippingAddress, err = fieldcrypt.Decrypt(fieldcrypt.OrderShippingAddress, shippingAddress); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt shipping address: " + err.Error()})
+		return
+	}
 
 	// 创建前端期望格式的订单对象
 	order := map[string]interface{}{
@@ -519,26 +500,7 @@ func UpdateOrderStatus(c *gin.Context) {
 
 	var req models.OrderUpdateStatusRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
-		return
-	}
-
-	// Validate user permissions for status updates
-	userRole, roleExists := c.Get("role")
-	if !roleExists {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User role not found"})
-		return
-	}
-
-	// Safe type assertion with error handling
-	role, ok := userRole.(string)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user role type"})
-		return
-	}
-
-	if role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can update order status"})
+		respondBindError(c, "Invalid request payload", err)
 		return
 	}
 
@@ -558,6 +520,12 @@ func UpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
+	// Refunds move money, so they need their own permission on top of orders:update_status
+	if req.Status == "refunded" && !middleware.HasPermission(c, authz.OrdersRefund) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to refund orders", "permission": authz.OrdersRefund})
+		return
+	}
+
 	// Get current order status to validate transition
 	var currentStatus string
 	err = db.DB.QueryRow("SELECT order_status FROM orders WHERE id = ?", orderID).Scan(&currentStatus)
@@ -595,6 +563,13 @@ func UpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionOrderStatusChange,
+		TargetType: audit.TargetOrder,
+		TargetID:   strconv.Itoa(orderID),
+		Details:    map[string]interface{}{"from": currentStatus, "to": req.Status},
+	})
+
 	c.JSON(http.StatusOK, gin.H{"message": "Order status updated successfully", "order_id": orderID, "new_status": req.Status})
 }
 
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/db"
+	"web-security/backend/mail"
+	"web-security/backend/models"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// Mailer 发送邮件的实现，由InitMailer根据配置选择
+	Mailer mail.Sender = &mail.LogSender{}
+	// mailFrontendURL 邮件中链接指向的前端地址
+	mailFrontendURL = "http://localhost:3000"
+)
+
+// InitMailer 初始化邮件发送器和邮件链接使用的前端地址
+func InitMailer(sender mail.Sender, frontendURL string) {
+	Mailer = sender
+	mailFrontendURL = strings.TrimRight(frontendURL, "/")
+}
+
+// forgotPasswordMessage 无论邮箱是否存在都返回相同的提示，避免泄露账户是否注册
+const forgotPasswordMessage = "如果该邮箱已注册，我们已向其发送重置密码的链接"
+
+// ForgotPassword 申请重置密码，向注册邮箱发送一次性重置链接
+func ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	var user models.User
+	err := db.DB.QueryRow("SELECT id, username, email, account_status FROM users WHERE email = ?", req.Email).Scan(
+		&user.ID, &user.Username, &user.Email, &user.AccountStatus,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询错误: " + err.Error()})
+		return
+	}
+
+	if err == nil && user.AccountStatus == "active" {
+		// 在后台生成令牌并发送邮件，使响应时间与邮箱不存在时一致
+		go sendPasswordResetEmail(user)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": forgotPasswordMessage})
+}
+
+// sendPasswordResetEmail 生成重置令牌并通过邮件发送重置链接，失败只记录日志
+func sendPasswordResetEmail(user models.User) {
+	token, err := utils.CreatePasswordResetToken(user.ID)
+	if err != nil {
+		log.Printf("生成密码重置令牌失败(user_id=%d): %v", user.ID, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", mailFrontendURL, url.QueryEscape(token))
+	body := fmt.Sprintf("%s，您好：\n\n我们收到了重置您账户密码的请求。请在%d分钟内打开以下链接设置新密码，链接只能使用一次：\n\n%s\n\n如果这不是您本人的操作，请忽略此邮件，您的密码不会被修改。",
+		user.Username, int(utils.PasswordResetTokenExpiry.Minutes()), link)
+
+	err = Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "重置您的密码",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("发送密码重置邮件失败(user_id=%d): %v", user.ID, err)
+	}
+}
+
+// ResetPassword 使用重置令牌设置新密码，成功后该用户所有设备上的会话全部失效
+func ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	userID, err := utils.LookupPasswordResetToken(req.Token)
+	if err == utils.ErrInvalidResetToken {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "校验重置令牌失败: " + err.Error()})
+		return
+	}
+
+	// 先检查密码策略再消耗令牌，这样密码不符合要求时用户还可以继续使用同一个链接
+	var user models.User
+	err = db.DB.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&user.Username, &user.Email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.ErrInvalidResetToken.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询错误: " + err.Error()})
+		return
+	}
+	if err := utils.ValidatePassword(req.NewPassword, user.Username, user.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	consumedUserID, err := utils.ConsumePasswordResetToken(req.Token)
+	if err == utils.ErrInvalidResetToken || (err == nil && consumedUserID != userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.ErrInvalidResetToken.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "校验重置令牌失败: " + err.Error()})
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码哈希失败"})
+		return
+	}
+
+	// 重置链接发送到了账户的邮箱，能使用它说明用户控制着这个邮箱
+	now := time.Now()
+	result, err := db.DB.Exec(`
+		UPDATE users SET password_hash = ?, email_verified_at = COALESCE(email_verified_at, ?),
+		email_proven_at = COALESCE(email_proven_at, ?), updated_at = ?
+		WHERE id = ? AND account_status = 'active'
+	`, hashedPassword, now, now, now, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新密码失败: " + err.Error()})
+		return
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.ErrInvalidResetToken.Error()})
+		return
+	}
+
+	// 密码已更改，让所有已登录的设备重新登录
+	if err := utils.InvalidateUserTokens(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码已更新，但撤销会话失败: " + err.Error()})
+		return
+	}
+
+	utils.RecordSecurityEvent(utils.SecurityEvent{
+		Type:      utils.SecurityEventPasswordReset,
+		UserID:    userID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	audit.Record(c, audit.Event{
+		Action:      audit.ActionPasswordReset,
+		ActorUserID: userID,
+		TargetType:  audit.TargetUser,
+		TargetID:    strconv.Itoa(userID),
+	})
+
+	utils.ClearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "密码已重置，请使用新密码登录"})
+}
+
+// ChangePassword 已登录用户修改密码：需要验证当前密码，修改后所有设备上的会话失效，并为当前设备签发新的令牌对
+func ChangePassword(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	var user models.User
+	err := db.DB.QueryRow("SELECT id, username, email, password_hash, role, account_status, totp_enabled FROM users WHERE id = ?", userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role, &user.AccountStatus, &user.TOTPEnabled,
+	)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+
+	// 当前密码的校验与登录共用防暴力破解限制，避免拿到访问令牌后无限次猜测密码
+	wait, err := utils.CheckLoginAllowed(user.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "登录检查失败: " + err.Error()})
+		return
+	}
+	if wait > 0 {
+		respondLoginThrottled(c, wait)
+		return
+	}
+	if ok, _, err := utils.VerifyPassword(user.PasswordHash, req.CurrentPassword); err != nil || !ok {
+		recordLoginFailure(c, user.ID, user.Username, "invalid_current_password")
+		wait, err := utils.RegisterLoginFailure(user.ID, user.Username, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			log.Printf("记录登录失败次数失败: %v", err)
+		}
+		if wait >= utils.LoginLockoutDuration() {
+			respondLoginThrottled(c, wait)
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "当前密码不正确"})
+		return
+	}
+	_ = utils.ClearLoginFailures(user.Username)
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "新密码不能与当前密码相同"})
+		return
+	}
+	if err := utils.ValidatePassword(req.NewPassword, user.Username, user.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码哈希失败"})
+		return
+	}
+
+	_, err = db.DB.Exec("UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?", hashedPassword, time.Now(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新密码失败: " + err.Error()})
+		return
+	}
+
+	// 撤销所有会话（包括当前会话），旧密码下签发的令牌全部失效
+	if err := utils.InvalidateUserTokens(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码已更新，但撤销会话失败: " + err.Error()})
+		return
+	}
+
+	utils.RecordSecurityEvent(utils.SecurityEvent{
+		Type:      utils.SecurityEventPasswordChanged,
+		UserID:    user.ID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionPasswordChange,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+	})
+
+	// 当前设备使用新的会话继续保持登录
+	accessToken, refreshToken, ok := startSession(c, user)
+	if !ok {
+		return
+	}
+
+	response := gin.H{"message": "密码已修改，其他设备需要重新登录"}
+	if utils.TokensInResponseBody() {
+		response["access_token"] = accessToken
+		response["refresh_token"] = refreshToken
+	}
+	c.JSON(http.StatusOK, response)
+}
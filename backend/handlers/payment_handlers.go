@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
+	"web-security/backend/audit"
 	"web-security/backend/db"
 	"web-security/backend/models"
 	"web-security/backend/payment"
@@ -31,8 +33,8 @@ func CreatePaymentSession(c *gin.Context) {
 
 	// Fetch the order from the database
 	var order models.Order
-	err = db.DB.QueryRow("SELECT id, user_id, total_amount, order_status, shipping_address, created_at, updated_at FROM orders WHERE id = ?", orderID).Scan(
-		&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.ShippingAddress, &order.CreatedAt, &order.UpdatedAt,
+	err = db.DB.QueryRow("SELECT id, user_id, total_amount, order_status, created_at, updated_at FROM orders WHERE id = ?", orderID).Scan(
+		&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -100,6 +102,13 @@ func CreatePaymentSession(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionPaymentCheckout,
+		TargetType: audit.TargetOrder,
+		TargetID:   strconv.Itoa(orderID),
+		Details:    map[string]interface{}{"session_id": sessionID, "total_amount": order.TotalAmount},
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"payment_url": paymentURL,
 		"session_id":  sessionID,
@@ -107,7 +116,8 @@ func CreatePaymentSession(c *gin.Context) {
 	})
 }
 
-// HandlePaymentSuccess handles the webhook or callback from Stripe for successful payments
+// HandlePaymentSuccess confirms a payment when Stripe redirects the browser back after checkout.
+// The request is not authenticated; the order is found through the paid Stripe checkout session.
 func HandlePaymentSuccess(c *gin.Context) {
 	sessionID := c.Query("session_id")
 	if sessionID == "" {
@@ -128,48 +138,40 @@ func HandlePaymentSuccess(c *gin.Context) {
 		return
 	}
 
-	// 查找订单 - 首先尝试通过payment_intent_id查找
-	var orderID int
-	var tx *sql.Tx
-	var dbErr error
-	
-	tx, dbErr = db.DB.Begin()
-	if dbErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + dbErr.Error()})
+	// 回调不需要登录，只信任Stripe返回的结账会话：订单必须是创建这个会话的订单（payment_intent_id保存的是会话ID，
+	// 已确认过的订单保存的是支付意图ID），并且与会话元数据中的订单ID一致。不再接受查询参数中的orderID，
+	// 否则可以用自己已支付的会话把任意订单标记为已支付
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
 		return
 	}
-	
-	// 设置事务回滚
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+	defer tx.Rollback()
+
+	// 没有支付意图时交易ID就是会话ID，避免用空字符串匹配到其他订单
+	transactionID := paymentResult.TransactionID
+	if transactionID == "" {
+		transactionID = sessionID
+	}
 
-	// 首先尝试使用Session ID查找订单
-	err = tx.QueryRow("SELECT id FROM orders WHERE payment_intent_id = ?", sessionID).Scan(&orderID)
+	var (
+		orderID       int
+		paymentStatus sql.NullString
+	)
+	err = tx.QueryRow("SELECT id, payment_status FROM orders WHERE payment_intent_id IN (?, ?) FOR UPDATE",
+		sessionID, transactionID).Scan(&orderID, &paymentStatus)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found for this payment"})
+		return
+	}
 	if err != nil {
-		// 如果找不到，尝试使用支付意图ID查找
-		if err == sql.ErrNoRows && paymentResult.TransactionID != "" {
-			err = tx.QueryRow("SELECT id FROM orders WHERE payment_intent_id = ?", paymentResult.TransactionID).Scan(&orderID)
-		}
-		
-		// 如果还是找不到，尝试从URL查询参数中获取订单ID
-		if err == sql.ErrNoRows {
-			orderIDStr := c.Query("orderID")
-			if orderIDStr != "" {
-				if orderID, err = strconv.Atoi(orderIDStr); err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID in query parameter"})
-					return
-				}
-			} else {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Order not found for this payment"})
-				return
-			}
-		} else if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error finding order: " + err.Error()})
-			return
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error finding order: " + err.Error()})
+		return
+	}
+	if paymentResult.OrderID != strconv.Itoa(orderID) {
+		log.Printf("Stripe会话 %s 的订单 %q 与保存该会话的订单 %d 不一致", sessionID, paymentResult.OrderID, orderID)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found for this payment"})
+		return
 	}
 
 	// 计算支付金额（从分转换为元）
@@ -181,33 +183,44 @@ func HandlePaymentSuccess(c *gin.Context) {
 		paymentMethodDisplay = "card" // 默认为信用卡
 	}
 
-	// 更新订单状态和支付信息
-	_, err = tx.Exec(`
-		UPDATE orders 
-		SET order_status = ?, 
-		    payment_status = ?, 
-		    payment_method = ?,
-		    payment_intent_id = ?,
-		    updated_at = ? 
-		WHERE id = ?
-	`, 
-		"paid&processing", // 订单状态
-		"completed", // 支付状态
-		paymentMethodDisplay, // 支付方式
-		paymentResult.TransactionID, // 交易ID 
-		time.Now(), // 更新时间
-		orderID, // 订单ID
-	)
-	
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status: " + err.Error()})
-		return
-	}
+	// 浏览器可能多次打开成功页面，已确认过的订单只返回结果，不重复更新和记录审计事件
+	if paymentStatus.String != "completed" {
+		_, err = tx.Exec(`
+			UPDATE orders 
+			SET order_status = ?, 
+			    payment_status = ?, 
+			    payment_method = ?,
+			    payment_intent_id = ?,
+			    updated_at = ? 
+			WHERE id = ?
+		`,
+			"paid&processing",    // 订单状态
+			"completed",          // 支付状态
+			paymentMethodDisplay, // 支付方式
+			transactionID,        // 交易ID
+			time.Now(),           // 更新时间
+			orderID,              // 订单ID
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status: " + err.Error()})
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
+			return
+		}
 
-	// 提交事务
-	if err = tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
-		return 
+		audit.Record(c, audit.Event{
+			Action:     audit.ActionPaymentCompleted,
+			TargetType: audit.TargetOrder,
+			TargetID:   strconv.Itoa(orderID),
+			Details: map[string]interface{}{
+				"amount":         paymentAmount,
+				"payment_method": paymentMethodDisplay,
+				"transaction_id": transactionID,
+				"session_id":     sessionID,
+			},
+		})
 	}
 
 	// 返回成功信息，包含更多支付详情
@@ -217,7 +230,7 @@ func HandlePaymentSuccess(c *gin.Context) {
 		"status":         "paid",
 		"payment_amount": paymentAmount,
 		"payment_method": paymentMethodDisplay,
-		"transaction_id": paymentResult.TransactionID,
+		"transaction_id": transactionID,
 		"payment_time":   paymentResult.PaymentTime,
 	})
 }
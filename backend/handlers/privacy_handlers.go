@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"web-security/backend/audit"
+	"web-security/backend/db"
+	"web-security/backend/models"
+	"web-security/backend/privacy"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportMyData 导出当前用户的资料、订单、购物车、收藏、评价和第三方身份，默认返回ZIP，format=json时返回JSON
+func ExportMyData(c *gin.Context) {
+	userID := c.GetInt("userID")
+	format := c.DefaultQuery("format", "zip")
+	if format != "zip" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format只能是zip或json"})
+		return
+	}
+
+	export, err := privacy.ExportUserData(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "导出个人数据失败: " + err.Error()})
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionUserDataExport,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"format": format},
+	})
+
+	// 导出内容包含个人信息，不允许缓存
+	c.Header("Cache-Control", "no-store")
+	filename := fmt.Sprintf("user-%d-export-%s", userID, export.ExportedAt.Format("20060102-150405"))
+	if format == "json" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.JSON(http.StatusOK, export)
+		return
+	}
+
+	// 先写入内存，生成失败时还能返回错误
+	var buf bytes.Buffer
+	if err := export.WriteZip(&buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成导出文件失败: " + err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+// GetMyErasureRequest 查看当前用户最近一次注销申请
+func GetMyErasureRequest(c *gin.Context) {
+	request, err := privacy.LatestErasure(c.GetInt("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询注销申请失败: " + err.Error()})
+		return
+	}
+	if request == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "没有注销申请"})
+		return
+	}
+	c.JSON(http.StatusOK, request)
+}
+
+// RequestMyErasure 当前用户申请注销账户，需要再次输入密码。宽限期内可以撤销
+func RequestMyErasure(c *gin.Context) {
+	userID := c.GetInt("userID")
+	var req models.ErasureRequestBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	var passwordHash string
+	err := db.DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+	if ok, _, err := utils.VerifyPassword(passwordHash, req.Password); err != nil || !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "密码不正确"})
+		return
+	}
+
+	request, err := privacy.RequestErasure(userID, userID, req.Reason, false)
+	if err != nil {
+		respondErasureError(c, request, err)
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionUserErasureRequest,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"request_id": request.ID, "scheduled_for": request.ScheduledFor},
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "已收到注销申请，到期前可以撤销",
+		"request": request,
+	})
+}
+
+// CancelMyErasure 当前用户撤销待执行的注销申请
+func CancelMyErasure(c *gin.Context) {
+	userID := c.GetInt("userID")
+	request, err := privacy.CancelErasure(userID, userID)
+	if err != nil {
+		respondErasureError(c, nil, err)
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionUserErasureCancel,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"request_id": request.ID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "注销申请已撤销",
+		"request": request,
+	})
+}
+
+// AdminGetUserErasure 管理员查看用户最近一次注销申请
+func AdminGetUserErasure(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+	request, err := privacy.LatestErasure(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询注销申请失败: " + err.Error()})
+		return
+	}
+	if request == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "没有注销申请"})
+		return
+	}
+	c.JSON(http.StatusOK, request)
+}
+
+// AdminCancelUserErasure 管理员撤销用户待执行的注销申请
+func AdminCancelUserErasure(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+	request, err := privacy.CancelErasure(userID, c.GetInt("userID"))
+	if err != nil {
+		respondErasureError(c, nil, err)
+		return
+	}
+
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionUserErasureCancel,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"request_id": request.ID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "注销申请已撤销",
+		"request": request,
+	})
+}
+
+// respondErasureError 把注销流程的错误转换为响应，request不为nil时一并返回
+func respondErasureError(c *gin.Context, request *privacy.ErasureRequest, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, privacy.ErrUserNotFound), errors.Is(err, privacy.ErrNoPendingErasure):
+		status = http.StatusNotFound
+	case errors.Is(err, privacy.ErrAlreadyErased), errors.Is(err, privacy.ErrErasurePending):
+		status = http.StatusConflict
+	case errors.Is(err, privacy.ErrOrdersInProgress):
+		status = http.StatusAccepted
+	}
+	body := gin.H{"error": err.Error()}
+	if request != nil {
+		body["request"] = request
+	}
+	c.JSON(status, body)
+}
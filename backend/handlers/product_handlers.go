@@ -9,29 +9,30 @@ import (
 	"web-security/backend/models"
 
 	"github.com/gin-gonic/gin"
-	"github.com/microcosm-cc/bluemonday" // For XSS sanitization
 )
 
-var xssPolicy = bluemonday.UGCPolicy()
-
 // CreateProduct handles the creation of a new product.
 func CreateProduct(c *gin.Context) {
 	var req models.ProductCreate
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		respondBindError(c, "Invalid request payload", err)
 		return
 	}
 
-	// Sanitize content for XSS protection
-	sanitizedName := xssPolicy.Sanitize(req.Name)
-	sanitizedDescription := xssPolicy.Sanitize(req.Description)
-	
 	// Default values
 	if !req.IsActive {
 		req.IsActive = true // Products are active by default
 	}
 
-	stmt, err := db.DB.Prepare(`
+	// The product and its change record are committed together
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
 		INSERT INTO products(
 			name, description, price, discount_price, stock_quantity, 
 			category_id, image_main, images_gallery, sku, 
@@ -45,8 +46,8 @@ func CreateProduct(c *gin.Context) {
 	defer stmt.Close()
 
 	res, err := stmt.Exec(
-		sanitizedName, 
-		sanitizedDescription, 
+		req.Name,
+		req.Description,
 		req.Price, 
 		req.DiscountPrice, 
 		req.StockQuantity, 
@@ -67,7 +68,7 @@ func CreateProduct(c *gin.Context) {
 	
 	// Fetch the created product to return complete data including DB defaults
 	var product models.Product
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT id, name, description, price, discount_price, stock_quantity, 
 		category_id, image_main, images_gallery, sku, is_featured, is_active, 
 		view_count, tags, created_at, updated_at 
@@ -84,6 +85,16 @@ func CreateProduct(c *gin.Context) {
 		return
 	}
 
+	if err := recordCatalogChange(tx, c, catalogEntityProduct, product.ID, catalogActionCreate, nil, productSnapshot(product)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record product change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit product: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityProduct, product.ID, catalogActionCreate, nil, productSnapshot(product))
+
 	c.JSON(http.StatusCreated, product)
 }
 
@@ -228,17 +239,25 @@ func UpdateProduct(c *gin.Context) {
 
 	var req models.ProductUpdate
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		respondBindError(c, "Invalid request payload", err)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
 		return
 	}
+	defer tx.Rollback()
 
-	// Fetch current product to ensure it exists and to have default values
+	// Fetch current product to ensure it exists and to have default values.
+	// The row is locked so the "before" snapshot matches what this update overwrites.
 	var currentProduct models.Product
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT name, description, price, discount_price, stock_quantity, 
 		category_id, image_main, images_gallery, sku, is_featured, 
 		is_active, view_count, tags 
-		FROM products WHERE id = ?
+		FROM products WHERE id = ? FOR UPDATE
 	`, productID).Scan(
 		&currentProduct.Name, &currentProduct.Description, &currentProduct.Price,
 		&currentProduct.DiscountPrice, &currentProduct.StockQuantity, &currentProduct.CategoryID,
@@ -258,11 +277,11 @@ func UpdateProduct(c *gin.Context) {
 	// Apply updates using values from request or current values if not provided
 	nameToUpdate := currentProduct.Name
 	if req.Name != nil {
-		nameToUpdate = xssPolicy.Sanitize(*req.Name) // Sanitize Name for XSS
+		nameToUpdate = *req.Name
 	}
 	descriptionToUpdate := currentProduct.Description
 	if req.Description != nil {
-		descriptionToUpdate = xssPolicy.Sanitize(*req.Description) // Sanitize Description for XSS
+		descriptionToUpdate = *req.Description
 	}
 	priceToUpdate := currentProduct.Price
 	if req.Price != nil {
@@ -318,7 +337,7 @@ func UpdateProduct(c *gin.Context) {
 		WHERE id = ?
 	`
 
-	stmt, err := db.DB.Prepare(updateQuery)
+	stmt, err := tx.Prepare(updateQuery)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare update: " + err.Error()})
 		return
@@ -338,7 +357,7 @@ func UpdateProduct(c *gin.Context) {
 
 	// Fetch the updated product to show the result
 	var p models.Product
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		SELECT id, name, description, price, discount_price, stock_quantity, 
 		category_id, image_main, images_gallery, sku, is_featured, is_active, 
 		view_count, tags, created_at, updated_at 
@@ -354,6 +373,16 @@ func UpdateProduct(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product post-update: " + err.Error()})
 		return
 	}
+
+	if err := recordCatalogChange(tx, c, catalogEntityProduct, productID, catalogActionUpdate, productSnapshot(currentProduct), productSnapshot(p)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record product change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit product update: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityProduct, productID, catalogActionUpdate, productSnapshot(currentProduct), productSnapshot(p))
 	c.JSON(http.StatusOK, p)
 }
 
@@ -366,7 +395,37 @@ func DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	stmt, err := db.DB.Prepare("DELETE FROM products WHERE id = ?")
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// Keep a snapshot of the product being deleted for the change record
+	var product models.Product
+	err = tx.QueryRow(`
+		SELECT name, description, price, discount_price, stock_quantity, 
+		category_id, image_main, images_gallery, sku, is_featured, 
+		is_active, view_count, tags 
+		FROM products WHERE id = ? FOR UPDATE
+	`, productID).Scan(
+		&product.Name, &product.Description, &product.Price,
+		&product.DiscountPrice, &product.StockQuantity, &product.CategoryID,
+		&product.ImageMain, &product.ImagesGallery, &product.SKU,
+		&product.IsFeatured, &product.IsActive, &product.ViewCount,
+		&product.Tags,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found or already deleted"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error on fetch: " + err.Error()})
+		}
+		return
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM products WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare delete statement: " + err.Error()})
 		return
@@ -385,5 +444,15 @@ func DeleteProduct(c *gin.Context) {
 		return
 	}
 
+	if err := recordCatalogChange(tx, c, catalogEntityProduct, productID, catalogActionDelete, productSnapshot(product), nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record product change: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit product deletion: " + err.Error()})
+		return
+	}
+	auditCatalogChange(c, catalogEntityProduct, productID, catalogActionDelete, productSnapshot(product), nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
 }
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/authz"
+	"web-security/backend/db"
+	"web-security/backend/middleware"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListRoles 列出所有角色及其权限，以及可分配的权限列表
+func ListRoles(c *gin.Context) {
+	permissions, err := authz.ListPermissions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取权限列表失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"roles":       authz.ListRoles(),
+		"permissions": permissions,
+	})
+}
+
+// SetRolePermissions 替换角色的全部权限
+func SetRolePermissions(c *gin.Context) {
+	role := c.Param("role")
+
+	var req struct {
+		Permissions []string `json:"permissions" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+	// 不能把自己没有的权限授予任何角色，否则拥有users:roles的角色可以给自己加权限
+	if permission := firstMissingPermission(c, req.Permissions); permission != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能授予自己没有的权限", "permission": permission})
+		return
+	}
+
+	if err := authz.SetRolePermissions(role, req.Permissions); err != nil {
+		switch {
+		case errors.Is(err, authz.ErrUnknownRole):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, authz.ErrUnknownPermission), errors.Is(err, authz.ErrInvalidGrant):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新角色权限失败: " + err.Error()})
+		}
+		return
+	}
+
+	log.Printf("角色 %s 的权限已由用户 %d 更新为 %v", role, c.GetInt("userID"), req.Permissions)
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionRolePermissionsChange,
+		TargetType: audit.TargetRole,
+		TargetID:   role,
+		Details:    map[string]interface{}{"permissions": req.Permissions},
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "角色权限已更新",
+		"role":        role,
+		"permissions": req.Permissions,
+	})
+}
+
+// AdminSetUserRole 修改用户的角色。令牌中携带角色，修改后该用户的所有会话失效，重新登录后新角色生效。
+func AdminSetUserRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, "无效的请求数据", err)
+		return
+	}
+
+	// 防止管理员误操作撤销自己的权限
+	if userID == c.GetInt("userID") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能修改自己的角色"})
+		return
+	}
+	if !authz.RoleExists(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "角色不存在"})
+		return
+	}
+
+	// 只能分配自己拥有其全部权限的角色，例如拥有users:roles的运营角色不能把别人（或同伙）提升为admin
+	if permission := firstMissingPermission(c, authz.RolePermissions(req.Role)); permission != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能分配权限超出自己的角色", "permission": permission})
+		return
+	}
+
+	var previousRole string
+	err = db.DB.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&previousRole)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询用户失败: " + err.Error()})
+		}
+		return
+	}
+	// 同样不能修改权限超出自己的用户的角色（例如把管理员降级）
+	if permission := firstMissingPermission(c, authz.RolePermissions(previousRole)); permission != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能修改权限超出自己的用户的角色", "permission": permission})
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE users SET role = ?, updated_at = ? WHERE id = ?", req.Role, time.Now(), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新用户角色失败: " + err.Error()})
+		return
+	}
+
+	if previousRole != req.Role {
+		if err := utils.InvalidateUserTokens(userID); err != nil {
+			log.Printf("修改角色后撤销用户 %d 的会话失败: %v", userID, err)
+		}
+		utils.RecordSecurityEvent(utils.SecurityEvent{
+			Type:      utils.SecurityEventRoleChanged,
+			UserID:    userID,
+			IP:        c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Details: map[string]interface{}{
+				"from":       previousRole,
+				"to":         req.Role,
+				"changed_by": c.GetInt("userID"),
+			},
+		})
+		audit.Record(c, audit.Event{
+			Action:     audit.ActionUserRoleChange,
+			TargetType: audit.TargetUser,
+			TargetID:   strconv.Itoa(userID),
+			Details:    map[string]interface{}{"from": previousRole, "to": req.Role},
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "用户角色已更新",
+		"user_id": userID,
+		"role":    req.Role,
+	})
+}
+
+// firstMissingPermission 返回当前用户（或API密钥）没有的第一个权限，全部拥有时返回空字符串
+func firstMissingPermission(c *gin.Context, permissions []string) string {
+	for _, permission := range permissions {
+		if !middleware.HasPermission(c, permission) {
+			return permission
+		}
+	}
+	return ""
+}
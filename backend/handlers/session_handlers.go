@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"web-security/backend/db"
+	"web-security/backend/models"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListMySessions 获取当前用户在所有设备上的活跃会话
+func ListMySessions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+	currentSessionID, _ := c.Get("sessionID")
+
+	sessions, err := utils.ListUserSessions(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取会话列表失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": toSessionResponses(sessions, currentSessionID)})
+}
+
+// RevokeMySession 撤销当前用户的指定会话（例如注销丢失的手机）
+func RevokeMySession(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+
+	sessionID := c.Param("id")
+	session, err := utils.GetSession(sessionID)
+	if err == utils.ErrSessionNotFound || (err == nil && session.UserID != userID.(int)) {
+		// 不区分"不存在"和"不属于当前用户"，避免泄露其他用户的会话信息
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取会话失败: " + err.Error()})
+		return
+	}
+
+	if err := utils.RevokeSession(sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销会话失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "会话已撤销", "session_id": sessionID})
+}
+
+// RevokeOtherSessions 退出除当前设备以外的所有设备
+func RevokeOtherSessions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+		return
+	}
+	currentSessionID, _ := c.Get("sessionID")
+
+	if err := utils.InvalidateUserTokensExcept(userID.(int), currentSessionID.(string)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "退出其他设备失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "已退出其他所有设备"})
+}
+
+// AdminListUserSessions 管理员专用：查看指定用户的活跃会话
+func AdminListUserSessions(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	sessions, err := utils.ListUserSessions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取会话列表失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":  userID,
+		"sessions": toSessionResponses(sessions, nil),
+	})
+}
+
+// AdminRevokeUserSession 管理员专用：撤销指定用户的某个会话
+func AdminRevokeUserSession(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	sessionID := c.Param("sessionID")
+	session, err := utils.GetSession(sessionID)
+	if err == utils.ErrSessionNotFound || (err == nil && session.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取会话失败: " + err.Error()})
+		return
+	}
+
+	if err := utils.RevokeSession(sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销会话失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "会话已撤销",
+		"user_id":    userID,
+		"session_id": sessionID,
+	})
+}
+
+// AdminRevokeAllUserSessions 管理员专用：让指定用户在所有设备上退出登录，但不停用账户
+func AdminRevokeAllUserSessions(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	if err := utils.InvalidateUserTokens(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销会话失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "用户的所有会话已撤销",
+		"user_id": userID,
+	})
+}
+
+// toSessionResponses 将会话转换为响应格式，按最后活跃时间倒序排列
+func toSessionResponses(sessions []utils.Session, currentSessionID interface{}) []models.SessionResponse {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	responses := []models.SessionResponse{}
+	for _, session := range sessions {
+		responses = append(responses, models.SessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    currentSessionID != nil && session.ID == currentSessionID,
+		})
+	}
+	return responses
+}
+
+// AdminListUserSecurityEvents 管理员专用：查看指定用户最近的安全事件（如刷新令牌被重复使用）
+func AdminListUserSecurityEvents(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	events, err := utils.ListUserSecurityEvents(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取安全事件失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": userID,
+		"events":  events,
+	})
+}
+
+// AdminUnlockUserLogin 管理员专用：解除因多次登录失败而被锁定的账户
+func AdminUnlockUserLogin(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户ID"})
+		return
+	}
+
+	var username string
+	err = db.DB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+		return
+	}
+
+	unlocked, err := utils.UnlockLogin(userID, username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "解除锁定失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "登录锁定已解除",
+		"user_id":  userID,
+		"unlocked": unlocked,
+	})
+}
@@ -2,18 +2,21 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
+	"web-security/backend/audit"
+	"web-security/backend/authz"
 	"web-security/backend/db"
+	"web-security/backend/fieldcrypt"
 	"web-security/backend/models"
+	"web-security/backend/privacy"
+	"web-security/backend/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/microcosm-cc/bluemonday"
 )
 
-var profileSanitizer = bluemonday.UGCPolicy()
-
 // GetUserProfile 获取当前认证用户的完整资料
 func GetUserProfile(c *gin.Context) {
 	// 从上下文中获取用户ID（在AuthMiddleware中设置）
@@ -25,20 +28,21 @@ func GetUserProfile(c *gin.Context) {
 
 	// 使用指针变量来处理可能为NULL的值
 	var (
-		id int
+		id                                   int
 		username, email, role, accountStatus string
-		fullName, phone, address, city, stateProvince, zipPostalCode *string
-		lastLogin *time.Time
-		createdAt, updatedAt time.Time
+		fullName, stateProvince              *string
+		phone, address, city, zipPostalCode  sql.NullString // 加密保存
+		lastLogin, emailVerifiedAt           *time.Time
+		createdAt, updatedAt                 time.Time
 	)
 
 	// 根据用户ID查询完整的用户资料
 	err := db.DB.QueryRow(`
-		SELECT id, username, email, full_name, phone, address, city, state_province, zip_postal_code, role, 
+		SELECT id, username, email, email_verified_at, full_name, phone, address, city, state_province, zip_postal_code, role, 
 		last_login, account_status, created_at, updated_at 
 		FROM users WHERE id = ?
 	`, userID).Scan(
-		&id, &username, &email, &fullName, &phone, &address, &city, &stateProvince, &zipPostalCode,
+		&id, &username, &email, &emailVerifiedAt, &fullName, &phone, &address, &city, &stateProvince, &zipPostalCode,
 		&role, &lastLogin, &accountStatus, &createdAt, &updatedAt,
 	)
 
@@ -56,6 +60,7 @@ func GetUserProfile(c *gin.Context) {
 		ID:            id,
 		Username:      username,
 		Email:         email,
+		EmailVerified: emailVerifiedAt != nil,
 		Role:          role,
 		AccountStatus: accountStatus,
 		LastLogin:     lastLogin,
@@ -67,25 +72,33 @@ func GetUserProfile(c *gin.Context) {
 	if fullName != nil {
 		response.FullName = *fullName
 	}
-	if phone != nil {
-		response.Phone = *phone
-	}
-	if address != nil {
-		response.Address = *address
-	}
-	if city != nil {
-		response.City = *city
-	}
 	if stateProvince != nil {
 		response.StateProvince = *stateProvince
 	}
-	if zipPostalCode != nil {
-		response.ZipPostalCode = *zipPostalCode
+	if err := decryptProfile(&response, phone, address, city, zipPostalCode); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "解密用户资料失败: " + err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// decryptProfile 解密加密保存的个人信息字段，填入响应
+func decryptProfile(user *models.UserResponse, phone, address, city, zipPostalCode sql.NullString) error {
+	var err error
+	if user.Phone, err = fieldcrypt.DecryptNull(fieldcrypt.UserPhone, phone); err != nil {
+		return err
+	}
+	if user.Address, err = fieldcrypt.DecryptNull(fieldcrypt.UserAddress, address); err != nil {
+		return err
+	}
+	if user.City, err = fieldcrypt.DecryptNull(fieldcrypt.UserCity, city); err != nil {
+		return err
+	}
+	user.ZipPostalCode, err = fieldcrypt.DecryptNull(fieldcrypt.UserZipPostalCode, zipPostalCode)
+	return err
+}
+
 // UpdateUserProfile 更新当前认证用户的资料
 func UpdateUserProfile(c *gin.Context) {
 	// 从上下文中获取用户ID（在AuthMiddleware中设置）
@@ -95,27 +108,29 @@ func UpdateUserProfile(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		FullName      string `json:"full_name"`
-		Phone         string `json:"phone"`
-		Address       string `json:"address"`
-		City          string `json:"city"`
-		StateProvince string `json:"state_province"`
-		ZipPostalCode string `json:"zip_postal_code"`
-	}
-
+	var req models.ProfileUpdateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		respondBindError(c, "无效的请求数据", err)
 		return
 	}
 
-	// 净化用户输入
-	req.FullName = profileSanitizer.Sanitize(req.FullName)
-	req.Phone = profileSanitizer.Sanitize(req.Phone)
-	req.Address = profileSanitizer.Sanitize(req.Address)
-	req.City = profileSanitizer.Sanitize(req.City)
-	req.StateProvince = profileSanitizer.Sanitize(req.StateProvince)
-	req.ZipPostalCode = profileSanitizer.Sanitize(req.ZipPostalCode)
+	// 电话、地址、城市和邮编加密保存，电话另外保存盲索引用于查找
+	var encrypted [4]string
+	for i, field := range []struct {
+		col   fieldcrypt.Column
+		value string
+	}{
+		{fieldcrypt.UserPhone, req.Phone},
+		{fieldcrypt.UserAddress, req.Address},
+		{fieldcrypt.UserCity, req.City},
+		{fieldcrypt.UserZipPostalCode, req.ZipPostalCode},
+	} {
+		var err error
+		if encrypted[i], err = fieldcrypt.Encrypt(field.col, field.value); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "加密用户资料失败: " + err.Error()})
+			return
+		}
+	}
 
 	// 构建更新SQL语句
 	stmt, err := db.DB.Prepare(`
@@ -123,6 +138,7 @@ func UpdateUserProfile(c *gin.Context) {
 		SET 
 			full_name = ?, 
 			phone = ?, 
+			phone_bidx = ?,
 			address = ?,
 			city = ?,
 			state_province = ?,
@@ -138,7 +154,8 @@ func UpdateUserProfile(c *gin.Context) {
 
 	// 执行更新操作
 	now := time.Now()
-	_, err = stmt.Exec(req.FullName, req.Phone, req.Address, req.City, req.StateProvince, req.ZipPostalCode, now, userID)
+	_, err = stmt.Exec(req.FullName, encrypted[0], fieldcrypt.BlindIndex(fieldcrypt.UserPhone, req.Phone), encrypted[1], encrypted[2],
+		req.StateProvince, encrypted[3], now, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新用户资料失败: " + err.Error()})
 		return
@@ -178,14 +195,9 @@ func UpdateUserPreferences(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		Theme               string `json:"theme"`
-		NotificationsEnabled bool   `json:"notifications_enabled"`
-		Language            string `json:"language"`
-	}
-
+	var req models.PreferencesUpdateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		respondBindError(c, "无效的请求数据", err)
 		return
 	}
 
@@ -217,9 +229,22 @@ func ListAllUsers(c *gin.Context) {
 	
 	offset := (page - 1) * limit
 
+	// 电话加密保存，按盲索引精确查找
+	where := ""
+	args := []interface{}{}
+	if phone := c.Query("phone"); phone != "" {
+		index := fieldcrypt.BlindIndex(fieldcrypt.UserPhone, phone)
+		if !index.Valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的电话号码"})
+			return
+		}
+		where = "WHERE phone_bidx = ?"
+		args = append(args, index.String)
+	}
+
 	// 查询用户总数
 	var totalUsers int
-	err := db.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&totalUsers)
+	err := db.DB.QueryRow("SELECT COUNT(*) FROM users "+where, args...).Scan(&totalUsers)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户总数失败: " + err.Error()})
 		return
@@ -228,10 +253,10 @@ func ListAllUsers(c *gin.Context) {
 	// 查询用户列表（分页）
 	rows, err := db.DB.Query(`
 		SELECT id, username, email, full_name, role, account_status, created_at, last_login
-		FROM users
+		FROM users `+where+`
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
-	`, limit, offset)
+	`, append(args, limit, offset)...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户列表失败: " + err.Error()})
 		return
@@ -271,13 +296,14 @@ func GetUserByID(c *gin.Context) {
 	}
 
 	var user models.UserResponse
+	var phone, address sql.NullString
 	err = db.DB.QueryRow(`
 		SELECT id, username, email, full_name, phone, address, role, 
 		last_login, account_status, created_at, updated_at
 		FROM users WHERE id = ?
 	`, userID).Scan(
 		&user.ID, &user.Username, &user.Email, &user.FullName,
-		&user.Phone, &user.Address, &user.Role, &user.LastLogin,
+		&phone, &address, &user.Role, &user.LastLogin,
 		&user.AccountStatus, &user.CreatedAt, &user.UpdatedAt,
 	)
 
@@ -289,6 +315,10 @@ func GetUserByID(c *gin.Context) {
 		}
 		return
 	}
+	if err := decryptProfile(&user, phone, address, sql.NullString{}, sql.NullString{}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "解密用户资料失败: " + err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, user)
 }
@@ -306,7 +336,7 @@ func UpdateUserStatus(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		respondBindError(c, "无效的请求数据", err)
 		return
 	}
 
@@ -316,6 +346,29 @@ func UpdateUserStatus(c *gin.Context) {
 		return
 	}
 
+	// 防止管理员误操作停用自己的账户
+	if userID == c.GetInt("userID") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能修改自己的账户状态"})
+		return
+	}
+
+	// 记录修改前的状态，写入审计日志
+	var previousStatus, targetRole string
+	err = db.DB.QueryRow("SELECT account_status, role FROM users WHERE id = ?", userID).Scan(&previousStatus, &targetRole)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询用户失败: " + err.Error()})
+		}
+		return
+	}
+	// 不能停用权限超出自己的用户，例如拥有users:suspend的客服角色停用管理员
+	if permission := firstMissingPermission(c, authz.RolePermissions(targetRole)); permission != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能修改权限超出自己的用户的状态", "permission": permission})
+		return
+	}
+
 	// 更新用户状态
 	stmt, err := db.DB.Prepare("UPDATE users SET account_status = ?, updated_at = ? WHERE id = ?")
 	if err != nil {
@@ -337,10 +390,19 @@ func UpdateUserStatus(c *gin.Context) {
 		return
 	}
 
-	// 当用户被停用时，使其所有令牌无效（考虑安全性）
+	audit.Record(c, audit.Event{
+		Action:     audit.ActionUserStatusChange,
+		TargetType: audit.TargetUser,
+		TargetID:   strconv.Itoa(userID),
+		Details:    map[string]interface{}{"from": previousStatus, "to": req.Status},
+	})
+
+	// 当用户被停用时，使其所有会话失效（考虑安全性）
 	if req.Status == "suspended" || req.Status == "inactive" {
-		// 这里可以调用令牌黑名单逻辑，但简单起见，我们可以假设用户的令牌已被处理
-		// utils.InvalidateUserTokens(userID) // 理论上应该调用这个
+		if err := utils.InvalidateUserTokens(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "用户状态已更新，但撤销会话失败: " + err.Error()})
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -350,7 +412,8 @@ func UpdateUserStatus(c *gin.Context) {
 	})
 }
 
-// DeleteUser 管理员专用：删除用户
+// DeleteUser 管理员专用：注销用户。账户不直接删除，而是创建注销申请，宽限期结束后清除个人信息并保留订单；
+// immediate=true时跳过宽限期立即执行
 func DeleteUser(c *gin.Context) {
 	userID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -359,34 +422,57 @@ func DeleteUser(c *gin.Context) {
 	}
 
 	// 检查是否尝试删除自己（不允许）
-	currentUserID, _ := c.Get("userID")
-	if currentUserID.(int) == userID {
+	currentUserID := c.GetInt("userID")
+	if currentUserID == userID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "不能删除自己的账户"})
 		return
 	}
+	immediate := c.Query("immediate") == "true"
 
-	// 执行删除操作
-	stmt, err := db.DB.Prepare("DELETE FROM users WHERE id = ?")
+	// 注销后用户名会被替换，先取出需要写入审计日志的字段
+	var deletedUsername, deletedRole string
+	err = db.DB.QueryRow("SELECT username, role FROM users WHERE id = ?", userID).Scan(&deletedUsername, &deletedRole)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "准备删除语句失败: " + err.Error()})
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询用户失败: " + err.Error()})
+		}
 		return
 	}
-	defer stmt.Close()
-
-	result, err := stmt.Exec(userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除用户失败: " + err.Error()})
+	// 不能注销权限超出自己的用户
+	if permission := firstMissingPermission(c, authz.RolePermissions(deletedRole)); permission != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能注销权限超出自己的用户", "permission": permission})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+	request, err := privacy.RequestErasure(userID, currentUserID, "deleted by admin", immediate)
+	if request != nil && !errors.Is(err, privacy.ErrErasurePending) {
+		audit.Record(c, audit.Event{
+			Action:     audit.ActionUserErasureRequest,
+			TargetType: audit.TargetUser,
+			TargetID:   strconv.Itoa(userID),
+			Details: map[string]interface{}{
+				"username":      deletedUsername,
+				"role":          deletedRole,
+				"request_id":    request.ID,
+				"immediate":     immediate,
+				"scheduled_for": request.ScheduledFor,
+			},
+		})
+	}
+	if err != nil {
+		respondErasureError(c, request, err)
 		return
 	}
 
+	message := "已创建注销申请，宽限期结束后执行"
+	if request.Status == privacy.ErasureCompleted {
+		message = "用户已注销"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"message": "用户已成功删除",
+		"message": message,
 		"user_id": userID,
+		"request": request,
 	})
 }
@@ -0,0 +1,416 @@
+// Package iprules 按IP地址或CIDR网段允许或拒绝访问。规则保存在MySQL中，完整的规则列表缓存在Redis里，
+// 各实例在内存中保留一份副本，通过Redis中的版本号感知其他实例对规则的修改。
+package iprules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"web-security/backend/db"
+	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 规则的动作
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// 规则的作用范围
+const (
+	ScopeAll   = "all"   // 所有请求
+	ScopeAdmin = "admin" // 只作用于管理接口
+)
+
+const (
+	// Redis中缓存的规则列表和版本号
+	rulesCacheKey   = "ip_rules"
+	rulesVersionKey = "ip_rules:version"
+	// versionCheckInterval 检查版本号的间隔，其他实例修改的规则最多延迟这么久生效
+	versionCheckInterval = 5 * time.Second
+)
+
+// ErrInvalidRule 规则的IP、动作或范围无效
+var ErrInvalidRule = errors.New("无效的IP规则")
+
+// ErrRuleNotFound 规则不存在
+var ErrRuleNotFound = errors.New("IP规则不存在")
+
+// ErrCacheNotUpdated 规则的修改已经保存到数据库，但没能更新Redis中的缓存，
+// 其他实例要等到缓存重建后才能看到这次修改
+var ErrCacheNotUpdated = errors.New("IP规则已保存，但更新缓存失败")
+
+// Rule 一条IP规则
+type Rule struct {
+	ID        int64      `json:"id"`
+	CIDR      string     `json:"cidr"`
+	Action    string     `json:"action"`
+	Scope     string     `json:"scope"`
+	Reason    string     `json:"reason"`
+	CreatedBy *int       `json:"created_by,omitempty"` // 自动封禁的规则为空
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // 为空表示永久有效
+	CreatedAt time.Time  `json:"created_at"`
+
+	network *net.IPNet
+}
+
+// Expired 规则是否已经过期
+func (r *Rule) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// Config 描述IP规则的配置
+type Config struct {
+	// AdminAllowlistOnly 管理接口只允许来自scope为admin的allow规则中的IP访问
+	AdminAllowlistOnly bool
+	// AutoBanDuration 因登录暴力破解被锁定的IP自动封禁的时长，为0时不自动封禁
+	AutoBanDuration time.Duration
+	// TrustedProxies 可信代理的IP或CIDR，不会被自动封禁
+	TrustedProxies []string
+}
+
+var (
+	config = Config{AutoBanDuration: time.Hour}
+	// trustedProxies 解析后的可信代理网段
+	trustedProxies []*net.IPNet
+)
+
+var cache = struct {
+	sync.RWMutex
+	rules     []Rule
+	version   int64
+	checkedAt time.Time
+}{}
+
+// Init 设置配置并加载规则，服务启动时调用
+func Init(cfg Config) error {
+	config = cfg
+	trustedProxies = nil
+	for _, proxy := range cfg.TrustedProxies {
+		network, err := ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("无效的可信代理: %w", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	if err := refresh(true); err != nil {
+		return err
+	}
+	if cfg.AdminAllowlistOnly && !hasAdminAllowRules() {
+		log.Printf("警告: 已启用管理接口IP白名单，但没有任何scope为admin的allow规则，所有管理接口都将被拒绝")
+	}
+	return nil
+}
+
+// AdminAllowlistOnly 管理接口是否只允许白名单中的IP访问
+func AdminAllowlistOnly() bool {
+	return config.AdminAllowlistOnly
+}
+
+// Decision 对一个IP的判定结果
+type Decision struct {
+	Allowed bool
+	// Rule 起作用的规则，没有匹配的规则时为nil
+	Rule *Rule
+}
+
+// Check 判断IP能否访问指定范围的接口。同一范围内allow规则优先于deny规则，可以在封禁的网段中放行个别地址；
+// 管理接口同时受scope为all和admin的规则约束。启用管理接口白名单后，管理接口必须匹配scope为admin的allow规则。
+func Check(ip, scope string) Decision {
+	refreshIfStale()
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Decision{Allowed: !(scope == ScopeAdmin && config.AdminAllowlistOnly)}
+	}
+
+	now := time.Now()
+	var allow, deny, adminAllow, adminDeny *Rule
+	cache.RLock()
+	for i := range cache.rules {
+		rule := &cache.rules[i]
+		if rule.Expired(now) || !rule.network.Contains(parsed) {
+			continue
+		}
+		switch {
+		case rule.Scope == ScopeAll && rule.Action == ActionAllow && allow == nil:
+			allow = rule
+		case rule.Scope == ScopeAll && rule.Action == ActionDeny && deny == nil:
+			deny = rule
+		case rule.Scope == ScopeAdmin && rule.Action == ActionAllow && adminAllow == nil:
+			adminAllow = rule
+		case rule.Scope == ScopeAdmin && rule.Action == ActionDeny && adminDeny == nil:
+			adminDeny = rule
+		}
+	}
+	cache.RUnlock()
+
+	if deny != nil && allow == nil {
+		return Decision{Allowed: false, Rule: copyRule(deny)}
+	}
+	if scope != ScopeAdmin {
+		return Decision{Allowed: true, Rule: copyRule(allow)}
+	}
+
+	if adminAllow != nil {
+		return Decision{Allowed: true, Rule: copyRule(adminAllow)}
+	}
+	if adminDeny != nil {
+		return Decision{Allowed: false, Rule: copyRule(adminDeny)}
+	}
+	return Decision{Allowed: !config.AdminAllowlistOnly}
+}
+
+func copyRule(rule *Rule) *Rule {
+	if rule == nil {
+		return nil
+	}
+	copied := *rule
+	return &copied
+}
+
+// hasAdminAllowRules 是否存在有效的管理接口allow规则
+func hasAdminAllowRules() bool {
+	now := time.Now()
+	cache.RLock()
+	defer cache.RUnlock()
+	for _, rule := range cache.rules {
+		if rule.Scope == ScopeAdmin && rule.Action == ActionAllow && !rule.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDR 解析单个IP或CIDR网段，单个IP按/32或/128处理，返回规范化后的网段
+func ParseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %s不是有效的IP地址", ErrInvalidRule, value)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s不是有效的CIDR网段", ErrInvalidRule, value)
+	}
+	return network, nil
+}
+
+// Create 新建规则
+func Create(rule Rule) (*Rule, error) {
+	network, err := ParseCIDR(rule.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	rule.CIDR = network.String()
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return nil, fmt.Errorf("%w: action必须是allow或deny", ErrInvalidRule)
+	}
+	if rule.Scope == "" {
+		rule.Scope = ScopeAll
+	}
+	if rule.Scope != ScopeAll && rule.Scope != ScopeAdmin {
+		return nil, fmt.Errorf("%w: scope必须是all或admin", ErrInvalidRule)
+	}
+	if rule.ExpiresAt != nil && !rule.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: 过期时间必须晚于当前时间", ErrInvalidRule)
+	}
+	if len(rule.Reason) > 255 {
+		return nil, fmt.Errorf("%w: 原因不能超过255个字符", ErrInvalidRule)
+	}
+
+	rule.CreatedAt = time.Now()
+	res, err := db.DB.Exec(`INSERT INTO ip_rules (cidr, action, scope, reason, created_by, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rule.CIDR, rule.Action, rule.Scope, rule.Reason, rule.CreatedBy, rule.ExpiresAt, rule.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rule.ID, _ = res.LastInsertId()
+	rule.network = network
+
+	if err := publish(); err != nil {
+		return &rule, fmt.Errorf("%w: %v", ErrCacheNotUpdated, err)
+	}
+	return &rule, nil
+}
+
+// Delete 删除规则
+func Delete(id int64) error {
+	res, err := db.DB.Exec("DELETE FROM ip_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrRuleNotFound
+	}
+	if err := publish(); err != nil {
+		return fmt.Errorf("%w: %v", ErrCacheNotUpdated, err)
+	}
+	return nil
+}
+
+// List 列出规则，includeExpired为false时只返回仍然有效的规则
+func List(includeExpired bool) ([]Rule, error) {
+	query := "SELECT id, cidr, action, scope, reason, created_by, expires_at, created_at FROM ip_rules"
+	if !includeExpired {
+		query += " WHERE expires_at IS NULL OR expires_at > NOW()"
+	}
+	return queryRules(query + " ORDER BY id DESC")
+}
+
+// AutoBan 封禁因登录暴力破解被锁定的IP。白名单中的IP和已经被封禁的IP不会重复处理，
+// 可信代理和内网、回环地址也不会被封禁，否则经过它们的所有用户都会被拒绝访问。
+func AutoBan(ip, reason string) (*Rule, error) {
+	if config.AutoBanDuration <= 0 || !autoBannable(ip) {
+		return nil, nil
+	}
+	if decision := Check(ip, ScopeAll); !decision.Allowed || decision.Rule != nil {
+		return nil, nil
+	}
+	expiresAt := time.Now().Add(config.AutoBanDuration)
+	return Create(Rule{CIDR: ip, Action: ActionDeny, Scope: ScopeAll, Reason: reason, ExpiresAt: &expiresAt})
+}
+
+// autoBannable 判断IP是否可以被自动封禁
+func autoBannable(value string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryRules 查询规则并解析网段
+func queryRules(query string, args ...interface{}) ([]Rule, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		var rule Rule
+		var createdBy sql.NullInt64
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&rule.ID, &rule.CIDR, &rule.Action, &rule.Scope, &rule.Reason, &createdBy, &expiresAt, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			rule.CreatedBy = &id
+		}
+		if expiresAt.Valid {
+			rule.ExpiresAt = &expiresAt.Time
+		}
+		if rule.network, err = ParseCIDR(rule.CIDR); err != nil {
+			log.Printf("忽略无效的IP规则 %d: %v", rule.ID, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// publish 从数据库重新生成Redis中的规则列表并增加版本号，通知所有实例重新加载
+func publish() error {
+	rules, err := List(false)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pipe := redis_client.Rdb.TxPipeline()
+	pipe.Set(ctx, rulesCacheKey, data, 0)
+	version := pipe.Incr(ctx, rulesVersionKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	store(rules, version.Val())
+	return nil
+}
+
+// refreshIfStale 定期检查Redis中的版本号，版本变化时重新加载。加载失败时继续使用内存中的规则。
+func refreshIfStale() {
+	cache.RLock()
+	stale := time.Since(cache.checkedAt) > versionCheckInterval
+	cache.RUnlock()
+	if !stale {
+		return
+	}
+	if err := refresh(false); err != nil {
+		log.Printf("刷新IP规则失败，继续使用旧数据: %v", err)
+	}
+}
+
+// refresh 版本号变化或force为true时从Redis加载规则，Redis中没有缓存时从数据库加载并写入Redis
+func refresh(force bool) error {
+	ctx := context.Background()
+	cache.Lock()
+	cache.checkedAt = time.Now()
+	current := cache.version
+	cache.Unlock()
+
+	version, err := redis_client.Rdb.Get(ctx, rulesVersionKey).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if !force && err == nil && version == current {
+		return nil
+	}
+
+	data, err := redis_client.Rdb.Get(ctx, rulesCacheKey).Bytes()
+	if err == redis.Nil {
+		return publish()
+	}
+	if err != nil {
+		return err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return publish()
+	}
+	valid := rules[:0]
+	for _, rule := range rules {
+		if rule.network, err = ParseCIDR(rule.CIDR); err != nil {
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	store(valid, version)
+	return nil
+}
+
+// store 替换内存中的规则
+func store(rules []Rule, version int64) {
+	cache.Lock()
+	cache.rules = rules
+	cache.version = version
+	cache.checkedAt = time.Now()
+	cache.Unlock()
+}
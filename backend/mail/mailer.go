@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message represents an outgoing email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers email messages. Implementations can be swapped without touching the handlers.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// Supported mail drivers
+const (
+	DriverLog  = "log"
+	DriverFile = "file"
+)
+
+// NewSender creates a Sender for the configured driver
+func NewSender(driver, outboxDir string) (Sender, error) {
+	switch driver {
+	case DriverLog, "":
+		return &LogSender{}, nil
+	case DriverFile:
+		return NewFileSender(outboxDir)
+	default:
+		return nil, fmt.Errorf("unsupported mail driver: %s", driver)
+	}
+}
+
+// LogSender writes messages to the application log. Intended for local development only.
+type LogSender struct{}
+
+// Send logs the message
+func (s *LogSender) Send(msg Message) error {
+	log.Printf("[mail] to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileSender writes every message to its own file in an outbox directory
+type FileSender struct {
+	dir string
+}
+
+// NewFileSender creates a FileSender, creating the outbox directory if necessary
+func NewFileSender(dir string) (*FileSender, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("mail outbox directory is not configured")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create mail outbox: %w", err)
+	}
+	return &FileSender{dir: dir}, nil
+}
+
+// Send writes the message to <outbox>/<timestamp>-<recipient>.eml
+func (s *FileSender) Send(msg Message) error {
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(msg.To)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), recipient)
+
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		msg.To, msg.Subject, time.Now().Format(time.RFC1123Z), msg.Body)
+
+	// Messages may contain secrets such as reset links, so keep them private to the service user
+	return os.WriteFile(filepath.Join(s.dir, name), []byte(content), 0o600)
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"web-security/backend/audit"
+	"web-security/backend/authz"
 	"web-security/backend/config"
 	"web-security/backend/db"
+	"web-security/backend/fieldcrypt"
 	"web-security/backend/handlers"
+	"web-security/backend/iprules"
+	"web-security/backend/mail"
+	"web-security/backend/middleware"
+	"web-security/backend/notify"
+	"web-security/backend/oidc"
+	"web-security/backend/privacy"
+	"web-security/backend/sanitize"
+	"web-security/backend/utils"
 
 	"github.com/gin-gonic/gin"
 
@@ -26,13 +43,192 @@ func main() {
 	db.InitMySQL(cfg.DBSource)
 	defer db.CloseMySQL()
 
+	// Roles and permissions are stored in MySQL
+	if err := authz.Init(); err != nil {
+		log.Fatalf("Could not load roles and permissions: %v", err)
+	}
+
+	// Keys for the encrypted personal data columns
+	err = fieldcrypt.Init(fieldcrypt.Config{
+		MasterKey:     cfg.FieldEncryptionMasterKey,
+		MasterKeyFile: cfg.FieldEncryptionMasterKeyFile,
+		OldMasterKeys: strings.Split(cfg.FieldEncryptionOldMasterKeys, ","),
+	})
+	if err != nil {
+		log.Fatalf("Could not load field encryption keys: %v", err)
+	}
+
 	// Initialize Redis client
 	redis_client.InitRedis(cfg.RedisAddress, cfg.RedisPassword, cfg.RedisDB)
 	defer redis_client.CloseRedis() // Added defer to close Redis connection
 
+	// Load IP allow/deny rules into the Redis cache
+	err = iprules.Init(iprules.Config{
+		AdminAllowlistOnly: cfg.IPAdminAllowlistOnly,
+		AutoBanDuration:    cfg.IPAutoBanDuration,
+		TrustedProxies:     trustedProxies(cfg.TrustedProxies),
+	})
+	if err != nil {
+		log.Fatalf("Could not load IP rules: %v", err)
+	}
+
+	// Account erasure requests are executed in the background once their grace period is over
+	err = privacy.Init(privacy.Config{
+		GracePeriod:   cfg.ErasureGracePeriod,
+		CheckInterval: cfg.ErasureCheckInterval,
+	})
+	if err != nil {
+		log.Fatalf("Could not start account erasure: %v", err)
+	}
+
+	// Load JWT signing and verification keys
+	err = utils.InitJWTKeys(utils.JWTKeyConfig{
+		Algorithm:        cfg.JWTSigningAlgorithm,
+		SigningKeyID:     cfg.JWTSigningKeyID,
+		PrivateKeyFile:   cfg.JWTPrivateKeyFile,
+		Secret:           cfg.JWTSecret,
+		VerificationKeys: strings.Split(cfg.JWTVerificationKeys, ","),
+		RetiredKeyIDs:    strings.Split(cfg.JWTRetiredKeyIDs, ","),
+	})
+	if err != nil {
+		log.Fatalf("Could not load JWT keys: %v", err)
+	}
+
+	// Password policy applied on registration, reset and change
+	err = utils.InitPasswordPolicy(utils.PasswordPolicyConfig{
+		MinLength:        cfg.PasswordMinLength,
+		MaxLength:        cfg.PasswordMaxLength,
+		BreachedListFile: cfg.PasswordBreachedListFile,
+	})
+	if err != nil {
+		log.Fatalf("Could not load password policy: %v", err)
+	}
+
+	// Hash algorithm for new passwords, older hashes are upgraded on login
+	err = utils.InitPasswordHasher(utils.PasswordHashConfig{
+		Algorithm:         cfg.PasswordHashAlgorithm,
+		Argon2Memory:      cfg.PasswordArgon2MemoryKiB,
+		Argon2Iterations:  cfg.PasswordArgon2Iterations,
+		Argon2Parallelism: cfg.PasswordArgon2Parallelism,
+		BcryptCost:        cfg.PasswordBcryptCost,
+	})
+	if err != nil {
+		log.Fatalf("Could not configure password hashing: %v", err)
+	}
+	// Logins for unknown usernames take as long as logins for accounts on each hash cost still in use
+	if err := handlers.RefreshPasswordTimingProfiles(time.Hour); err != nil {
+		log.Fatalf("Could not load password hash profiles: %v", err)
+	}
+
+	// Attributes of the auth cookies
+	err = utils.InitAuthCookies(utils.CookieConfig{
+		Secure:     cfg.CookieSecure,
+		HTTPOnly:   cfg.CookieHTTPOnly,
+		SameSite:   cfg.CookieSameSite,
+		Domain:     cfg.CookieDomain,
+		CookieOnly: cfg.AuthCookieOnly,
+		CSRFSecret: cfg.CSRFSecret,
+	})
+	if err != nil {
+		log.Fatalf("Could not configure auth cookies: %v", err)
+	}
+
+	// Brute-force protection for login
+	utils.InitLoginThrottle(utils.LoginThrottleConfig{
+		MaxUserFailures: cfg.LoginMaxFailuresPerUser,
+		MaxIPFailures:   cfg.LoginMaxFailuresPerIP,
+		FailureWindow:   cfg.LoginFailureWindow,
+		LockoutDuration: cfg.LoginLockoutDuration,
+		OnIPLocked:      lockedIPHandler(cfg.IPAutoBanEnabled),
+	})
+
+	// Unusual login detection
+	err = utils.InitLoginRisk(utils.LoginRiskConfig{
+		Enabled:             cfg.LoginRiskEnabled,
+		StepUp:              cfg.LoginRiskStepUp,
+		GeoIPFile:           cfg.LoginRiskGeoIPFile,
+		MaxTravelSpeedKmh:   cfg.LoginRiskMaxTravelSpeedKmh,
+		MinTravelDistanceKm: cfg.LoginRiskMinTravelDistanceKm,
+		SharedIPMaxAccounts: cfg.LoginRiskSharedIPMaxAccounts,
+		SharedIPWindow:      cfg.LoginRiskSharedIPWindow,
+		HistoryTTL:          cfg.LoginRiskHistoryTTL,
+	})
+	if err != nil {
+		log.Fatalf("Could not configure login risk detection: %v", err)
+	}
+
+	// Per route group rate limits, must be loaded before the routes are registered
+	err = middleware.InitRateLimits(map[string]string{
+		"auth":     cfg.RateLimitAuth,
+		"session":  cfg.RateLimitSession,
+		"pre_auth": cfg.RateLimitPreAuth,
+		"payments": cfg.RateLimitPayments,
+		"catalog":  cfg.RateLimitCatalog,
+		"default":  cfg.RateLimitDefault,
+		"api_key":  cfg.RateLimitAPIKey,
+	})
+	if err != nil {
+		log.Fatalf("Could not load rate limits: %v", err)
+	}
+
+	// Security headers sent with every response
+	err = middleware.InitSecurityHeaders(middleware.SecurityHeadersConfig{
+		CSP:                   cfg.SecurityCSP,
+		CSPReportOnly:         cfg.SecurityCSPReportOnly,
+		CSPReportURI:          cfg.SecurityCSPReportURI,
+		HSTSMaxAge:            cfg.SecurityHSTSMaxAge,
+		HSTSIncludeSubdomains: cfg.SecurityHSTSIncludeSubdomains,
+		HSTSPreload:           cfg.SecurityHSTSPreload,
+		FrameOptions:          cfg.SecurityFrameOptions,
+		ReferrerPolicy:        cfg.SecurityReferrerPolicy,
+		PermissionsPolicy:     cfg.SecurityPermissionsPolicy,
+	})
+	if err != nil {
+		log.Fatalf("Could not configure security headers: %v", err)
+	}
+
+	// Two-factor authentication policy
+	handlers.InitMFAPolicy(cfg.MFAIssuer, cfg.MFARequiredForAdmins)
+
+	// Email verification for new accounts
+	if err := utils.InitEmailVerification(cfg.EmailVerificationRequired, cfg.EmailVerificationSecret); err != nil {
+		log.Fatalf("Could not initialize email verification: %v", err)
+	}
+
+	// Initialize mail sender used for password reset and verification emails
+	mailSender, err := mail.NewSender(cfg.MailDriver, cfg.MailOutboxDir)
+	if err != nil {
+		log.Fatalf("Could not initialize mail sender: %v", err)
+	}
+	handlers.InitMailer(mailSender, cfg.FrontendURL)
+
+	// Alerts about unusual logins, delivered by mail by default
+	loginNotifier, err := notify.NewNotifier(cfg.LoginAlertNotifier, mailSender)
+	if err != nil {
+		log.Fatalf("Could not initialize login notifier: %v", err)
+	}
+	handlers.InitLoginNotifier(loginNotifier)
+
+	// OpenID Connect providers for social and enterprise login, discovery is fetched on first use
+	oidcProviders := make([]oidc.ProviderConfig, 0, len(cfg.OIDCProviders))
+	for _, provider := range cfg.OIDCProviders {
+		oidcProviders = append(oidcProviders, oidc.ProviderConfig{
+			Name:         provider.Name,
+			DisplayName:  provider.DisplayName,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  provider.RedirectURL,
+			Scopes:       provider.Scopes,
+			TrustEmail:   provider.TrustEmail,
+		})
+	}
+	if err := oidc.Init(oidcProviders); err != nil {
+		log.Fatalf("Could not configure OIDC providers: %v", err)
+	}
+
 	// Initialize Stripe payment processor
-	frontendURL := "http://localhost:3000" // Frontend URL for payment callbacks
-	handlers.InitPaymentProcessor(cfg.StripeAPIKey, frontendURL)
+	handlers.InitPaymentProcessor(cfg.StripeAPIKey, cfg.FrontendURL) // Frontend URL for payment callbacks
 
 	// Set Gin mode (release, debug, test)
 	ginMode := os.Getenv("GIN_MODE")
@@ -41,29 +237,36 @@ func main() {
 	}
 	gin.SetMode(ginMode)
 
-	router := gin.Default()
+	// Request bodies are sanitized according to their sanitize struct tags while binding
+	sanitize.Install()
 
-	// 为所有请求添加CORS头的自定义中间件
-	router.Use(func(c *gin.Context) {
-		// 获取请求源
-		origin := c.Request.Header.Get("Origin")
-		
-		// 允许所有来源 - 在开发环境中通常这是安全的
-		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Type")
-		c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24小时
-
-		// 如果是OPTIONS请求，直接返回200 OK
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
-		}
+	router := gin.Default()
+	// Only trust X-Forwarded-For from configured proxies so ClientIP cannot be spoofed
+	if err := router.SetTrustedProxies(trustedProxies(cfg.TrustedProxies)); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	// Request IDs tie log lines and audit entries to a single request
+	router.Use(middleware.RequestID())
+	// Reject banned IPs before any other work is done
+	router.Use(middleware.IPFilter())
 
-		c.Next()
-	})
+	// CORS allowlist, registered on the router so preflight requests for any path are answered
+	corsPolicy := middleware.CORSPolicy{
+		AllowedOrigins:        strings.Split(cfg.CORSAllowedOrigins, ","),
+		AllowedOriginPatterns: strings.Split(cfg.CORSAllowedOriginPatterns, ","),
+		AllowCredentials:      cfg.CORSAllowCredentials,
+		MaxAge:                cfg.CORSMaxAge,
+	}
+	corsOverrides, err := middleware.ParseCORSOverrides(cfg.CORSGroupOverrides, corsPolicy)
+	if err != nil {
+		log.Fatalf("Could not load CORS overrides: %v", err)
+	}
+	corsHandler, err := middleware.CORS(middleware.CORSConfig{Default: corsPolicy, Overrides: corsOverrides})
+	if err != nil {
+		log.Fatalf("Could not configure CORS: %v", err)
+	}
+	router.Use(corsHandler)
+	router.Use(middleware.SecurityHeaders())
 
 	// 配置静态文件服务
 	router.Static("/product-images", "./static/product-images") // 提供产品图片访问
@@ -75,8 +278,16 @@ func main() {
 		})
 	})
 
+	// Public signing keys, so other services can verify our tokens without a shared secret
+	router.GET("/.well-known/jwks.json", handlers.GetJWKS)
+
+	// CSP violation reports, outside the /api group because browsers do not send the CSRF header
+	routes.SetupSecurityRoutes(router.Group("/api/security"))
+
 	// Setup routes
 	api := router.Group("/api")
+	// Requests authenticated by cookie must echo the CSRF token in the X-CSRF-Token header
+	api.Use(middleware.CSRFMiddleware())
 	// 添加新的认证路由
 	routes.SetupAuthRoutes(api.Group("/auth"))
 	routes.SetupUserRoutes(api.Group("/users"))
@@ -85,14 +296,68 @@ func main() {
 	routes.SetupOrderRoutes(api.Group("/orders"))
 	routes.SetupPaymentRoutes(api.Group("/payments"))
 	routes.SetupCartRoutes(api.Group("/cart")) // 添加购物车路由
+	routes.SetupAuditRoutes(api.Group("/audit"))
+	routes.SetupIPRuleRoutes(api.Group("/ip-rules"))
+	routes.SetupAPIKeyRoutes(api.Group("/api-keys"))
 
 	// Start server
 	serverAddr := cfg.ServerAddress
 	if serverAddr == "" {
 		serverAddr = ":8080" // Default port if not in config
 	}
-	log.Printf("Server starting on %s", serverAddr)
-	if err := router.Run(serverAddr); err != nil {
-		log.Fatalf("Failed to run server: %v", err)
+	server := &http.Server{Addr: serverAddr, Handler: router}
+	go func() {
+		log.Printf("Server starting on %s", serverAddr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to run server: %v", err)
+		}
+	}()
+
+	// Shut down gracefully so queued audit events are written before the database connection closes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+	if err := audit.Close(shutdownCtx); err != nil {
+		log.Printf("Failed to flush audit log: %v", err)
+	}
+}
+
+// lockedIPHandler returns the hook run when an IP is locked out for login brute-force.
+// With IP_AUTO_BAN_ENABLED the IP is banned from all endpoints, not only login
+func lockedIPHandler(autoBan bool) func(ip string) {
+	if !autoBan {
+		return nil
+	}
+	return func(ip string) {
+		rule, err := iprules.AutoBan(ip, "登录失败次数过多")
+		if err != nil {
+			log.Printf("Failed to auto-ban IP %s: %v", ip, err)
+			return
+		}
+		if rule != nil {
+			utils.RecordSecurityEvent(utils.SecurityEvent{
+				Type:    utils.SecurityEventIPBanned,
+				IP:      ip,
+				Details: map[string]interface{}{"rule_id": rule.ID, "expires_at": rule.ExpiresAt},
+			})
+		}
+	}
+}
+
+// trustedProxies parses TRUSTED_PROXIES, an empty value trusts no proxy
+func trustedProxies(value string) []string {
+	var proxies []string
+	for _, proxy := range strings.Split(value, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
 	}
+	return proxies
 }
@@ -1,34 +1,46 @@
 package middleware
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"strings"
+	"web-security/backend/apikeys"
+	"web-security/backend/authz"
 	"web-security/backend/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware 验证请求中的JWT访问令牌
+// AuthMiddleware 验证请求中的JWT访问令牌，或者X-API-Key头中的API密钥
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 从Authorization头获取令牌
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "需要认证令牌"})
-			c.Abort()
+		if c.GetHeader(apikeys.Header) != "" {
+			authenticateAPIKey(c)
 			return
 		}
 
-		// 检查Authorization头的格式
-		parts := strings.SplitN(authHeader, " ", 2)
-		if !(len(parts) == 2 && parts[0] == "Bearer") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "认证令牌格式无效"})
+		// 优先从Authorization头获取令牌，没有时使用HttpOnly的access_token Cookie
+		tokenString := ""
+		authHeader := c.GetHeader("Authorization")
+		if authHeader != "" {
+			// 检查Authorization头的格式
+			parts := strings.SplitN(authHeader, " ", 2)
+			if !(len(parts) == 2 && parts[0] == "Bearer") {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "认证令牌格式无效"})
+				c.Abort()
+				return
+			}
+			tokenString = parts[1]
+		} else if cookie, err := c.Cookie(utils.AccessTokenCookie); err == nil {
+			tokenString = cookie
+		}
+		if tokenString == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "需要认证令牌"})
 			c.Abort()
 			return
 		}
 
-		tokenString := parts[1]
-
 		// 检查令牌是否在黑名单中
 		blacklisted, err := utils.IsTokenBlacklisted(tokenString)
 		if err != nil {
@@ -50,48 +62,137 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 验证令牌是否在Redis中并且是最新的
-		valid, err := utils.ValidateTokenInRedis(claims.UserID, tokenString, true)
-		if err != nil || !valid {
+		// 验证令牌所属的会话是否有效，并且令牌是该会话最新签发的
+		session, err := utils.ValidateTokenInRedis(claims, tokenString, true)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "令牌已失效，请重新登录"})
 			c.Abort()
 			return
 		}
 
+		// 更新会话的最后活跃时间，失败不影响本次请求
+		_ = utils.TouchSession(session, c.ClientIP())
+
 		// 将用户信息设置到上下文中，以便后续的处理器使用
 		c.Set("userID", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("role", claims.Role)
 		c.Set("userRole", claims.Role) // 为了兼容性，同时设置 userRole
+		c.Set("sessionID", claims.SessionID)
+		c.Set("accessToken", tokenString)
 
 		c.Next()
 	}
 }
 
-// AdminAuthMiddleware 验证用户是否具有管理员角色
-func AdminAuthMiddleware() gin.HandlerFunc {
+// authenticateAPIKey 验证API密钥。密钥不对应任何用户，上下文中没有userID，
+// 只能访问由RequirePermission按权限范围放行的接口，操作者以"api_key:<前缀>"记录
+func authenticateAPIKey(c *gin.Context) {
+	if c.GetHeader("Authorization") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能同时使用API密钥和认证令牌"})
+		c.Abort()
+		return
+	}
+
+	key, err := apikeys.Authenticate(c.GetHeader(apikeys.Header), c.ClientIP())
+	if errors.Is(err, apikeys.ErrInvalidKey) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证API密钥时出错"})
+		c.Abort()
+		return
+	}
+
+	c.Set("apiKey", key)
+	c.Set("username", key.Actor())
+	c.Set("role", authz.RoleAPIKey)
+	c.Next()
+}
+
+// HasPermission 判断当前请求是否拥有权限：API密钥按密钥的权限范围判断，用户按角色判断
+func HasPermission(c *gin.Context, permission string) bool {
+	if value, ok := c.Get("apiKey"); ok {
+		return value.(*apikeys.APIKey).HasScope(permission)
+	}
+	return authz.HasPermission(c.GetString("role"), permission)
+}
+
+// RequirePermission 要求当前用户的角色（或者API密钥的权限范围）拥有全部指定的权限，需要放在AuthMiddleware之后
+func RequirePermission(permissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 先通过普通认证中间件
-		AuthMiddleware()(c)
-		if c.IsAborted() {
+		role := c.GetString("role")
+		if role == "" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户角色时出错"})
+			c.Abort()
 			return
 		}
 
-		// 检查用户角色
-		role, exists := c.Get("role")
-		if !exists {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户角色时出错"})
+		for _, permission := range permissions {
+			if !HasPermission(c, permission) {
+				log.Printf("权限不足: user=%d actor=%s role=%s permission=%s %s %s",
+					c.GetInt("userID"), c.GetString("username"), role, permission, c.Request.Method, c.FullPath())
+				c.JSON(http.StatusForbidden, gin.H{"error": "权限不足", "permission": permission})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// MFAPendingMiddleware 验证两步验证等待令牌（mfa_pending），只用于登录的第二步
+func MFAPendingMiddleware() gin.HandlerFunc {
+	return pendingLoginMiddleware(utils.ValidateMFAPendingToken, "mfaPending", "两步验证令牌")
+}
+
+// LoginStepUpMiddleware 验证异常登录的二次验证令牌（login_step_up），只用于提交邮件验证码
+func LoginStepUpMiddleware() gin.HandlerFunc {
+	return pendingLoginMiddleware(utils.ValidateLoginStepUpToken, "stepUpPending", "二次验证令牌")
+}
+
+// pendingLoginMiddleware 验证登录过程中签发的一次性等待令牌，flag为写入上下文的标记，name用于错误提示
+func pendingLoginMiddleware(validate func(string) (*utils.Claims, error), flag, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		parts := strings.SplitN(authHeader, " ", 2)
+		if !(len(parts) == 2 && parts[0] == "Bearer") {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "需要" + name})
+			c.Abort()
+			return
+		}
+		tokenString := parts[1]
+
+		// 已使用过的等待令牌会被加入黑名单
+		blacklisted, err := utils.IsTokenBlacklisted(tokenString)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "验证令牌时出错"})
+			c.Abort()
+			return
+		}
+		if blacklisted {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": name + "已失效，请重新登录"})
 			c.Abort()
 			return
 		}
 
-		// 验证用户是否为管理员
-		if role != "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "需要管理员权限"})
+		claims, err := validate(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的" + name + ": " + err.Error()})
 			c.Abort()
 			return
 		}
 
+		c.Set("userID", claims.UserID)
+		c.Set("username", claims.Username)
+		c.Set("role", claims.Role)
+		c.Set(flag, true)
+		c.Set("mfaClaims", claims)
+		c.Set("mfaToken", tokenString)
+
 		c.Next()
 	}
 }
@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORSPolicy 描述一组路由的跨域策略
+type CORSPolicy struct {
+	// AllowedOrigins 精确匹配的来源，例如"https://shop.example.com"；"*"表示允许任意来源，但此时不允许携带凭据
+	AllowedOrigins []string
+	// AllowedOriginPatterns 通配符来源，"*"只匹配一段子域名或端口，例如"https://*.example.com"、"http://localhost:*"
+	AllowedOriginPatterns []string
+	// AllowCredentials 是否允许携带Cookie等凭据
+	AllowCredentials bool
+	// MaxAge 预检请求结果的缓存时间
+	MaxAge time.Duration
+}
+
+// CORSConfig 描述全局跨域策略和按路由前缀覆盖的策略
+type CORSConfig struct {
+	Default CORSPolicy
+	// Overrides 键为路径前缀（例如"/api/products"），按最长前缀匹配
+	Overrides map[string]CORSPolicy
+}
+
+var (
+	corsAllowMethods  = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsAllowHeaders  = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With", "X-CSRF-Token", "X-Request-ID"}
+	corsExposeHeaders = []string{
+		"Content-Length", "Content-Type",
+		"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After",
+		"X-Request-ID",
+	}
+)
+
+// corsRoute 路径前缀及其对应的CORS处理函数
+type corsRoute struct {
+	prefix  string
+	handler gin.HandlerFunc
+}
+
+// CORS 返回按配置生成的跨域中间件，需要注册在路由器上（而不是路由组上），这样没有匹配路由的预检请求也能得到处理。
+// 被拒绝的来源会返回403并记录日志。
+func CORS(cfg CORSConfig) (gin.HandlerFunc, error) {
+	defaultHandler, err := newCORSHandler("default", cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]corsRoute, 0, len(cfg.Overrides))
+	for prefix, policy := range cfg.Overrides {
+		handler, err := newCORSHandler(prefix, policy)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, corsRoute{prefix: strings.TrimRight(prefix, "/"), handler: handler})
+	}
+	// 最长前缀优先
+	sort.Slice(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		for _, route := range routes {
+			if path == route.prefix || strings.HasPrefix(path, route.prefix+"/") {
+				route.handler(c)
+				return
+			}
+		}
+		defaultHandler(c)
+	}, nil
+}
+
+// newCORSHandler 基于gin-contrib/cors为一个策略创建处理函数
+func newCORSHandler(name string, policy CORSPolicy) (gin.HandlerFunc, error) {
+	config := cors.Config{
+		AllowMethods:     corsAllowMethods,
+		AllowHeaders:     corsAllowHeaders,
+		ExposeHeaders:    corsExposeHeaders,
+		AllowCredentials: policy.AllowCredentials,
+		MaxAge:           policy.MaxAge,
+	}
+
+	allowAll := false
+	exact := map[string]bool{}
+	for _, origin := range policy.AllowedOrigins {
+		origin = strings.TrimSpace(origin)
+		switch {
+		case origin == "":
+			continue
+		case origin == "*":
+			allowAll = true
+		default:
+			normalized, err := normalizeOrigin(origin)
+			if err != nil {
+				return nil, fmt.Errorf("CORS策略 %s: %w", name, err)
+			}
+			exact[normalized] = true
+		}
+	}
+
+	var patterns []string
+	for _, pattern := range policy.AllowedOriginPatterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if strings.Count(pattern, "*") != 1 || !strings.Contains(pattern, "://") {
+			return nil, fmt.Errorf("CORS策略 %s: 无效的来源通配符 %q", name, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if allowAll {
+		// 允许任意来源时浏览器不接受携带凭据的响应，这里直接关闭凭据
+		if policy.AllowCredentials {
+			return nil, fmt.Errorf("CORS策略 %s: 允许任意来源时不能同时允许携带凭据", name)
+		}
+		config.AllowAllOrigins = true
+		return cors.New(config), nil
+	}
+
+	config.AllowOriginWithContextFunc = func(c *gin.Context, origin string) bool {
+		normalized := strings.ToLower(origin)
+		if exact[normalized] {
+			return true
+		}
+		for _, pattern := range patterns {
+			if matchOriginPattern(pattern, normalized) {
+				return true
+			}
+		}
+		log.Printf("拒绝跨域请求: origin=%s method=%s path=%s policy=%s ip=%s",
+			origin, c.Request.Method, c.Request.URL.Path, name, c.ClientIP())
+		return false
+	}
+	return cors.New(config), nil
+}
+
+// normalizeOrigin 校验并规范化来源，来源只能包含协议、主机和端口
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", fmt.Errorf("无效的来源 %q，格式应为 scheme://host[:port]", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// matchOriginPattern 匹配通配符来源，"*"只能匹配一段不包含"."、"/"、":"和"@"的内容，
+// 因此"https://*.example.com"不会匹配"https://a.b.example.com"或"https://evil.com/.example.com"
+func matchOriginPattern(pattern, origin string) bool {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "./:@")
+}
+
+// ParseCORSOverrides 解析按路由前缀覆盖的来源配置，格式为"前缀=来源1,来源2;前缀=来源"，
+// 来源中包含"*"且不是单独的"*"时视为通配符
+func ParseCORSOverrides(spec string, base CORSPolicy) (map[string]CORSPolicy, error) {
+	overrides := map[string]CORSPolicy{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, origins, found := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("无效的CORS覆盖配置 %q，格式应为 /路径前缀=来源1,来源2", entry)
+		}
+
+		policy := CORSPolicy{AllowCredentials: base.AllowCredentials, MaxAge: base.MaxAge}
+		for _, origin := range strings.Split(origins, ",") {
+			origin = strings.TrimSpace(origin)
+			switch {
+			case origin == "":
+				continue
+			case origin == "*":
+				// 公开接口，允许任意来源但不携带凭据
+				policy.AllowedOrigins = append(policy.AllowedOrigins, origin)
+				policy.AllowCredentials = false
+			case strings.Contains(origin, "*"):
+				policy.AllowedOriginPatterns = append(policy.AllowedOriginPatterns, origin)
+			default:
+				policy.AllowedOrigins = append(policy.AllowedOrigins, origin)
+			}
+		}
+		overrides[prefix] = policy
+	}
+	return overrides, nil
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"web-security/backend/apikeys"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSRFMiddleware 双重提交Cookie方式的CSRF防护。
+// 通过Cookie认证的状态变更请求（POST、PUT、PATCH、DELETE）必须在X-CSRF-Token请求头中回传csrf_token Cookie的值，
+// 并且令牌必须绑定到认证Cookie所属的会话。
+// 使用Authorization头或X-API-Key头认证的请求不受浏览器自动携带Cookie的影响，不需要CSRF令牌。
+func CSRFMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		if !usesCookieAuth(c) {
+			c.Next()
+			return
+		}
+
+		cookieToken, err := c.Cookie(utils.CSRFTokenCookie)
+		headerToken := c.GetHeader(utils.CSRFHeader)
+		if err != nil || cookieToken == "" || headerToken == "" ||
+			subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 ||
+			!csrfTokenBoundToSession(c, headerToken) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "CSRF令牌无效或缺失"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// csrfTokenBoundToSession 检查CSRF令牌是否绑定到认证Cookie所属的会话，认证Cookie无效时一律拒绝
+func csrfTokenBoundToSession(c *gin.Context, token string) bool {
+	sessionID := utils.CookieSessionID(c)
+	return sessionID != "" && utils.ValidCSRFToken(token, sessionID)
+}
+
+// usesCookieAuth 判断请求是否依赖浏览器自动携带的认证Cookie
+func usesCookieAuth(c *gin.Context) bool {
+	if c.GetHeader("Authorization") != "" || c.GetHeader(apikeys.Header) != "" {
+		return false
+	}
+	for _, name := range []string{utils.AccessTokenCookie, utils.RefreshTokenCookie} {
+		if value, err := c.Cookie(name); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+	"web-security/backend/db"
+	"web-security/backend/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireVerifiedEmail 要求当前用户已验证邮箱，需要放在AuthMiddleware之后。
+// 未开启邮箱验证时直接放行。
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !utils.EmailVerificationRequired() {
+			c.Next()
+			return
+		}
+
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "用户未认证"})
+			c.Abort()
+			return
+		}
+
+		var verifiedAt *time.Time
+		err := db.DB.QueryRow("SELECT email_verified_at FROM users WHERE id = ?", userID).Scan(&verifiedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取用户信息失败: " + err.Error()})
+			c.Abort()
+			return
+		}
+		if verifiedAt == nil {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "请先验证邮箱地址",
+				"code":  "email_not_verified",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
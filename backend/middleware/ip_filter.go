@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"web-security/backend/iprules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPFilter 拒绝被IP规则封禁的客户端，注册在路由器上，对所有请求生效
+func IPFilter() gin.HandlerFunc {
+	return ipRuleCheck(iprules.ScopeAll)
+}
+
+// AdminIPAllowlist 管理接口的IP检查：除了全局规则，还要满足scope为admin的规则，
+// 启用白名单模式后只有白名单中的IP可以访问
+func AdminIPAllowlist() gin.HandlerFunc {
+	return ipRuleCheck(iprules.ScopeAdmin)
+}
+
+func ipRuleCheck(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decision := iprules.Check(c.ClientIP(), scope)
+		if !decision.Allowed {
+			ruleID := int64(0)
+			if decision.Rule != nil {
+				ruleID = decision.Rule.ID
+			}
+			log.Printf("IP规则拒绝访问: ip=%s scope=%s rule=%d path=%s", c.ClientIP(), scope, ruleID, c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, gin.H{"error": "访问被拒绝"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"web-security/backend/apikeys"
+	"web-security/backend/redis_client"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// 限流算法
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+// 限流维度
+const (
+	RateLimitByIP    = "ip"    // 按客户端IP
+	RateLimitByUser  = "user"  // 按登录用户或API密钥，未登录时退回到IP，需要放在AuthMiddleware之后
+	RateLimitByRoute = "route" // 按路由，所有客户端共享同一个配额
+)
+
+// rateLimitPrefix 限流键前缀，键为"ratelimit:策略名:维度:值"
+const rateLimitPrefix = "ratelimit:"
+
+// rateLimitSeq 用于生成滑动窗口中唯一的成员
+var rateLimitSeq atomic.Uint64
+
+// RateLimitPolicy 描述一个命名的限流策略
+type RateLimitPolicy struct {
+	Name      string
+	Algorithm string
+	Limit     int           // 窗口内允许的请求数（令牌桶的容量）
+	Window    time.Duration // 统计窗口（令牌桶补满所需的时间）
+	KeyBy     string
+}
+
+// 默认策略，可以通过配置覆盖
+var rateLimitPolicies = map[string]*RateLimitPolicy{
+	"auth": {Name: "auth", Algorithm: RateLimitSlidingWindow, Limit: 20, Window: time.Minute, KeyBy: RateLimitByIP},
+	// session 刷新令牌、获取CSRF令牌和会话管理，正常使用时调用频繁，未登录时按IP计数
+	"session": {Name: "session", Algorithm: RateLimitTokenBucket, Limit: 120, Window: time.Minute, KeyBy: RateLimitByUser},
+	// pre_auth 放在AuthMiddleware之前按IP计数，限制无效令牌的请求，配额应大于单个API密钥的配额
+	"pre_auth": {Name: "pre_auth", Algorithm: RateLimitTokenBucket, Limit: 1200, Window: time.Minute, KeyBy: RateLimitByIP},
+	"payments": {Name: "payments", Algorithm: RateLimitSlidingWindow, Limit: 10, Window: time.Minute, KeyBy: RateLimitByUser},
+	"catalog":  {Name: "catalog", Algorithm: RateLimitTokenBucket, Limit: 300, Window: time.Minute, KeyBy: RateLimitByIP},
+	"default":  {Name: "default", Algorithm: RateLimitTokenBucket, Limit: 120, Window: time.Minute, KeyBy: RateLimitByUser},
+	// api_key 使用API密钥的请求不使用路由上的策略，而是按密钥单独计数，密钥可以设置自己的配额
+	"api_key": {Name: "api_key", Algorithm: RateLimitTokenBucket, Limit: 600, Window: time.Minute, KeyBy: RateLimitByUser},
+}
+
+// InitRateLimits 根据配置覆盖限流策略，specs的键为策略名，值的格式为"次数/窗口[,算法][,维度]"，
+// 例如"20/1m"或"300/1m,token_bucket,ip"。值为空时保留默认策略，未指定的算法和维度沿用默认值。
+func InitRateLimits(specs map[string]string) error {
+	for name, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		policy, err := ParseRateLimitPolicy(name, spec, *rateLimitPolicy(name))
+		if err != nil {
+			return err
+		}
+		rateLimitPolicies[name] = policy
+	}
+	return nil
+}
+
+// ParseRateLimitPolicy 解析"次数/窗口[,算法][,维度]"格式的限流策略，未指定的部分使用base中的值
+func ParseRateLimitPolicy(name, spec string, base RateLimitPolicy) (*RateLimitPolicy, error) {
+	parts := strings.Split(spec, ",")
+	policy := &RateLimitPolicy{Name: name, Algorithm: base.Algorithm, KeyBy: base.KeyBy}
+
+	rate := strings.SplitN(strings.TrimSpace(parts[0]), "/", 2)
+	if len(rate) != 2 {
+		return nil, fmt.Errorf("无效的限流配置 %q (策略 %s)，格式应为 次数/窗口", spec, name)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(rate[0]))
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("无效的限流次数 %q (策略 %s)", rate[0], name)
+	}
+	window, err := time.ParseDuration(strings.TrimSpace(rate[1]))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("无效的限流窗口 %q (策略 %s)", rate[1], name)
+	}
+	policy.Limit = limit
+	policy.Window = window
+
+	if len(parts) > 1 {
+		policy.Algorithm = strings.TrimSpace(parts[1])
+		if policy.Algorithm != RateLimitTokenBucket && policy.Algorithm != RateLimitSlidingWindow {
+			return nil, fmt.Errorf("不支持的限流算法 %q (策略 %s)", policy.Algorithm, name)
+		}
+	}
+	if len(parts) > 2 {
+		policy.KeyBy = strings.TrimSpace(parts[2])
+		if policy.KeyBy != RateLimitByIP && policy.KeyBy != RateLimitByUser && policy.KeyBy != RateLimitByRoute {
+			return nil, fmt.Errorf("不支持的限流维度 %q (策略 %s)", policy.KeyBy, name)
+		}
+	}
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("无效的限流配置 %q (策略 %s)", spec, name)
+	}
+	return policy, nil
+}
+
+// tokenBucketScript 令牌桶：按时间匀速补充令牌，每个请求消耗一个令牌。
+// 使用Redis服务器时间，多个实例之间不受本地时钟偏差影响。
+// 返回 {是否允许, 剩余令牌, 补满所需毫秒数, 需要等待的毫秒数}
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local rate = capacity / window_ms
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil then
+  tokens = capacity
+  ts = now
+end
+
+tokens = math.min(capacity, tokens + (now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window_ms)
+local reset = math.ceil((capacity - tokens) / rate)
+return {allowed, math.floor(tokens), reset, wait}
+`)
+
+// slidingWindowScript 滑动窗口：记录窗口内每个请求的时间戳，超过上限时拒绝。
+// 返回 {是否允许, 剩余次数, 窗口内最早的请求过期所需毫秒数, 需要等待的毫秒数}
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local member = ARGV[3]
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window_ms)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', KEYS[1], now, member)
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window_ms)
+
+local reset = window_ms
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] ~= nil then
+  reset = math.max(0, tonumber(oldest[2]) + window_ms - now)
+end
+local wait = 0
+if allowed == 0 then
+  wait = reset
+end
+return {allowed, limit - count, reset, wait}
+`)
+
+// RateLimit 返回使用指定命名策略的限流中间件，响应中带有X-RateLimit-*头。
+// Redis不可用时放行请求并记录日志，避免限流故障导致整个服务不可用。
+// 没有单独配置策略的名字（通常是路由组名）沿用默认策略的配额，但按自己的名字计数，各组的配额互不占用。
+func RateLimit(name string) gin.HandlerFunc {
+	policy := rateLimitPolicy(name)
+
+	return func(c *gin.Context) {
+		policy := policy
+		if value, ok := c.Get("apiKey"); ok {
+			policy = apiKeyRateLimitPolicy(value.(*apikeys.APIKey))
+		}
+		key := rateLimitKey(c, policy)
+
+		var (
+			result []int64
+			err    error
+		)
+		switch policy.Algorithm {
+		case RateLimitSlidingWindow:
+			// 有序集合的成员必须唯一，同一毫秒内的多个请求也要分别计数
+			member := strconv.FormatInt(time.Now().UnixNano(), 36) + ":" + strconv.FormatUint(rateLimitSeq.Add(1), 36)
+			result, err = slidingWindowScript.Run(context.Background(), redis_client.Rdb, []string{key},
+				policy.Limit, policy.Window.Milliseconds(), member).Int64Slice()
+		default:
+			result, err = tokenBucketScript.Run(context.Background(), redis_client.Rdb, []string{key},
+				policy.Limit, policy.Window.Milliseconds()).Int64Slice()
+		}
+		if err != nil || len(result) != 4 {
+			log.Printf("限流策略 %s 暂时不可用，放行请求: %v", policy.Name, err)
+			c.Next()
+			return
+		}
+
+		allowed, remaining, resetMs, waitMs := result[0] == 1, result[1], result[2], result[3]
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(policy.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(millisToSeconds(resetMs)))
+		c.Header("X-RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int(policy.Window.Seconds())))
+
+		if !allowed {
+			retryAfter := millisToSeconds(waitMs)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       "请求过于频繁，请稍后再试",
+				"retry_after": retryAfter,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimitPolicy 返回命名策略，没有单独配置时复制默认策略并使用该名字作为限流键的一部分
+func rateLimitPolicy(name string) *RateLimitPolicy {
+	if policy, ok := rateLimitPolicies[name]; ok {
+		return policy
+	}
+	policy := *rateLimitPolicies["default"]
+	policy.Name = name
+	return &policy
+}
+
+// rateLimitKey 根据策略的维度生成限流键
+func rateLimitKey(c *gin.Context, policy *RateLimitPolicy) string {
+	switch policy.KeyBy {
+	case RateLimitByRoute:
+		return rateLimitPrefix + policy.Name + ":route:" + c.Request.Method + " " + c.FullPath()
+	case RateLimitByUser:
+		if value, ok := c.Get("apiKey"); ok {
+			return fmt.Sprintf("%s%s:api_key:%d", rateLimitPrefix, policy.Name, value.(*apikeys.APIKey).ID)
+		}
+		if userID, exists := c.Get("userID"); exists {
+			return fmt.Sprintf("%s%s:user:%v", rateLimitPrefix, policy.Name, userID)
+		}
+	}
+	return rateLimitPrefix + policy.Name + ":ip:" + c.ClientIP()
+}
+
+// apiKeyRateLimitPolicy 返回API密钥使用的限流策略，密钥设置了配额时替换策略中的次数
+func apiKeyRateLimitPolicy(key *apikeys.APIKey) *RateLimitPolicy {
+	policy := rateLimitPolicies["api_key"]
+	if key.RateLimit > 0 && key.RateLimit != policy.Limit {
+		copied := *policy
+		copied.Limit = key.RateLimit
+		return &copied
+	}
+	return policy
+}
+
+// millisToSeconds 毫秒向上取整为秒，至少为1秒
+func millisToSeconds(ms int64) int {
+	seconds := int(math.Ceil(float64(ms) / 1000))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader 携带请求ID的请求头和响应头
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey 请求上下文中保存请求ID的键
+const requestIDKey = "requestID"
+
+// maxRequestIDLength 接受的客户端请求ID的最大长度
+const maxRequestIDLength = 64
+
+// RequestID 为每个请求分配请求ID，写入上下文和响应头，便于把日志、审计记录和客户端报错对应起来。
+// 前置代理或客户端传入了合法的X-Request-ID时沿用它，否则生成新的ID。
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// GetRequestID 返回本次请求的请求ID
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// validRequestID 只接受长度有限的字母、数字、"-"和"_"，避免把任意内容写进日志和审计记录
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID 生成128位随机请求ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -20,10 +20,10 @@ type Category struct {
 
 // CategoryCreate represents the data needed to create a new category
 type CategoryCreate struct {
-	Name         string `json:"name" binding:"required,min=2,max=50"`
-	Description  string `json:"description,omitempty"`
-	Icon         string `json:"icon,omitempty"`
-	Image        string `json:"image,omitempty"`
+	Name         string `json:"name" binding:"required,min=2,max=50" sanitize:"text"`
+	Description  string `json:"description,omitempty" sanitize:"text"`
+	Icon         string `json:"icon,omitempty" sanitize:"text"`
+	Image        string `json:"image,omitempty" sanitize:"url"`
 	DisplayOrder int    `json:"display_order"`
 	ParentID     *int   `json:"parent_id,omitempty"`
 	IsFeatured   bool   `json:"is_featured"`
@@ -31,10 +31,10 @@ type CategoryCreate struct {
 
 // CategoryUpdate represents the data needed to update an existing category
 type CategoryUpdate struct {
-	Name         *string `json:"name,omitempty"` // Pointer to allow partial updates
-	Description  *string `json:"description,omitempty"`
-	Icon         *string `json:"icon,omitempty"`
-	Image        *string `json:"image,omitempty"`
+	Name         *string `json:"name,omitempty" sanitize:"text"` // Pointer to allow partial updates
+	Description  *string `json:"description,omitempty" sanitize:"text"`
+	Icon         *string `json:"icon,omitempty" sanitize:"text"`
+	Image        *string `json:"image,omitempty" sanitize:"url"`
 	DisplayOrder *int    `json:"display_order,omitempty"`
 	ParentID     *int    `json:"parent_id,omitempty"`
 	IsFeatured   *bool   `json:"is_featured,omitempty"`
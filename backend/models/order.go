@@ -38,7 +38,7 @@ type OrderItem struct {
 // OrderCreateRequest represents the data needed to create a new order
 type OrderCreateRequest struct {
 	UserID          int                `json:"user_id" binding:"required"` // Usually obtained from authenticated user context
-	ShippingAddress string             `json:"shipping_address" binding:"required"`
+	ShippingAddress string             `json:"shipping_address" binding:"required,max=1000" sanitize:"text"`
 	Items           []OrderItemRequest `json:"items" binding:"required,dive"` // dive validates each element in the slice
 }
 
@@ -50,5 +50,5 @@ type OrderItemRequest struct {
 
 // OrderUpdateStatusRequest represents the data needed to update an order's status
 type OrderUpdateStatusRequest struct {
-	Status string `json:"status" binding:"required"`
+	Status string `json:"status" binding:"required" sanitize:"text"`
 }
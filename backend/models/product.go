@@ -26,33 +26,33 @@ type Product struct {
 
 // ProductCreate represents the data needed to create a new product
 type ProductCreate struct {
-	Name          string   `json:"name" binding:"required,min=3,max=100"`
-	Description   string   `json:"description"`
+	Name          string   `json:"name" binding:"required,min=3,max=100" sanitize:"text"`
+	Description   string   `json:"description" sanitize:"html"`
 	Price         float64  `json:"price" binding:"required,gt=0"`
 	DiscountPrice *float64 `json:"discount_price,omitempty"`
 	StockQuantity int      `json:"stock_quantity" binding:"required,gte=0"`
 	CategoryID    int      `json:"category_id" binding:"required,gt=0"`
-	ImageMain     string   `json:"image_main,omitempty"`
-	ImagesGallery string   `json:"images_gallery,omitempty"`
-	SKU           string   `json:"sku,omitempty"`
+	ImageMain     string   `json:"image_main,omitempty" sanitize:"url"`
+	ImagesGallery string   `json:"images_gallery,omitempty" sanitize:"text"`
+	SKU           string   `json:"sku,omitempty" sanitize:"text"`
 	IsFeatured    bool     `json:"is_featured"`
 	IsActive      bool     `json:"is_active" binding:"required"`
-	Tags          string   `json:"tags,omitempty"`
+	Tags          string   `json:"tags,omitempty" sanitize:"text"`
 }
 
 // ProductUpdate represents the data needed to update an existing product
 type ProductUpdate struct {
-	Name          *string  `json:"name,omitempty"` // Pointers to allow partial updates
-	Description   *string  `json:"description,omitempty"`
+	Name          *string  `json:"name,omitempty" sanitize:"text"` // Pointers to allow partial updates
+	Description   *string  `json:"description,omitempty" sanitize:"html"`
 	Price         *float64 `json:"price,omitempty"`
 	DiscountPrice *float64 `json:"discount_price,omitempty"`
 	StockQuantity *int     `json:"stock_quantity,omitempty"`
 	CategoryID    *int     `json:"category_id,omitempty"`
-	ImageMain     *string  `json:"image_main,omitempty"`
-	ImagesGallery *string  `json:"images_gallery,omitempty"`
-	SKU           *string  `json:"sku,omitempty"`
+	ImageMain     *string  `json:"image_main,omitempty" sanitize:"url"`
+	ImagesGallery *string  `json:"images_gallery,omitempty" sanitize:"text"`
+	SKU           *string  `json:"sku,omitempty" sanitize:"text"`
 	IsFeatured    *bool    `json:"is_featured,omitempty"`
 	IsActive      *bool    `json:"is_active,omitempty"`
 	ViewCount     *int     `json:"view_count,omitempty"`
-	Tags          *string  `json:"tags,omitempty"`
+	Tags          *string  `json:"tags,omitempty" sanitize:"text"`
 }
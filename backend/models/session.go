@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// SessionResponse represents a login session (one per device) sent back in responses
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // Whether this is the session making the request
+}
@@ -20,20 +20,23 @@ type User struct {
 	LastLogin     *time.Time `json:"last_login"`
 	AccountStatus string     `json:"account_status"` // 'active', 'inactive', 'suspended'
 	RefreshToken  string     `json:"-"` // Not exposed in JSON responses
+	TOTPSecret    string     `json:"-"` // Base32 TOTP secret, never exposed
+	TOTPEnabled   bool       `json:"totp_enabled"`
+	MFARequired   bool       `json:"mfa_required"` // Whether the user must use two-factor authentication
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
 // UserRegister represents the data needed for user registration
 type UserRegister struct {
-	Username string `json:"username" binding:"required,min=3,max=50"`
-	Password string `json:"password" binding:"required,min=6,max=50"`
-	Email    string `json:"email" binding:"required,email"`
+	Username string `json:"username" binding:"required,min=3,max=50" sanitize:"text"`
+	Password string `json:"password" binding:"required"` // Length and strength are checked against the password policy
+	Email    string `json:"email" binding:"required,email" sanitize:"text"`
 }
 
 // UserLogin represents the data needed for user login
 type UserLogin struct {
-	Username string `json:"username" binding:"required"`
+	Username string `json:"username" binding:"required" sanitize:"text"`
 	Password string `json:"password" binding:"required"`
 }
 
@@ -42,6 +45,7 @@ type UserResponse struct {
 	ID            int        `json:"id"`
 	Username      string     `json:"username"`
 	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
 	FullName      string     `json:"full_name,omitempty"`
 	Phone         string     `json:"phone,omitempty"`
 	Address       string     `json:"address,omitempty"`
@@ -62,3 +66,60 @@ type TokenResponse struct {
 	ExpiresIn    int         `json:"expires_in"` // Seconds until access token expires
 }
 
+// MFACodeRequest represents a TOTP code or a one-time recovery code submitted for two-factor authentication
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFADisableRequest represents the data needed to turn off two-factor authentication
+type MFADisableRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// ForgotPasswordRequest represents the data needed to request a password reset email
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest represents the data needed to set a new password with a reset token
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"` // Checked against the password policy
+}
+
+// ChangePasswordRequest represents the data needed to change the password of the logged in user
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"` // Checked against the password policy
+}
+
+// ProfileUpdateRequest represents the profile fields a user can change
+type ProfileUpdateRequest struct {
+	FullName      string `json:"full_name" binding:"max=100" sanitize:"text"`
+	Phone         string `json:"phone" binding:"max=20" sanitize:"text"` // Encrypted, lengths are checked here because the columns hold ciphertext
+	Address       string `json:"address" binding:"max=1000" sanitize:"text"`
+	City          string `json:"city" binding:"max=100" sanitize:"text"`
+	StateProvince string `json:"state_province" binding:"max=100" sanitize:"text"`
+	ZipPostalCode string `json:"zip_postal_code" binding:"max=20" sanitize:"text"`
+}
+
+// PreferencesUpdateRequest represents the display and notification preferences of a user
+type PreferencesUpdateRequest struct {
+	Theme                string `json:"theme" sanitize:"text"`
+	NotificationsEnabled bool   `json:"notifications_enabled"`
+	Language             string `json:"language" sanitize:"text"`
+}
+
+// ErasureRequestBody is sent by a user asking for their account to be erased
+type ErasureRequestBody struct {
+	Password string `json:"password" binding:"required"` // Confirms that the account owner is making the request
+	Reason   string `json:"reason" binding:"max=255" sanitize:"text"`
+}
+
+// OIDCCallbackRequest carries the parameters the identity provider appended to the redirect URL
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" binding:"required,max=2048"`
+	State string `json:"state" binding:"required,max=128"`
+}
@@ -0,0 +1,126 @@
+// Package notify tells users about security relevant activity on their account, such as a
+// login from a device or location they have not used before.
+package notify
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"web-security/backend/mail"
+)
+
+// LoginAlert describes a login that was flagged as unusual
+type LoginAlert struct {
+	UserID    int
+	Username  string
+	Email     string
+	IP        string
+	UserAgent string
+	// Country is the ISO country code of the login, empty when it could not be determined
+	Country string
+	// Reasons lists why the login was flagged, see the LoginRisk* constants in utils
+	Reasons []string
+	// StepUpRequired is true when the login has to be confirmed before tokens are issued
+	StepUpRequired bool
+	Time           time.Time
+}
+
+// Notifier delivers login alerts. Implementations can be swapped without touching the handlers.
+type Notifier interface {
+	NotifyLogin(alert LoginAlert) error
+}
+
+// Supported notifier drivers
+const (
+	DriverMail = "mail"
+	DriverLog  = "log"
+	DriverNone = "none"
+)
+
+// NewNotifier creates a Notifier for the configured driver. The mail driver delivers
+// through sender, so it follows MAIL_DRIVER.
+func NewNotifier(driver string, sender mail.Sender) (Notifier, error) {
+	switch driver {
+	case DriverMail, "":
+		if sender == nil {
+			return nil, fmt.Errorf("mail notifier requires a mail sender")
+		}
+		return &MailNotifier{sender: sender}, nil
+	case DriverLog:
+		return &LogNotifier{}, nil
+	case DriverNone:
+		return NopNotifier{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported notifier driver: %s", driver)
+	}
+}
+
+// MailNotifier emails the alert to the account's address
+type MailNotifier struct {
+	sender mail.Sender
+}
+
+// reasonDescriptions are shown to the user, keyed by the utils.LoginRisk* values
+var reasonDescriptions = map[string]string{
+	"new_device":            "使用了新的设备或浏览器",
+	"new_network":           "来自新的网络",
+	"impossible_travel":     "登录地点与上次相距过远",
+	"many_accounts_from_ip": "该网络短时间内登录了多个账户",
+}
+
+// NotifyLogin sends the alert email
+func (n *MailNotifier) NotifyLogin(alert LoginAlert) error {
+	if alert.Email == "" {
+		return fmt.Errorf("user %d has no email address", alert.UserID)
+	}
+
+	reasons := make([]string, 0, len(alert.Reasons))
+	for _, reason := range alert.Reasons {
+		if description, ok := reasonDescriptions[reason]; ok {
+			reasons = append(reasons, "- "+description)
+		} else {
+			reasons = append(reasons, "- "+reason)
+		}
+	}
+	location := alert.IP
+	if alert.Country != "" {
+		location += " (" + alert.Country + ")"
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s，您好：\n\n我们检测到您的账户有一次异常登录：\n\n", alert.Username)
+	fmt.Fprintf(&body, "时间：%s\n地点：%s\n设备：%s\n\n原因：\n%s\n\n",
+		alert.Time.Format("2006-01-02 15:04:05 MST"), location, alert.UserAgent, strings.Join(reasons, "\n"))
+	if alert.StepUpRequired {
+		body.WriteString("这次登录需要输入发送到您邮箱的验证码才能完成。")
+	} else {
+		body.WriteString("如果是您本人的操作，请忽略此邮件。")
+	}
+	body.WriteString("如果不是您本人的操作，请立即修改密码，并在账户设置中退出其他设备。")
+
+	return n.sender.Send(mail.Message{
+		To:      alert.Email,
+		Subject: "您的账户有新的登录",
+		Body:    body.String(),
+	})
+}
+
+// LogNotifier writes alerts to the application log. Intended for local development only.
+type LogNotifier struct{}
+
+// NotifyLogin logs the alert
+func (n *LogNotifier) NotifyLogin(alert LoginAlert) error {
+	log.Printf("[notify] unusual login user_id=%d ip=%s country=%s reasons=%v step_up=%t",
+		alert.UserID, alert.IP, alert.Country, alert.Reasons, alert.StepUpRequired)
+	return nil
+}
+
+// NopNotifier discards alerts
+type NopNotifier struct{}
+
+// NotifyLogin does nothing
+func (NopNotifier) NotifyLogin(LoginAlert) error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// StateCookie 保存state的Cookie，把回调和发起登录的浏览器绑定在一起，防止登录CSRF
+	StateCookie = "oidc_state"
+	// StateTTL 发起登录后完成登录的时限
+	StateTTL = 10 * time.Minute
+
+	statePrefix = "oidc_state:"
+	// clockSkew 校验ID令牌时间声明时允许的时钟误差
+	clockSkew = time.Minute
+)
+
+// ErrInvalidCode 提供方拒绝了授权码，通常是授权码已过期或已使用
+var ErrInvalidCode = errors.New("授权码无效或已过期，请重新登录")
+
+// signingAlgorithms 接受的ID令牌签名算法。不接受none和以client secret为密钥的HS系列
+var signingAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// flowState 一次授权请求的状态，以state为键保存在Redis中
+type flowState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// LinkUserID 不为0时表示已登录用户在绑定新的身份，而不是登录
+	LinkUserID int `json:"link_user_id,omitempty"`
+}
+
+// Authorization 发起登录的结果，浏览器需要跳转到URL
+type Authorization struct {
+	URL   string
+	State string
+}
+
+// Result 完成授权码交换并验证ID令牌后得到的身份
+type Result struct {
+	Claims Claims
+	// LinkUserID 发起绑定的用户，登录时为0
+	LinkUserID int
+}
+
+// Claims ID令牌中用到的用户信息
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// idTokenClaims ID令牌的声明
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string       `json:"nonce"`
+	AuthorizedParty   string       `json:"azp"`
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// flexibleBool 有的提供方把email_verified返回为字符串"true"
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("无效的布尔值: %s", data)
+	}
+	return nil
+}
+
+// Begin 生成state、nonce和PKCE的code_verifier，保存到Redis后返回授权地址。
+// linkUserID不为0时，完成后把身份绑定到该用户
+func (p *Provider) Begin(linkUserID int) (*Authorization, error) {
+	discovery, err := p.loadDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	flow := flowState{Provider: p.Name, LinkUserID: linkUserID}
+	if flow.Nonce, err = randomToken(32); err != nil {
+		return nil, err
+	}
+	if flow.Verifier, err = randomToken(32); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return nil, err
+	}
+	if err := redis_client.Rdb.Set(context.Background(), statePrefix+state, data, StateTTL).Err(); err != nil {
+		return nil, fmt.Errorf("保存登录状态失败: %w", err)
+	}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", flow.Nonce)
+	query.Set("code_challenge", codeChallenge(flow.Verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return &Authorization{URL: authURL.String(), State: state}, nil
+}
+
+// Finish 取出并删除state对应的状态，用授权码和code_verifier换取ID令牌并验证，state只能使用一次
+func (p *Provider) Finish(state, code string) (*Result, error) {
+	if state == "" || code == "" {
+		return nil, ErrInvalidState
+	}
+	data, err := redis_client.Rdb.GetDel(context.Background(), statePrefix+state).Bytes()
+	if err == redis.Nil {
+		return nil, ErrInvalidState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取登录状态失败: %w", err)
+	}
+	var flow flowState
+	if err := json.Unmarshal(data, &flow); err != nil || flow.Provider != p.Name {
+		return nil, ErrInvalidState
+	}
+
+	rawIDToken, err := p.exchangeCode(code, flow.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(rawIDToken, flow.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Claims: *claims, LinkUserID: flow.LinkUserID}, nil
+}
+
+// exchangeCode 在令牌端点用授权码换取ID令牌。配置了client secret时使用client_secret_basic认证
+func (p *Provider) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := p.loadDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// RFC 6749 2.3.1：client_id和client_secret先做表单编码再放入Basic认证
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		var tokenError struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&tokenError) == nil && tokenError.Error == "invalid_grant" {
+			return "", ErrInvalidCode
+		}
+		return "", fmt.Errorf("%w: 令牌端点返回 %d (%s)", ErrProviderUnavailable, resp.StatusCode, tokenError.Error)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := decodeResponse(resp, &tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: 令牌端点没有返回id_token", ErrInvalidIDToken)
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken 验证ID令牌的签名、iss、aud、azp、exp、iat和nonce
+func (p *Provider) verifyIDToken(raw, nonce string) (*Claims, error) {
+	discovery, err := p.loadDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(signingAlgorithms),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+	)
+	var claims idTokenClaims
+	if _, err := parser.ParseWithClaims(raw, &claims, p.verificationKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Subject == "" || claims.IssuedAt == nil {
+		return nil, fmt.Errorf("%w: 缺少sub或iat", ErrInvalidIDToken)
+	}
+	// 有多个受众时必须有azp，azp存在时必须是我们自己
+	if (len(claims.Audience) > 1 && claims.AuthorizedParty == "") ||
+		(claims.AuthorizedParty != "" && claims.AuthorizedParty != p.ClientID) {
+		return nil, fmt.Errorf("%w: azp不匹配", ErrInvalidIDToken)
+	}
+	// nonce把ID令牌和本次授权请求绑定，防止重放其他请求得到的令牌
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce不匹配", ErrInvalidIDToken)
+	}
+
+	return &Claims{
+		Subject:           claims.Subject,
+		Email:             strings.TrimSpace(claims.Email),
+		EmailVerified:     bool(claims.EmailVerified) || (p.TrustEmail && claims.Email != ""),
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// codeChallenge PKCE的S256变换
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
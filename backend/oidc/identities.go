@@ -0,0 +1,143 @@
+package oidc
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"web-security/backend/db"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	// ErrIdentityNotFound 身份不存在，或者不属于当前用户
+	ErrIdentityNotFound = errors.New("绑定的身份不存在")
+	// ErrIdentityLinked 该身份已经绑定到其他账户
+	ErrIdentityLinked = errors.New("该身份已绑定到其他账户")
+)
+
+// Identity 用户绑定的一个外部身份，以提供方和sub唯一确定
+type Identity struct {
+	ID          int64      `json:"id"`
+	UserID      int        `json:"user_id"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"` // 最近一次登录时提供方返回的邮箱
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// execer 既可以是db.DB也可以是事务，创建用户和绑定身份需要在同一个事务中完成
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// FindIdentity 根据提供方和sub查找身份，不存在时返回ErrIdentityNotFound
+func FindIdentity(provider, subject string) (*Identity, error) {
+	identities, err := queryIdentities("WHERE provider = ? AND subject = ?", provider, subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, ErrIdentityNotFound
+	}
+	return &identities[0], nil
+}
+
+// LinkIdentity 把身份绑定到用户
+func LinkIdentity(userID int, provider string, claims Claims) (*Identity, error) {
+	return LinkIdentityTx(db.DB, userID, provider, claims)
+}
+
+// LinkIdentityTx 在给定的事务中把身份绑定到用户，身份已绑定到任何账户时返回ErrIdentityLinked
+func LinkIdentityTx(tx execer, userID int, provider string, claims Claims) (*Identity, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	identity := &Identity{
+		UserID:      userID,
+		Provider:    provider,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		CreatedAt:   now,
+		LastLoginAt: &now,
+	}
+	res, err := tx.Exec(`
+		INSERT INTO user_identities(user_id, provider, subject, email, created_at, last_login_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+	`, userID, provider, claims.Subject, nullString(claims.Email), now, now)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return nil, ErrIdentityLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if identity.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// TouchIdentity 登录成功后更新最后登录时间和提供方返回的邮箱
+func TouchIdentity(id int64, email string) error {
+	_, err := db.DB.Exec("UPDATE user_identities SET last_login_at = ?, email = ? WHERE id = ?",
+		time.Now().UTC(), nullString(email), id)
+	return err
+}
+
+// ListIdentities 列出用户绑定的全部身份
+func ListIdentities(userID int) ([]Identity, error) {
+	return queryIdentities("WHERE user_id = ? ORDER BY id", userID)
+}
+
+// UnlinkIdentity 解除用户绑定的身份
+func UnlinkIdentity(userID int, id int64) (*Identity, error) {
+	identities, err := queryIdentities("WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, ErrIdentityNotFound
+	}
+	res, err := db.DB.Exec("DELETE FROM user_identities WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrIdentityNotFound
+	}
+	return &identities[0], nil
+}
+
+func queryIdentities(where string, args ...interface{}) ([]Identity, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, user_id, provider, subject, email, created_at, last_login_at
+		FROM user_identities `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var (
+			identity    Identity
+			email       sql.NullString
+			lastLoginAt sql.NullTime
+		)
+		err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &email,
+			&identity.CreatedAt, &lastLoginAt)
+		if err != nil {
+			return nil, err
+		}
+		identity.Email = email.String
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = &lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
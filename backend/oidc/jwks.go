@@ -0,0 +1,210 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minJWKSRefreshInterval 遇到未知kid时重新获取JWKS的最短间隔，防止伪造的令牌让我们频繁请求提供方
+const minJWKSRefreshInterval = time.Minute
+
+// keySet 提供方当前公布的签名公钥
+type keySet struct {
+	keys      []publicKey
+	fetchedAt time.Time
+}
+
+type publicKey struct {
+	kid string
+	alg string // JWK中声明的算法，可以为空
+	key interface{}
+}
+
+// rawJWK JWKS中的一个密钥，只解析验证签名需要的字段
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey 根据ID令牌头部的kid和alg选择公钥。kid未知时重新获取一次JWKS，以支持提供方轮换密钥
+func (p *Provider) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg := token.Method.Alg()
+
+	keys, err := p.loadKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	if key := keys.find(kid, alg); key != nil {
+		return key, nil
+	}
+	if time.Since(keys.fetchedAt) < minJWKSRefreshInterval {
+		return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+	}
+	if keys, err = p.loadKeys(true); err != nil {
+		return nil, err
+	}
+	if key := keys.find(kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+}
+
+// loadKeys 获取并缓存JWKS，refresh为true时忽略缓存
+func (p *Provider) loadKeys(refresh bool) (*keySet, error) {
+	discovery, err := p.loadDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil && !refresh {
+		return p.keys, nil
+	}
+
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := &keySet{fetchedAt: time.Now()}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			// 不支持的密钥类型跳过即可，不影响其他密钥
+			continue
+		}
+		keys.keys = append(keys.keys, publicKey{kid: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+	if len(keys.keys) == 0 {
+		return nil, fmt.Errorf("%w: JWKS中没有可用的签名密钥", ErrProviderUnavailable)
+	}
+	p.keys = keys
+	return keys, nil
+}
+
+// find 查找与kid和算法匹配的公钥。令牌没有kid时，只有唯一一个类型匹配的密钥才会被使用
+func (s *keySet) find(kid, alg string) interface{} {
+	var candidates []publicKey
+	for _, key := range s.keys {
+		if kid != "" && key.kid != kid {
+			continue
+		}
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if !keyMatchesAlgorithm(key.key, alg) {
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	if len(candidates) != 1 {
+		return nil
+	}
+	return candidates[0].key
+}
+
+// keyMatchesAlgorithm 公钥类型必须和令牌的算法一致，防止算法混淆攻击
+func keyMatchesAlgorithm(key interface{}, alg string) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case "ES256":
+			return key.Curve == elliptic.P256()
+		case "ES384":
+			return key.Curve == elliptic.P384()
+		case "ES512":
+			return key.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// parseJWK 把JWK转换为公钥，支持RSA、EC（P-256/384/521）和OKP（Ed25519）
+func parseJWK(jwk rawJWK) (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA密钥参数无效")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("不支持的曲线: %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("EC公钥不在曲线上")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("不支持的曲线: %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519公钥长度无效")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("不支持的密钥类型: %s", jwk.Kty)
+}
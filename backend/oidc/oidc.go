@@ -0,0 +1,210 @@
+// Package oidc 通过OpenID Connect提供方（Google、Okta、Azure AD、Keycloak等）登录。
+// 使用授权码模式和PKCE，state和nonce保存在Redis中只能使用一次，ID令牌按提供方公布的JWKS验证签名。
+// 提供方的地址通过discovery文档获取，第一次使用时加载，之后一直缓存。
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discoveryPath 相对于issuer的discovery文档路径
+	discoveryPath = "/.well-known/openid-configuration"
+	// maxResponseSize 提供方响应的最大字节数
+	maxResponseSize = 1 << 20
+)
+
+var (
+	// ErrUnknownProvider 未配置的提供方
+	ErrUnknownProvider = errors.New("未配置的登录方式")
+	// ErrInvalidState state不存在、已使用、已过期，或者不属于当前浏览器
+	ErrInvalidState = errors.New("登录请求已失效，请重新登录")
+	// ErrInvalidIDToken ID令牌的签名或声明无效
+	ErrInvalidIDToken = errors.New("身份提供方返回的ID令牌无效")
+	// ErrProviderUnavailable 无法访问提供方，或者提供方返回了错误
+	ErrProviderUnavailable = errors.New("无法连接身份提供方")
+)
+
+// httpClient 访问提供方使用的HTTP客户端，避免提供方无响应时请求一直挂起
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// ProviderConfig 一个提供方的配置
+type ProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string // 为空时作为公共客户端，只依靠PKCE
+	RedirectURL  string
+	Scopes       []string
+	// TrustEmail 提供方没有返回email_verified时也认为邮箱已验证，只用于由企业自己管理邮箱的提供方
+	TrustEmail bool
+}
+
+// Provider 一个已配置的提供方
+type Provider struct {
+	ProviderConfig
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      *keySet
+}
+
+// ProviderInfo 登录页面展示的提供方信息
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// discoveryDocument discovery文档中用到的字段
+type discoveryDocument struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+var providers = map[string]*Provider{}
+
+// Init 加载配置中的提供方。这里只检查配置，不访问提供方，提供方暂时不可用不影响服务启动
+func Init(configs []ProviderConfig) error {
+	loaded := map[string]*Provider{}
+	for _, cfg := range configs {
+		if err := checkEndpoint(cfg.Issuer); err != nil {
+			return fmt.Errorf("提供方 %s 的issuer无效: %w", cfg.Name, err)
+		}
+		if _, err := url.Parse(cfg.RedirectURL); err != nil || cfg.RedirectURL == "" {
+			return fmt.Errorf("提供方 %s 的回调地址无效: %s", cfg.Name, cfg.RedirectURL)
+		}
+		if !containsString(cfg.Scopes, "openid") {
+			cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+		}
+		cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+		loaded[cfg.Name] = &Provider{ProviderConfig: cfg}
+	}
+	providers = loaded
+	return nil
+}
+
+// Providers 列出已配置的提供方，按名称排序
+func Providers() []ProviderInfo {
+	list := make([]ProviderInfo, 0, len(providers))
+	for _, provider := range providers {
+		list = append(list, ProviderInfo{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Lookup 根据名称查找提供方
+func Lookup(name string) (*Provider, error) {
+	provider, ok := providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
+
+// loadDiscovery 获取并缓存discovery文档。失败时不缓存，下次请求重新获取
+func (p *Provider) loadDiscovery() (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var doc discoveryDocument
+	if err := getJSON(p.Issuer+discoveryPath, &doc); err != nil {
+		return nil, err
+	}
+	// discovery文档中的issuer必须与配置完全一致，防止被其他提供方冒充
+	if strings.TrimRight(doc.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("%w: discovery中的issuer %q 与配置不一致", ErrProviderUnavailable, doc.Issuer)
+	}
+	for _, endpoint := range []string{doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI} {
+		if err := checkEndpoint(endpoint); err != nil {
+			return nil, fmt.Errorf("%w: discovery中的地址无效: %v", ErrProviderUnavailable, err)
+		}
+	}
+	if len(doc.CodeChallengeMethods) > 0 && !containsString(doc.CodeChallengeMethods, "S256") {
+		return nil, fmt.Errorf("%w: 提供方不支持S256的PKCE", ErrProviderUnavailable)
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// checkEndpoint 提供方的地址必须使用HTTPS，本机地址除外，便于在开发环境中使用cmd/stubidp
+func checkEndpoint(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("无效的地址: %q", raw)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if u.Scheme == "http" && isLoopback(u.Hostname()) {
+		return nil
+	}
+	return fmt.Errorf("必须使用HTTPS: %s", raw)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// getJSON 请求提供方的地址并解析JSON响应
+func getJSON(endpoint string, v interface{}) error {
+	resp, err := httpClient.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp, v)
+}
+
+// decodeResponse 检查状态码并解析JSON响应，响应大小有上限
+func decodeResponse(resp *http.Response, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s 返回 %d: %s", ErrProviderUnavailable, resp.Request.URL.Redacted(), resp.StatusCode, truncate(string(body), 200))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: 无法解析响应: %v", ErrProviderUnavailable, err)
+	}
+	return nil
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,249 @@
+package oidc
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+	"web-security/backend/oidc/oidctest"
+	"web-security/backend/redis_client"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testClientID     = "web-security"
+	testClientSecret = "stub-secret"
+)
+
+// setupProvider 启动Redis和提供方，并把提供方配置为"stub"
+func setupProvider(t *testing.T) (*Provider, *oidctest.Server) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redis_client.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	idp := oidctest.NewServer(testClientID, testClientSecret)
+	t.Cleanup(idp.Close)
+
+	err := Init([]ProviderConfig{{
+		Name:         "stub",
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "http://localhost:5173/auth/callback/stub",
+		Scopes:       []string{"email", "profile"},
+	}})
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	provider, err := Lookup("stub")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	return provider, idp
+}
+
+// begin 发起授权请求并解析授权地址
+func begin(t *testing.T, provider *Provider, linkUserID int) oidctest.Authorization {
+	t.Helper()
+	authorization, err := provider.Begin(linkUserID)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	auth, err := oidctest.ParseAuthorization(authorization.URL)
+	if err != nil {
+		t.Fatalf("ParseAuthorization: %v", err)
+	}
+	if auth.State != authorization.State || auth.ClientID != testClientID {
+		t.Fatalf("授权地址中的参数不正确: %+v", auth)
+	}
+	return auth
+}
+
+// login 完成一次登录，ID令牌由sign根据本次请求的nonce生成
+func login(t *testing.T, provider *Provider, idp *oidctest.Server, sign func(nonce string) string) (*Result, error) {
+	t.Helper()
+	auth := begin(t, provider, 0)
+	code := idp.IssueCode(auth, sign(auth.Nonce))
+	return provider.Finish(auth.State, code)
+}
+
+func TestFinishReturnsVerifiedClaims(t *testing.T) {
+	provider, idp := setupProvider(t)
+
+	auth := begin(t, provider, 42)
+	claims := idp.Claims(auth.Nonce, "subject-1")
+	claims["email"] = " alice@example.com "
+	claims["email_verified"] = "true"
+	claims["preferred_username"] = "alice"
+	result, err := provider.Finish(auth.State, idp.IssueCode(auth, idp.Sign(claims)))
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	want := Claims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true, PreferredUsername: "alice"}
+	if result.Claims != want {
+		t.Errorf("Claims = %+v, want %+v", result.Claims, want)
+	}
+	if result.LinkUserID != 42 {
+		t.Errorf("LinkUserID = %d, want 42", result.LinkUserID)
+	}
+}
+
+func TestFinishRejectsUnknownAndReusedState(t *testing.T) {
+	provider, idp := setupProvider(t)
+
+	if _, err := provider.Finish("unknown-state", "code"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("未知的state: err = %v, want ErrInvalidState", err)
+	}
+
+	auth := begin(t, provider, 0)
+	if _, err := provider.Finish(auth.State, idp.IssueCode(auth, idp.Sign(idp.Claims(auth.Nonce, "subject-1")))); err != nil {
+		t.Fatalf("第一次Finish: %v", err)
+	}
+	// 即使提供方又签发了新的授权码，同一个state也不能再次使用
+	if _, err := provider.Finish(auth.State, idp.IssueCode(auth, idp.Sign(idp.Claims(auth.Nonce, "subject-1")))); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("重复使用state: err = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestFinishRejectsStateOfAnotherProvider(t *testing.T) {
+	provider, idp := setupProvider(t)
+	auth := begin(t, provider, 0)
+
+	other := &Provider{ProviderConfig: ProviderConfig{Name: "other"}}
+	if _, err := other.Finish(auth.State, idp.IssueCode(auth, "")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("err = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestFinishRejectsPKCEVerifierMismatch(t *testing.T) {
+	provider, idp := setupProvider(t)
+
+	// 授权码是为另一个授权请求签发的（例如被注入的攻击者的授权码），本次请求的code_verifier与它的code_challenge不匹配
+	victim := begin(t, provider, 0)
+	attacker := begin(t, provider, 0)
+	code := idp.IssueCode(attacker, idp.Sign(idp.Claims(victim.Nonce, "attacker")))
+
+	if _, err := provider.Finish(victim.State, code); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("err = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsInvalidClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(claims jwt.MapClaims)
+	}{
+		{"nonce不匹配", func(claims jwt.MapClaims) { claims["nonce"] = "another-nonce" }},
+		{"缺少nonce", func(claims jwt.MapClaims) { delete(claims, "nonce") }},
+		{"iss不匹配", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{"aud不匹配", func(claims jwt.MapClaims) { claims["aud"] = "another-client" }},
+		{"多个受众但没有azp", func(claims jwt.MapClaims) { claims["aud"] = []string{testClientID, "another-client"} }},
+		{"azp不匹配", func(claims jwt.MapClaims) { claims["azp"] = "another-client" }},
+		{"已过期", func(claims jwt.MapClaims) {
+			claims["iat"] = time.Now().Add(-time.Hour).Unix()
+			claims["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+		}},
+		{"缺少exp", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+		{"缺少iat", func(claims jwt.MapClaims) { delete(claims, "iat") }},
+		{"缺少sub", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+	}
+
+	provider, idp := setupProvider(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := login(t, provider, idp, func(nonce string) string {
+				claims := idp.Claims(nonce, "subject-1")
+				tt.mutate(claims)
+				return idp.Sign(claims)
+			})
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAcceptsMultipleAudiencesWithAuthorizedParty(t *testing.T) {
+	provider, idp := setupProvider(t)
+	_, err := login(t, provider, idp, func(nonce string) string {
+		claims := idp.Claims(nonce, "subject-1")
+		claims["aud"] = []string{testClientID, "another-client"}
+		claims["azp"] = testClientID
+		return idp.Sign(claims)
+	})
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsUnsafeAlgorithms(t *testing.T) {
+	provider, idp := setupProvider(t)
+	publicKey, err := x509.MarshalPKIXPublicKey(idp.PublicKey())
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    interface{}
+	}{
+		{"alg=none", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType},
+		// HS256以client secret为密钥，任何知道secret的一方都能伪造
+		{"HS256使用client secret", jwt.SigningMethodHS256, []byte(testClientSecret)},
+		// 算法混淆：以提供方公开的RSA公钥作为HMAC密钥
+		{"HS256使用公钥", jwt.SigningMethodHS256, publicKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := login(t, provider, idp, func(nonce string) string {
+				token := jwt.NewWithClaims(tt.method, idp.Claims(nonce, "subject-1"))
+				token.Header["kid"] = idp.KeyID()
+				signed, err := token.SignedString(tt.key)
+				if err != nil {
+					t.Fatalf("SignedString: %v", err)
+				}
+				return signed
+			})
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestUnknownKeyIDRefreshesJWKS(t *testing.T) {
+	provider, idp := setupProvider(t)
+	sign := func(nonce string) string { return idp.Sign(idp.Claims(nonce, "subject-1")) }
+
+	if _, err := login(t, provider, idp, sign); err != nil {
+		t.Fatalf("轮换密钥前登录: %v", err)
+	}
+	if n := idp.JWKSRequests(); n != 1 {
+		t.Fatalf("JWKS请求次数 = %d, want 1", n)
+	}
+
+	// 提供方轮换了密钥，刚获取过JWKS时不会为未知的kid重新获取，防止伪造的令牌让我们频繁请求提供方
+	idp.RotateKey()
+	if _, err := login(t, provider, idp, sign); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("最短间隔内的未知kid: err = %v, want ErrInvalidIDToken", err)
+	}
+	if n := idp.JWKSRequests(); n != 1 {
+		t.Fatalf("最短间隔内JWKS请求次数 = %d, want 1", n)
+	}
+
+	// 超过最短间隔后，未知的kid触发重新获取JWKS，新密钥签名的令牌通过验证
+	provider.mu.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-minJWKSRefreshInterval)
+	provider.mu.Unlock()
+	if _, err := login(t, provider, idp, sign); err != nil {
+		t.Fatalf("重新获取JWKS后登录: %v", err)
+	}
+	if n := idp.JWKSRequests(); n != 2 {
+		t.Fatalf("JWKS请求次数 = %d, want 2", n)
+	}
+}
@@ -0,0 +1,256 @@
+// Package oidctest 提供运行在httptest服务器上的OpenID Connect提供方，用于测试第三方登录。
+// 与cmd/stubidp一样检查PKCE、redirect_uri、客户端认证并且授权码只能使用一次，
+// 但ID令牌的内容由测试决定，可以构造各种无效的令牌来验证后端是否拒绝。
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey 提供方的一个RS256签名密钥
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// pendingCode 已签发、等待换取令牌的授权码
+type pendingCode struct {
+	challenge   string
+	redirectURI string
+	idToken     string
+}
+
+// Authorization 后端生成的授权地址中的参数
+type Authorization struct {
+	ClientID    string
+	RedirectURI string
+	State       string
+	Nonce       string
+	Challenge   string
+}
+
+// Server 测试用的提供方，issuer就是服务器的URL
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string // 为空时作为公共客户端，不检查客户端认证
+
+	mu           sync.Mutex
+	active       signingKey
+	published    []signingKey
+	codes        map[string]pendingCode
+	nextKeyID    int
+	jwksRequests int
+}
+
+// NewServer 启动提供方并生成第一个签名密钥
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{ClientID: clientID, ClientSecret: clientSecret, codes: map[string]pendingCode{}}
+	s.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("/jwks", s.handleJWKS)
+	mux.HandleFunc("/token", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// RotateKey 生成新的签名密钥，之后签发的令牌使用新密钥，JWKS中只公布新密钥
+func (s *Server) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: 生成签名密钥失败: %v", err))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextKeyID++
+	s.active = signingKey{kid: fmt.Sprintf("key-%d", s.nextKeyID), key: key}
+	s.published = []signingKey{s.active}
+}
+
+// KeyID 当前签名密钥的kid
+func (s *Server) KeyID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.kid
+}
+
+// PublicKey 当前签名密钥的公钥
+func (s *Server) PublicKey() *rsa.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &s.active.key.PublicKey
+}
+
+// JWKSRequests JWKS被请求的次数
+func (s *Server) JWKSRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksRequests
+}
+
+// Claims 返回一组有效的ID令牌声明，测试可以在签名前修改
+func (s *Server) Claims(nonce, subject string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   s.URL,
+		"aud":   s.ClientID,
+		"sub":   subject,
+		"nonce": nonce,
+		"iat":   now.Unix(),
+		"exp":   now.Add(10 * time.Minute).Unix(),
+	}
+}
+
+// Sign 用当前密钥以RS256签名ID令牌，头部带有kid
+func (s *Server) Sign(claims jwt.Claims) string {
+	s.mu.Lock()
+	key := s.active
+	s.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.key)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: 签名ID令牌失败: %v", err))
+	}
+	return signed
+}
+
+// ParseAuthorization 解析后端生成的授权地址，要求使用授权码模式和S256的PKCE
+func ParseAuthorization(authorizationURL string) (Authorization, error) {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		return Authorization{}, err
+	}
+	query := u.Query()
+	if query.Get("response_type") != "code" {
+		return Authorization{}, fmt.Errorf("response_type为 %q", query.Get("response_type"))
+	}
+	if query.Get("code_challenge_method") != "S256" {
+		return Authorization{}, fmt.Errorf("code_challenge_method为 %q", query.Get("code_challenge_method"))
+	}
+	auth := Authorization{
+		ClientID:    query.Get("client_id"),
+		RedirectURI: query.Get("redirect_uri"),
+		State:       query.Get("state"),
+		Nonce:       query.Get("nonce"),
+		Challenge:   query.Get("code_challenge"),
+	}
+	if auth.State == "" || auth.Nonce == "" || auth.Challenge == "" {
+		return Authorization{}, errors.New("授权地址缺少state、nonce或code_challenge")
+	}
+	return auth, nil
+}
+
+// IssueCode 为授权请求签发授权码，用它换取令牌时返回idToken
+func (s *Server) IssueCode(auth Authorization, idToken string) string {
+	code := randomString()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = pendingCode{challenge: auth.Challenge, redirectURI: auth.RedirectURI, idToken: idToken}
+	return code
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.jwksRequests++
+	keys := make([]map[string]string, 0, len(s.published))
+	for _, key := range s.published {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": key.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.key.E)).Bytes()),
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// handleToken 授权码只能使用一次，code_verifier、redirect_uri或客户端认证不对时返回invalid_grant或invalid_client
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if !s.authenticateClient(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	pending, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if !ok || subtle.ConstantTimeCompare([]byte(challenge), []byte(pending.challenge)) != 1 ||
+		r.PostForm.Get("redirect_uri") != pending.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   600,
+		"id_token":     pending.idToken,
+	})
+}
+
+func (s *Server) authenticateClient(r *http.Request) bool {
+	if s.ClientSecret == "" {
+		return r.PostForm.Get("client_id") == s.ClientID
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	return id == s.ClientID && subtle.ConstantTimeCompare([]byte(secret), []byte(s.ClientSecret)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("oidctest: 生成随机数失败: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
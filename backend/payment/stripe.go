@@ -89,7 +89,8 @@ func (s *StripeProcessor) CreatePaymentSession(ctx context.Context, order *Order
 		Metadata:    metadata,
 		LineItems:   lineItems,
 		Mode:        stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:  stripe.String(fmt.Sprintf("%s?orderID=%d", s.successURL, order.ID)),
+		// Stripe replaces {CHECKOUT_SESSION_ID}; the success callback confirms the payment through this session
+		SuccessURL:  stripe.String(fmt.Sprintf("%s?orderID=%d&session_id={CHECKOUT_SESSION_ID}", s.successURL, order.ID)),
 		CancelURL:   stripe.String(fmt.Sprintf("%s?orderID=%d", s.cancelURL, order.ID)),
 	}
 	
@@ -110,6 +111,7 @@ type PaymentResult struct {
 	PaymentMethod string    // 支付方式 (card, alipay, etc)
 	PaymentTime   time.Time // 支付时间
 	TransactionID string    // 交易ID/付款意图ID
+	OrderID       string    // 创建会话时写入元数据的订单ID
 	CustomerEmail string    // 客户邮箱（如果可用）
 	RawSession    *stripe.CheckoutSession // 原始会话数据供高级使用
 }
@@ -132,6 +134,7 @@ func (s *StripeProcessor) VerifyPaymentSession(ctx context.Context, sessionID st
 	result := &PaymentResult{
 		Status:     string(sess.PaymentStatus),
 		Currency:   string(sess.Currency),
+		OrderID:    sess.Metadata["orderID"],
 		RawSession: sess,
 	}
 	
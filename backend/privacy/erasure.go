@@ -0,0 +1,359 @@
+package privacy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"web-security/backend/audit"
+	"web-security/backend/db"
+	"web-security/backend/utils"
+)
+
+// 注销申请的状态
+const (
+	ErasurePending   = "pending"
+	ErasureCancelled = "cancelled"
+	ErasureCompleted = "completed"
+)
+
+const (
+	// ErasedUsernamePrefix 注销后的用户名为该前缀加用户ID，注册时不能使用
+	ErasedUsernamePrefix = "deleted_user_"
+	// dueBatchSize 每次检查最多处理的到期申请数
+	dueBatchSize = 100
+	// postponeDelay 有订单正在处理或配送时，注销推迟的时间
+	postponeDelay = 24 * time.Hour
+)
+
+var (
+	// ErrUserNotFound 用户不存在
+	ErrUserNotFound = errors.New("用户不存在")
+	// ErrAlreadyErased 账户已经注销
+	ErrAlreadyErased = errors.New("账户已经注销")
+	// ErrErasurePending 已经有待执行的注销申请
+	ErrErasurePending = errors.New("已经有待执行的注销申请")
+	// ErrNoPendingErasure 没有待执行的注销申请
+	ErrNoPendingErasure = errors.New("没有待执行的注销申请")
+	// ErrOrdersInProgress 还有正在处理或配送中的订单，需要收货地址，注销已推迟
+	ErrOrdersInProgress = errors.New("还有正在处理或配送中的订单，注销已推迟")
+
+	// errNotPending 申请已经被撤销，或者由其他实例执行过
+	errNotPending = errors.New("注销申请不是待执行状态")
+)
+
+// Config 注销的宽限期和检查间隔
+type Config struct {
+	// GracePeriod 申请后多久执行注销，期间用户或管理员可以撤销
+	GracePeriod time.Duration
+	// CheckInterval 检查到期申请的间隔，为0时不在本进程中执行
+	CheckInterval time.Duration
+}
+
+var config Config
+
+// ErasureRequest 一次注销申请
+type ErasureRequest struct {
+	ID           int64      `json:"id"`
+	UserID       int        `json:"user_id"`
+	Status       string     `json:"status"`
+	RequestedBy  int        `json:"requested_by"`
+	Reason       string     `json:"reason,omitempty"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	CancelledAt  *time.Time `json:"cancelled_at,omitempty"`
+	CancelledBy  *int       `json:"cancelled_by,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+}
+
+const erasureColumns = "id, user_id, status, requested_by, reason, requested_at, scheduled_for, cancelled_at, cancelled_by, completed_at"
+
+// Init 保存配置并在后台定期执行到期的注销申请。多个实例同时运行时，每个申请只会被其中一个执行
+func Init(cfg Config) error {
+	if cfg.GracePeriod < 0 {
+		return fmt.Errorf("注销宽限期不能为负数")
+	}
+	config = cfg
+	if cfg.CheckInterval > 0 {
+		go runDueErasures(cfg.CheckInterval)
+	}
+	return nil
+}
+
+func runDueErasures(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n, err := ProcessDueErasures(); err != nil {
+			log.Printf("执行到期的注销申请失败: %v", err)
+		} else if n > 0 {
+			log.Printf("已注销 %d 个账户", n)
+		}
+	}
+}
+
+// RequestErasure 为用户创建注销申请，宽限期结束后执行。immediate为true时跳过宽限期立即执行，
+// 有订单正在处理或配送时返回ErrOrdersInProgress，申请保留并推迟执行
+func RequestErasure(userID, requestedBy int, reason string, immediate bool) (*ErasureRequest, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 锁定用户行，同一用户的并发申请在这里排队
+	var erasedAt sql.NullTime
+	err = tx.QueryRow("SELECT erased_at FROM users WHERE id = ? FOR UPDATE", userID).Scan(&erasedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if erasedAt.Valid {
+		return nil, ErrAlreadyErased
+	}
+
+	pending, err := scanErasure(tx.QueryRow("SELECT "+erasureColumns+" FROM account_erasure_requests WHERE user_id = ? AND status = ?",
+		userID, ErasurePending))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if pending != nil {
+		return pending, ErrErasurePending
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	scheduledFor := now.Add(config.GracePeriod)
+	if immediate {
+		scheduledFor = now
+	}
+	res, err := tx.Exec("INSERT INTO account_erasure_requests(user_id, status, requested_by, reason, requested_at, scheduled_for) VALUES(?, ?, ?, ?, ?, ?)",
+		userID, ErasurePending, requestedBy, reason, now, scheduledFor)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	request := &ErasureRequest{ID: id, UserID: userID, Status: ErasurePending, RequestedBy: requestedBy, Reason: reason,
+		RequestedAt: now, ScheduledFor: scheduledFor}
+	if immediate {
+		if err := executeErasure(id); err != nil {
+			if latest, lerr := LatestErasure(userID); lerr == nil && latest != nil {
+				request = latest
+			}
+			return request, err
+		}
+		return LatestErasure(userID)
+	}
+	return request, nil
+}
+
+// CancelErasure 撤销用户待执行的注销申请
+func CancelErasure(userID, cancelledBy int) (*ErasureRequest, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 和执行注销时一样锁定申请行，已经开始执行的注销不能再撤销
+	request, err := scanErasure(tx.QueryRow("SELECT "+erasureColumns+" FROM account_erasure_requests WHERE user_id = ? AND status = ? FOR UPDATE",
+		userID, ErasurePending))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPendingErasure
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	_, err = tx.Exec("UPDATE account_erasure_requests SET status = ?, cancelled_at = ?, cancelled_by = ? WHERE id = ?",
+		ErasureCancelled, now, cancelledBy, request.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	request.Status = ErasureCancelled
+	request.CancelledAt = &now
+	request.CancelledBy = &cancelledBy
+	return request, nil
+}
+
+// LatestErasure 返回用户最近一次注销申请，没有时返回nil
+func LatestErasure(userID int) (*ErasureRequest, error) {
+	request, err := scanErasure(db.DB.QueryRow("SELECT "+erasureColumns+" FROM account_erasure_requests WHERE user_id = ? ORDER BY id DESC LIMIT 1", userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// ProcessDueErasures 执行宽限期已经结束的注销申请，返回注销的账户数
+func ProcessDueErasures() (int, error) {
+	rows, err := db.DB.Query("SELECT id FROM account_erasure_requests WHERE status = ? AND scheduled_for <= ? ORDER BY scheduled_for LIMIT ?",
+		ErasurePending, time.Now().UTC(), dueBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	for _, id := range ids {
+		err := executeErasure(id)
+		switch {
+		case err == nil:
+			erased++
+		case errors.Is(err, errNotPending):
+		case errors.Is(err, ErrOrdersInProgress):
+			log.Printf("注销申请 %d 推迟执行: %v", id, err)
+		default:
+			log.Printf("执行注销申请 %d 失败: %v", id, err)
+		}
+	}
+	return erased, nil
+}
+
+// executeErasure 清除账户中的个人信息。订单保留金额和商品明细，收货地址、账单地址和备注清空；
+// 购物车、收藏、评价和恢复码删除。申请行被锁定，已经被撤销或由其他实例执行过的申请返回errNotPending
+func executeErasure(requestID int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	request, err := scanErasure(tx.QueryRow("SELECT "+erasureColumns+" FROM account_erasure_requests WHERE id = ? FOR UPDATE", requestID))
+	if err != nil {
+		return err
+	}
+	if request.Status != ErasurePending {
+		return errNotPending
+	}
+
+	// 已付款但还没送达的订单需要收货地址，等订单完成后再注销
+	var inProgress int
+	err = tx.QueryRow("SELECT COUNT(*) FROM orders WHERE user_id = ? AND order_status IN ('paid&processing', 'shipped')", request.UserID).Scan(&inProgress)
+	if err != nil {
+		return err
+	}
+	if inProgress > 0 {
+		if _, err := tx.Exec("UPDATE account_erasure_requests SET scheduled_for = ? WHERE id = ?",
+			time.Now().UTC().Add(postponeDelay), requestID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrOrdersInProgress
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET username = CONCAT(?, id), email = CONCAT('deleted+', id, '@invalid'),
+		password_hash = '!', email_verified_at = NULL, email_proven_at = NULL, full_name = NULL, phone = NULL, phone_bidx = NULL, address = NULL,
+		city = NULL, state_province = NULL, zip_postal_code = NULL, role = 'user', last_login = NULL,
+		account_status = 'inactive', refresh_token = NULL, totp_secret = NULL, totp_enabled = 0, mfa_required = 0,
+		erased_at = ?
+		WHERE id = ?
+	`, ErasedUsernamePrefix, time.Now().UTC(), request.UserID)
+	if err != nil {
+		return fmt.Errorf("清除用户资料失败: %w", err)
+	}
+	res, err := tx.Exec("UPDATE orders SET shipping_address = '', billing_address = NULL, notes = NULL WHERE user_id = ?", request.UserID)
+	if err != nil {
+		return fmt.Errorf("清除订单地址失败: %w", err)
+	}
+	ordersKept, _ := res.RowsAffected()
+	for _, table := range []string{"cart_items", "wishlist", "reviews", "user_recovery_codes", "user_identities"} {
+		// 表名是固定的，不是用户输入
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", request.UserID); err != nil {
+			return fmt.Errorf("删除 %s 失败: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE account_erasure_requests SET status = ?, completed_at = ? WHERE id = ?",
+		ErasureCompleted, time.Now().UTC(), requestID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Redis中的会话和登录记录，失败时只记录日志，会话和记录都会过期
+	if err := utils.InvalidateUserTokens(request.UserID); err != nil {
+		log.Printf("撤销已注销用户 %d 的会话失败: %v", request.UserID, err)
+	}
+	if err := utils.ForgetLogins(request.UserID); err != nil {
+		log.Printf("删除已注销用户 %d 的登录记录失败: %v", request.UserID, err)
+	}
+	if err := utils.DeleteUserSecurityEvents(request.UserID); err != nil {
+		log.Printf("删除已注销用户 %d 的安全事件失败: %v", request.UserID, err)
+	}
+
+	// 由后台任务执行，没有请求上下文，操作者记为system
+	_, err = audit.Append(audit.Event{
+		Action:        audit.ActionUserErase,
+		ActorUsername: "system",
+		TargetType:    audit.TargetUser,
+		TargetID:      strconv.Itoa(request.UserID),
+		Details: map[string]interface{}{
+			"request_id":   request.ID,
+			"requested_by": request.RequestedBy,
+			"orders_kept":  ordersKept,
+		},
+	})
+	if err != nil {
+		log.Printf("写入审计日志失败 (%s): %v", audit.ActionUserErase, err)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanErasure(row rowScanner) (*ErasureRequest, error) {
+	var (
+		request     ErasureRequest
+		cancelledAt sql.NullTime
+		cancelledBy sql.NullInt64
+		completedAt sql.NullTime
+	)
+	err := row.Scan(&request.ID, &request.UserID, &request.Status, &request.RequestedBy, &request.Reason,
+		&request.RequestedAt, &request.ScheduledFor, &cancelledAt, &cancelledBy, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	if cancelledAt.Valid {
+		request.CancelledAt = &cancelledAt.Time
+	}
+	if cancelledBy.Valid {
+		by := int(cancelledBy.Int64)
+		request.CancelledBy = &by
+	}
+	if completedAt.Valid {
+		request.CompletedAt = &completedAt.Time
+	}
+	return &request, nil
+}
@@ -0,0 +1,352 @@
+// Package privacy 处理用户个人数据的导出和账户注销。注销不删除用户记录：宽限期结束后清除账户中的
+// 个人信息，订单的金额和商品明细保留用于财务对账，只去掉地址和备注。
+package privacy
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+	"web-security/backend/db"
+	"web-security/backend/fieldcrypt"
+	"web-security/backend/models"
+)
+
+// Export 一个用户的全部个人数据
+type Export struct {
+	ExportedAt time.Time           `json:"exported_at"`
+	Profile    models.UserResponse `json:"profile"`
+	Orders     []ExportOrder       `json:"orders"`
+	Cart       []ExportCartItem    `json:"cart"`
+	Wishlist   []ExportWishlist    `json:"wishlist"`
+	Reviews    []ExportReview      `json:"reviews"`
+	Identities []ExportIdentity    `json:"identities"`
+}
+
+// ExportOrder 导出的订单，包含订单明细
+type ExportOrder struct {
+	ID               int                `json:"id"`
+	OrderNumber      string             `json:"order_number"`
+	Status           string             `json:"status"`
+	PaymentStatus    string             `json:"payment_status"`
+	PaymentMethod    string             `json:"payment_method,omitempty"`
+	Subtotal         float64            `json:"subtotal"`
+	Tax              float64            `json:"tax"`
+	ShippingCost     float64            `json:"shipping_cost"`
+	DiscountAmount   float64            `json:"discount_amount"`
+	TotalAmount      float64            `json:"total_amount"`
+	ShippingAddress  string             `json:"shipping_address"`
+	BillingAddress   string             `json:"billing_address,omitempty"`
+	ShippingTracking string             `json:"shipping_tracking,omitempty"`
+	Notes            string             `json:"notes,omitempty"`
+	CreatedAt        time.Time          `json:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at"`
+	Items            []models.OrderItem `json:"items"`
+}
+
+// ExportCartItem 导出的购物车商品
+type ExportCartItem struct {
+	ProductID   int       `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	Quantity    int       `json:"quantity"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ExportWishlist 导出的收藏商品
+type ExportWishlist struct {
+	ProductID   int       `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ExportReview 导出的商品评价
+type ExportReview struct {
+	ID          int       `json:"id"`
+	ProductID   int       `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	Rating      int       `json:"rating"`
+	Title       string    `json:"title,omitempty"`
+	Comment     string    `json:"comment,omitempty"`
+	IsApproved  bool      `json:"is_approved"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ExportIdentity 导出的第三方登录身份
+type ExportIdentity struct {
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// ExportUserData 收集用户的资料、订单、购物车、收藏、评价和绑定的第三方身份，加密的字段解密后导出
+func ExportUserData(userID int) (*Export, error) {
+	export := &Export{ExportedAt: time.Now().UTC()}
+	var err error
+	if export.Profile, err = exportProfile(userID); err != nil {
+		return nil, err
+	}
+	if export.Orders, err = exportOrders(userID); err != nil {
+		return nil, err
+	}
+	if export.Cart, err = exportCart(userID); err != nil {
+		return nil, err
+	}
+	if export.Wishlist, err = exportWishlist(userID); err != nil {
+		return nil, err
+	}
+	if export.Reviews, err = exportReviews(userID); err != nil {
+		return nil, err
+	}
+	if export.Identities, err = exportIdentities(userID); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// WriteZip 把导出的数据按类别写成ZIP中的多个JSON文件
+func (e *Export) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", e.Profile},
+		{"orders.json", e.Orders},
+		{"cart.json", e.Cart},
+		{"wishlist.json", e.Wishlist},
+		{"reviews.json", e.Reviews},
+		{"identities.json", e.Identities},
+	}
+	for _, file := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: e.ExportedAt})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func exportProfile(userID int) (models.UserResponse, error) {
+	var (
+		profile                             models.UserResponse
+		fullName, stateProvince             sql.NullString
+		phone, address, city, zipPostalCode sql.NullString
+		emailVerifiedAt                     sql.NullTime
+	)
+	err := db.DB.QueryRow(`
+		SELECT id, username, email, email_verified_at, full_name, phone, address, city, state_province, zip_postal_code,
+		role, last_login, account_status, created_at, updated_at
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&profile.ID, &profile.Username, &profile.Email, &emailVerifiedAt, &fullName, &phone, &address, &city,
+		&stateProvince, &zipPostalCode, &profile.Role, &profile.LastLogin, &profile.AccountStatus,
+		&profile.CreatedAt, &profile.UpdatedAt,
+	)
+	if err != nil {
+		return profile, err
+	}
+	profile.EmailVerified = emailVerifiedAt.Valid
+	profile.FullName = fullName.String
+	profile.StateProvince = stateProvince.String
+
+	if profile.Phone, err = fieldcrypt.DecryptNull(fieldcrypt.UserPhone, phone); err != nil {
+		return profile, err
+	}
+	if profile.Address, err = fieldcrypt.DecryptNull(fieldcrypt.UserAddress, address); err != nil {
+		return profile, err
+	}
+	if profile.City, err = fieldcrypt.DecryptNull(fieldcrypt.UserCity, city); err != nil {
+		return profile, err
+	}
+	profile.ZipPostalCode, err = fieldcrypt.DecryptNull(fieldcrypt.UserZipPostalCode, zipPostalCode)
+	return profile, err
+}
+
+func exportOrders(userID int) ([]ExportOrder, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, order_number, order_status, payment_status, payment_method, subtotal, tax, shipping_cost,
+		discount_amount, total_amount, shipping_address, billing_address, shipping_tracking, notes, created_at, updated_at
+		FROM orders WHERE user_id = ? ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []ExportOrder{}
+	index := map[int]int{}
+	for rows.Next() {
+		var (
+			order                                   ExportOrder
+			status, paymentStatus, paymentMethod    sql.NullString
+			billingAddress, shippingTracking, notes sql.NullString
+			shippingAddress                         string
+		)
+		err := rows.Scan(&order.ID, &order.OrderNumber, &status, &paymentStatus, &paymentMethod, &order.Subtotal,
+			&order.Tax, &order.ShippingCost, &order.DiscountAmount, &order.TotalAmount, &shippingAddress,
+			&billingAddress, &shippingTracking, &notes, &order.CreatedAt, &order.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		order.Status = status.String
+		order.PaymentStatus = paymentStatus.String
+		order.PaymentMethod = paymentMethod.String
+		order.BillingAddress = billingAddress.String
+		order.ShippingTracking = shippingTracking.String
+		order.Notes = notes.String
+		if order.ShippingAddress, err = fieldcrypt.Decrypt(fieldcrypt.OrderShippingAddress, shippingAddress); err != nil {
+			return nil, err
+		}
+		order.Items = []models.OrderItem{}
+		index[order.ID] = len(orders)
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+
+	itemRows, err := db.DB.Query(`
+		SELECT oi.id, oi.order_id, oi.product_id, oi.product_name, oi.product_sku, oi.quantity, oi.unit_price,
+		oi.discount_amount, oi.price_at_purchase, oi.subtotal, oi.item_status, oi.created_at
+		FROM order_items oi JOIN orders o ON o.id = oi.order_id
+		WHERE o.user_id = ? ORDER BY oi.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var (
+			item            models.OrderItem
+			sku, itemStatus sql.NullString
+		)
+		err := itemRows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.ProductName, &sku, &item.Quantity,
+			&item.UnitPrice, &item.DiscountAmount, &item.PriceAtPurchase, &item.Subtotal, &itemStatus, &item.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		item.ProductSKU = sku.String
+		item.ItemStatus = itemStatus.String
+		if i, ok := index[item.OrderID]; ok {
+			orders[i].Items = append(orders[i].Items, item)
+		}
+	}
+	return orders, itemRows.Err()
+}
+
+func exportCart(userID int) ([]ExportCartItem, error) {
+	rows, err := db.DB.Query(`
+		SELECT ci.product_id, p.name, ci.quantity, ci.created_at, ci.updated_at
+		FROM cart_items ci JOIN products p ON p.id = ci.product_id
+		WHERE ci.user_id = ? ORDER BY ci.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ExportCartItem{}
+	for rows.Next() {
+		var item ExportCartItem
+		if err := rows.Scan(&item.ProductID, &item.ProductName, &item.Quantity, &item.CreatedAt, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func exportWishlist(userID int) ([]ExportWishlist, error) {
+	rows, err := db.DB.Query(`
+		SELECT w.product_id, p.name, w.created_at
+		FROM wishlist w JOIN products p ON p.id = w.product_id
+		WHERE w.user_id = ? ORDER BY w.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ExportWishlist{}
+	for rows.Next() {
+		var item ExportWishlist
+		if err := rows.Scan(&item.ProductID, &item.ProductName, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func exportReviews(userID int) ([]ExportReview, error) {
+	rows, err := db.DB.Query(`
+		SELECT r.id, r.product_id, p.name, r.rating, r.title, r.comment, r.is_approved, r.created_at, r.updated_at
+		FROM reviews r JOIN products p ON p.id = r.product_id
+		WHERE r.user_id = ? ORDER BY r.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []ExportReview{}
+	for rows.Next() {
+		var (
+			review         ExportReview
+			title, comment sql.NullString
+			isApproved     sql.NullBool
+		)
+		err := rows.Scan(&review.ID, &review.ProductID, &review.ProductName, &review.Rating, &title, &comment,
+			&isApproved, &review.CreatedAt, &review.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		review.Title = title.String
+		review.Comment = comment.String
+		review.IsApproved = isApproved.Bool
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+func exportIdentities(userID int) ([]ExportIdentity, error) {
+	rows, err := db.DB.Query(`
+		SELECT provider, subject, email, created_at, last_login_at
+		FROM user_identities WHERE user_id = ? ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []ExportIdentity{}
+	for rows.Next() {
+		var (
+			identity    ExportIdentity
+			email       sql.NullString
+			lastLoginAt sql.NullTime
+		)
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &email, &identity.CreatedAt, &lastLoginAt); err != nil {
+			return nil, err
+		}
+		identity.Email = email.String
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = &lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"web-security/backend/authz"
+	"web-security/backend/handlers"
+	"web-security/backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupAPIKeyRoutes 设置API密钥的管理路由
+func SetupAPIKeyRoutes(router *gin.RouterGroup) {
+	router.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("api_keys"), middleware.RequirePermission(authz.APIKeysManage))
+	{
+		router.GET("", handlers.ListAPIKeys)
+		router.POST("", handlers.CreateAPIKey)
+		router.GET("/:id", handlers.GetAPIKey)
+		router.DELETE("/:id", handlers.RevokeAPIKey)
+	}
+}
@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"web-security/backend/authz"
+	"web-security/backend/handlers"
+	"web-security/backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupAuditRoutes 设置审计日志的查询和校验路由
+func SetupAuditRoutes(router *gin.RouterGroup) {
+	router.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("audit"), middleware.RequirePermission(authz.AuditRead))
+	{
+		router.GET("/events", handlers.ListAuditEvents)
+		router.GET("/verify", handlers.VerifyAuditLog)
+	}
+}
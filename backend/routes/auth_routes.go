@@ -9,15 +9,63 @@ import (
 
 // SetupAuthRoutes 设置与认证相关的路由
 func SetupAuthRoutes(router *gin.RouterGroup) {
-	// 公共路由（不需要认证）
-	router.POST("/register", handlers.RegisterUserHandler) // 用户注册
-	router.POST("/login", handlers.LoginUserHandler)      // 用户登录
-	router.POST("/refresh", handlers.RefreshToken)        // 刷新令牌
+	// 可以用来猜测密码、验证码或探测账户的接口使用严格的限流策略，按IP计数
+	strict := router.Group("")
+	strict.Use(middleware.RateLimit("auth"))
+	{
+		strict.POST("/register", handlers.RegisterUserHandler) // 用户注册
+		strict.POST("/login", handlers.LoginUserHandler)       // 用户登录
+
+		// 找回密码
+		strict.POST("/password/forgot", handlers.ForgotPassword) // 发送重置密码邮件
+		strict.POST("/password/reset", handlers.ResetPassword)   // 使用重置令牌设置新密码
+
+		// 邮箱验证
+		strict.GET("/email/verify", handlers.VerifyEmail) // 通过邮件中的链接验证邮箱
 
-	// 需要认证的路由
+		// 登录第二步（两步验证），使用登录时返回的mfa_token认证
+		mfaLogin := strict.Group("/login/mfa")
+		mfaLogin.Use(middleware.MFAPendingMiddleware())
+		{
+			mfaLogin.POST("", handlers.VerifyLoginMFA)           // 提交TOTP验证码或恢复码
+			mfaLogin.POST("/totp/enroll", handlers.EnrollTOTP)   // 被要求使用两步验证但尚未绑定时，在登录过程中绑定
+			mfaLogin.POST("/totp/confirm", handlers.ConfirmTOTP) // 确认绑定并完成登录
+		}
+
+		// 第三方登录（OpenID Connect）：后端生成授权地址，提供方跳转回前端后，由前端提交回调中的code和state
+		strict.GET("/oidc/providers", handlers.ListOIDCProviders)         // 可用的登录方式
+		strict.POST("/oidc/:provider/authorize", handlers.StartOIDCLogin) // 获取授权地址
+		strict.POST("/oidc/:provider/callback", handlers.OIDCCallback)    // 完成登录或绑定
+
+		// 异常登录的二次验证，使用登录时返回的step_up_token认证
+		strict.POST("/login/step-up", middleware.LoginStepUpMiddleware(), handlers.VerifyLoginStepUp) // 提交邮件验证码
+	}
+
+	// 刷新令牌和获取CSRF令牌在正常使用时调用频繁，使用较宽松的策略
+	router.POST("/refresh", middleware.RateLimit("session"), handlers.RefreshToken) // 刷新令牌
+	router.GET("/csrf", middleware.RateLimit("session"), handlers.GetCSRFToken)     // 获取CSRF令牌（Cookie认证模式）
+
+	// 需要认证的路由：认证之前按IP限流，认证之后按用户限流
 	protected := router.Group("")
-	protected.Use(middleware.AuthMiddleware())
+	protected.Use(middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("session"))
 	{
-		protected.POST("/logout", handlers.LogoutHandler) // 用户注销
+		protected.POST("/logout", handlers.LogoutHandler)                                               // 用户注销
+		protected.POST("/email/resend", middleware.RateLimit("auth"), handlers.ResendVerificationEmail) // 重新发送验证邮件
+
+		// 会话管理
+		protected.GET("/sessions", handlers.ListMySessions)         // 查看所有设备上的会话
+		protected.DELETE("/sessions/:id", handlers.RevokeMySession) // 撤销指定会话
+		protected.DELETE("/sessions", handlers.RevokeOtherSessions) // 退出其他所有设备
+
+		// 两步验证管理，需要提交验证码，和登录一样使用严格策略
+		protected.POST("/mfa/totp/enroll", middleware.RateLimit("auth"), handlers.EnrollTOTP)                 // 生成TOTP密钥
+		protected.POST("/mfa/totp/confirm", middleware.RateLimit("auth"), handlers.ConfirmTOTP)               // 确认绑定并获取恢复码
+		protected.POST("/mfa/totp/disable", middleware.RateLimit("auth"), handlers.DisableTOTP)               // 关闭两步验证
+		protected.POST("/mfa/recovery-codes", middleware.RateLimit("auth"), handlers.RegenerateRecoveryCodes) // 重新生成恢复码
+
+		// 绑定的第三方身份
+		protected.POST("/oidc/:provider/link", middleware.RateLimit("auth"), handlers.StartOIDCLink) // 获取绑定新身份的授权地址
+		protected.GET("/oidc/identities", handlers.ListMyIdentities)                                 // 查看绑定的身份
+		protected.DELETE("/oidc/identities/:id", handlers.UnlinkMyIdentity)                          // 解除绑定
 	}
 }
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
 	"web-security/backend/middleware"
 
@@ -11,7 +12,7 @@ import (
 func SetupCartRoutes(router *gin.RouterGroup) {
 	// 所有购物车路由都需要认证
 	cartRoutes := router.Group("")
-	cartRoutes.Use(middleware.AuthMiddleware())
+	cartRoutes.Use(middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("cart"))
 	{
 		// 获取购物车
 		cartRoutes.GET("", handlers.GetCart)
@@ -19,11 +20,11 @@ func SetupCartRoutes(router *gin.RouterGroup) {
 		// 添加商品到购物车
 		cartRoutes.POST("", handlers.AddToCart)
 		
-		// 更新购物车商品数量
-		cartRoutes.PUT("/:id", handlers.UpdateCartItem)
+		// 更新购物车商品数量，只能修改自己的购物车项
+		cartRoutes.PUT("/:id", middleware.RequireOwnership(authz.CartItems, "id", ""), handlers.UpdateCartItem)
 		
 		// 删除购物车商品
-		cartRoutes.DELETE("/:id", handlers.RemoveFromCart)
+		cartRoutes.DELETE("/:id", middleware.RequireOwnership(authz.CartItems, "id", ""), handlers.RemoveFromCart)
 		
 		// 清空购物车
 		cartRoutes.DELETE("", handlers.ClearCart)
@@ -1,8 +1,9 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
-	// "web-security/backend/middleware" // For admin auth middleware later
+	"web-security/backend/middleware"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,20 +11,15 @@ import (
 // SetupCategoryRoutes sets up the category-related routes
 func SetupCategoryRoutes(router *gin.RouterGroup) {
 	// Public routes for viewing categories
-	router.GET("/", handlers.GetCategories)
-	router.GET("/:id", handlers.GetCategoryByID)
+	router.GET("/", middleware.RateLimit("catalog"), handlers.GetCategories)
+	router.GET("/:id", middleware.RateLimit("catalog"), handlers.GetCategoryByID)
 
-	// Admin/Protected routes for managing categories
-	// adminGroup := router.Group("/")
-	// adminGroup.Use(middleware.AdminAuthMiddleware()) // Placeholder for admin auth
-	// {
-	//  adminGroup.POST("/", handlers.CreateCategory)
-	//  adminGroup.PUT("/:id", handlers.UpdateCategory)
-	//  adminGroup.DELETE("/:id", handlers.DeleteCategory)
-	// }
-
-	// For now, without specific admin middleware
-	router.POST("/", handlers.CreateCategory)
-	router.PUT("/:id", handlers.UpdateCategory)
-	router.DELETE("/:id", handlers.DeleteCategory)
+	// Catalog management needs an authenticated user with the categories:write permission
+	adminGroup := router.Group("/")
+	adminGroup.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("admin_categories"), middleware.RequirePermission(authz.CategoriesWrite))
+	{
+		adminGroup.POST("/", handlers.CreateCategory)
+		adminGroup.PUT("/:id", handlers.UpdateCategory)
+		adminGroup.DELETE("/:id", handlers.DeleteCategory)
+	}
 }
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"web-security/backend/authz"
+	"web-security/backend/handlers"
+	"web-security/backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupIPRuleRoutes 设置IP访问规则的管理路由
+func SetupIPRuleRoutes(router *gin.RouterGroup) {
+	router.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("ip_rules"), middleware.RequirePermission(authz.IPRulesManage))
+	{
+		router.GET("", handlers.ListIPRules)
+		router.POST("", handlers.CreateIPRule)
+		router.DELETE("/:id", handlers.DeleteIPRule)
+	}
+}
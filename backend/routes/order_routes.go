@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
 	"web-security/backend/middleware" // For authentication middleware
 
@@ -10,25 +11,26 @@ import (
 // SetupOrderRoutes sets up the order-related routes
 func SetupOrderRoutes(router *gin.RouterGroup) { // router is effectively /api/orders
 	// Route for creating an order: POST /api/orders
-	// Apply AuthMiddleware directly to this route.
-	router.POST("", middleware.AuthMiddleware(), handlers.CreateOrder)
+	// Apply AuthMiddleware directly to this route. Accounts with an unverified email cannot place orders.
+	router.POST("", middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("orders"), middleware.RequireVerifiedEmail(), handlers.CreateOrder)
 
 	// Group for other user-specific order routes that have further path segments
 	// e.g., /api/orders/user/:userID, /api/orders/:id
 	// These routes will effectively be under /api/orders/ due to their path segments
 	userOrderSpecificRoutes := router.Group("/") // This group is still effectively /api/orders base
-	userOrderSpecificRoutes.Use(middleware.AuthMiddleware())
+	userOrderSpecificRoutes.Use(middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("orders"))
 	{
-		userOrderSpecificRoutes.GET("/user/:userID", handlers.GetOrdersByUserID) // Path: /api/orders/user/:userID
-		userOrderSpecificRoutes.GET("/:id", handlers.GetOrderByID)               // Path: /api/orders/:id
+		// Users only see their own orders, staff with orders:read see everyone's
+		userOrderSpecificRoutes.GET("/user/:userID", middleware.RequireSelfOrPermission("userID", authz.OrdersRead), handlers.GetOrdersByUserID) // Path: /api/orders/user/:userID
+		userOrderSpecificRoutes.GET("/:id", middleware.RequireOwnership(authz.Orders, "id", authz.OrdersRead), handlers.GetOrderByID)           // Path: /api/orders/:id
 	}
 
-	// Admin routes for managing orders
+	// Staff routes for managing orders
 	// e.g., /api/orders/:id/status
 	adminOrderRoutes := router.Group("/") // This group is still effectively /api/orders base
-	adminOrderRoutes.Use(middleware.AdminAuthMiddleware())
+	adminOrderRoutes.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("admin_orders"))
 	{
-		adminOrderRoutes.PUT("/:id/status", handlers.UpdateOrderStatus)       // Path: /api/orders/:id/status
+		adminOrderRoutes.PUT("/:id/status", middleware.RequirePermission(authz.OrdersUpdateStatus), handlers.UpdateOrderStatus) // Path: /api/orders/:id/status
 		// adminOrderRoutes.GET("/", handlers.GetAllOrders) // If an admin needs to see all orders at /api/orders/ (use with care due to POST "" above)
 	}
 }
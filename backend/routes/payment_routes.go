@@ -1,18 +1,26 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
+	"web-security/backend/middleware"
 
 	"github.com/gin-gonic/gin"
 )
 
 // SetupPaymentRoutes sets up the payment-related routes
 func SetupPaymentRoutes(router *gin.RouterGroup) {
-	// Order payment endpoints
-	router.POST("/orders/:id/checkout", handlers.CreatePaymentSession)
-	router.GET("/orders/:id/payment-status", handlers.CheckPaymentStatus)
-	
-	// Payment callback endpoints
-	router.GET("/success", handlers.HandlePaymentSuccess)
-	router.GET("/cancel", handlers.HandlePaymentCancel)
+	// Order payment endpoints are tied to the logged in user; strict limits on everything that talks to the payment provider.
+	// Only the owner can pay for an order, staff with orders:read can check its status
+	orderPayments := router.Group("/orders/:id")
+	orderPayments.Use(middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("payments"))
+	{
+		orderPayments.POST("/checkout", middleware.RequireOwnership(authz.Payments, "id", ""), handlers.CreatePaymentSession)
+		orderPayments.GET("/payment-status", middleware.RequireOwnership(authz.Payments, "id", authz.OrdersRead), handlers.CheckPaymentStatus)
+	}
+
+	// Payment callback endpoints. Stripe redirects the browser here without our Authorization header,
+	// so the payment is confirmed through the Stripe checkout session instead of the logged in user
+	router.GET("/success", middleware.RateLimit("payments"), handlers.HandlePaymentSuccess)
+	router.GET("/cancel", middleware.RateLimit("payments"), handlers.HandlePaymentCancel)
 }
@@ -1,8 +1,9 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
-	// "web-security/backend/middleware" // For admin auth middleware later
+	"web-security/backend/middleware"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,20 +11,16 @@ import (
 // SetupProductRoutes sets up the product-related routes
 func SetupProductRoutes(router *gin.RouterGroup) {
 	// Public routes for viewing products
-	router.GET("", handlers.GetProducts)    // Changed from "/" to "" to match without trailing slash
-	router.GET("/:id", handlers.GetProductByID)
+	// Browsing the catalog gets a loose limit
+	router.GET("", middleware.RateLimit("catalog"), handlers.GetProducts)    // Changed from "/" to "" to match without trailing slash
+	router.GET("/:id", middleware.RateLimit("catalog"), handlers.GetProductByID)
 
-	// Admin/Protected routes for managing products
-	// adminGroup := router.Group("")  // Changed from "/" to ""
-	// adminGroup.Use(middleware.AdminAuthMiddleware()) // Placeholder for admin auth
-	// {
-	//  adminGroup.POST("", handlers.CreateProduct)  // Changed from "/" to ""
-	//  adminGroup.PUT("/:id", handlers.UpdateProduct)
-	//  adminGroup.DELETE("/:id", handlers.DeleteProduct)
-	// }
-
-	// For now, without specific admin middleware for simplicity of initial setup
-	router.POST("", handlers.CreateProduct)  // Changed from "/" to "" to match without trailing slash
-	router.PUT("/:id", handlers.UpdateProduct)
-	router.DELETE("/:id", handlers.DeleteProduct)
+	// Catalog management needs an authenticated user with the products:write permission
+	adminGroup := router.Group("")
+	adminGroup.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("admin_products"), middleware.RequirePermission(authz.ProductsWrite))
+	{
+		adminGroup.POST("", handlers.CreateProduct) // "" rather than "/" to match without trailing slash
+		adminGroup.PUT("/:id", handlers.UpdateProduct)
+		adminGroup.DELETE("/:id", handlers.DeleteProduct)
+	}
 }
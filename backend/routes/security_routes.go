@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"web-security/backend/handlers"
+	"web-security/backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupSecurityRoutes 设置安全相关的路由。
+// 浏览器发送CSP报告时会携带Cookie但不会带CSRF头，因此该路由组不能挂在使用CSRFMiddleware的/api组下。
+func SetupSecurityRoutes(router *gin.RouterGroup) {
+	router.POST("/csp-report", middleware.RateLimit("csp_report"), handlers.ReportCSPViolation)
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"web-security/backend/authz"
 	"web-security/backend/handlers"
 	"web-security/backend/middleware"
 
@@ -11,29 +12,51 @@ import (
 func SetupUserRoutes(router *gin.RouterGroup) {
 	// 注意：主要认证路由已移至auth_routes.go
 	// 这里保留向后兼容，不再推荐使用
-	router.POST("/register", handlers.RegisterUserHandler)
-	router.POST("/login", handlers.LoginUserHandler)
+	router.POST("/register", middleware.RateLimit("auth"), handlers.RegisterUserHandler)
+	router.POST("/login", middleware.RateLimit("auth"), handlers.LoginUserHandler)
 
 	// 受保护的路由 - 需要认证
 	authGroup := router.Group("/")
-	authGroup.Use(middleware.AuthMiddleware())
+	authGroup.Use(middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("users"))
 	{
 		// 用户资料管理
 		authGroup.GET("/profile", handlers.GetUserProfile)
 		authGroup.PUT("/profile", handlers.UpdateUserProfile)
+		authGroup.PUT("/password", handlers.ChangePassword)
 
 		// 用户偏好设置
 		authGroup.GET("/preferences", handlers.GetUserPreferences)
 		authGroup.PUT("/preferences", handlers.UpdateUserPreferences)
+
+		// 个人数据导出和账户注销
+		authGroup.GET("/me/export", handlers.ExportMyData)
+		authGroup.GET("/me/erasure", handlers.GetMyErasureRequest)
+		authGroup.POST("/me/erasure", middleware.RateLimit("auth"), handlers.RequestMyErasure) // 需要密码，和登录一样限制尝试次数
+		authGroup.DELETE("/me/erasure", handlers.CancelMyErasure)
 	}
 
-	// 管理员路由 - 需要管理员权限
+	// 管理员路由 - 每个接口需要对应的权限
 	adminGroup := router.Group("/admin")
-	adminGroup.Use(middleware.AdminAuthMiddleware())
+	adminGroup.Use(middleware.AdminIPAllowlist(), middleware.RateLimit("pre_auth"), middleware.AuthMiddleware(), middleware.RateLimit("admin_users"))
 	{
-		adminGroup.GET("/", handlers.ListAllUsers)
-		adminGroup.GET("/:id", handlers.GetUserByID)
-		adminGroup.PUT("/:id/status", handlers.UpdateUserStatus)
-		adminGroup.DELETE("/:id", handlers.DeleteUser)
+		adminGroup.GET("/", middleware.RequirePermission(authz.UsersRead), handlers.ListAllUsers)
+		adminGroup.GET("/:id", middleware.RequirePermission(authz.UsersRead), handlers.GetUserByID)
+		adminGroup.PUT("/:id/status", middleware.RequirePermission(authz.UsersSuspend), handlers.UpdateUserStatus)
+		adminGroup.DELETE("/:id", middleware.RequirePermission(authz.UsersDelete), handlers.DeleteUser)
+		adminGroup.GET("/:id/erasure", middleware.RequirePermission(authz.UsersDelete), handlers.AdminGetUserErasure)
+		adminGroup.DELETE("/:id/erasure", middleware.RequirePermission(authz.UsersDelete), handlers.AdminCancelUserErasure)
+
+		// 用户会话管理，无需停用账户即可让被盗用的设备下线
+		adminGroup.GET("/:id/sessions", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminListUserSessions)
+		adminGroup.DELETE("/:id/sessions", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminRevokeAllUserSessions)
+		adminGroup.DELETE("/:id/sessions/:sessionID", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminRevokeUserSession)
+		adminGroup.GET("/:id/security-events", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminListUserSecurityEvents)
+		adminGroup.PUT("/:id/mfa-required", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminSetMFARequired)
+		adminGroup.DELETE("/:id/login-lock", middleware.RequirePermission(authz.UsersSecurity), handlers.AdminUnlockUserLogin)
+
+		// 角色和权限管理
+		adminGroup.PUT("/:id/role", middleware.RequirePermission(authz.UsersRoles), handlers.AdminSetUserRole)
+		adminGroup.GET("/roles", middleware.RequirePermission(authz.UsersRoles), handlers.ListRoles)
+		adminGroup.PUT("/roles/:role/permissions", middleware.RequirePermission(authz.UsersRoles), handlers.SetRolePermissions)
 	}
 }
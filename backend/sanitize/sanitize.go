@@ -0,0 +1,327 @@
+// Package sanitize 按结构体字段上的sanitize标签净化请求体。安装为gin的校验器后，
+// 所有ShouldBind*调用在校验binding规则之前先净化字段，不符合策略的输入以400拒绝。
+package sanitize
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// TagName 请求结构体字段上声明净化策略的标签，例如 `sanitize:"text"`
+const TagName = "sanitize"
+
+// 净化策略，未标记的字段不做处理，等同于PolicyNone
+const (
+	// PolicyText 纯文本：去掉首尾空白，包含HTML标签、控制字符或非法UTF-8时拒绝
+	PolicyText = "text"
+	// PolicyHTML 富文本：按UGC策略保留安全的HTML，去掉脚本、事件属性等危险内容
+	PolicyHTML = "html"
+	// PolicyURL 链接：只允许http/https绝对地址或以/开头的站内路径
+	PolicyURL = "url"
+	// PolicyNone 不处理，用于密码、令牌等需要原样保留的字段
+	PolicyNone = "none"
+)
+
+var ugcPolicy = bluemonday.UGCPolicy()
+
+// ErrInvalidTag 请求结构体上的sanitize标签写错了（未知的策略或不支持的字段类型），属于程序错误而不是输入错误
+var ErrInvalidTag = errors.New("无效的sanitize标签")
+
+// checkedTypes 已经检查过标签的结构体类型，值为检查结果（nil表示标签都有效）
+var checkedTypes sync.Map
+
+// Violation 一个字段不符合净化策略
+type Violation struct {
+	Field   string `json:"field"`
+	Policy  string `json:"policy"`
+	Message string `json:"message"`
+}
+
+// Violations 一次绑定中发现的全部违规字段
+type Violations []Violation
+
+func (v Violations) Error() string {
+	parts := make([]string, len(v))
+	for i, violation := range v {
+		parts[i] = violation.Field + ": " + violation.Message
+	}
+	return "输入内容不合法 (" + strings.Join(parts, "; ") + ")"
+}
+
+// Validator 在gin的默认校验之前按sanitize标签净化请求结构体，
+// 这样binding标签中的长度等规则校验的是净化后的值
+type Validator struct {
+	next binding.StructValidator
+}
+
+// Install 替换gin的全局校验器，之后所有ShouldBind*调用都会先净化再校验，需要在注册路由前调用
+func Install() {
+	if _, ok := binding.Validator.(*Validator); ok {
+		return
+	}
+	binding.Validator = &Validator{next: binding.Validator}
+}
+
+// ValidateStruct 实现binding.StructValidator
+func (v *Validator) ValidateStruct(obj any) error {
+	if err := Struct(obj); err != nil {
+		return err
+	}
+	if v.next == nil {
+		return nil
+	}
+	return v.next.ValidateStruct(obj)
+}
+
+// Engine 实现binding.StructValidator，返回底层的校验引擎
+func (v *Validator) Engine() any {
+	if v.next == nil {
+		return nil
+	}
+	return v.next.Engine()
+}
+
+// Struct 按sanitize标签就地净化obj，obj必须是指针，发现违规时返回Violations
+func Struct(obj any) error {
+	value := reflect.ValueOf(obj)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return nil
+	}
+	if err := CheckTags(value.Elem().Type()); err != nil {
+		return err
+	}
+	var violations Violations
+	walk(value.Elem(), "", &violations)
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
+
+// CheckTags 检查类型中所有sanitize标签的策略和字段类型，每个类型只检查一次。
+// 标签无效时返回包装了ErrInvalidTag的错误，绑定时由调用方作为服务器错误处理，不会在请求中panic
+func CheckTags(typ reflect.Type) error {
+	if cached, ok := checkedTypes.Load(typ); ok {
+		err, _ := cached.(error)
+		return err
+	}
+	err := checkType(typ, typ.String(), map[reflect.Type]bool{})
+	if err != nil {
+		checkedTypes.Store(typ, err)
+	} else {
+		checkedTypes.Store(typ, true)
+	}
+	return err
+}
+
+// checkType 递归检查结构体、指针和切片中的字段，visited防止自引用的类型无限递归
+func checkType(typ reflect.Type, path string, visited map[reflect.Type]bool) error {
+	switch typ.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return checkType(typ.Elem(), path, visited)
+	case reflect.Struct:
+		if visited[typ] {
+			return nil
+		}
+		visited[typ] = true
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := path + "." + field.Name
+			policy := field.Tag.Get(TagName)
+			if policy == "" || policy == PolicyNone {
+				if err := checkType(field.Type, name, visited); err != nil {
+					return err
+				}
+				continue
+			}
+			if !knownPolicy(policy) {
+				return fmt.Errorf("%w: 字段 %s 使用了未知的净化策略 %q", ErrInvalidTag, name, policy)
+			}
+			if !stringLike(field.Type) {
+				return fmt.Errorf("%w: 字段 %s 的类型 %s 不支持净化策略 %q", ErrInvalidTag, name, field.Type, policy)
+			}
+		}
+	}
+	return nil
+}
+
+// stringLike 判断类型是否为string，或者由指针和切片包装的string
+func stringLike(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.String:
+		return true
+	case reflect.Pointer, reflect.Slice:
+		return stringLike(typ.Elem())
+	}
+	return false
+}
+
+// knownPolicy 判断是否为已定义的净化策略
+func knownPolicy(policy string) bool {
+	switch policy {
+	case PolicyNone, PolicyText, PolicyHTML, PolicyURL:
+		return true
+	}
+	return false
+}
+
+// walk 递归处理结构体、指针和切片中带标签的字符串字段
+func walk(value reflect.Value, path string, violations *Violations) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			walk(value.Elem(), path, violations)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			walk(value.Index(i), path+"["+strconv.Itoa(i)+"]", violations)
+		}
+	case reflect.Struct:
+		typ := value.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := fieldName(field)
+			if path != "" {
+				name = path + "." + name
+			}
+			policy := field.Tag.Get(TagName)
+			if policy == "" || policy == PolicyNone {
+				walk(value.Field(i), name, violations)
+				continue
+			}
+			applyPolicy(value.Field(i), name, policy, violations)
+		}
+	}
+}
+
+// applyPolicy 处理string、*string和[]string字段，字段类型已经由CheckTags检查过
+func applyPolicy(value reflect.Value, name, policy string, violations *Violations) {
+	switch value.Kind() {
+	case reflect.Pointer:
+		if !value.IsNil() {
+			applyPolicy(value.Elem(), name, policy, violations)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			applyPolicy(value.Index(i), name+"["+strconv.Itoa(i)+"]", policy, violations)
+		}
+	case reflect.String:
+		cleaned, err := Value(policy, value.String())
+		if err != nil {
+			*violations = append(*violations, Violation{Field: name, Policy: policy, Message: err.Error()})
+			return
+		}
+		if value.CanSet() {
+			value.SetString(cleaned)
+		}
+	}
+}
+
+// Value 按策略净化单个值，不符合策略时返回原因，策略未定义时返回包装了ErrInvalidTag的错误
+func Value(policy, s string) (string, error) {
+	switch policy {
+	case PolicyNone, "":
+		return s, nil
+	case PolicyText:
+		return Text(s)
+	case PolicyHTML:
+		return HTML(s)
+	case PolicyURL:
+		return URL(s)
+	default:
+		return "", fmt.Errorf("%w: 未知的净化策略 %q", ErrInvalidTag, policy)
+	}
+}
+
+// Text 净化纯文本，返回去掉首尾空白的原文，不对内容做转义，输出时由前端转义
+func Text(s string) (string, error) {
+	if err := checkCharacters(s, true); err != nil {
+		return "", err
+	}
+	s = strings.TrimSpace(s)
+	if tagOpen.MatchString(s) {
+		return "", fmt.Errorf("不能包含HTML标签")
+	}
+	return s, nil
+}
+
+// tagOpen 匹配浏览器会当作标签、注释或文档类型声明开头的"<"，未闭合的标签也算在内，
+// 防止和其他内容拼接后形成标签；单独的<、>和&等字符不受影响
+var tagOpen = regexp.MustCompile(`<[a-zA-Z/!?]`)
+
+// HTML 按UGC策略净化富文本
+func HTML(s string) (string, error) {
+	if err := checkCharacters(s, true); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(ugcPolicy.Sanitize(s)), nil
+}
+
+// URL 校验链接，空字符串视为未填写
+func URL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return s, nil
+	}
+	if err := checkCharacters(s, false); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(s, " \\\"'<>") {
+		return "", fmt.Errorf("链接包含不允许的字符")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("不是合法的链接")
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//"):
+		// 站内路径
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	default:
+		return "", fmt.Errorf("只允许http/https链接或以/开头的站内路径")
+	}
+	return s, nil
+}
+
+// checkCharacters 拒绝非法UTF-8和控制字符，multiline为true时允许换行和制表符
+func checkCharacters(s string, multiline bool) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("包含非法的UTF-8字符")
+	}
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\r' || r == '\t') {
+			continue
+		}
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return fmt.Errorf("包含不允许的控制字符")
+		}
+	}
+	return nil
+}
+
+// fieldName 使用json标签中的字段名，与请求体中的名字一致
+func fieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cookie名称
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFTokenCookie    = "csrf_token"
+
+	// CSRFHeader 客户端需要在状态变更请求中通过该请求头回传csrf_token Cookie的值
+	CSRFHeader = "X-CSRF-Token"
+
+	// refreshTokenCookiePath 刷新令牌只需要发送给认证接口，缩小Cookie的发送范围
+	refreshTokenCookiePath = "/api/auth"
+)
+
+// CookieConfig 描述认证Cookie的属性
+type CookieConfig struct {
+	// Secure 只通过HTTPS发送Cookie，生产环境必须开启
+	Secure bool
+	// HTTPOnly 禁止前端JavaScript读取令牌Cookie
+	HTTPOnly bool
+	// SameSite 可选值：lax、strict、none（none要求同时开启Secure）
+	SameSite string
+	// Domain Cookie的域名，留空表示仅用于当前域名
+	Domain string
+	// CookieOnly 为true时登录和刷新接口不再在响应体中返回令牌，只通过Cookie下发
+	CookieOnly bool
+	// CSRFSecret 计算CSRF令牌时使用的HMAC密钥，令牌与会话绑定，留空时使用临时生成的密钥
+	CSRFSecret string
+}
+
+var cookieConfig = struct {
+	secure     bool
+	httpOnly   bool
+	sameSite   http.SameSite
+	domain     string
+	cookieOnly bool
+	csrfSecret []byte
+}{
+	httpOnly: true,
+	sameSite: http.SameSiteLaxMode,
+}
+
+// InitAuthCookies 根据配置设置认证Cookie的属性
+func InitAuthCookies(cfg CookieConfig) error {
+	var sameSite http.SameSite
+	switch strings.ToLower(cfg.SameSite) {
+	case "", "lax":
+		sameSite = http.SameSiteLaxMode
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		if !cfg.Secure {
+			return fmt.Errorf("COOKIE_SAMESITE=none 需要同时开启 COOKIE_SECURE")
+		}
+		sameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("不支持的SameSite值: %s", cfg.SameSite)
+	}
+
+	cookieConfig.secure = cfg.Secure
+	cookieConfig.httpOnly = cfg.HTTPOnly
+	cookieConfig.sameSite = sameSite
+	cookieConfig.domain = cfg.Domain
+	cookieConfig.cookieOnly = cfg.CookieOnly
+
+	if cfg.CSRFSecret != "" {
+		cookieConfig.csrfSecret = []byte(cfg.CSRFSecret)
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	cookieConfig.csrfSecret = key
+	log.Printf("警告: 未配置CSRF_SECRET，使用临时生成的密钥计算CSRF令牌，重启后或多实例部署时需要重新获取令牌")
+	return nil
+}
+
+// TokensInResponseBody 登录和刷新接口是否在响应体中返回令牌
+func TokensInResponseBody() bool {
+	return !cookieConfig.cookieOnly
+}
+
+// setCookie 使用配置的属性写入Cookie
+func setCookie(c *gin.Context, name, value string, maxAge int, path string, httpOnly bool) {
+	c.SetSameSite(cookieConfig.sameSite)
+	c.SetCookie(name, value, maxAge, path, cookieConfig.domain, cookieConfig.secure, httpOnly)
+}
+
+// SetAuthCookies 写入访问令牌和刷新令牌Cookie，并在需要时下发与会话绑定的CSRF令牌
+func SetAuthCookies(c *gin.Context, sessionID, accessToken, refreshToken string) error {
+	setCookie(c, AccessTokenCookie, accessToken, int(AccessTokenExpiry.Seconds()), "/", cookieConfig.httpOnly)
+	setCookie(c, RefreshTokenCookie, refreshToken, int(RefreshTokenExpiry.Seconds()), refreshTokenCookiePath, cookieConfig.httpOnly)
+
+	// 已有绑定到同一会话的CSRF令牌时保持不变，避免其他标签页中正在进行的请求失败
+	if token, err := c.Cookie(CSRFTokenCookie); err == nil && ValidCSRFToken(token, sessionID) {
+		return nil
+	}
+	_, err := IssueCSRFToken(c, sessionID)
+	return err
+}
+
+// ClearAuthCookies 清除认证相关的Cookie
+func ClearAuthCookies(c *gin.Context) {
+	setCookie(c, AccessTokenCookie, "", -1, "/", cookieConfig.httpOnly)
+	setCookie(c, RefreshTokenCookie, "", -1, refreshTokenCookiePath, cookieConfig.httpOnly)
+	// 旧版本把刷新令牌Cookie写在根路径下，一并清除
+	setCookie(c, RefreshTokenCookie, "", -1, "/", cookieConfig.httpOnly)
+	setCookie(c, CSRFTokenCookie, "", -1, "/", false)
+}
+
+// SetFlowCookie 写入短时间有效的HttpOnly Cookie，用于把多步骤的流程（如第三方登录）绑定到发起它的浏览器
+func SetFlowCookie(c *gin.Context, name, value string, maxAge int, path string) {
+	setCookie(c, name, value, maxAge, path, true)
+}
+
+// ClearFlowCookie 清除SetFlowCookie写入的Cookie
+func ClearFlowCookie(c *gin.Context, name, path string) {
+	setCookie(c, name, "", -1, path, true)
+}
+
+// IssueCSRFToken 生成与会话绑定的CSRF令牌并写入Cookie。该Cookie不设置HttpOnly，前端需要读取后放入X-CSRF-Token请求头。
+// 令牌格式为"随机数.HMAC(会话ID, 随机数)"，通过其他途径（如兄弟子域名）注入的Cookie无法用于别人的会话。
+func IssueCSRFToken(c *gin.Context, sessionID string) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	token := nonce + "." + csrfTokenMAC(sessionID, nonce)
+	setCookie(c, CSRFTokenCookie, token, int(RefreshTokenExpiry.Seconds()), "/", false)
+	return token, nil
+}
+
+// ValidCSRFToken 检查CSRF令牌是否绑定到指定的会话
+func ValidCSRFToken(token, sessionID string) bool {
+	nonce, mac, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(csrfTokenMAC(sessionID, nonce)))
+}
+
+// csrfTokenMAC 计算CSRF令牌中的HMAC部分
+func csrfTokenMAC(sessionID, nonce string) string {
+	h := hmac.New(sha256.New, cookieConfig.csrfSecret)
+	h.Write([]byte(sessionID + ":" + nonce))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CookieSessionID 返回认证Cookie中令牌所属的会话ID，没有有效的令牌时返回空字符串。
+// 只校验签名不校验过期时间，访问令牌过期的请求仍能确定CSRF令牌绑定的会话，令牌是否有效由认证中间件判断。
+func CookieSessionID(c *gin.Context) string {
+	for _, name := range []string{AccessTokenCookie, RefreshTokenCookie} {
+		token, err := c.Cookie(name)
+		if err != nil || token == "" {
+			continue
+		}
+		if claims, err := parseTokenIgnoringExpiry(token); err == nil && claims.SessionID != "" {
+			return claims.SessionID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+)
+
+const (
+	// EmailVerificationTokenExpiry 邮箱验证链接的有效期
+	EmailVerificationTokenExpiry = 48 * time.Hour
+
+	// 重新发送验证邮件的冷却时间和每小时上限
+	verificationResendCooldown = time.Minute
+	verificationResendPerHour  = 5
+	// 冷却键为"email_verify_cooldown:用户ID"，计数键为"email_verify_resend:用户ID"
+	verificationCooldownPrefix = "email_verify_cooldown:"
+	verificationResendPrefix   = "email_verify_resend:"
+)
+
+// ErrInvalidVerificationToken 验证链接无效、被篡改或已过期
+var ErrInvalidVerificationToken = errors.New("验证链接无效或已过期")
+
+var emailVerification = struct {
+	required bool
+	secret   []byte
+}{}
+
+// InitEmailVerification 初始化邮箱验证。required为true时，未验证邮箱的账户会被限制部分功能。
+// 未配置签名密钥时使用随机密钥，重启后之前发出的验证链接全部失效，只适合本地开发。
+func InitEmailVerification(required bool, secret string) error {
+	emailVerification.required = required
+	if secret != "" {
+		emailVerification.secret = []byte(secret)
+		return nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	emailVerification.secret = key
+	if required {
+		log.Printf("警告: 未配置EMAIL_VERIFICATION_SECRET，使用临时生成的密钥签名验证链接，重启后链接失效")
+	}
+	return nil
+}
+
+// EmailVerificationRequired 是否要求用户验证邮箱
+func EmailVerificationRequired() bool {
+	return emailVerification.required
+}
+
+// emailVerificationPayload 验证链接中携带的内容，包含邮箱地址，修改邮箱后旧链接自动失效
+type emailVerificationPayload struct {
+	UserID    int    `json:"uid"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// GenerateEmailVerificationToken 生成签名的邮箱验证令牌，格式为"base64(内容).base64(HMAC-SHA256)"
+func GenerateEmailVerificationToken(userID int, email string) (string, error) {
+	payload, err := json.Marshal(emailVerificationPayload{
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(EmailVerificationTokenExpiry).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signVerificationPayload(encoded), nil
+}
+
+// ParseEmailVerificationToken 校验签名和有效期，返回令牌对应的用户ID和邮箱
+func ParseEmailVerificationToken(token string) (int, string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	encoded, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signVerificationPayload(encoded))) {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	var payload emailVerificationPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	if time.Now().Unix() > payload.ExpiresAt {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	return payload.UserID, payload.Email, nil
+}
+
+// signVerificationPayload 计算验证令牌内容的HMAC签名
+func signVerificationPayload(encoded string) string {
+	mac := hmac.New(sha256.New, emailVerification.secret)
+	mac.Write([]byte("email-verification:" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// AllowVerificationEmailResend 检查用户是否可以重新发送验证邮件：两次之间至少间隔一分钟，每小时最多五次。
+// 不允许时返回需要等待的时间。
+func AllowVerificationEmailResend(userID int) (bool, time.Duration, error) {
+	ctx := context.Background()
+	id := strconv.Itoa(userID)
+
+	cooldownKey := verificationCooldownPrefix + id
+	ok, err := redis_client.Rdb.SetNX(ctx, cooldownKey, "1", verificationResendCooldown).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	if !ok {
+		ttl, _ := redis_client.Rdb.TTL(ctx, cooldownKey).Result()
+		return false, positiveDuration(ttl, verificationResendCooldown), nil
+	}
+
+	counterKey := verificationResendPrefix + id
+	count, err := redis_client.Rdb.Incr(ctx, counterKey).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	if count == 1 {
+		redis_client.Rdb.Expire(ctx, counterKey, time.Hour)
+	}
+	if count > verificationResendPerHour {
+		ttl, _ := redis_client.Rdb.TTL(ctx, counterKey).Result()
+		return false, positiveDuration(ttl, time.Hour), nil
+	}
+	return true, 0, nil
+}
+
+// positiveDuration Redis返回的TTL可能为负数（键不存在或没有过期时间），此时使用默认值
+func positiveDuration(d, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoLocation IP地址对应的大致位置
+type GeoLocation struct {
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// geoIPRange 一个网段及其位置，start为16字节形式的起始地址
+type geoIPRange struct {
+	start    net.IP
+	network  *net.IPNet
+	location GeoLocation
+}
+
+// GeoIPDatabase 从本地CSV文件加载的IP地理位置库，查询时不访问外部服务
+type GeoIPDatabase struct {
+	ranges []geoIPRange
+}
+
+// LoadGeoIPDatabase 加载CSV格式的IP地理位置库。第一行为表头，必须包含network（CIDR）、
+// latitude和longitude列，country_iso_code或country列可选，其他列会被忽略，
+// 因此可以直接使用MaxMind GeoLite2 City的Blocks CSV文件。网段之间不能重叠。
+func LoadGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开IP地理位置库失败: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("读取IP地理位置库表头失败: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	networkCol, hasNetwork := columns["network"]
+	latCol, hasLat := columns["latitude"]
+	lonCol, hasLon := columns["longitude"]
+	if !hasNetwork || !hasLat || !hasLon {
+		return nil, fmt.Errorf("IP地理位置库缺少network、latitude或longitude列")
+	}
+	countryCol, hasCountry := columns["country_iso_code"]
+	if !hasCountry {
+		countryCol, hasCountry = columns["country"]
+	}
+
+	db := &GeoIPDatabase{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("IP地理位置库第%d行格式错误: %w", line, err)
+		}
+		if len(record) <= networkCol || len(record) <= latCol || len(record) <= lonCol {
+			return nil, fmt.Errorf("IP地理位置库第%d行列数不足", line)
+		}
+		// 没有坐标的网段（例如只知道国家）无法用于距离计算
+		if record[latCol] == "" || record[lonCol] == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(record[networkCol]))
+		if err != nil {
+			return nil, fmt.Errorf("IP地理位置库第%d行网段无效: %w", line, err)
+		}
+		lat, err := strconv.ParseFloat(record[latCol], 64)
+		if err != nil {
+			return nil, fmt.Errorf("IP地理位置库第%d行纬度无效: %w", line, err)
+		}
+		lon, err := strconv.ParseFloat(record[lonCol], 64)
+		if err != nil {
+			return nil, fmt.Errorf("IP地理位置库第%d行经度无效: %w", line, err)
+		}
+
+		location := GeoLocation{Latitude: lat, Longitude: lon}
+		if hasCountry && len(record) > countryCol {
+			location.Country = record[countryCol]
+		}
+		db.ranges = append(db.ranges, geoIPRange{start: network.IP.To16(), network: network, location: location})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+// Lookup 查询IP地址所在的位置
+func (db *GeoIPDatabase) Lookup(ip string) (GeoLocation, bool) {
+	parsed := net.ParseIP(ip)
+	if db == nil || parsed == nil {
+		return GeoLocation{}, false
+	}
+	addr := parsed.To16()
+
+	// 找到起始地址不大于addr的最后一个网段
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, addr) > 0
+	})
+	if i == 0 {
+		return GeoLocation{}, false
+	}
+	r := db.ranges[i-1]
+	if !r.network.Contains(parsed) {
+		return GeoLocation{}, false
+	}
+	return r.location, true
+}
+
+// Len 返回库中的网段数量
+func (db *GeoIPDatabase) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.ranges)
+}
+
+// DistanceKm 按球面距离计算两个位置之间的公里数
+func DistanceKm(a, b GeoLocation) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
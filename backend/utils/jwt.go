@@ -8,40 +8,38 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWT相关的配置常量
-const (
-	// JWTSecret 签名密钥，在实际生产环境中应该从环境变量或配置文件中读取
-	// 这个密钥只是示例，不要在生产环境使用
-	jwtSecret = "XvhM9%tH#qsP8^5!ZkL2@3aW7*dG6fYbE"
-)
-
 // 时间常量
 var (
 	// AccessTokenExpiry Access token的有效期为15分钟
 	AccessTokenExpiry = 15 * time.Minute
 	// RefreshTokenExpiry Refresh token的有效期为7天
 	RefreshTokenExpiry = 7 * 24 * time.Hour
+	// MFAPendingTokenExpiry 两步验证等待令牌的有效期为5分钟
+	MFAPendingTokenExpiry = 5 * time.Minute
+	// LoginStepUpTokenExpiry 异常登录二次验证令牌的有效期为10分钟，留出接收邮件的时间
+	LoginStepUpTokenExpiry = 10 * time.Minute
 )
 
 // Claims是我们JWT中的自定义声明
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	TokenType string `json:"token_type"` // "access" or "refresh"
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	TokenType string `json:"token_type"` // "access", "refresh", "mfa_pending" or "login_step_up"
+	SessionID string `json:"sid"`        // 签发该令牌的会话ID
 	jwt.RegisteredClaims
 }
 
-// GenerateJWTPair 生成一对JWT令牌（access token和refresh token）
-func GenerateJWTPair(userID int, username, role string) (string, string, error) {
+// GenerateJWTPair 为指定会话生成一对JWT令牌（access token和refresh token）
+func GenerateJWTPair(userID int, username, role, sessionID string) (string, string, error) {
 	// 生成Access Token
-	accessToken, err := generateToken(userID, username, role, "access", AccessTokenExpiry)
+	accessToken, err := generateToken(userID, username, role, "access", sessionID, AccessTokenExpiry)
 	if err != nil {
 		return "", "", fmt.Errorf("生成访问令牌失败: %w", err)
 	}
 
 	// 生成Refresh Token
-	refreshToken, err := generateToken(userID, username, role, "refresh", RefreshTokenExpiry)
+	refreshToken, err := generateToken(userID, username, role, "refresh", sessionID, RefreshTokenExpiry)
 	if err != nil {
 		return "", "", fmt.Errorf("生成刷新令牌失败: %w", err)
 	}
@@ -50,14 +48,22 @@ func GenerateJWTPair(userID int, username, role string) (string, string, error)
 }
 
 // generateToken 是一个辅助函数，用于生成特定类型的JWT令牌
-func generateToken(userID int, username, role, tokenType string, expiry time.Duration) (string, error) {
+func generateToken(userID int, username, role, tokenType, sessionID string, expiry time.Duration) (string, error) {
+	// 每个令牌都有唯一的jti
+	tokenID, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
 	now := time.Now()
 	claims := Claims{
-		UserID:   userID,
-		Username: username,
-		Role:     role,
+		UserID:    userID,
+		Username:  username,
+		Role:      role,
 		TokenType: tokenType,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -65,8 +71,8 @@ func generateToken(userID int, username, role, tokenType string, expiry time.Dur
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	// 使用当前签名密钥签名，头部带有kid
+	tokenString, err := signToken(claims)
 	if err != nil {
 		return "", err
 	}
@@ -76,16 +82,12 @@ func generateToken(userID int, username, role, tokenType string, expiry time.Dur
 
 // ParseToken 解析并验证JWT令牌，返回Claims
 func ParseToken(tokenString string) (*Claims, error) {
+	// 根据kid选择验证密钥，并校验签名方法
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&Claims{},
-		func(token *jwt.Token) (interface{}, error) {
-			// 验证签名方法
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("意外的签名方法: %v", token.Header["alg"])
-			}
-			return []byte(jwtSecret), nil
-		},
+		lookupVerificationKey,
+		jwt.WithValidMethods([]string{SigningAlgorithmRS256, SigningAlgorithmEdDSA, SigningAlgorithmHS256}),
 	)
 
 	if err != nil {
@@ -100,6 +102,22 @@ func ParseToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// parseTokenIgnoringExpiry 校验JWT令牌的签名但不检查过期时间等声明，只用于确定令牌所属的会话
+func parseTokenIgnoringExpiry(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		lookupVerificationKey,
+		jwt.WithValidMethods([]string{SigningAlgorithmRS256, SigningAlgorithmEdDSA, SigningAlgorithmHS256}),
+		jwt.WithoutClaimsValidation(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
 // ValidateAccessToken 验证访问令牌是否有效
 func ValidateAccessToken(tokenString string) (*Claims, error) {
 	claims, err := ParseToken(tokenString)
@@ -127,3 +145,43 @@ func ValidateRefreshToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
+
+// GenerateMFAPendingToken 在密码验证通过、但还需要两步验证时签发短期令牌。
+// 该令牌不绑定会话，只能用于完成两步验证，换取正式的令牌对。
+func GenerateMFAPendingToken(userID int, username, role string) (string, error) {
+	return generateToken(userID, username, role, "mfa_pending", "", MFAPendingTokenExpiry)
+}
+
+// ValidateMFAPendingToken 验证两步验证等待令牌是否有效
+func ValidateMFAPendingToken(tokenString string) (*Claims, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != "mfa_pending" {
+		return nil, errors.New("无效的两步验证令牌类型")
+	}
+
+	return claims, nil
+}
+
+// GenerateLoginStepUpToken 在登录被判定为异常、需要通过邮件验证码二次验证时签发短期令牌。
+// 与两步验证等待令牌分开，不能用于绑定TOTP。
+func GenerateLoginStepUpToken(userID int, username, role string) (string, error) {
+	return generateToken(userID, username, role, "login_step_up", "", LoginStepUpTokenExpiry)
+}
+
+// ValidateLoginStepUpToken 验证二次验证令牌是否有效
+func ValidateLoginStepUpToken(tokenString string) (*Claims, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != "login_step_up" {
+		return nil, errors.New("无效的二次验证令牌类型")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// 支持的签名算法
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+// JWTKeyConfig 描述JWT签名和验证密钥的配置
+type JWTKeyConfig struct {
+	// Algorithm 签名算法：RS256、EdDSA，或仅用于本地开发的HS256
+	Algorithm string
+	// SigningKeyID 当前签名密钥的kid
+	SigningKeyID string
+	// PrivateKeyFile 当前签名私钥的PEM文件路径（RS256/EdDSA）
+	PrivateKeyFile string
+	// Secret HS256使用的共享密钥
+	Secret string
+	// VerificationKeys 额外的验证密钥，格式为"kid:公钥文件路径"，用于密钥轮换期间验证旧密钥签发的令牌
+	VerificationKeys []string
+	// RetiredKeyIDs 已退役的kid，即使仍配置了对应的公钥，这些kid签发的令牌也会被拒绝
+	RetiredKeyIDs []string
+}
+
+// jwtKey 表示密钥环中的一个密钥
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{} // 只有当前签名密钥才有私钥
+	verifyKey interface{}
+}
+
+// jwtKeyRing 保存当前的签名密钥和所有可用于验证的密钥
+type jwtKeyRing struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+	retired map[string]bool
+}
+
+var keyRing *jwtKeyRing
+
+// InitJWTKeys 根据配置加载JWT密钥。
+// 未配置私钥时会生成一个仅存在于内存中的临时Ed25519密钥，重启后已签发的令牌全部失效，只适合本地开发。
+func InitJWTKeys(cfg JWTKeyConfig) error {
+	ring := &jwtKeyRing{
+		keys:    map[string]*jwtKey{},
+		retired: map[string]bool{},
+	}
+	for _, kid := range cfg.RetiredKeyIDs {
+		if kid = strings.TrimSpace(kid); kid != "" {
+			ring.retired[kid] = true
+		}
+	}
+
+	signing, err := loadSigningKey(cfg)
+	if err != nil {
+		return err
+	}
+	if ring.retired[signing.id] {
+		return fmt.Errorf("当前签名密钥 %s 已被配置为退役密钥", signing.id)
+	}
+	ring.signing = signing
+	ring.keys[signing.id] = signing
+
+	for _, entry := range cfg.VerificationKeys {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("无效的验证密钥配置 %q，格式应为 kid:文件路径", entry)
+		}
+		kid, path := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, exists := ring.keys[kid]; exists {
+			return fmt.Errorf("重复的密钥ID: %s", kid)
+		}
+		key, err := loadVerificationKey(kid, path)
+		if err != nil {
+			return err
+		}
+		ring.keys[kid] = key
+	}
+
+	keyRing = ring
+	return nil
+}
+
+// loadSigningKey 加载当前的签名密钥
+func loadSigningKey(cfg JWTKeyConfig) (*jwtKey, error) {
+	kid := cfg.SigningKeyID
+
+	switch cfg.Algorithm {
+	case SigningAlgorithmHS256:
+		if cfg.Secret == "" {
+			return nil, errors.New("使用HS256时必须配置JWT_SECRET")
+		}
+		if kid == "" {
+			kid = "hs256"
+		}
+		secret := []byte(cfg.Secret)
+		return &jwtKey{id: kid, method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+
+	case SigningAlgorithmRS256, SigningAlgorithmEdDSA, "":
+		if cfg.PrivateKeyFile == "" {
+			return generateEphemeralKey(kid)
+		}
+		if kid == "" {
+			return nil, errors.New("配置了签名私钥时必须同时配置JWT_SIGNING_KEY_ID")
+		}
+		data, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取签名私钥失败: %w", err)
+		}
+		key, err := parsePrivateKey(kid, data)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Algorithm != "" && key.method.Alg() != cfg.Algorithm {
+			return nil, fmt.Errorf("签名私钥类型与算法 %s 不匹配", cfg.Algorithm)
+		}
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("不支持的签名算法: %s", cfg.Algorithm)
+	}
+}
+
+// generateEphemeralKey 生成临时的Ed25519签名密钥
+func generateEphemeralKey(kid string) (*jwtKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		suffix, err := randomHex(4)
+		if err != nil {
+			return nil, err
+		}
+		kid = "ephemeral-" + suffix
+	}
+	log.Printf("警告: 未配置JWT_PRIVATE_KEY_FILE，使用临时生成的Ed25519密钥(kid=%s)签发令牌，仅适用于本地开发", kid)
+	return &jwtKey{id: kid, method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: public}, nil
+}
+
+// parsePrivateKey 解析PEM格式的RSA或Ed25519私钥
+func parsePrivateKey(kid string, data []byte) (*jwtKey, error) {
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &jwtKey{id: kid, method: jwt.SigningMethodRS256, signKey: rsaKey, verifyKey: &rsaKey.PublicKey}, nil
+	}
+	if edKey, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		private, ok := edKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("密钥 %s 不是有效的Ed25519私钥", kid)
+		}
+		return &jwtKey{id: kid, method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: private.Public()}, nil
+	}
+	return nil, fmt.Errorf("无法解析密钥 %s 的私钥，仅支持RSA和Ed25519", kid)
+}
+
+// loadVerificationKey 加载仅用于验证的公钥，也接受私钥文件（只使用其中的公钥部分）
+func loadVerificationKey(kid, path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取验证密钥 %s 失败: %w", kid, err)
+	}
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &jwtKey{id: kid, method: jwt.SigningMethodRS256, verifyKey: rsaKey}, nil
+	}
+	if edKey, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &jwtKey{id: kid, method: jwt.SigningMethodEdDSA, verifyKey: edKey}, nil
+	}
+	key, err := parsePrivateKey(kid, data)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析验证密钥 %s，仅支持RSA和Ed25519", kid)
+	}
+	key.signKey = nil
+	return key, nil
+}
+
+// signToken 使用当前签名密钥签发令牌，并在头部写入kid
+func signToken(claims jwt.Claims) (string, error) {
+	if keyRing == nil {
+		return "", errors.New("JWT密钥尚未初始化")
+	}
+
+	token := jwt.NewWithClaims(keyRing.signing.method, claims)
+	token.Header["kid"] = keyRing.signing.id
+	return token.SignedString(keyRing.signing.signKey)
+}
+
+// lookupVerificationKey 根据令牌头部的kid选择验证密钥，未知或已退役的kid一律拒绝
+func lookupVerificationKey(token *jwt.Token) (interface{}, error) {
+	if keyRing == nil {
+		return nil, errors.New("JWT密钥尚未初始化")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("令牌缺少kid")
+	}
+	if keyRing.retired[kid] {
+		return nil, fmt.Errorf("签名密钥 %s 已退役", kid)
+	}
+	key, ok := keyRing.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+	}
+
+	// 令牌声明的算法必须与该密钥的算法一致，防止算法混淆攻击
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("意外的签名方法: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+// JWK 表示JSON Web Key中的一个公钥
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA模数
+	E   string `json:"e,omitempty"`   // RSA公共指数
+	Crv string `json:"crv,omitempty"` // OKP曲线
+	X   string `json:"x,omitempty"`   // OKP公钥
+}
+
+// JWKSet 表示 /.well-known/jwks.json 的响应内容
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS 返回所有可用于验证的公钥，HS256共享密钥和已退役的密钥不会公开
+func PublicJWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if keyRing == nil {
+		return set
+	}
+
+	// 当前签名密钥排在第一位
+	if jwk, ok := toJWK(keyRing.signing); ok {
+		set.Keys = append(set.Keys, jwk)
+	}
+	kids := make([]string, 0, len(keyRing.keys))
+	for kid := range keyRing.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		if kid == keyRing.signing.id || keyRing.retired[kid] {
+			continue
+		}
+		if jwk, ok := toJWK(keyRing.keys[kid]); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// toJWK 将公钥转换为JWK格式
+func toJWK(key *jwtKey) (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch public := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: key.id,
+			Use: "sig",
+			Alg: key.method.Alg(),
+			N:   encode(public.N.Bytes()),
+			E:   encode(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: key.id,
+			Use: "sig",
+			Alg: key.method.Alg(),
+			Crv: "Ed25519",
+			X:   encode(public),
+		}, true
+	}
+	// 其他类型（如HS256共享密钥）不公开
+	return JWK{}, false
+}
@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// 用户登录过的设备指纹集合，键为"login_devices:用户ID"
+	loginDevicesPrefix = "login_devices:"
+	// 用户登录过的网段集合，键为"login_networks:用户ID"
+	loginNetworksPrefix = "login_networks:"
+	// 用户上次登录的位置，键为"login_geo:用户ID"
+	loginGeoPrefix = "login_geo:"
+	// 最近在某个IP上通过密码验证的用户，有序集合，分数为时间戳，键为"login_ip_users:IP"
+	loginIPUsersPrefix = "login_ip_users:"
+	// 登录二次验证的邮件验证码摘要，键为"login_step_up:令牌jti"
+	loginStepUpPrefix = "login_step_up:"
+
+	// LoginStepUpCodeDigits 二次验证邮件验证码的位数
+	LoginStepUpCodeDigits = 6
+)
+
+// 异常登录的原因
+const (
+	LoginRiskNewDevice        = "new_device"            // 从未使用过的设备
+	LoginRiskNewNetwork       = "new_network"           // 从未使用过的网段
+	LoginRiskImpossibleTravel = "impossible_travel"     // 与上次登录的地点相距太远，时间上不可能到达
+	LoginRiskSharedIP         = "many_accounts_from_ip" // 同一IP短时间内登录了多个账户
+)
+
+// ErrInvalidStepUpCode 二次验证码不正确或已过期
+var ErrInvalidStepUpCode = errors.New("验证码不正确或已过期")
+
+// LoginRiskConfig 描述异常登录检测的配置
+type LoginRiskConfig struct {
+	// Enabled 是否检测异常登录
+	Enabled bool
+	// StepUp 没有启用两步验证的账户出现异常登录时，是否要求通过邮件验证码完成二次验证
+	StepUp bool
+	// GeoIPFile 本地IP地理位置库（CSV），为空时不检测异地登录
+	GeoIPFile string
+	// MaxTravelSpeedKmh 两次登录之间的移动速度超过该值视为不可能的行程
+	MaxTravelSpeedKmh float64
+	// MinTravelDistanceKm 距离小于该值时不检测速度，容忍IP定位的误差
+	MinTravelDistanceKm float64
+	// SharedIPMaxAccounts 同一IP在统计窗口内允许登录的账户数，超过后视为异常
+	SharedIPMaxAccounts int
+	// SharedIPWindow 同一IP登录账户数的统计窗口
+	SharedIPWindow time.Duration
+	// HistoryTTL 设备和网段记录的保留时间，超过该时间未使用的设备再次登录时视为新设备
+	HistoryTTL time.Duration
+}
+
+var loginRisk = LoginRiskConfig{
+	Enabled:             true,
+	StepUp:              true,
+	MaxTravelSpeedKmh:   900,
+	MinTravelDistanceKm: 300,
+	SharedIPMaxAccounts: 5,
+	SharedIPWindow:      time.Hour,
+	HistoryTTL:          180 * 24 * time.Hour,
+}
+
+// loginGeoIP 异常登录检测使用的IP地理位置库，未配置时为nil
+var loginGeoIP *GeoIPDatabase
+
+// InitLoginRisk 根据配置设置异常登录检测的参数，未配置的数值保持默认值
+func InitLoginRisk(cfg LoginRiskConfig) error {
+	loginRisk.Enabled = cfg.Enabled
+	loginRisk.StepUp = cfg.StepUp
+	if cfg.MaxTravelSpeedKmh > 0 {
+		loginRisk.MaxTravelSpeedKmh = cfg.MaxTravelSpeedKmh
+	}
+	if cfg.MinTravelDistanceKm > 0 {
+		loginRisk.MinTravelDistanceKm = cfg.MinTravelDistanceKm
+	}
+	if cfg.SharedIPMaxAccounts > 0 {
+		loginRisk.SharedIPMaxAccounts = cfg.SharedIPMaxAccounts
+	}
+	if cfg.SharedIPWindow > 0 {
+		loginRisk.SharedIPWindow = cfg.SharedIPWindow
+	}
+	if cfg.HistoryTTL > 0 {
+		loginRisk.HistoryTTL = cfg.HistoryTTL
+	}
+
+	loginGeoIP = nil
+	if cfg.GeoIPFile != "" {
+		db, err := LoadGeoIPDatabase(cfg.GeoIPFile)
+		if err != nil {
+			return err
+		}
+		loginGeoIP = db
+	}
+	return nil
+}
+
+// LoginRiskStepUpEnabled 异常登录时是否要求二次验证
+func LoginRiskStepUpEnabled() bool {
+	return loginRisk.Enabled && loginRisk.StepUp
+}
+
+// LoginAttempt 一次通过了密码验证的登录
+type LoginAttempt struct {
+	UserID    int
+	IP        string
+	UserAgent string
+	// LastLogin 用户上次成功登录的时间，用于计算两次登录之间的移动速度
+	LastLogin *time.Time
+}
+
+// LoginRisk 异常登录检测的结果
+type LoginRisk struct {
+	Reasons  []string               `json:"reasons"`
+	Location *GeoLocation           `json:"location,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// Flagged 是否检测到异常
+func (r *LoginRisk) Flagged() bool {
+	return r != nil && len(r.Reasons) > 0
+}
+
+func (r *LoginRisk) add(reason string) {
+	r.Reasons = append(r.Reasons, reason)
+}
+
+// loginGeoRecord 保存在Redis中的上次登录位置
+type loginGeoRecord struct {
+	IP       string      `json:"ip"`
+	Location GeoLocation `json:"location"`
+}
+
+// AssessLogin 根据设备、网段、上次登录的位置和同一IP登录的账户数判断本次登录是否异常。
+// 只读取历史记录，登录最终成功后需要调用RememberLogin更新记录。
+func AssessLogin(attempt LoginAttempt) (*LoginRisk, error) {
+	risk := &LoginRisk{Reasons: []string{}, Details: map[string]interface{}{}}
+	if !loginRisk.Enabled {
+		return risk, nil
+	}
+	ctx := context.Background()
+	uid := strconv.Itoa(attempt.UserID)
+
+	// 没有任何历史记录的账户（第一次登录或记录已过期）无从比较，不标记新设备和新网段
+	knownDevices, err := redis_client.Rdb.SCard(ctx, loginDevicesPrefix+uid).Result()
+	if err != nil {
+		return nil, err
+	}
+	if knownDevices > 0 {
+		known, err := redis_client.Rdb.SIsMember(ctx, loginDevicesPrefix+uid, DeviceFingerprint(attempt.UserAgent)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if !known {
+			risk.add(LoginRiskNewDevice)
+		}
+
+		if network := ipNetworkPrefix(attempt.IP); network != "" {
+			known, err := redis_client.Rdb.SIsMember(ctx, loginNetworksPrefix+uid, network).Result()
+			if err != nil {
+				return nil, err
+			}
+			if !known {
+				risk.add(LoginRiskNewNetwork)
+			}
+		}
+	}
+
+	if err := checkImpossibleTravel(ctx, attempt, risk); err != nil {
+		return nil, err
+	}
+	if err := checkSharedIP(ctx, attempt, risk); err != nil {
+		return nil, err
+	}
+	return risk, nil
+}
+
+// checkImpossibleTravel 比较本次和上次登录的位置，移动速度超过上限时标记为异常
+func checkImpossibleTravel(ctx context.Context, attempt LoginAttempt, risk *LoginRisk) error {
+	location, ok := loginGeoIP.Lookup(attempt.IP)
+	if !ok {
+		return nil
+	}
+	risk.Location = &location
+
+	if attempt.LastLogin == nil {
+		return nil
+	}
+	data, err := redis_client.Rdb.Get(ctx, loginGeoPrefix+strconv.Itoa(attempt.UserID)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var previous loginGeoRecord
+	if err := json.Unmarshal([]byte(data), &previous); err != nil {
+		return nil
+	}
+
+	distance := DistanceKm(previous.Location, location)
+	if distance < loginRisk.MinTravelDistanceKm {
+		return nil
+	}
+	// 间隔不足一分钟时按一分钟计算，避免除以0
+	hours := time.Since(*attempt.LastLogin).Hours()
+	if hours < 1.0/60 {
+		hours = 1.0 / 60
+	}
+	speed := distance / hours
+	if speed > loginRisk.MaxTravelSpeedKmh {
+		risk.add(LoginRiskImpossibleTravel)
+		risk.Details["distance_km"] = int(distance)
+		risk.Details["speed_kmh"] = int(speed)
+		risk.Details["previous_ip"] = previous.IP
+		risk.Details["previous_country"] = previous.Location.Country
+	}
+	return nil
+}
+
+// checkSharedIP 记录在该IP上通过密码验证的账户，统计窗口内账户数超过上限时标记为异常
+func checkSharedIP(ctx context.Context, attempt LoginAttempt, risk *LoginRisk) error {
+	key := loginIPUsersPrefix + attempt.IP
+	now := time.Now()
+	windowStart := now.Add(-loginRisk.SharedIPWindow)
+
+	pipe := redis_client.Rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: attempt.UserID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(windowStart.UnixMilli(), 10))
+	count := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, loginRisk.SharedIPWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if int(count.Val()) > loginRisk.SharedIPMaxAccounts {
+		risk.add(LoginRiskSharedIP)
+		risk.Details["accounts_from_ip"] = count.Val()
+	}
+	return nil
+}
+
+// RememberLogin 登录成功后记录设备、网段和位置，之后从这些设备和网段登录不再视为异常
+func RememberLogin(attempt LoginAttempt) error {
+	if !loginRisk.Enabled {
+		return nil
+	}
+	ctx := context.Background()
+	uid := strconv.Itoa(attempt.UserID)
+
+	pipe := redis_client.Rdb.TxPipeline()
+	pipe.SAdd(ctx, loginDevicesPrefix+uid, DeviceFingerprint(attempt.UserAgent))
+	pipe.Expire(ctx, loginDevicesPrefix+uid, loginRisk.HistoryTTL)
+	if network := ipNetworkPrefix(attempt.IP); network != "" {
+		pipe.SAdd(ctx, loginNetworksPrefix+uid, network)
+		pipe.Expire(ctx, loginNetworksPrefix+uid, loginRisk.HistoryTTL)
+	}
+	if location, ok := loginGeoIP.Lookup(attempt.IP); ok {
+		data, err := json.Marshal(loginGeoRecord{IP: attempt.IP, Location: location})
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, loginGeoPrefix+uid, data, loginRisk.HistoryTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ForgetLogins 删除用户的登录设备、网段和位置记录，账户注销时调用
+func ForgetLogins(userID int) error {
+	uid := strconv.Itoa(userID)
+	return redis_client.Rdb.Del(context.Background(), loginDevicesPrefix+uid, loginNetworksPrefix+uid, loginGeoPrefix+uid).Err()
+}
+
+// userAgentVersionPattern User-Agent中的版本号，浏览器自动升级后仍视为同一设备
+var userAgentVersionPattern = regexp.MustCompile(`[0-9][0-9._]*`)
+
+// DeviceFingerprint 根据去掉版本号的User-Agent计算设备指纹
+func DeviceFingerprint(userAgent string) string {
+	normalized := strings.ToLower(userAgentVersionPattern.ReplaceAllString(userAgent, ""))
+	return hashToken(strings.Join(strings.Fields(normalized), " "))[:32]
+}
+
+// ipNetworkPrefix 返回IP所在的网段：IPv4取/24，IPv6取/48
+func ipNetworkPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// CreateLoginStepUpCode 为二次验证令牌生成一次性邮件验证码，Redis中只保存摘要，有效期与令牌相同
+func CreateLoginStepUpCode(claims *Claims) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < LoginStepUpCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", LoginStepUpCodeDigits, n.Int64())
+
+	err = redis_client.Rdb.Set(context.Background(), loginStepUpPrefix+claims.ID,
+		hashToken(claims.ID+":"+code), LoginStepUpTokenExpiry).Err()
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// VerifyLoginStepUpCode 校验二次验证码，验证成功后验证码作废
+func VerifyLoginStepUpCode(claims *Claims, code string) error {
+	ctx := context.Background()
+	key := loginStepUpPrefix + claims.ID
+	expected, err := redis_client.Rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return ErrInvalidStepUpCode
+	}
+	if err != nil {
+		return err
+	}
+
+	actual := hashToken(claims.ID + ":" + strings.TrimSpace(code))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+		return ErrInvalidStepUpCode
+	}
+	return redis_client.Rdb.Del(ctx, key).Err()
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// 登录失败计数前缀，键为"login_fail:user:用户名"或"login_fail:ip:IP"
+	loginFailurePrefix = "login_fail:"
+	// 登录锁定前缀，键存在期间拒绝该用户名或IP的登录请求
+	loginLockPrefix = "login_lock:"
+	// 渐进延迟前缀，键存在期间需要等待后才能再次尝试
+	loginDelayPrefix = "login_delay:"
+	// 锁定标记前缀，锁定到期后用于记录解锁事件
+	loginLockedMarkerPrefix = "login_locked:"
+
+	loginScopeUser = "user"
+	loginScopeIP   = "ip"
+)
+
+// LoginThrottleConfig 描述登录防暴力破解的配置
+type LoginThrottleConfig struct {
+	// MaxUserFailures 同一用户名在统计窗口内允许的失败次数，达到后锁定
+	MaxUserFailures int
+	// MaxIPFailures 同一IP在统计窗口内允许的失败次数，达到后锁定
+	MaxIPFailures int
+	// FailureWindow 失败次数的统计窗口
+	FailureWindow time.Duration
+	// LockoutDuration 锁定时长
+	LockoutDuration time.Duration
+	// FreeAttempts 不需要等待的失败次数，之后每次失败的等待时间翻倍
+	FreeAttempts int
+	// MaxDelay 渐进延迟的上限
+	MaxDelay time.Duration
+	// OnIPLocked IP因失败次数过多被锁定后调用，例如自动封禁该IP，为空时不做处理
+	OnIPLocked func(ip string)
+}
+
+var loginThrottle = LoginThrottleConfig{
+	MaxUserFailures: 5,
+	MaxIPFailures:   20,
+	FailureWindow:   15 * time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	FreeAttempts:    2,
+	MaxDelay:        30 * time.Second,
+}
+
+// InitLoginThrottle 根据配置设置登录防暴力破解的参数，未配置的项保持默认值
+func InitLoginThrottle(cfg LoginThrottleConfig) {
+	if cfg.MaxUserFailures > 0 {
+		loginThrottle.MaxUserFailures = cfg.MaxUserFailures
+	}
+	if cfg.MaxIPFailures > 0 {
+		loginThrottle.MaxIPFailures = cfg.MaxIPFailures
+	}
+	if cfg.FailureWindow > 0 {
+		loginThrottle.FailureWindow = cfg.FailureWindow
+	}
+	if cfg.LockoutDuration > 0 {
+		loginThrottle.LockoutDuration = cfg.LockoutDuration
+	}
+	if cfg.FreeAttempts > 0 {
+		loginThrottle.FreeAttempts = cfg.FreeAttempts
+	}
+	if cfg.MaxDelay > 0 {
+		loginThrottle.MaxDelay = cfg.MaxDelay
+	}
+	loginThrottle.OnIPLocked = cfg.OnIPLocked
+}
+
+// LoginLockoutDuration 返回锁定时长
+func LoginLockoutDuration() time.Duration {
+	return loginThrottle.LockoutDuration
+}
+
+// loginKey 生成登录限制相关的键，用户名统一转为小写
+func loginKey(prefix, scope, value string) string {
+	if scope == loginScopeUser {
+		value = strings.ToLower(value)
+	}
+	return prefix + scope + ":" + value
+}
+
+// CheckLoginAllowed 在校验密码之前检查用户名和IP是否被锁定或仍在等待期内，返回需要等待的时间，0表示允许
+func CheckLoginAllowed(username, ip string) (time.Duration, error) {
+	ctx := context.Background()
+
+	var wait time.Duration
+	for _, key := range []string{
+		loginKey(loginLockPrefix, loginScopeUser, username),
+		loginKey(loginLockPrefix, loginScopeIP, ip),
+		loginKey(loginDelayPrefix, loginScopeUser, username),
+	} {
+		ttl, err := redis_client.Rdb.PTTL(ctx, key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	// 锁定已经到期，记录自动解锁事件
+	recordExpiredLock(ctx, loginScopeUser, username)
+	recordExpiredLock(ctx, loginScopeIP, ip)
+	return 0, nil
+}
+
+// recordExpiredLock 锁定到期后第一次尝试登录时记录解锁事件
+func recordExpiredLock(ctx context.Context, scope, value string) {
+	deleted, err := redis_client.Rdb.Del(ctx, loginKey(loginLockedMarkerPrefix, scope, value)).Result()
+	if err != nil || deleted == 0 {
+		return
+	}
+	RecordSecurityEvent(SecurityEvent{
+		Type:    SecurityEventLoginUnlocked,
+		IP:      ipForScope(scope, value),
+		Details: map[string]interface{}{"scope": scope, "subject": value, "reason": "expired"},
+	})
+}
+
+// RegisterLoginFailure 记录一次登录失败（用户名不存在或密码错误），达到上限时锁定。
+// userID为0表示用户名不存在。返回下一次尝试前需要等待的时间。
+func RegisterLoginFailure(userID int, username, ip, userAgent string) (time.Duration, error) {
+	ctx := context.Background()
+
+	userFailures, err := incrementFailures(ctx, loginKey(loginFailurePrefix, loginScopeUser, username))
+	if err != nil {
+		return 0, err
+	}
+	ipFailures, err := incrementFailures(ctx, loginKey(loginFailurePrefix, loginScopeIP, ip))
+	if err != nil {
+		return 0, err
+	}
+
+	if ipFailures >= int64(loginThrottle.MaxIPFailures) {
+		if err := lockLogin(ctx, 0, loginScopeIP, ip, ip, userAgent, ipFailures); err != nil {
+			return 0, err
+		}
+		return loginThrottle.LockoutDuration, nil
+	}
+	if userFailures >= int64(loginThrottle.MaxUserFailures) {
+		if err := lockLogin(ctx, userID, loginScopeUser, username, ip, userAgent, userFailures); err != nil {
+			return 0, err
+		}
+		return loginThrottle.LockoutDuration, nil
+	}
+
+	// 超过免等待次数后，每次失败的等待时间翻倍
+	excess := int(userFailures) - loginThrottle.FreeAttempts
+	if excess <= 0 {
+		return 0, nil
+	}
+	delay := time.Duration(math.Min(
+		float64(time.Second)*math.Pow(2, float64(excess-1)),
+		float64(loginThrottle.MaxDelay),
+	))
+	err = redis_client.Rdb.Set(ctx, loginKey(loginDelayPrefix, loginScopeUser, username), userFailures, delay).Err()
+	return delay, err
+}
+
+// incrementFailures 失败次数加一，第一次失败时开始计算统计窗口
+func incrementFailures(ctx context.Context, key string) (int64, error) {
+	count, err := redis_client.Rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		redis_client.Rdb.Expire(ctx, key, loginThrottle.FailureWindow)
+	}
+	return count, nil
+}
+
+// lockLogin 锁定用户名或IP并记录安全事件
+func lockLogin(ctx context.Context, userID int, scope, value, ip, userAgent string, failures int64) error {
+	pipe := redis_client.Rdb.TxPipeline()
+	pipe.Set(ctx, loginKey(loginLockPrefix, scope, value), failures, loginThrottle.LockoutDuration)
+	// 标记的有效期比锁定更长，锁定到期后仍能记录解锁事件
+	pipe.Set(ctx, loginKey(loginLockedMarkerPrefix, scope, value), failures, loginThrottle.LockoutDuration+24*time.Hour)
+	pipe.Del(ctx, loginKey(loginFailurePrefix, scope, value))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	RecordSecurityEvent(SecurityEvent{
+		Type:      SecurityEventLoginLocked,
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]interface{}{
+			"scope":    scope,
+			"subject":  value,
+			"failures": failures,
+			"duration": loginThrottle.LockoutDuration.String(),
+		},
+	})
+
+	if scope == loginScopeIP && loginThrottle.OnIPLocked != nil {
+		loginThrottle.OnIPLocked(ip)
+	}
+	return nil
+}
+
+// ClearLoginFailures 登录成功后清除该用户名的失败记录（IP的失败记录保留，避免攻击者用自己的账户重置计数）
+func ClearLoginFailures(username string) error {
+	ctx := context.Background()
+	return redis_client.Rdb.Del(ctx,
+		loginKey(loginFailurePrefix, loginScopeUser, username),
+		loginKey(loginDelayPrefix, loginScopeUser, username),
+	).Err()
+}
+
+// UnlockLogin 管理员手动解除用户名的锁定（包括第二步验证的锁定），返回该用户之前是否处于锁定状态
+func UnlockLogin(userID int, username, adminIP string) (bool, error) {
+	ctx := context.Background()
+	deleted, err := redis_client.Rdb.Del(ctx,
+		loginKey(loginLockPrefix, loginScopeUser, username),
+		loginKey(loginLockedMarkerPrefix, loginScopeUser, username),
+		loginKey(loginFailurePrefix, loginScopeUser, username),
+		loginKey(loginDelayPrefix, loginScopeUser, username),
+		mfaLockPrefix+strconv.Itoa(userID),
+		mfaFailurePrefix+strconv.Itoa(userID),
+	).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+
+	RecordSecurityEvent(SecurityEvent{
+		Type:    SecurityEventLoginUnlocked,
+		UserID:  userID,
+		IP:      adminIP,
+		Details: map[string]interface{}{"scope": loginScopeUser, "subject": username, "reason": "admin"},
+	})
+	return true, nil
+}
+
+// ipForScope IP范围的事件把IP写入事件的IP字段
+func ipForScope(scope, value string) string {
+	if scope == loginScopeIP {
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 支持的密码哈希算法
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	// dummyPassword 生成占位哈希用的密码，不对应任何账户
+	dummyPassword = "dummy-password-for-timing"
+)
+
+// ErrUnknownPasswordHash 保存的哈希不是支持的格式
+var ErrUnknownPasswordHash = errors.New("无法识别的密码哈希格式")
+
+// PasswordHashConfig 描述新密码使用的哈希算法和参数
+type PasswordHashConfig struct {
+	// Algorithm argon2id或bcrypt
+	Algorithm string
+	// Argon2Memory Argon2id使用的内存，单位KiB
+	Argon2Memory uint32
+	// Argon2Iterations Argon2id的迭代次数
+	Argon2Iterations uint32
+	// Argon2Parallelism Argon2id的并行度
+	Argon2Parallelism uint8
+	// BcryptCost bcrypt的代价因子
+	BcryptCost int
+}
+
+// PasswordHasher 一种密码哈希算法，通过哈希的前缀识别
+type PasswordHasher interface {
+	// Hash 用当前参数生成编码后的哈希
+	Hash(password string) (string, error)
+	// Matches 判断哈希是否由该算法生成
+	Matches(encoded string) bool
+	// Verify 校验密码，比较过程是常数时间的
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash 哈希的参数和当前参数不同时返回true
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher 生成PHC格式的Argon2id哈希：$argon2id$v=19$m=65536,t=3,p=2$salt$hash
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// Hash 实现PasswordHasher
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("生成盐值失败: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Matches 实现PasswordHasher
+func (h Argon2idHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// Verify 实现PasswordHasher，使用哈希中保存的参数重新计算
+func (h Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// NeedsRehash 实现PasswordHasher
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params != h || len(salt) != argon2SaltLength || len(key) != argon2KeyLength
+}
+
+// decodeArgon2id 解析PHC格式的Argon2id哈希
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("不支持的Argon2版本: %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("Argon2参数格式错误: %w", err)
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, fmt.Errorf("Argon2参数无效: %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("Argon2盐值格式错误: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("Argon2哈希格式错误")
+	}
+	return params, salt, key, nil
+}
+
+// BcryptHasher 生成$2a$格式的bcrypt哈希
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash 实现PasswordHasher
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Matches 实现PasswordHasher
+func (h BcryptHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// Verify 实现PasswordHasher
+func (h BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash 实现PasswordHasher
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+var passwordHashing = struct {
+	current PasswordHasher
+	known   []PasswordHasher
+	// dummyHash 用户不存在时用来校验的哈希，使登录耗时和用户是否存在无关
+	dummyHash string
+}{
+	current: BcryptHasher{Cost: bcrypt.DefaultCost},
+	known:   []PasswordHasher{Argon2idHasher{}, BcryptHasher{}},
+}
+
+// InitPasswordHasher 根据配置选择新密码使用的哈希算法，已有的哈希在下次登录时升级
+func InitPasswordHasher(cfg PasswordHashConfig) error {
+	var current PasswordHasher
+	switch cfg.Algorithm {
+	case PasswordHashArgon2id:
+		if cfg.Argon2Iterations < 1 || cfg.Argon2Parallelism < 1 {
+			return fmt.Errorf("Argon2id的迭代次数和并行度必须大于0")
+		}
+		if cfg.Argon2Memory < 8*uint32(cfg.Argon2Parallelism) {
+			return fmt.Errorf("Argon2id的内存至少为并行度的8倍KiB")
+		}
+		current = Argon2idHasher{Memory: cfg.Argon2Memory, Iterations: cfg.Argon2Iterations, Parallelism: cfg.Argon2Parallelism}
+	case PasswordHashBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt代价因子必须在 %d 到 %d 之间", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		current = BcryptHasher{Cost: cfg.BcryptCost}
+	default:
+		return fmt.Errorf("不支持的密码哈希算法 %q", cfg.Algorithm)
+	}
+
+	dummyHash, err := current.Hash(dummyPassword)
+	if err != nil {
+		return fmt.Errorf("生成占位哈希失败: %w", err)
+	}
+	passwordHashing.current = current
+	passwordHashing.dummyHash = dummyHash
+	return nil
+}
+
+// HashPassword 用当前配置的算法和参数哈希密码
+func HashPassword(password string) (string, error) {
+	return passwordHashing.current.Hash(password)
+}
+
+// VerifyPassword 根据哈希前缀选择算法校验密码，密码正确且哈希使用的不是当前算法或参数时needsRehash为true
+func VerifyPassword(encoded, password string) (ok bool, needsRehash bool, err error) {
+	hasher := hasherFor(encoded)
+	if hasher == nil {
+		return false, false, ErrUnknownPasswordHash
+	}
+	ok, err = hasher.Verify(encoded, password)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, !passwordHashing.current.Matches(encoded) || passwordHashing.current.NeedsRehash(encoded), nil
+}
+
+// NoPasswordHash 没有密码的账户（通过第三方登录创建的账户）保存的password_hash，任何密码都无法通过校验
+const NoPasswordHash = "!"
+
+// HasPassword 判断账户是否设置了可以用来登录的密码
+func HasPassword(encoded string) bool {
+	return hasherFor(encoded) != nil
+}
+
+// dummyProfile 一种仍在使用的哈希参数组合的占位哈希，weight为使用这种参数的账户数
+type dummyProfile struct {
+	hash   string
+	weight int
+}
+
+// dummyHashes 按账户实际使用的哈希参数生成的占位哈希。
+// 尚未升级的旧哈希（如bcrypt cost 10）和当前算法的校验耗时不同，只用当前算法做占位校验时，
+// 响应时间仍然能区分"用户不存在"和"使用旧哈希的用户"
+var dummyHashes = struct {
+	sync.RWMutex
+	profiles []dummyProfile
+	total    int
+	// key 把用户名映射到参数组合时使用的HMAC密钥，进程启动时随机生成
+	key []byte
+}{}
+
+// SetPasswordHashProfiles 根据每种哈希参数组合的账户数（键为哈希中盐值之前的部分，例如"$2a$10"或
+// "$argon2id$v=19$m=65536,t=3,p=2"），为每种组合生成占位哈希。
+// 之后VerifyDummyPassword按账户数的比例为不存在的用户名固定选择一种组合，耗时的分布和真实账户一致
+func SetPasswordHashProfiles(counts map[string]int) error {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var profiles []dummyProfile
+	total := 0
+	for _, name := range names {
+		hasher := hasherForProfile(name)
+		if hasher == nil || counts[name] <= 0 {
+			continue
+		}
+		hash, err := hasher.Hash(dummyPassword)
+		if err != nil {
+			return fmt.Errorf("生成占位哈希失败(%s): %w", name, err)
+		}
+		profiles = append(profiles, dummyProfile{hash: hash, weight: counts[name]})
+		total += counts[name]
+	}
+
+	dummyHashes.Lock()
+	defer dummyHashes.Unlock()
+	if dummyHashes.key == nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		dummyHashes.key = key
+	}
+	dummyHashes.profiles = profiles
+	dummyHashes.total = total
+	return nil
+}
+
+// hasherForProfile 根据参数组合构造使用相同参数的哈希算法，无法识别时返回nil
+func hasherForProfile(profile string) PasswordHasher {
+	if strings.HasPrefix(profile, "$argon2id$") {
+		params, _, _, err := decodeArgon2id(profile + "$AAAAAAAAAAAAAAAAAAAAAA$AA")
+		if err != nil {
+			return nil
+		}
+		return params
+	}
+	if (BcryptHasher{}).Matches(profile + "$") {
+		var cost int
+		if _, err := fmt.Sscanf(profile[4:], "%d", &cost); err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil
+		}
+		return BcryptHasher{Cost: cost}
+	}
+	return nil
+}
+
+// dummyHashFor 为用户名选择占位哈希：同一个用户名每次选到同一种参数组合，不同用户名按账户数的比例分布
+func dummyHashFor(username string) string {
+	dummyHashes.RLock()
+	defer dummyHashes.RUnlock()
+	if dummyHashes.total == 0 {
+		return passwordHashing.dummyHash
+	}
+
+	mac := hmac.New(sha256.New, dummyHashes.key)
+	mac.Write([]byte(strings.ToLower(username)))
+	point := int(binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(dummyHashes.total))
+	for _, profile := range dummyHashes.profiles {
+		if point < profile.weight {
+			return profile.hash
+		}
+		point -= profile.weight
+	}
+	return passwordHashing.dummyHash
+}
+
+// VerifyDummyPassword 用户不存在（或没有密码）时调用，做一次和真实校验代价相同的计算
+func VerifyDummyPassword(username, password string) {
+	dummyHash := dummyHashFor(username)
+	if dummyHash == "" {
+		// 没有调用InitPasswordHasher时，用当前参数哈希一次，代价和校验相同
+		_, _ = passwordHashing.current.Hash(password)
+		return
+	}
+	_, _, _ = VerifyPassword(dummyHash, password)
+}
+
+// hasherFor 根据哈希前缀找到对应的算法
+func hasherFor(encoded string) PasswordHasher {
+	for _, hasher := range passwordHashing.known {
+		if hasher.Matches(encoded) {
+			return hasher
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// PasswordPolicyConfig 描述密码策略的配置
+type PasswordPolicyConfig struct {
+	// MinLength 密码的最小长度（按字符计算）
+	MinLength int
+	// MaxLength 密码的最大长度，bcrypt只使用前72个字节
+	MaxLength int
+	// BreachedListFile 已泄露密码列表文件，每行一个明文密码，或HIBP格式的"SHA1:次数"
+	BreachedListFile string
+}
+
+// passwordPolicy 当前生效的密码策略
+var passwordPolicy = struct {
+	minLength int
+	maxLength int
+	breached  map[string]struct{} // 已泄露密码的SHA-1摘要（大写十六进制）
+}{
+	minLength: 8,
+	maxLength: 72,
+	breached:  map[string]struct{}{},
+}
+
+// InitPasswordPolicy 根据配置加载密码策略
+func InitPasswordPolicy(cfg PasswordPolicyConfig) error {
+	if cfg.MinLength > 0 {
+		passwordPolicy.minLength = cfg.MinLength
+	}
+	if cfg.MaxLength > 0 {
+		passwordPolicy.maxLength = cfg.MaxLength
+	}
+	if passwordPolicy.minLength > passwordPolicy.maxLength {
+		return fmt.Errorf("密码最小长度 %d 大于最大长度 %d", passwordPolicy.minLength, passwordPolicy.maxLength)
+	}
+
+	if cfg.BreachedListFile == "" {
+		return nil
+	}
+	breached, err := loadBreachedPasswords(cfg.BreachedListFile)
+	if err != nil {
+		return err
+	}
+	passwordPolicy.breached = breached
+	return nil
+}
+
+// loadBreachedPasswords 读取已泄露密码列表，只在内存中保留摘要
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取已泄露密码列表失败: %w", err)
+	}
+	defer file.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[breachedListEntryHash(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取已泄露密码列表失败: %w", err)
+	}
+	return breached, nil
+}
+
+// breachedListEntryHash 将列表中的一行转换为SHA-1摘要，HIBP格式的行本身就是摘要
+func breachedListEntryHash(line string) string {
+	candidate := line
+	if i := strings.IndexByte(line, ':'); i == 40 {
+		candidate = line[:i]
+	}
+	if len(candidate) == 40 {
+		if _, err := hex.DecodeString(candidate); err == nil {
+			return strings.ToUpper(candidate)
+		}
+	}
+	return passwordSHA1(line)
+}
+
+// passwordSHA1 计算密码的SHA-1摘要（大写十六进制），与HIBP的格式一致
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// ValidatePassword 按照密码策略检查新密码，返回的错误信息可以直接展示给用户
+func ValidatePassword(password, username, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < passwordPolicy.minLength {
+		return fmt.Errorf("密码长度不能少于%d个字符", passwordPolicy.minLength)
+	}
+	if length > passwordPolicy.maxLength || len(password) > 72 {
+		return fmt.Errorf("密码长度不能超过%d个字符", passwordPolicy.maxLength)
+	}
+	if strings.TrimSpace(password) == "" {
+		return errors.New("密码不能全部为空白字符")
+	}
+
+	lowered := strings.ToLower(password)
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		return errors.New("密码不能包含用户名")
+	}
+	if local, _, found := strings.Cut(strings.ToLower(email), "@"); found && len(local) >= 3 && strings.Contains(lowered, local) {
+		return errors.New("密码不能包含邮箱名")
+	}
+
+	if _, ok := passwordPolicy.breached[passwordSHA1(password)]; ok {
+		return errors.New("该密码出现在已泄露的密码列表中，请换一个密码")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// 密码重置令牌前缀，键为"password_reset:令牌摘要"，值为用户ID
+	passwordResetPrefix = "password_reset:"
+	// 用户当前有效的重置令牌摘要，键为"password_reset_user:用户ID"，用于让旧的重置链接失效
+	passwordResetUserPrefix = "password_reset_user:"
+	// PasswordResetTokenExpiry 密码重置令牌的有效期
+	PasswordResetTokenExpiry = 30 * time.Minute
+)
+
+// ErrInvalidResetToken 重置令牌不存在、已过期或已被使用
+var ErrInvalidResetToken = errors.New("重置链接无效或已过期")
+
+// CreatePasswordResetToken 为用户生成一次性密码重置令牌，Redis中只保存令牌的摘要。
+// 同一用户只有最近一次生成的令牌有效。
+func CreatePasswordResetToken(userID int) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	tokenHash := hashToken(token)
+	userKey := passwordResetUserPrefix + strconv.Itoa(userID)
+
+	ctx := context.Background()
+	previous, err := redis_client.Rdb.Get(ctx, userKey).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	pipe := redis_client.Rdb.TxPipeline()
+	if previous != "" {
+		pipe.Del(ctx, passwordResetPrefix+previous)
+	}
+	pipe.Set(ctx, passwordResetPrefix+tokenHash, userID, PasswordResetTokenExpiry)
+	pipe.Set(ctx, userKey, tokenHash, PasswordResetTokenExpiry)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupPasswordResetToken 查询重置令牌对应的用户ID，但不消耗令牌
+func LookupPasswordResetToken(token string) (int, error) {
+	if token == "" {
+		return 0, ErrInvalidResetToken
+	}
+	value, err := redis_client.Rdb.Get(context.Background(), passwordResetPrefix+hashToken(token)).Result()
+	if err == redis.Nil {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, nil
+}
+
+// ConsumePasswordResetToken 校验并消耗重置令牌，返回对应的用户ID。令牌只能使用一次。
+func ConsumePasswordResetToken(token string) (int, error) {
+	if token == "" {
+		return 0, ErrInvalidResetToken
+	}
+	ctx := context.Background()
+
+	// GETDEL保证并发请求中只有一个能拿到令牌
+	value, err := redis_client.Rdb.GetDel(ctx, passwordResetPrefix+hashToken(token)).Result()
+	if err == redis.Nil {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, ErrInvalidResetToken
+	}
+	redis_client.Rdb.Del(ctx, passwordResetUserPrefix+value)
+	return userID, nil
+}
@@ -2,59 +2,62 @@ package utils
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"strconv"
 	"time"
 	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
 )
 
 const (
-	// Redis中存储令牌的前缀
-	accessTokenPrefix  = "access_token:"
-	refreshTokenPrefix = "refresh_token:"
 	// 令牌黑名单前缀
 	tokenBlacklistPrefix = "blacklist:"
+	// 已轮换的刷新令牌前缀，键为"refresh_rotated:令牌摘要"，值为令牌所属的家族
+	rotatedRefreshTokenPrefix = "refresh_rotated:"
 )
 
-// StoreAccessToken 将访问令牌存储到Redis中
-func StoreAccessToken(userID int, token string) error {
-	// 以"access_token:用户ID"为键存储访问令牌
-	key := accessTokenPrefix + strconv.Itoa(userID)
-	// 设置令牌过期时间略长于令牌本身的过期时间，以便有时间进行清理
-	expiry := AccessTokenExpiry + 5*time.Minute
-
-	_, err := redis_client.Rdb.Set(context.Background(), key, token, expiry).Result()
-	return err
+// RefreshTokenFamily 描述一个刷新令牌家族。
+// 每次登录创建的会话就是一个家族，之后每次轮换出的刷新令牌都属于同一家族，
+// 家族ID即会话ID。
+type RefreshTokenFamily struct {
+	FamilyID string `json:"family_id"`
+	UserID   int    `json:"user_id"`
 }
 
-// StoreRefreshToken 将刷新令牌存储到Redis中
-func StoreRefreshToken(userID int, token string) error {
-	// 以"refresh_token:用户ID"为键存储刷新令牌
-	key := refreshTokenPrefix + strconv.Itoa(userID)
-	// 设置令牌过期时间略长于令牌本身的过期时间
-	expiry := RefreshTokenExpiry + 1*time.Hour
+// StoreAccessToken 将访问令牌绑定到会话上，同一会话只有最新签发的访问令牌有效
+func StoreAccessToken(sessionID string, token string) error {
+	return updateSession(sessionID, nil, map[string]interface{}{"access_token_hash": hashToken(token)})
+}
 
-	_, err := redis_client.Rdb.Set(context.Background(), key, token, expiry).Result()
-	return err
+// StoreRefreshToken 将刷新令牌绑定到会话上，并顺延会话及用户会话索引的过期时间
+func StoreRefreshToken(sessionID string, token string) error {
+	expiresAt := time.Now().Add(SessionTTL)
+	return updateSession(sessionID, &expiresAt, map[string]interface{}{"refresh_token_hash": hashToken(token)})
 }
 
-// ValidateTokenInRedis 验证令牌是否存在于Redis中并且是最新的
-func ValidateTokenInRedis(userID int, token string, isAccessToken bool) (bool, error) {
-	prefix := refreshTokenPrefix
-	if isAccessToken {
-		prefix = accessTokenPrefix
+// ValidateTokenInRedis 验证令牌所属的会话是否仍然有效，并且令牌是该会话最新签发的
+func ValidateTokenInRedis(claims *Claims, token string, isAccessToken bool) (*Session, error) {
+	session, err := GetSession(claims.SessionID)
+	if err != nil {
+		return nil, err
 	}
-	key := prefix + strconv.Itoa(userID)
 
-	// 从Redis获取当前存储的令牌
-	storedToken, err := redis_client.Rdb.Get(context.Background(), key).Result()
-	if err != nil {
-		// 如果键不存在，令牌无效
-		return false, fmt.Errorf("令牌不存在于Redis中: %w", err)
+	// 会话必须属于令牌中声明的用户
+	if session.UserID != claims.UserID {
+		return nil, ErrSessionNotFound
 	}
 
-	// 检查提供的令牌是否与存储的令牌匹配
-	return token == storedToken, nil
+	storedHash := session.RefreshTokenHash
+	if isAccessToken {
+		storedHash = session.AccessTokenHash
+	}
+	if storedHash == "" || storedHash != hashToken(token) {
+		return nil, errors.New("令牌不是该会话最新签发的令牌")
+	}
+
+	return session, nil
 }
 
 // IsTokenBlacklisted 检查令牌是否在黑名单中
@@ -74,32 +77,197 @@ func BlacklistToken(token string, expiry time.Duration) error {
 	return err
 }
 
+// RefreshRotation 表示一次刷新令牌轮换的结果
+type RefreshRotation int
+
+const (
+	// RefreshRotated 旧令牌已轮换为新的令牌对
+	RefreshRotated RefreshRotation = iota
+	// RefreshReused 旧令牌此前已被轮换过，且不在宽限期内，应视为令牌被盗用
+	RefreshReused
+	// RefreshRetried 旧令牌刚刚被轮换过（客户端重试或并发请求），返回已签发的后继令牌对
+	RefreshRetried
+	// RefreshStale 旧令牌已不是会话最新签发的刷新令牌，或会话已被撤销
+	RefreshStale
+)
+
+// refreshSuccessorGrace 刷新令牌轮换后的宽限期。
+// 宽限期内再次提交旧令牌（例如响应在网络中丢失后客户端重试）会拿到同一对后继令牌，而不会被当作重复使用。
+const refreshSuccessorGrace = 10 * time.Second
+
+// refreshSuccessorPrefix 后继令牌对的前缀，键为"refresh_successor:旧令牌摘要"，只在宽限期内保留
+const refreshSuccessorPrefix = "refresh_successor:"
+
+// RefreshSuccessor 是刷新令牌轮换后签发的后继令牌对
+type RefreshSuccessor struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	RefreshHash  string `json:"refresh_hash"`
+}
+
+// rotateRefreshTokenScript 原子地完成刷新令牌轮换：标记旧令牌已轮换、写入新令牌摘要、顺延会话和索引的过期时间，
+// 并在宽限期内保存后继令牌对。任何一步之前失败都不会留下"已轮换"标记。
+// KEYS: 会话、轮换标记、用户会话索引、后继令牌对
+// ARGV: 旧刷新令牌摘要、新访问令牌摘要、新刷新令牌摘要、家族JSON、标记保留毫秒数、
+// 会话过期毫秒时间戳、会话过期时间字符串、索引保留秒数、后继令牌对JSON、宽限期毫秒数
+// 返回 {结果, 后继令牌对JSON}
+var rotateRefreshTokenScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+  local successor = redis.call('GET', KEYS[4])
+  if successor then
+    local current = redis.call('HGET', KEYS[1], 'refresh_token_hash')
+    if current and current == cjson.decode(successor)['refresh_hash'] then
+      return {2, successor}
+    end
+  end
+  return {1, ''}
+end
+if redis.call('HGET', KEYS[1], 'refresh_token_hash') ~= ARGV[1] then
+  return {3, ''}
+end
+redis.call('SET', KEYS[2], ARGV[4], 'PX', ARGV[5])
+redis.call('HSET', KEYS[1], 'access_token_hash', ARGV[2], 'refresh_token_hash', ARGV[3], 'expires_at', ARGV[7])
+redis.call('PEXPIREAT', KEYS[1], ARGV[6])
+redis.call('EXPIRE', KEYS[3], ARGV[8])
+redis.call('SET', KEYS[4], ARGV[9], 'PX', ARGV[10])
+return {0, ''}
+`)
+
+// RotateRefreshToken 将旧刷新令牌原子地轮换为新的令牌对。
+// 新令牌对必须在调用前生成完毕，这样签发失败时旧令牌仍然可用，客户端重试不会被误判为重复使用。
+// 结果为RefreshRetried时，返回宽限期内已经签发过的后继令牌对，调用方应把它返回给客户端。
+func RotateRefreshToken(oldToken string, claims *Claims, accessToken, refreshToken string) (RefreshRotation, *RefreshSuccessor, error) {
+	family, err := json.Marshal(RefreshTokenFamily{FamilyID: claims.SessionID, UserID: claims.UserID})
+	if err != nil {
+		return 0, nil, err
+	}
+	successor, err := json.Marshal(RefreshSuccessor{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		RefreshHash:  hashToken(refreshToken),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// 标记保留到令牌本身过期为止，过期后的令牌无法通过签名校验，不再需要检测
+	expiry := RefreshTokenExpiry
+	if claims.ExpiresAt != nil {
+		expiry = time.Until(claims.ExpiresAt.Time)
+	}
+	if expiry <= 0 {
+		expiry = time.Minute
+	}
+
+	oldHash := hashToken(oldToken)
+	expiresAt := time.Now().Add(SessionTTL)
+	keys := []string{
+		sessionPrefix + claims.SessionID,
+		rotatedRefreshTokenPrefix + oldHash,
+		userSessionsPrefix + strconv.Itoa(claims.UserID),
+		refreshSuccessorPrefix + oldHash,
+	}
+	result, err := rotateRefreshTokenScript.Run(context.Background(), redis_client.Rdb, keys,
+		oldHash, hashToken(accessToken), hashToken(refreshToken), family, expiry.Milliseconds(),
+		expiresAt.UnixMilli(), formatSessionTime(expiresAt), int64(SessionTTL/time.Second),
+		successor, refreshSuccessorGrace.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rotation := RefreshRotation(result[0].(int64))
+	if rotation != RefreshRetried {
+		return rotation, nil, nil
+	}
+	var previous RefreshSuccessor
+	if err := json.Unmarshal([]byte(result[1].(string)), &previous); err != nil {
+		return 0, nil, err
+	}
+	return RefreshRetried, &previous, nil
+}
+
+// RefreshTokenSuccessor 返回宽限期内旧刷新令牌的后继令牌对。
+// 后继令牌已经再次轮换或会话已被撤销时返回nil，此时旧令牌的出现应视为重复使用。
+func RefreshTokenSuccessor(token string, sessionID string) (*RefreshSuccessor, error) {
+	data, err := redis_client.Rdb.Get(context.Background(), refreshSuccessorPrefix+hashToken(token)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var successor RefreshSuccessor
+	if err := json.Unmarshal(data, &successor); err != nil {
+		return nil, err
+	}
+	session, err := GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.RefreshTokenHash != successor.RefreshHash {
+		return nil, nil
+	}
+	return &successor, nil
+}
+
+// DetectRefreshTokenReuse 检查刷新令牌是否已经被轮换过。
+// 已轮换的令牌再次出现说明令牌可能被盗用，返回其所属的家族以便整体撤销。
+func DetectRefreshTokenReuse(token string) (*RefreshTokenFamily, error) {
+	data, err := redis_client.Rdb.Get(context.Background(), rotatedRefreshTokenPrefix+hashToken(token)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var family RefreshTokenFamily
+	if err := json.Unmarshal(data, &family); err != nil {
+		return nil, err
+	}
+	return &family, nil
+}
+
+// RevokeTokenFamily 撤销整个刷新令牌家族，并记录安全事件
+func RevokeTokenFamily(family *RefreshTokenFamily, ip, userAgent string) error {
+	RecordSecurityEvent(SecurityEvent{
+		Type:      SecurityEventRefreshTokenReuse,
+		UserID:    family.UserID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]interface{}{
+			"family_id": family.FamilyID,
+		},
+	})
+
+	return RevokeSession(family.FamilyID)
+}
+
 // InvalidateUserTokens 使指定用户的所有令牌失效（例如在密码更改或注销所有设备时）
 func InvalidateUserTokens(userID int) error {
-	accessKey := accessTokenPrefix + strconv.Itoa(userID)
-	refreshKey := refreshTokenPrefix + strconv.Itoa(userID)
-
-	// 获取当前令牌，以便将它们加入黑名单
-	accessToken, err := redis_client.Rdb.Get(context.Background(), accessKey).Result()
-	if err == nil {
-		// 如果令牌存在，将其加入黑名单
-		if err := BlacklistToken(accessToken, AccessTokenExpiry); err != nil {
-			return err
-		}
+	return InvalidateUserTokensExcept(userID, "")
+}
+
+// InvalidateUserTokensExcept 使指定用户除keepSessionID以外的所有会话失效（"退出其他所有设备"）
+func InvalidateUserTokensExcept(userID int, keepSessionID string) error {
+	sessions, err := ListUserSessions(userID)
+	if err != nil {
+		return err
 	}
 
-	refreshToken, err := redis_client.Rdb.Get(context.Background(), refreshKey).Result()
-	if err == nil {
-		// 如果令牌存在，将其加入黑名单
-		if err := BlacklistToken(refreshToken, RefreshTokenExpiry); err != nil {
+	// 撤销用户的每一个会话，会话删除后其签发的令牌将无法通过校验
+	for _, session := range sessions {
+		if session.ID == keepSessionID {
+			continue
+		}
+		if err := RevokeSession(session.ID); err != nil {
 			return err
 		}
 	}
-
-	// 从Redis中删除令牌
-	pipe := redis_client.Rdb.Pipeline()
-	pipe.Del(context.Background(), accessKey)
-	pipe.Del(context.Background(), refreshKey)
-	_, err = pipe.Exec(context.Background())
-	return err
+	return nil
 }
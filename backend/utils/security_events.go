@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 全局安全事件列表的键
+	securityEventsKey = "security_events"
+	// 单个用户安全事件列表的前缀，键为"security_events:用户ID"
+	userSecurityEventsPrefix = "security_events:"
+	// 保留的事件数量上限
+	maxSecurityEvents     = 1000
+	maxUserSecurityEvents = 100
+)
+
+// 安全事件类型
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+	SecurityEventPasswordReset     = "password_reset"
+	SecurityEventPasswordChanged   = "password_changed"
+	SecurityEventLoginLocked       = "login_locked"
+	SecurityEventLoginUnlocked     = "login_unlocked"
+	SecurityEventRoleChanged       = "role_changed"
+	SecurityEventAccessDenied      = "access_denied"
+	SecurityEventSuspiciousLogin   = "suspicious_login"
+	SecurityEventIPBanned          = "ip_banned"
+	SecurityEventMFALocked         = "mfa_locked"
+)
+
+// SecurityEvent 表示一次需要关注的安全事件
+type SecurityEvent struct {
+	Type      string                 `json:"type"`
+	UserID    int                    `json:"user_id,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// RecordSecurityEvent 记录安全事件到日志和Redis中，写入失败不影响调用方的流程
+func RecordSecurityEvent(event SecurityEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("序列化安全事件失败: %v", err)
+		return
+	}
+	log.Printf("安全事件: %s", data)
+
+	ctx := context.Background()
+	pipe := redis_client.Rdb.Pipeline()
+	pipe.LPush(ctx, securityEventsKey, data)
+	pipe.LTrim(ctx, securityEventsKey, 0, maxSecurityEvents-1)
+	if event.UserID != 0 {
+		userKey := userSecurityEventsPrefix + strconv.Itoa(event.UserID)
+		pipe.LPush(ctx, userKey, data)
+		pipe.LTrim(ctx, userKey, 0, maxUserSecurityEvents-1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("保存安全事件失败: %v", err)
+	}
+}
+
+// ListUserSecurityEvents 获取指定用户最近的安全事件
+func ListUserSecurityEvents(userID int) ([]SecurityEvent, error) {
+	items, err := redis_client.Rdb.LRange(context.Background(), userSecurityEventsPrefix+strconv.Itoa(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []SecurityEvent{}
+	for _, item := range items {
+		var event SecurityEvent
+		if err := json.Unmarshal([]byte(item), &event); err != nil {
+			continue // 跳过无法解析的记录
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// DeleteUserSecurityEvents 删除用户的安全事件列表，全局列表中的记录保留
+func DeleteUserSecurityEvents(userID int) error {
+	return redis_client.Rdb.Del(context.Background(), userSecurityEventsPrefix+strconv.Itoa(userID)).Err()
+}
+
+// RecordAccessDenied 记录越权访问其他用户资源的尝试
+func RecordAccessDenied(c *gin.Context, resource string, resourceID, ownerID int) {
+	RecordSecurityEvent(SecurityEvent{
+		Type:      SecurityEventAccessDenied,
+		UserID:    c.GetInt("userID"),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Details: map[string]interface{}{
+			"resource":    resource,
+			"resource_id": resourceID,
+			"owner_id":    ownerID,
+			"role":        c.GetString("role"),
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+		},
+	})
+}
@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// 会话数据的前缀，键为"session:会话ID"，值为按字段存储的哈希
+	sessionPrefix = "session:"
+	// 用户会话索引的前缀，键为"user_sessions:用户ID"，值为该用户所有会话ID的集合
+	userSessionsPrefix = "user_sessions:"
+	// 会话最后活跃时间的刷新间隔，避免每个请求都写Redis
+	sessionTouchInterval = time.Minute
+)
+
+// SessionTTL 会话在Redis中的保留时间，略长于刷新令牌的有效期
+var SessionTTL = RefreshTokenExpiry + 1*time.Hour
+
+// ErrSessionNotFound 表示会话不存在或已被撤销
+var ErrSessionNotFound = errors.New("会话不存在或已被撤销")
+
+// Session 表示一个设备上的登录会话
+type Session struct {
+	ID               string    `json:"id"`
+	UserID           int       `json:"user_id"`
+	UserAgent        string    `json:"user_agent"`
+	IP               string    `json:"ip"`
+	AccessTokenHash  string    `json:"access_token_hash,omitempty"`
+	RefreshTokenHash string    `json:"refresh_token_hash,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastSeenAt       time.Time `json:"last_seen_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// CreateSession 为一次登录创建新的会话，每个设备拥有独立的会话
+func CreateSession(userID int, userAgent, ip string) (*Session, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         sessionID,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(SessionTTL),
+	}
+
+	// 会话哈希和用户的会话索引在同一事务中写入
+	indexKey := userSessionsPrefix + strconv.Itoa(userID)
+	pipe := redis_client.Rdb.TxPipeline()
+	pipe.HSet(context.Background(), sessionPrefix+sessionID, session.fields())
+	pipe.PExpireAt(context.Background(), sessionPrefix+sessionID, session.ExpiresAt)
+	pipe.SAdd(context.Background(), indexKey, sessionID)
+	pipe.Expire(context.Background(), indexKey, SessionTTL)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession 根据会话ID获取会话
+func GetSession(sessionID string) (*Session, error) {
+	if sessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := redis_client.Rdb.HGetAll(context.Background(), sessionPrefix+sessionID).Result()
+	if err != nil {
+		// 旧版本以JSON字符串保存的会话视为不存在，用户重新登录一次即可
+		if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return sessionFromFields(data)
+}
+
+// TouchSession 更新会话的最后活跃时间和IP。
+// 只写这两个字段，不会覆盖并发的刷新请求刚写入的令牌摘要。
+func TouchSession(session *Session, ip string) error {
+	if time.Since(session.LastSeenAt) < sessionTouchInterval && session.IP == ip {
+		return nil
+	}
+	session.LastSeenAt = time.Now()
+	session.IP = ip
+	return updateSession(session.ID, nil, map[string]interface{}{
+		"last_seen_at": formatSessionTime(session.LastSeenAt),
+		"ip":           ip,
+	})
+}
+
+// RevokeSession 撤销指定的会话，该会话签发的所有令牌随之失效
+func RevokeSession(sessionID string) error {
+	session, err := GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pipe := redis_client.Rdb.Pipeline()
+	pipe.Del(context.Background(), sessionPrefix+sessionID)
+	pipe.SRem(context.Background(), userSessionsPrefix+strconv.Itoa(session.UserID), sessionID)
+	_, err = pipe.Exec(context.Background())
+	return err
+}
+
+// ListUserSessions 返回用户当前所有有效的会话，并顺便清理已过期的索引项
+func ListUserSessions(userID int) ([]Session, error) {
+	indexKey := userSessionsPrefix + strconv.Itoa(userID)
+	sessionIDs, err := redis_client.Rdb.SMembers(context.Background(), indexKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for _, sessionID := range sessionIDs {
+		session, err := GetSession(sessionID)
+		if err == ErrSessionNotFound {
+			redis_client.Rdb.SRem(context.Background(), indexKey, sessionID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, nil
+}
+
+// updateSessionScript 只在会话仍然存在时更新其中的字段，避免为已撤销的会话写入残缺的哈希。
+// KEYS[1]为会话键，KEYS[2]为用户的会话索引；ARGV[1]为新的过期时间（毫秒时间戳，0表示不变），
+// ARGV[2]为索引的保留秒数，其余参数为字段名和值。返回0表示会话不存在。
+var updateSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+for i = 3, #ARGV, 2 do
+  redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+local expire_at = tonumber(ARGV[1])
+if expire_at > 0 then
+  redis.call('PEXPIREAT', KEYS[1], expire_at)
+  redis.call('EXPIRE', KEYS[2], tonumber(ARGV[2]))
+end
+return 1
+`)
+
+// updateSession 按字段更新会话。expiresAt不为nil时同时顺延会话和用户会话索引的过期时间，
+// 保证被刷新续期的会话始终能通过索引找到（InvalidateUserTokens依赖该索引）。
+func updateSession(sessionID string, expiresAt *time.Time, fields map[string]interface{}) error {
+	session, err := GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{int64(0), int64(SessionTTL / time.Second)}
+	if expiresAt != nil {
+		args[0] = expiresAt.UnixMilli()
+		fields["expires_at"] = formatSessionTime(*expiresAt)
+	}
+	for name, value := range fields {
+		args = append(args, name, value)
+	}
+
+	keys := []string{sessionPrefix + sessionID, userSessionsPrefix + strconv.Itoa(session.UserID)}
+	updated, err := updateSessionScript.Run(context.Background(), redis_client.Rdb, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// fields 返回会话在Redis哈希中的字段
+func (s *Session) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                 s.ID,
+		"user_id":            s.UserID,
+		"user_agent":         s.UserAgent,
+		"ip":                 s.IP,
+		"access_token_hash":  s.AccessTokenHash,
+		"refresh_token_hash": s.RefreshTokenHash,
+		"created_at":         formatSessionTime(s.CreatedAt),
+		"last_seen_at":       formatSessionTime(s.LastSeenAt),
+		"expires_at":         formatSessionTime(s.ExpiresAt),
+	}
+}
+
+// sessionFromFields 从Redis哈希字段还原会话
+func sessionFromFields(data map[string]string) (*Session, error) {
+	userID, err := strconv.Atoi(data["user_id"])
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{
+		ID:               data["id"],
+		UserID:           userID,
+		UserAgent:        data["user_agent"],
+		IP:               data["ip"],
+		AccessTokenHash:  data["access_token_hash"],
+		RefreshTokenHash: data["refresh_token_hash"],
+	}
+	for name, target := range map[string]*time.Time{
+		"created_at":   &session.CreatedAt,
+		"last_seen_at": &session.LastSeenAt,
+		"expires_at":   &session.ExpiresAt,
+	} {
+		if *target, err = time.Parse(time.RFC3339Nano, data[name]); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// formatSessionTime 会话中的时间统一以RFC3339格式保存
+func formatSessionTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// generateSessionID 生成随机的会话ID
+func generateSessionID() (string, error) {
+	return randomHex(16)
+}
+
+// randomHex 生成n字节的随机数并编码为十六进制字符串
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken 计算令牌的SHA-256摘要，Redis中只保存摘要而不保存令牌原文
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
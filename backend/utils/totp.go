@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"web-security/backend/redis_client"
+)
+
+// TOTP参数（RFC 6238），与常见的认证器App（Google Authenticator、1Password等）保持一致
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSkewSteps  = 1  // 允许前后各一个时间步长的时钟偏差
+	totpSecretSize = 20 // 160位密钥
+
+	// 已使用的TOTP时间步长前缀，防止同一个验证码被重放
+	totpUsedPrefix = "totp_used:"
+	// 恢复码的数量和格式
+	recoveryCodeCount = 10
+
+	// 两步验证尝试次数前缀，键为"mfa_attempts:令牌jti"
+	mfaAttemptsPrefix = "mfa_attempts:"
+	// MaxMFAAttempts 每个两步验证等待令牌允许的最大尝试次数
+	MaxMFAAttempts = 5
+
+	// 用户第二步验证失败次数前缀，键为"mfa_fail:用户ID"，不随重新登录而重置
+	mfaFailurePrefix = "mfa_fail:"
+	// 第二步验证锁定前缀，键存在期间拒绝该用户的所有第二步验证
+	mfaLockPrefix = "mfa_lock:"
+	// MaxMFAFailuresPerUser 统计窗口内每个用户允许的第二步验证失败次数，达到后锁定
+	MaxMFAFailuresPerUser = 10
+	// mfaFailureWindow 第二步验证失败次数的统计窗口，远长于登录失败的窗口，慢速猜测同样会被锁定
+	mfaFailureWindow = 24 * time.Hour
+	// mfaLockoutDuration 第二步验证的锁定时长，锁定到期后失败次数不清零，再失败一次会立即重新锁定
+	mfaLockoutDuration = time.Hour
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret 生成新的Base32编码TOTP密钥
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI 生成otpauth://格式的URI，前端可以将其渲染为二维码供认证器App扫描
+func TOTPProvisioningURI(issuer, accountName, secret string) string {
+	label := url.PathEscape(issuer + ":" + accountName)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// ValidateTOTPCode 校验TOTP验证码，成功时返回匹配的时间步长，用于防重放
+func ValidateTOTPCode(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for offset := int64(-totpSkewSteps); offset <= totpSkewSteps; offset++ {
+		step := current + offset
+		expected := totpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// MarkTOTPStepUsed 记录用户已使用过的时间步长，同一时间步长的验证码只能使用一次
+func MarkTOTPStepUsed(userID int, step int64) (bool, error) {
+	key := fmt.Sprintf("%s%d:%d", totpUsedPrefix, userID, step)
+	expiry := totpPeriod * time.Duration(2*totpSkewSteps+2)
+	return redis_client.Rdb.SetNX(context.Background(), key, "used", expiry).Result()
+}
+
+// totpCode 按照RFC 4226计算指定时间步长的验证码
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// 动态截断
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// GenerateRecoveryCodes 生成一组一次性恢复码，格式为xxxxx-xxxxx
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode 计算恢复码的摘要，数据库中只保存摘要
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.TrimSpace(code))
+	return hashToken(normalized)
+}
+
+// RegisterMFAAttempt 记录一次两步验证尝试，返回该等待令牌累计的尝试次数
+func RegisterMFAAttempt(claims *Claims) (int64, error) {
+	key := mfaAttemptsPrefix + claims.ID
+	// 计数保留到令牌过期为止，不同类型的等待令牌有效期不同
+	ttl := MFAPendingTokenExpiry
+	if claims.ExpiresAt != nil && time.Until(claims.ExpiresAt.Time) > ttl {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	pipe := redis_client.Rdb.Pipeline()
+	incr := pipe.Incr(context.Background(), key)
+	pipe.Expire(context.Background(), key, ttl)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// MFALockedFor 返回用户的第二步验证还需锁定多久，0表示未锁定
+func MFALockedFor(userID int) (time.Duration, error) {
+	ttl, err := redis_client.Rdb.PTTL(context.Background(), mfaLockPrefix+strconv.Itoa(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// RegisterMFAFailure 记录用户一次第二步验证失败（TOTP、恢复码或邮件验证码），
+// 达到上限时锁定该用户的第二步验证并记录安全事件。返回是否已被锁定
+func RegisterMFAFailure(userID int, ip, userAgent string) (bool, error) {
+	ctx := context.Background()
+	key := mfaFailurePrefix + strconv.Itoa(userID)
+	failures, err := redis_client.Rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	if failures == 1 {
+		redis_client.Rdb.Expire(ctx, key, mfaFailureWindow)
+	}
+	if failures < MaxMFAFailuresPerUser {
+		return false, nil
+	}
+
+	if err := redis_client.Rdb.Set(ctx, mfaLockPrefix+strconv.Itoa(userID), failures, mfaLockoutDuration).Err(); err != nil {
+		return false, err
+	}
+	RecordSecurityEvent(SecurityEvent{
+		Type:      SecurityEventMFALocked,
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]interface{}{
+			"failures": failures,
+			"duration": mfaLockoutDuration.String(),
+		},
+	})
+	return true, nil
+}
+
+// ClearMFAFailures 第二步验证成功后清除该用户的失败记录
+func ClearMFAFailures(userID int) error {
+	return redis_client.Rdb.Del(context.Background(), mfaFailurePrefix+strconv.Itoa(userID)).Err()
+}
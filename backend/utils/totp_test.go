@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret RFC 6238附录B中SHA-1测试向量使用的密钥"12345678901234567890"
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeMatchesRFC6238Vectors(t *testing.T) {
+	// RFC 6238附录B的8位验证码取后6位
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		step := tt.unix / int64(totpPeriod.Seconds())
+		if got := totpCode([]byte("12345678901234567890"), step); got != tt.want {
+			t.Errorf("T=%d: totpCode = %s, want %s", tt.unix, got, tt.want)
+		}
+
+		gotStep, ok := ValidateTOTPCode(rfc6238Secret, tt.want, time.Unix(tt.unix, 0))
+		if !ok || gotStep != step {
+			t.Errorf("T=%d: ValidateTOTPCode = (%d, %v), want (%d, true)", tt.unix, gotStep, ok, step)
+		}
+	}
+}
+
+func TestValidateTOTPCodeAllowsOneStepOfSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		name   string
+		offset int64
+		want   bool
+	}{
+		{"前两个步长", -2, false},
+		{"前一个步长", -1, true},
+		{"当前步长", 0, true},
+		{"后一个步长", 1, true},
+		{"后两个步长", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTPCode(rfc6238Secret, totpCode(key, current+tt.offset), now)
+			if ok != tt.want {
+				t.Fatalf("ok = %v, want %v", ok, tt.want)
+			}
+			if ok && step != current+tt.offset {
+				t.Errorf("step = %d, want %d", step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPCodeRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name string
+		code string
+	}{
+		{"空", ""},
+		{"5位", "87082"},
+		{"7位", "2870820"},
+		{"8位完整验证码", "94287082"},
+		{"错误的验证码", "287083"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := ValidateTOTPCode(rfc6238Secret, tt.code, now); ok {
+				t.Errorf("ValidateTOTPCode(%q) = true, want false", tt.code)
+			}
+		})
+	}
+
+	// 前后的空白会被去掉
+	if _, ok := ValidateTOTPCode(rfc6238Secret, " 287082 ", now); !ok {
+		t.Error("带空白的验证码被拒绝")
+	}
+}